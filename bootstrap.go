@@ -0,0 +1,205 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Observation is a group of identical reads in a sample, for example the
+// alignment of a collapsed fragment. Value is the bin of the observation such
+// as edit stop, junction length or any other grouping of reads, for example a
+// heat map cell or a single alignment.
+type Observation struct {
+	Value     int
+	ReadCount uint32
+	Norm      float64
+}
+
+// Interval is a point estimate with lower and upper confidence bounds
+type Interval struct {
+	Estimate float64 `json:"estimate"`
+	Lower    float64 `json:"lower"`
+	Upper    float64 `json:"upper"`
+}
+
+// BinInterval holds the confidence intervals of a single histogram bin for
+// both the normalized count and the fraction of the sample total.
+type BinInterval struct {
+	Value int
+	Norm  Interval
+	Frac  Interval
+}
+
+// Bootstrap resamples the reads within a sample to estimate confidence
+// intervals. The Poisson bootstrap is used: each read is drawn Poisson(1)
+// times, so an observation of n reads is resampled as Poisson(n) reads. This
+// avoids materializing every read of large samples.
+type Bootstrap struct {
+	N     int
+	Alpha float64
+	rng   *rand.Rand
+}
+
+func NewBootstrap(n int, alpha float64, seed int64) *Bootstrap {
+	if n <= 0 {
+		n = 200
+	}
+	if alpha <= 0 || alpha >= 1 {
+		alpha = 0.05
+	}
+
+	return &Bootstrap{N: n, Alpha: alpha, rng: rand.New(rand.NewSource(seed))}
+}
+
+// poisson draws from a Poisson distribution. Uses Knuth's method for small
+// lambda and a normal approximation otherwise.
+func (b *Bootstrap) poisson(lambda float64) float64 {
+	if lambda <= 0 {
+		return 0
+	}
+
+	if lambda < 30 {
+		l := math.Exp(-lambda)
+		k := 0.0
+		p := 1.0
+		for {
+			p *= b.rng.Float64()
+			if p <= l {
+				return k
+			}
+			k++
+		}
+	}
+
+	x := math.Floor(lambda + math.Sqrt(lambda)*b.rng.NormFloat64() + 0.5)
+	if x < 0 {
+		return 0
+	}
+	return x
+}
+
+// resample returns the bootstrap weight of each observation for a single
+// replicate. Weights are on the normalized scale of the observation.
+func (b *Bootstrap) resample(obs []Observation, weights []float64) {
+	for i, o := range obs {
+		if o.ReadCount == 0 {
+			weights[i] = 0
+			continue
+		}
+		scale := o.Norm / float64(o.ReadCount)
+		weights[i] = b.poisson(float64(o.ReadCount)) * scale
+	}
+}
+
+func (b *Bootstrap) interval(estimate float64, reps []float64) Interval {
+	sort.Float64s(reps)
+	return Interval{
+		Estimate: estimate,
+		Lower:    quantile(reps, b.Alpha/2),
+		Upper:    quantile(reps, 1-b.Alpha/2),
+	}
+}
+
+// Histogram computes percentile confidence intervals for the normalized count
+// and fraction of the sample total in each bin. Results are sorted by value.
+func (b *Bootstrap) Histogram(obs []Observation) []*BinInterval {
+	index := make(map[int]int)
+	values := make([]int, 0)
+	for _, o := range obs {
+		if _, ok := index[o.Value]; !ok {
+			index[o.Value] = 0
+			values = append(values, o.Value)
+		}
+	}
+	sort.Ints(values)
+	for i, v := range values {
+		index[v] = i
+	}
+
+	est := make([]float64, len(values))
+	total := 0.0
+	for _, o := range obs {
+		est[index[o.Value]] += o.Norm
+		total += o.Norm
+	}
+
+	normReps := make([][]float64, len(values))
+	fracReps := make([][]float64, len(values))
+	for i := range values {
+		normReps[i] = make([]float64, b.N)
+		fracReps[i] = make([]float64, b.N)
+	}
+
+	weights := make([]float64, len(obs))
+	bins := make([]float64, len(values))
+	for r := 0; r < b.N; r++ {
+		b.resample(obs, weights)
+		for i := range bins {
+			bins[i] = 0
+		}
+		rtotal := 0.0
+		for i, o := range obs {
+			bins[index[o.Value]] += weights[i]
+			rtotal += weights[i]
+		}
+		for i, v := range bins {
+			normReps[i][r] = v
+			if rtotal > 0 {
+				fracReps[i][r] = v / rtotal
+			}
+		}
+	}
+
+	hist := make([]*BinInterval, len(values))
+	for i, v := range values {
+		frac := 0.0
+		if total > 0 {
+			frac = est[i] / total
+		}
+		hist[i] = &BinInterval{
+			Value: v,
+			Norm:  b.interval(est[i], normReps[i]),
+			Frac:  b.interval(frac, fracReps[i]),
+		}
+	}
+
+	return hist
+}
+
+// quantile of sorted values using linear interpolation
+func quantile(sorted []float64, q float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	if n == 1 {
+		return sorted[0]
+	}
+
+	pos := q * float64(n-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	if lo == hi {
+		return sorted[lo]
+	}
+
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo))
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"testing"
+)
+
+func TestBootstrapHistogram(t *testing.T) {
+	obs := []Observation{
+		{Value: 10, ReadCount: 100, Norm: 200},
+		{Value: 10, ReadCount: 50, Norm: 100},
+		{Value: 12, ReadCount: 300, Norm: 600},
+		{Value: 15, ReadCount: 2, Norm: 4},
+	}
+
+	b := NewBootstrap(500, 0.05, 1)
+	hist := b.Histogram(obs)
+	if len(hist) != 3 {
+		t.Fatalf("Wrong number of bins. %d != %d", len(hist), 3)
+	}
+
+	if hist[0].Value != 10 || hist[0].Norm.Estimate != 300 {
+		t.Errorf("Wrong bin estimate: %+v", hist[0])
+	}
+
+	for _, bin := range hist {
+		if bin.Norm.Lower > bin.Norm.Estimate || bin.Norm.Upper < bin.Norm.Estimate {
+			t.Errorf("Estimate outside of interval: %+v", bin.Norm)
+		}
+		if bin.Frac.Lower > bin.Frac.Estimate || bin.Frac.Upper < bin.Frac.Estimate {
+			t.Errorf("Estimate outside of interval: %+v", bin.Frac)
+		}
+	}
+
+	// Small bins should have relatively wider intervals
+	small := (hist[2].Norm.Upper - hist[2].Norm.Lower) / hist[2].Norm.Estimate
+	large := (hist[1].Norm.Upper - hist[1].Norm.Lower) / hist[1].Norm.Estimate
+	if small <= large {
+		t.Errorf("Expected wider relative interval for small bin. %f <= %f", small, large)
+	}
+}
+
+func TestBootstrapFraction(t *testing.T) {
+	// Fraction of a single alignment with the rest of the sample in one bin
+	obs := []Observation{
+		{Value: 0, ReadCount: 50, Norm: 50},
+		{Value: -1, ReadCount: 100, Norm: 100},
+		{Value: -1, ReadCount: 50, Norm: 50},
+	}
+
+	b := NewBootstrap(200, 0.05, 1)
+	hist := b.Histogram(obs)
+	if len(hist) != 2 {
+		t.Fatalf("Wrong number of bins. %d != %d", len(hist), 2)
+	}
+
+	ci := hist[1].Frac
+	if hist[1].Value != 0 || ci.Estimate != 0.25 {
+		t.Errorf("Wrong estimate. %d %f != 0 %f", hist[1].Value, ci.Estimate, 0.25)
+	}
+	if ci.Lower >= 0.25 || ci.Upper <= 0.25 || ci.Lower <= 0 || ci.Upper >= 1 {
+		t.Errorf("Invalid interval: %+v", ci)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	vals := []float64{1, 2, 3, 4, 5}
+	if q := quantile(vals, 0.5); q != 3 {
+		t.Errorf("Wrong median. %f != %f", q, 3.0)
+	}
+	if q := quantile(vals, 0.125); q != 1.5 {
+		t.Errorf("Wrong quantile. %f != %f", q, 1.5)
+	}
+}
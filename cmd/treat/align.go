@@ -34,6 +34,8 @@ type AlignOptions struct {
 	S1           string
 	S2           string
 	EditOffset   int
+	Pileup       bool
+	Width        int
 }
 
 func PrintAlignment(a1, a2 string, tw int) {
@@ -78,12 +80,11 @@ func Align(options *AlignOptions) {
 	var tmpl *treat.Template
 
 	if len(options.TemplatePath) > 0 {
-		t, err := treat.NewTemplateFromFasta(options.TemplatePath, treat.FORWARD, rune(options.EditBase[0]))
+		t, _, err := loadTemplate(options.TemplatePath, options.EditBase, options.EditOffset)
 		if err != nil {
 			logrus.Fatal(err)
 		}
 		tmpl = t
-		tmpl.SetOffset(options.EditOffset)
 	}
 
 	f, err := os.Open(options.FragmentPath)
@@ -110,12 +111,22 @@ func Align(options *AlignOptions) {
 		a1, a2 := aln.SimpleAlign(frags[0], frags[1])
 		PrintAlignment(a1, a2, 80)
 
+	} else if options.Pileup {
+		p := treat.NewPileup(tmpl)
+		for rec := range gofasta.SimpleParser(f) {
+			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, tmpl.EditBase)
+			aln := treat.NewAlignment(frag, tmpl, false)
+			p.Add(fmt.Sprintf("R%d", len(p.Rows)+1), frag, aln)
+		}
+		buf := bufio.NewWriter(os.Stdout)
+		p.WriteTo(buf, options.Width)
+		buf.Flush()
 	} else {
 		for rec := range gofasta.SimpleParser(f) {
-			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
+			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, tmpl.EditBase)
 			aln := treat.NewAlignment(frag, tmpl, false)
 			buf := bufio.NewWriter(os.Stdout)
-			aln.WriteTo(buf, frag, tmpl, 80)
+			aln.WriteTo(buf, frag, tmpl, options.Width)
 			buf.Flush()
 		}
 	}
@@ -0,0 +1,412 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// analysisFunc computes the result of an expensive request and writes it to w
+type analysisFunc func(ctx context.Context, db *Database, w io.Writer) error
+
+// jsonAnalysis returns an analysisFunc which writes the data computed by fn
+// for gene encoded as json
+func jsonAnalysis(gene string, fn func(ctx context.Context, db *Database, tmpl *treat.Template) (interface{}, error)) analysisFunc {
+	return func(ctx context.Context, db *Database, w io.Writer) error {
+		tmpl, ok := db.geneTemplates[gene]
+		if !ok {
+			return fmt.Errorf("Gene not found: %s", gene)
+		}
+
+		data, err := fn(ctx, db, tmpl)
+		if err != nil {
+			return err
+		}
+
+		out, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(out)
+		return err
+	}
+}
+
+// apiJobHandle is returned when a request was queued as a background job
+type apiJobHandle struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	StatusURL string `json:"status_url"`
+	ResultURL string `json:"result_url"`
+}
+
+// wantsAsync returns true if the request asked to be run as a background job
+func wantsAsync(r *http.Request) bool {
+	return r.URL.Query().Get("async") == "1"
+}
+
+// wantsJSON returns true if the request came from a script rather than a
+// browser following a link
+func wantsJSON(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// submitAnalysis queues fn as a background job. Scripts get the job handle as
+// json, browsers are redirected to the job page. If cacheKey is set the
+// result is added to the chart cache.
+func (a *Application) submitAnalysis(w http.ResponseWriter, r *http.Request, db *Database, title, resultName, contentType, cacheKey string, fn analysisFunc) {
+	owner := ""
+	if user := a.GetUserFromContext(r); user != nil {
+		owner = user.Name
+	}
+
+	dbname := db.name
+	job := NewJob("analysis", fmt.Sprintf("%s (%s)", title, dbname), owner, func(j *Job) error {
+		db, err := a.AcquireDb(dbname)
+		if err != nil {
+			return err
+		}
+		defer db.release()
+
+		out, err := j.CreateResult(resultName, contentType)
+		if err != nil {
+			return err
+		}
+
+		j.SetProgress(0, "Running")
+		err = fn(j.Context(), db, out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(cacheKey) > 0 && a.enableCache {
+			data, err := ioutil.ReadFile(out.Name())
+			if err == nil {
+				a.cacheChart(db, cacheKey, data)
+			}
+		}
+
+		return nil
+	})
+
+	if err := a.jobs.Submit(job); err != nil {
+		logrus.Warnf("Failed to queue job: %s", err)
+		if wantsJSON(r) {
+			apiErrorf(w, http.StatusServiceUnavailable, "%s", err)
+		} else {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/jobs/"+job.ID, 302)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, &apiJobHandle{
+		ID:        job.ID,
+		State:     job.State(),
+		StatusURL: API_PREFIX + "/jobs/" + job.ID,
+		ResultURL: API_PREFIX + "/jobs/" + job.ID + "/result",
+	})
+}
+
+// heatMapData returns the edit stop by junction length heat map. If boot is
+// not nil each cell includes the lower and upper bounds of its confidence
+// interval.
+func heatMapData(ctx context.Context, db *Database, tmpl *treat.Template, fields *SearchFields, boot *treat.Bootstrap) (interface{}, error) {
+	var cells *[]treat.Observation
+	if boot != nil {
+		cells = new([]treat.Observation)
+	}
+
+	heat, max, err := heatMatrix(ctx, db.storage, tmpl, fields, cells)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(heat)
+	intervals := make(map[int]*treat.BinInterval)
+	if boot != nil {
+		for _, bin := range boot.Histogram(*cells) {
+			intervals[bin.Value] = bin
+		}
+	}
+
+	series := make([][]interface{}, n*n)
+	k := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			series[k] = []interface{}{i + int(tmpl.EditOffset), j, heat[i][j]}
+			if boot != nil {
+				lower, upper := 0.0, 0.0
+				if bin, ok := intervals[i*n+j]; ok {
+					lower, upper = bin.Norm.Lower, bin.Norm.Upper
+				}
+				series[k] = append(series[k], lower, upper)
+			}
+			k++
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["series"] = series
+	data["max"] = max
+	data["ci"] = boot != nil
+	data["guides"] = guidePlotBands(tmpl, func(site int) float64 {
+		return float64(site)
+	})
+
+	return data, nil
+}
+
+// guidePlotBands returns Highcharts x axis plot bands for the gRNAs of the
+// template with the anchor of each gRNA shaded darker. x maps an edit site
+// number to its position on the axis.
+func guidePlotBands(tmpl *treat.Template, x func(site int) float64) []map[string]interface{} {
+	band := func(start, end int) (float64, float64) {
+		a, b := x(tmpl.IndexLabel(start)), x(tmpl.IndexLabel(end))
+		return math.Min(a, b) - 0.5, math.Max(a, b) + 0.5
+	}
+
+	lanes, _ := guideLanes(tmpl.Guides)
+	bands := make([]map[string]interface{}, 0)
+	for i, g := range tmpl.Guides {
+		from, to := band(g.Start, g.End)
+		bands = append(bands, map[string]interface{}{
+			"from":  from,
+			"to":    to,
+			"color": "rgba(169, 169, 224, 0.2)",
+			"label": map[string]interface{}{"text": g.Name, "y": 12 + 12*lanes[i]},
+		})
+		if g.Anchor != nil {
+			from, to = band(g.Anchor.Start, g.Anchor.End)
+			bands = append(bands, map[string]interface{}{
+				"from":  from,
+				"to":    to,
+				"color": "rgba(169, 169, 224, 0.35)",
+			})
+		}
+	}
+
+	return bands
+}
+
+type editSiteBubble struct {
+	Name  int             `json:"name"`
+	Total float64         `json:"total"`
+	T     [][]interface{} `json:"t"`
+	Pre   int             `json:"pre"`
+	Full  int             `json:"full"`
+}
+
+// bubbleData returns the distribution of edit base counts at each edit site
+// for alignments at or past the edit stop site
+func bubbleData(ctx context.Context, db *Database, tmpl *treat.Template, fields *SearchFields) (interface{}, error) {
+	bubbleMap := make(map[int]map[uint32]float64)
+
+	err := db.storage.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if a.EditStop >= tmpl.EditStop {
+			frag, err := db.storage.GetFragment(key, a.Id)
+			if err != nil || frag == nil {
+				logrus.Printf("fragment not found: %s", err)
+				return
+			}
+
+			for i, t := range frag.EditSite {
+				eb, ok := bubbleMap[i]
+				if !ok {
+					eb = make(map[uint32]float64)
+				}
+				eb[t] += a.Norm
+				bubbleMap[i] = eb
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := tmpl.Len()
+	bubbles := make([]*editSiteBubble, n)
+
+	for key, val := range bubbleMap {
+		b := &editSiteBubble{
+			Name: (n - 1) - int(key) + int(tmpl.EditOffset),
+			T:    make([][]interface{}, 0),
+			Full: int(tmpl.EditSite[0][key]),
+			Pre:  int(tmpl.EditSite[1][key]),
+		}
+
+		for t, cnt := range val {
+			b.T = append(b.T, []interface{}{int(t), cnt})
+			b.Total += cnt
+		}
+		bubbles[int(key)] = b
+	}
+
+	return bubbles, nil
+}
+
+// searchAlignments returns all alignments matching fields sorted by read
+// count and the total normalized read count of each sample
+func searchAlignments(ctx context.Context, db *Database, fields *SearchFields) ([]*treat.Alignment, map[string]float64, error) {
+	totalMap := make(map[string]float64)
+	alignments := make([]*treat.Alignment, 0)
+	err := db.storage.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		a.Key = key
+		alignments = append(alignments, a)
+
+		totalMap[a.Key.Sample] += a.Norm
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Sort(ByReadCount{alignments})
+
+	return alignments, totalMap, nil
+}
+
+// pctIntervals returns bootstrap confidence intervals of the percent of the
+// search and percent of the edit stop by sample of each alignment in page.
+// alignments are all alignments matching the search, page a slice of them.
+// Each interval is the fraction of one alignment with the remaining reads of
+// the sample binned together.
+func pctIntervals(ctx context.Context, db *Database, boot *treat.Bootstrap, gene string, alignments, page []*treat.Alignment) ([]*treat.Interval, []*treat.Interval, error) {
+	type rowKey struct {
+		sample string
+		id     uint64
+	}
+
+	rows := make(map[rowKey]int)
+	editStops := make(map[int]bool)
+	for i, a := range page {
+		rows[rowKey{a.Key.Sample, a.Id}] = i
+		editStops[a.EditStop] = true
+	}
+
+	observation := func(sample string, a *treat.Alignment) treat.Observation {
+		val := -1
+		if i, ok := rows[rowKey{sample, a.Id}]; ok {
+			val = i
+		}
+		return treat.Observation{Value: val, ReadCount: a.ReadCount, Norm: a.Norm}
+	}
+
+	intervals := func(groups map[string][]treat.Observation) []*treat.Interval {
+		cis := make([]*treat.Interval, len(page))
+		for _, obs := range groups {
+			for _, bin := range boot.Histogram(obs) {
+				if bin.Value >= 0 {
+					frac := bin.Frac
+					cis[bin.Value] = &frac
+				}
+			}
+		}
+		return cis
+	}
+
+	search := make(map[string][]treat.Observation)
+	for _, a := range alignments {
+		search[a.Key.Sample] = append(search[a.Key.Sample], observation(a.Key.Sample, a))
+	}
+
+	// Edit stop totals are over all alignments of the gene
+	editStop := make(map[string][]treat.Observation)
+	fields := &SearchFields{Gene: gene, EditStop: -1, JuncEnd: -1, JuncLen: -1}
+	fields.unsetRanges()
+	err := db.storage.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if !editStops[a.EditStop] {
+			return
+		}
+		group := fmt.Sprintf("%s;%d", key.Sample, a.EditStop)
+		editStop[group] = append(editStop[group], observation(key.Sample, a))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return intervals(search), intervals(editStop), nil
+}
+
+// exportOptionsFromRequest returns the alignment export options set by the
+// format, columns, gzip and sort request parameters. Exports are sorted by
+// read count unless sort=none.
+func exportOptionsFromRequest(r *http.Request, db *Database) (*ExportOptions, error) {
+	vals := r.URL.Query()
+
+	opts := &ExportOptions{
+		Format:         vals.Get("format"),
+		Columns:        ParseExportColumns(strings.Join(vals["columns"], ",")),
+		Gzip:           vals.Get("gzip") == "1",
+		Sort:           vals.Get("sort"),
+		EditStopTotals: db.cacheEditStopTotals,
+	}
+
+	switch opts.Sort {
+	case "":
+		opts.Sort = "read_count"
+	case "none":
+		opts.Sort = ""
+	}
+
+	return opts, opts.Validate()
+}
+
+// writeJunctionsExport writes the junction clusters of all alignments
+// matching fields in csv format
+func writeJunctionsExport(ctx context.Context, w io.Writer, db *Database, fields *SearchFields, maxDist int) error {
+	tmpl, ok := db.geneTemplates[fields.Gene]
+	if !ok {
+		return fmt.Errorf("Gene not found: %s", fields.Gene)
+	}
+
+	summary := treat.NewJuncSummary(tmpl.EditBase, maxDist)
+	err := db.storage.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		summary.Add(key.Sample, a)
+	})
+	if err != nil {
+		return err
+	}
+
+	csvout := csv.NewWriter(w)
+	writeJuncClusters(csvout, fields.Gene, summary.Clusters(), summary.Samples(), 0, true)
+	csvout.Flush()
+	return csvout.Error()
+}
@@ -0,0 +1,583 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+const (
+	API_PREFIX        = "/api/v1"
+	API_DEFAULT_LIMIT = 100
+	API_MAX_LIMIT     = 10000
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiDatabase struct {
+	Name    string   `json:"name"`
+	Title   string   `json:"title"`
+	Default bool     `json:"default"`
+	Genes   []string `json:"genes"`
+}
+
+type apiAltRegion struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// apiGuide is a gRNA annotation with edit sites numbered including the offset
+type apiGuide struct {
+	Name        string `json:"name"`
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	AnchorStart *int   `json:"anchor_start,omitempty"`
+	AnchorEnd   *int   `json:"anchor_end,omitempty"`
+}
+
+type apiTemplate struct {
+	Gene        string          `json:"gene"`
+	Bases       string          `json:"bases"`
+	EditBase    string          `json:"edit_base"`
+	EditOffset  int             `json:"edit_offset"`
+	EditStop    int             `json:"edit_stop"`
+	FullyEdited string          `json:"fully_edited"`
+	StartCodon  int             `json:"start_codon"`
+	EditSites   [][]uint32      `json:"edit_sites"`
+	Labels      []string        `json:"labels"`
+	AltRegions  []*apiAltRegion `json:"alt_regions"`
+	Guides      []*apiGuide     `json:"grna"`
+}
+
+type apiSample struct {
+	Name         string `json:"name"`
+	KnockDown    string `json:"knock_down"`
+	Tetracycline bool   `json:"tetracycline"`
+	Replicate    int    `json:"replicate"`
+}
+
+type apiAlignment struct {
+	Id     uint64 `json:"id"`
+	Gene   string `json:"gene"`
+	Sample string `json:"sample"`
+	*treat.Alignment
+	JuncSeq string `json:"junc_seq"`
+}
+
+type apiFragment struct {
+	Name      string   `json:"name"`
+	ReadCount uint32   `json:"read_count"`
+	Sequence  string   `json:"sequence"`
+	Bases     string   `json:"bases"`
+	EditSites []uint32 `json:"edit_sites"`
+}
+
+type apiAlignmentDetail struct {
+	*apiAlignment
+	Fragment *apiFragment `json:"fragment"`
+}
+
+type apiAlignmentPage struct {
+	Total      int             `json:"total"`
+	Offset     int             `json:"offset"`
+	Limit      int             `json:"limit"`
+	Alignments []*apiAlignment `json:"alignments"`
+}
+
+type apiBin struct {
+	Value int     `json:"value"`
+	Norm  float64 `json:"norm_count"`
+	Reads uint32  `json:"read_count"`
+	Frac  float64 `json:"frac"`
+}
+
+type apiDistribution struct {
+	Sample string    `json:"sample"`
+	Total  float64   `json:"total"`
+	Bins   []*apiBin `json:"bins"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		logrus.Printf("Error encoding data as json: %s", err)
+		http.Error(w, "Fatal system error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func apiErrorf(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, &apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// apiDbGene returns the database and gene named in the request path. The
+// database is acquired for the request and the caller must release it.
+func apiDbGene(app *Application, w http.ResponseWriter, r *http.Request) (*Database, string, *treat.Template, bool) {
+	vars := mux.Vars(r)
+	if !app.CanAccess(r, vars["db"]) {
+		apiErrorf(w, http.StatusNotFound, "database not found: %s", vars["db"])
+		return nil, "", nil, false
+	}
+
+	db, err := app.AcquireDb(vars["db"])
+	if err != nil {
+		apiErrorf(w, http.StatusNotFound, "database not found: %s", vars["db"])
+		return nil, "", nil, false
+	}
+
+	gene, ok := vars["gene"]
+	if !ok {
+		return db, "", nil, true
+	}
+
+	tmpl, ok := db.geneTemplates[gene]
+	if !ok {
+		db.release()
+		apiErrorf(w, http.StatusNotFound, "gene not found: %s", gene)
+		return nil, "", nil, false
+	}
+
+	return db, gene, tmpl, true
+}
+
+// apiSearchFields decodes all SearchFields options from the query string.
+// Unlike the html pages the API is stateless and never reads or stores
+// search fields in the session.
+func apiSearchFields(app *Application, r *http.Request, gene string) (*SearchFields, error) {
+	fields := &SearchFields{
+		EditStop: -1,
+		JuncLen:  -1,
+		JuncEnd:  -1,
+		Limit:    API_DEFAULT_LIMIT,
+	}
+	fields.unsetRanges()
+
+	if err := app.decoder.Decode(fields, r.URL.Query()); err != nil {
+		return nil, err
+	}
+
+	if _, err := ParseWhere(fields.Where); err != nil {
+		return nil, err
+	}
+
+	fields.Gene = gene
+	if fields.Limit <= 0 || fields.Limit > API_MAX_LIMIT {
+		fields.Limit = API_MAX_LIMIT
+	}
+	if fields.Offset < 0 {
+		fields.Offset = 0
+	}
+
+	return fields, nil
+}
+
+func newApiAlignment(key *treat.AlignmentKey, a *treat.Alignment) *apiAlignment {
+	return &apiAlignment{
+		Id:        a.Id,
+		Gene:      key.Gene,
+		Sample:    key.Sample,
+		Alignment: a,
+		JuncSeq:   a.JuncSeq,
+	}
+}
+
+func ApiDatabasesHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := app.AllowedDbs(r)
+		names := make([]string, 0, len(allowed))
+		for name := range allowed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		dbs := make([]*apiDatabase, 0, len(names))
+		for _, name := range names {
+			dbs = append(dbs, &apiDatabase{
+				Name:    name,
+				Title:   allowed[name].Title(),
+				Default: name == app.DefaultDb(),
+				Genes:   allowed[name].genes,
+			})
+		}
+
+		writeJSON(w, http.StatusOK, dbs)
+	})
+}
+
+func ApiGenesHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, _, _, ok := apiDbGene(app, w, r)
+		if !ok {
+			return
+		}
+		defer db.release()
+
+		writeJSON(w, http.StatusOK, db.genes)
+	})
+}
+
+func ApiTemplateHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, gene, tmpl, ok := apiDbGene(app, w, r)
+		if !ok {
+			return
+		}
+		defer db.release()
+
+		labels := []string{"FE", "PE"}
+		regions := make([]*apiAltRegion, 0, len(tmpl.AltRegion))
+		for i, alt := range tmpl.AltRegion {
+			labels = append(labels, fmt.Sprintf("A%d", i+1))
+			regions = append(regions, &apiAltRegion{Start: alt.Start, End: alt.End})
+		}
+
+		guides := make([]*apiGuide, 0, len(tmpl.Guides))
+		for _, g := range tmpl.Guides {
+			guide := &apiGuide{Name: g.Name, Start: tmpl.IndexLabel(g.Start), End: tmpl.IndexLabel(g.End)}
+			if g.Anchor != nil {
+				start, end := tmpl.IndexLabel(g.Anchor.Start), tmpl.IndexLabel(g.Anchor.End)
+				guide.AnchorStart, guide.AnchorEnd = &start, &end
+			}
+			guides = append(guides, guide)
+		}
+
+		writeJSON(w, http.StatusOK, &apiTemplate{
+			Gene:        gene,
+			Bases:       tmpl.Bases,
+			EditBase:    string(tmpl.EditBase),
+			EditOffset:  int(tmpl.EditOffset),
+			EditStop:    tmpl.EditStop,
+			FullyEdited: tmpl.String(),
+			StartCodon:  tmpl.StartCodon,
+			EditSites:   tmpl.EditSite,
+			Labels:      labels,
+			AltRegions:  regions,
+			Guides:      guides,
+		})
+	})
+}
+
+func ApiSamplesHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, gene, _, ok := apiDbGene(app, w, r)
+		if !ok {
+			return
+		}
+		defer db.release()
+
+		keys, err := db.storage.SampleKeys(gene)
+		if err != nil {
+			logrus.Printf("Error fetching samples for gene %s: %s", gene, err)
+			apiErrorf(w, http.StatusInternalServerError, "failed to fetch samples")
+			return
+		}
+
+		samples := make([]*apiSample, 0, len(keys))
+		for _, k := range keys {
+			if k.Gene != gene {
+				continue
+			}
+			samples = append(samples, &apiSample{
+				Name:         k.Sample,
+				KnockDown:    k.KnockDown,
+				Tetracycline: k.Tetracycline,
+				Replicate:    k.Replicate,
+			})
+		}
+
+		writeJSON(w, http.StatusOK, samples)
+	})
+}
+
+func ApiAlignmentsHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, gene, _, ok := apiDbGene(app, w, r)
+		if !ok {
+			return
+		}
+		defer db.release()
+
+		fields, err := apiSearchFields(app, r, gene)
+		if err != nil {
+			apiErrorf(w, http.StatusBadRequest, "invalid query parameter: %s", err)
+			return
+		}
+
+		// Keep only the alignments up to the end of the page in memory
+		rows, total, err := topRows(r.Context(), db.storage, fields, fields.Offset+fields.Limit, lessReadCount)
+		if err != nil {
+			logrus.Printf("Error fetching alignments for gene: %s", gene)
+			apiErrorf(w, http.StatusInternalServerError, "failed to search alignments")
+			return
+		}
+
+		page := &apiAlignmentPage{
+			Total:      total,
+			Offset:     fields.Offset,
+			Limit:      fields.Limit,
+			Alignments: make([]*apiAlignment, 0),
+		}
+
+		if fields.Offset < len(rows) {
+			for _, row := range rows[fields.Offset:] {
+				page.Alignments = append(page.Alignments, newApiAlignment(row.key, row.aln))
+			}
+		}
+
+		writeJSON(w, http.StatusOK, page)
+	})
+}
+
+func ApiAlignmentHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, gene, _, ok := apiDbGene(app, w, r)
+		if !ok {
+			return
+		}
+		defer db.release()
+
+		vars := mux.Vars(r)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+		if err != nil {
+			apiErrorf(w, http.StatusBadRequest, "invalid alignment id: %s", vars["id"])
+			return
+		}
+
+		key, err := db.storage.GetKey(gene, vars["sample"])
+		if err != nil {
+			apiErrorf(w, http.StatusNotFound, "sample not found: %s", vars["sample"])
+			return
+		}
+
+		a, err := db.storage.GetAlignment(key, id)
+		if err != nil || a == nil {
+			apiErrorf(w, http.StatusNotFound, "alignment not found: %d", id)
+			return
+		}
+		a.Id = id
+
+		detail := &apiAlignmentDetail{apiAlignment: newApiAlignment(key, a)}
+
+		frag, err := db.storage.GetFragment(key, id)
+		if err == nil && frag != nil {
+			detail.Fragment = &apiFragment{
+				Name:      frag.Name,
+				ReadCount: frag.ReadCount,
+				Sequence:  frag.String(),
+				Bases:     frag.Bases,
+				EditSites: frag.EditSite,
+			}
+		}
+
+		writeJSON(w, http.StatusOK, detail)
+	})
+}
+
+// ApiDistributionHandler returns the per sample distribution of edit stop,
+// junction end or junction length for all alignments matching the query.
+func ApiDistributionHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, gene, _, ok := apiDbGene(app, w, r)
+		if !ok {
+			return
+		}
+		defer db.release()
+
+		var f func(a *treat.Alignment) int
+		switch mux.Vars(r)["field"] {
+		case "edit_stop":
+			f = func(a *treat.Alignment) int { return a.EditStop }
+		case "junc_end":
+			f = func(a *treat.Alignment) int { return a.JuncEnd }
+		case "junc_len":
+			f = func(a *treat.Alignment) int { return a.JuncLen }
+		default:
+			apiErrorf(w, http.StatusNotFound, "unknown distribution: %s", mux.Vars(r)["field"])
+			return
+		}
+
+		fields, err := apiSearchFields(app, r, gene)
+		if err != nil {
+			apiErrorf(w, http.StatusBadRequest, "invalid query parameter: %s", err)
+			return
+		}
+		fields.Offset = 0
+		fields.Limit = 0
+
+		dists := make(map[string]*apiDistribution)
+		bins := make(map[string]map[int]*apiBin)
+		err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+			d, ok := dists[key.Sample]
+			if !ok {
+				d = &apiDistribution{Sample: key.Sample, Bins: make([]*apiBin, 0)}
+				dists[key.Sample] = d
+				bins[key.Sample] = make(map[int]*apiBin)
+			}
+
+			val := f(a)
+			b, ok := bins[key.Sample][val]
+			if !ok {
+				b = &apiBin{Value: val}
+				bins[key.Sample][val] = b
+				d.Bins = append(d.Bins, b)
+			}
+
+			b.Norm += a.Norm
+			b.Reads += a.ReadCount
+			d.Total += a.Norm
+		})
+		if err != nil {
+			logrus.Printf("Error fetching alignments for gene: %s", gene)
+			apiErrorf(w, http.StatusInternalServerError, "failed to search alignments")
+			return
+		}
+
+		samples := make([]string, 0, len(dists))
+		for s := range dists {
+			samples = append(samples, s)
+		}
+		sort.Strings(samples)
+
+		data := make([]*apiDistribution, 0, len(samples))
+		for _, s := range samples {
+			d := dists[s]
+			sort.Slice(d.Bins, func(i, j int) bool { return d.Bins[i].Value < d.Bins[j].Value })
+			for _, b := range d.Bins {
+				if d.Total > 0 {
+					b.Frac = b.Norm / d.Total
+				}
+			}
+			data = append(data, d)
+		}
+
+		writeJSON(w, http.StatusOK, data)
+	})
+}
+
+func ApiJobsHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, app.visibleJobs(r))
+	})
+}
+
+func ApiJobHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job, ok := app.jobs.Get(mux.Vars(r)["id"])
+		if !ok || !app.canViewJob(r, job) {
+			apiErrorf(w, http.StatusNotFound, "job not found: %s", mux.Vars(r)["id"])
+			return
+		}
+
+		writeJSON(w, http.StatusOK, job.Status(true))
+	})
+}
+
+func ApiJobResultHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job, ok := app.jobs.Get(mux.Vars(r)["id"])
+		if !ok || !app.canViewJob(r, job) {
+			apiErrorf(w, http.StatusNotFound, "job not found: %s", mux.Vars(r)["id"])
+			return
+		}
+
+		if job.State() != JOB_DONE {
+			apiErrorf(w, http.StatusConflict, "job is %s", job.State())
+			return
+		}
+
+		path, name, ctype, ok := job.Result()
+		if !ok {
+			apiErrorf(w, http.StatusNotFound, "job has no result")
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			logrus.Printf("Error opening job result %s: %s", path, err)
+			apiErrorf(w, http.StatusNotFound, "job result not found")
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Disposition", "attachment; filename="+name)
+		io.Copy(w, f)
+	})
+}
+
+func ApiJobCancelHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job, ok := app.jobs.Get(mux.Vars(r)["id"])
+		if !ok || !app.canViewJob(r, job) {
+			apiErrorf(w, http.StatusNotFound, "job not found: %s", mux.Vars(r)["id"])
+			return
+		}
+
+		if !job.Cancel() {
+			apiErrorf(w, http.StatusConflict, "job is %s", job.State())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, job.Status(false))
+	})
+}
+
+func ApiSpecHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(app.tmpldir, "static", "openapi.json"))
+	})
+}
+
+// apiRouter registers the versioned JSON api
+func (a *Application) apiRouter(router *mux.Router) {
+	api := router.PathPrefix(API_PREFIX).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiErrorf(w, http.StatusNotFound, "not found")
+	})
+
+	api.Path("/openapi.json").Handler(ApiSpecHandler(a)).Methods("GET")
+	api.Path("/dbs").Handler(ApiDatabasesHandler(a)).Methods("GET")
+	api.Path("/dbs/{db}/genes").Handler(ApiGenesHandler(a)).Methods("GET")
+	api.Path("/dbs/{db}/genes/{gene}").Handler(ApiTemplateHandler(a)).Methods("GET")
+	api.Path("/dbs/{db}/genes/{gene}/samples").Handler(ApiSamplesHandler(a)).Methods("GET")
+	api.Path("/dbs/{db}/genes/{gene}/alignments").Handler(ApiAlignmentsHandler(a)).Methods("GET")
+	api.Path("/dbs/{db}/genes/{gene}/samples/{sample}/alignments/{id:[0-9]+}").Handler(ApiAlignmentHandler(a)).Methods("GET")
+	api.Path("/dbs/{db}/genes/{gene}/distributions/{field}").Handler(ApiDistributionHandler(a)).Methods("GET")
+	api.Path("/jobs").Handler(ApiJobsHandler(a)).Methods("GET")
+	api.Path("/jobs/{id}").Handler(ApiJobHandler(a)).Methods("GET")
+	api.Path("/jobs/{id}/result").Handler(ApiJobResultHandler(a)).Methods("GET")
+	api.Path("/jobs/{id}/cancel").Handler(ApiJobCancelHandler(a)).Methods("POST")
+}
@@ -0,0 +1,312 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// Minimal Apache Arrow IPC file (Feather v2) writer for flat tables of non
+// nullable columns. The flatbuffer metadata follows Schema.fbs, Message.fbs
+// and File.fbs from https://github.com/apache/arrow/tree/master/format
+
+const (
+	ARROW_MAGIC = "ARROW1"
+
+	arrowMetadataV5 = 4
+
+	// Message header union
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	// Type union
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+
+	arrowPrecisionDouble = 2
+)
+
+type arrowBlock struct {
+	offset  int64
+	metaLen int32
+	bodyLen int64
+}
+
+type arrowWriter struct {
+	w       io.Writer
+	offset  int64
+	fields  []*tableField
+	batches []*arrowBlock
+	body    bytes.Buffer
+}
+
+func newArrowWriter(w io.Writer, fields []*tableField) (*arrowWriter, error) {
+	a := &arrowWriter{w: w, fields: fields}
+
+	if err := a.write([]byte(ARROW_MAGIC + "\x00\x00")); err != nil {
+		return nil, err
+	}
+
+	b := flatbuffers.NewBuilder(1024)
+	schema := arrowSchema(b, fields)
+	if _, err := a.writeMessage(b, arrowHeaderSchema, schema, 0); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *arrowWriter) write(data []byte) error {
+	n, err := a.w.Write(data)
+	a.offset += int64(n)
+	return err
+}
+
+// arrowSchema builds the Schema table
+func arrowSchema(b *flatbuffers.Builder, fields []*tableField) flatbuffers.UOffsetT {
+	offsets := make([]flatbuffers.UOffsetT, len(fields))
+	for i, f := range fields {
+		name := b.CreateString(f.Name)
+
+		var typeType byte
+		switch f.Type {
+		case COLUMN_INT32, COLUMN_INT64:
+			typeType = arrowTypeInt
+			bits := int32(32)
+			if f.Type == COLUMN_INT64 {
+				bits = 64
+			}
+			b.StartObject(2)
+			b.PrependInt32Slot(0, bits, 0)
+			b.PrependBoolSlot(1, true, false)
+		case COLUMN_DOUBLE:
+			typeType = arrowTypeFloatingPoint
+			b.StartObject(1)
+			b.PrependInt16Slot(0, arrowPrecisionDouble, 0)
+		case COLUMN_BOOL:
+			typeType = arrowTypeBool
+			b.StartObject(0)
+		default:
+			typeType = arrowTypeUtf8
+			b.StartObject(0)
+		}
+		typ := b.EndObject()
+
+		b.StartVector(4, 0, 4)
+		children := b.EndVector(0)
+
+		b.StartObject(7)
+		b.PrependUOffsetTSlot(0, name, 0)
+		b.PrependBoolSlot(1, false, false)
+		b.PrependByteSlot(2, typeType, 0)
+		b.PrependUOffsetTSlot(3, typ, 0)
+		b.PrependUOffsetTSlot(5, children, 0)
+		offsets[i] = b.EndObject()
+	}
+
+	b.StartVector(4, len(offsets), 4)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(offsets[i])
+	}
+	vec := b.EndVector(len(offsets))
+
+	b.StartObject(4)
+	b.PrependUOffsetTSlot(1, vec, 0)
+	return b.EndObject()
+}
+
+// writeMessage writes an encapsulated Message with the given header. Returns
+// the length of the metadata including the prefix and padding.
+func (a *arrowWriter) writeMessage(b *flatbuffers.Builder, headerType byte, header flatbuffers.UOffsetT, bodyLen int64) (int32, error) {
+	b.StartObject(5)
+	b.PrependInt16Slot(0, arrowMetadataV5, 0)
+	b.PrependByteSlot(1, headerType, 0)
+	b.PrependUOffsetTSlot(2, header, 0)
+	b.PrependInt64Slot(3, bodyLen, 0)
+	b.Finish(b.EndObject())
+
+	meta := b.FinishedBytes()
+	pad := (8 - len(meta)%8) % 8
+
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:4], 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:8], uint32(len(meta)+pad))
+
+	if err := a.write(prefix[:]); err != nil {
+		return 0, err
+	}
+	if err := a.write(meta); err != nil {
+		return 0, err
+	}
+	if err := a.write(make([]byte, pad)); err != nil {
+		return 0, err
+	}
+
+	return int32(8 + len(meta) + pad), nil
+}
+
+// addBuffer appends data to the body padded to 8 bytes and returns its
+// offset and length
+func (a *arrowWriter) addBuffer(data []byte) [2]int64 {
+	offset := int64(a.body.Len())
+	a.body.Write(data)
+	if pad := (8 - len(data)%8) % 8; pad > 0 {
+		a.body.Write(make([]byte, pad))
+	}
+	return [2]int64{offset, int64(len(data))}
+}
+
+// WriteBatch writes the batch as a record batch
+func (a *arrowWriter) WriteBatch(batch *columnBatch) error {
+	if batch.rows == 0 {
+		return nil
+	}
+
+	a.body.Reset()
+	buffers := make([][2]int64, 0, 3*len(batch.columns))
+	for _, c := range batch.columns {
+		// Columns are not nullable so the validity bitmap is empty
+		buffers = append(buffers, [2]int64{int64(a.body.Len()), 0})
+
+		var data bytes.Buffer
+		switch c.field.Type {
+		case COLUMN_BOOL:
+			packed := make([]byte, (len(c.bools)+7)/8)
+			for i, v := range c.bools {
+				if v {
+					packed[i/8] |= 1 << uint(i%8)
+				}
+			}
+			buffers = append(buffers, a.addBuffer(packed))
+		case COLUMN_INT32:
+			binary.Write(&data, binary.LittleEndian, c.int32s)
+			buffers = append(buffers, a.addBuffer(data.Bytes()))
+		case COLUMN_INT64:
+			binary.Write(&data, binary.LittleEndian, c.int64s)
+			buffers = append(buffers, a.addBuffer(data.Bytes()))
+		case COLUMN_DOUBLE:
+			var v [8]byte
+			for _, d := range c.doubles {
+				binary.LittleEndian.PutUint64(v[:], math.Float64bits(d))
+				data.Write(v[:])
+			}
+			buffers = append(buffers, a.addBuffer(data.Bytes()))
+		case COLUMN_STRING:
+			offsets := make([]int32, len(c.strings)+1)
+			for i, s := range c.strings {
+				offsets[i+1] = offsets[i] + int32(len(s))
+				data.WriteString(s)
+			}
+			var ob bytes.Buffer
+			binary.Write(&ob, binary.LittleEndian, offsets)
+			buffers = append(buffers, a.addBuffer(ob.Bytes()))
+			buffers = append(buffers, a.addBuffer(data.Bytes()))
+		}
+	}
+
+	b := flatbuffers.NewBuilder(1024)
+
+	b.StartVector(16, len(batch.columns), 8)
+	for range batch.columns {
+		b.Prep(8, 16)
+		b.PrependInt64(0)
+		b.PrependInt64(int64(batch.rows))
+	}
+	nodes := b.EndVector(len(batch.columns))
+
+	b.StartVector(16, len(buffers), 8)
+	for i := len(buffers) - 1; i >= 0; i-- {
+		b.Prep(8, 16)
+		b.PrependInt64(buffers[i][1])
+		b.PrependInt64(buffers[i][0])
+	}
+	bufvec := b.EndVector(len(buffers))
+
+	b.StartObject(5)
+	b.PrependInt64Slot(0, int64(batch.rows), 0)
+	b.PrependUOffsetTSlot(1, nodes, 0)
+	b.PrependUOffsetTSlot(2, bufvec, 0)
+	rb := b.EndObject()
+
+	block := &arrowBlock{offset: a.offset, bodyLen: int64(a.body.Len())}
+	metaLen, err := a.writeMessage(b, arrowHeaderRecordBatch, rb, block.bodyLen)
+	if err != nil {
+		return err
+	}
+	block.metaLen = metaLen
+
+	if err := a.write(a.body.Bytes()); err != nil {
+		return err
+	}
+
+	a.batches = append(a.batches, block)
+	return nil
+}
+
+// Close writes the end of stream marker and the file footer
+func (a *arrowWriter) Close() error {
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[0:4], 0xffffffff)
+	if err := a.write(eos[:]); err != nil {
+		return err
+	}
+
+	b := flatbuffers.NewBuilder(1024)
+	schema := arrowSchema(b, a.fields)
+
+	b.StartVector(24, 0, 8)
+	dicts := b.EndVector(0)
+
+	b.StartVector(24, len(a.batches), 8)
+	for i := len(a.batches) - 1; i >= 0; i-- {
+		blk := a.batches[i]
+		b.Prep(8, 24)
+		b.PrependInt64(blk.bodyLen)
+		b.Pad(4)
+		b.PrependInt32(blk.metaLen)
+		b.PrependInt64(blk.offset)
+	}
+	batches := b.EndVector(len(a.batches))
+
+	b.StartObject(5)
+	b.PrependInt16Slot(0, arrowMetadataV5, 0)
+	b.PrependUOffsetTSlot(1, schema, 0)
+	b.PrependUOffsetTSlot(2, dicts, 0)
+	b.PrependUOffsetTSlot(3, batches, 0)
+	b.Finish(b.EndObject())
+
+	footer := b.FinishedBytes()
+	if err := a.write(footer); err != nil {
+		return err
+	}
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	if err := a.write(size[:]); err != nil {
+		return err
+	}
+
+	return a.write([]byte(ARROW_MAGIC))
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	TREAT_COOKIE_USER = "user"
+)
+
+// AuthOptions configures authentication of the web server. Authentication is
+// disabled unless a user file or proxy header is set.
+type AuthOptions struct {
+	// Secret used to sign session cookies. A random secret is generated if
+	// empty, in which case sessions do not survive a restart.
+	SessionSecret string
+
+	// Path to htpasswd style user file
+	UserFile string
+
+	// Trust the user name set in this header by a reverse proxy
+	ProxyHeader string
+}
+
+// User is an account allowed to access the web server. An empty list of
+// databases grants access to all databases.
+type User struct {
+	Name      string
+	Databases []string
+	hash      []byte
+}
+
+// CanAccess returns true if the user is allowed to view the database
+func (u *User) CanAccess(db string) bool {
+	if len(u.Databases) == 0 {
+		return true
+	}
+
+	for _, d := range u.Databases {
+		if d == db || d == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPassword returns true if password matches the user's hashed password
+func (u *User) CheckPassword(password string) bool {
+	if len(u.hash) == 0 {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(u.hash, []byte(password)) == nil
+}
+
+// LoadUsers parses an htpasswd style user file. Each line has the form
+// name:hash[:db1,db2,...] where hash is a bcrypt hash as generated by
+// "htpasswd -B" or "treat passwd". The optional third field restricts the
+// user to the listed databases. The hash may be empty when users are
+// authenticated by a reverse proxy.
+func LoadUsers(path string) (map[string]*User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("Invalid user file %s line %d", path, lineNum)
+		}
+
+		if len(parts[1]) > 0 && !strings.HasPrefix(parts[1], "$2") {
+			return nil, fmt.Errorf("Unsupported password hash for user %s. Only bcrypt hashes are supported (htpasswd -B)", parts[0])
+		}
+
+		user := &User{Name: parts[0], hash: []byte(parts[1])}
+		if len(parts) == 3 {
+			for _, db := range strings.Split(parts[2], ",") {
+				db = strings.TrimSpace(db)
+				if len(db) > 0 {
+					user.Databases = append(user.Databases, db)
+				}
+			}
+		}
+
+		users[user.Name] = user
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// sessionSecret returns the configured session secret or generates a random
+// one
+func sessionSecret(secret string) []byte {
+	if len(secret) > 0 {
+		return []byte(secret)
+	}
+
+	logrus.Warn("No session secret configured. Using random secret, sessions will not persist across restarts")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		logrus.Fatal(err)
+	}
+
+	return key
+}
+
+// Passwd prints a user file entry for the given user after reading the
+// password from stdin
+func Passwd(name string, dbs []string) {
+	if len(name) == 0 || strings.Contains(name, ":") {
+		logrus.Fatal("Please provide a valid user name")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	reader := bufio.NewReader(os.Stdin)
+	password, err := reader.ReadString('\n')
+	if err != nil && len(password) == 0 {
+		logrus.Fatal("Failed to read password")
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) == 0 {
+		logrus.Fatal("Password can not be empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	line := name + ":" + string(hash)
+	if len(dbs) > 0 {
+		sort.Strings(dbs)
+		line += ":" + strings.Join(dbs, ",")
+	}
+
+	fmt.Println(line)
+}
+
+func (a *Application) authEnabled() bool {
+	return a.users != nil || len(a.proxyHeader) > 0
+}
+
+// loginEnabled returns true if users log in with a password. When using proxy
+// auth the user file only restricts database access.
+func (a *Application) loginEnabled() bool {
+	return a.users != nil && len(a.proxyHeader) == 0
+}
+
+// authenticate returns the user of the request either from the proxy header
+// or the session. Returns nil if the request is not authenticated.
+func (a *Application) authenticate(r *http.Request) *User {
+	name := ""
+	if len(a.proxyHeader) > 0 {
+		name = r.Header.Get(a.proxyHeader)
+		if len(name) > 0 && a.users == nil {
+			// No user file, proxy users can access all databases
+			return &User{Name: name}
+		}
+	} else {
+		session, _ := a.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+		if n, ok := session.Values[TREAT_COOKIE_USER].(string); ok {
+			name = n
+		}
+	}
+
+	if len(name) == 0 {
+		return nil
+	}
+
+	user, ok := a.users[name]
+	if !ok {
+		return nil
+	}
+
+	return user
+}
+
+// GetUserFromContext returns the authenticated user of the request or nil if
+// authentication is disabled
+func (a *Application) GetUserFromContext(r *http.Request) *User {
+	user, _ := r.Context().Value("user").(*User)
+	return user
+}
+
+// CanAccess returns true if the request is allowed to view the database
+func (a *Application) CanAccess(r *http.Request, dbname string) bool {
+	if _, ok := a.Dbs()[dbname]; !ok {
+		return false
+	}
+
+	if !a.authEnabled() {
+		return true
+	}
+
+	user := a.GetUserFromContext(r)
+	if user == nil {
+		return false
+	}
+
+	return user.CanAccess(dbname)
+}
+
+// AllowedDbs returns the databases the request is allowed to view
+func (a *Application) AllowedDbs(r *http.Request) map[string]*Database {
+	all := a.Dbs()
+	if !a.authEnabled() {
+		return all
+	}
+
+	dbs := make(map[string]*Database)
+	for name, db := range all {
+		if a.CanAccess(r, name) {
+			dbs[name] = db
+		}
+	}
+
+	return dbs
+}
+
+// defaultDbFor returns the default database for the request. If the user
+// can't access the default database the first allowed database is used.
+func (a *Application) defaultDbFor(r *http.Request) string {
+	defaultDb := a.DefaultDb()
+	if a.CanAccess(r, defaultDb) {
+		return defaultDb
+	}
+
+	names := make([]string, 0)
+	for name := range a.AllowedDbs(r) {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+	return names[0]
+}
+
+// localRedirect returns next if it is a path on this server, otherwise "/".
+// Browsers treat a backslash as a slash so /\evil.com is the same as
+// //evil.com and is rejected.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.Contains(next, "\\") {
+		return "/"
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 || u.User != nil ||
+		strings.HasPrefix(u.Path, "//") || strings.Contains(u.Path, "\\") {
+		return "/"
+	}
+
+	return next
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/search?gene=RPS12&sample=s1", "/search?gene=RPS12&sample=s1"},
+		{"/heat#chart", "/heat#chart"},
+		{"search", "/"},
+		{"http://evil.com", "/"},
+		{"https://evil.com/search", "/"},
+		{"javascript:alert(1)", "/"},
+		{"//evil.com", "/"},
+		{"///evil.com", "/"},
+		{"/\\evil.com", "/"},
+		{"\\\\evil.com", "/"},
+		{"/\\/evil.com", "/"},
+		{"/search\\..\\", "/"},
+		{"/%5Cevil.com", "/"},
+		{"/\t/evil.com", "/"},
+		{"/\n/evil.com", "/"},
+		{"/%2F/evil.com", "/"},
+	}
+
+	for _, test := range tests {
+		if got := localRedirect(test.next); got != test.want {
+			t.Errorf("Wrong redirect for %q. %q != %q", test.next, got, test.want)
+		}
+	}
+}
+
+func TestCanUpload(t *testing.T) {
+	users := map[string]*User{
+		"alice": {Name: "alice"},
+		"bob":   {Name: "bob"},
+		"carol": {Name: "carol", Databases: []string{"b.db"}},
+		"dave":  {Name: "dave"},
+	}
+	snap := &dbSnapshot{dbs: map[string]*Database{"a.db": {name: "a.db"}, "b.db": {name: "b.db"}}}
+	app := &Application{snap: snap, users: users, admins: []string{"alice"}, uploaders: []string{"bob", "carol"}, adminToken: "secret"}
+
+	tests := []struct {
+		name   string
+		app    *Application
+		r      *http.Request
+		db     string
+		upload bool
+	}{
+		{"admin", app, adminRequest("10.0.0.1:1234", "", users["alice"]), "a.db", true},
+		{"uploader", app, adminRequest("10.0.0.1:1234", "", users["bob"]), "a.db", true},
+		{"uploader without access", app, adminRequest("10.0.0.1:1234", "", users["carol"]), "a.db", false},
+		{"uploader with access", app, adminRequest("10.0.0.1:1234", "", users["carol"]), "b.db", true},
+		{"viewer", app, adminRequest("10.0.0.1:1234", "", users["dave"]), "a.db", false},
+		{"no user", app, adminRequest("10.0.0.1:1234", "", nil), "a.db", false},
+		{"unknown db", app, adminRequest("10.0.0.1:1234", "", users["alice"]), "c.db", false},
+		{"no auth", &Application{snap: snap}, adminRequest("127.0.0.1:1234", "", nil), "a.db", false},
+		{"no auth token", &Application{snap: snap, adminToken: "secret"}, adminRequest("10.0.0.1:1234", "secret", nil), "a.db", true},
+		{"no auth wrong token", &Application{snap: snap, adminToken: "secret"}, adminRequest("10.0.0.1:1234", "guess", nil), "a.db", false},
+	}
+
+	for _, test := range tests {
+		if upload := test.app.canUpload(test.r, test.db); upload != test.upload {
+			t.Errorf("%s: wrong upload access. %t != %t", test.name, upload, test.upload)
+		}
+	}
+}
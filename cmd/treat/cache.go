@@ -0,0 +1,185 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/schema"
+	"github.com/sirupsen/logrus"
+)
+
+// chartCache is a size bounded LRU cache of encoded chart responses. It is
+// safe for concurrent use. A nil cache never stores anything.
+type chartCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newChartCache(size int) *chartCache {
+	return &chartCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached response for key
+func (c *chartCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// Add stores the response for key, evicting the least recently used entries
+// if the cache is full
+func (c *chartCache) Add(key string, data []byte) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*cacheEntry).data = data
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, data: data})
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns the number of cached responses
+func (c *chartCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Purge removes all cached responses
+func (c *chartCache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// cacheKeyEncoder encodes search fields into chart cache keys
+var cacheKeyEncoder = newCacheKeyEncoder()
+
+func newCacheKeyEncoder() *schema.Encoder {
+	enc := schema.NewEncoder()
+	// The default encoding rounds floats to 6 decimal places
+	enc.RegisterEncoder(float64(0), func(v reflect.Value) string {
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	})
+	return enc
+}
+
+// chartCacheKey returns the cache key for a chart endpoint. The key is built
+// from the schema encoding of the decoded search fields so the same search
+// yields the same key regardless of parameter order or whether it came from
+// the url or the session cookie, and new search fields are included without
+// changes here. Offset, limit and form state don't affect charts and are left
+// out. Any extra request parameters used by the endpoint are appended.
+func chartCacheKey(endpoint string, fields *SearchFields, r *http.Request, params ...string) string {
+	search := *fields
+	search.Offset = 0
+	search.Limit = 0
+	search.FormOpen = false
+
+	vals := make(url.Values)
+	if err := cacheKeyEncoder.Encode(&search, vals); err != nil {
+		logrus.Errorf("Failed to encode search fields for cache key: %s", err)
+		return fmt.Sprintf("%s|%#v", endpoint, search)
+	}
+	for _, v := range vals {
+		sort.Strings(v)
+	}
+
+	key := endpoint + "|" + vals.Encode()
+
+	query := r.URL.Query()
+	for _, p := range params {
+		key += fmt.Sprintf("|%s=%s", p, query.Get(p))
+	}
+
+	return key
+}
+
+// cachedChart writes the cached response for key if caching is enabled.
+// Returns true if the response was served from the cache.
+func (a *Application) cachedChart(w http.ResponseWriter, db *Database, key string) bool {
+	if !a.enableCache {
+		return false
+	}
+
+	out, ok := db.cache.Get(key)
+	if !ok {
+		return false
+	}
+
+	w.Write(out)
+	return true
+}
+
+// cacheChart stores the chart response for key if caching is enabled
+func (a *Application) cacheChart(db *Database, key string, out []byte) {
+	if a.enableCache {
+		db.cache.Add(key, out)
+	}
+}
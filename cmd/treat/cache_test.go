@@ -0,0 +1,100 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestChartCacheKeyFields(t *testing.T) {
+	r := httptest.NewRequest("GET", "/data/es-hist", nil)
+	base := chartCacheKey("/data/es-hist", &SearchFields{}, r)
+
+	// Fields which don't change charts
+	ignored := map[string]bool{"Offset": true, "Limit": true, "FormOpen": true}
+
+	typ := reflect.TypeOf(SearchFields{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Tag.Get("schema") == "-" {
+			continue
+		}
+
+		fields := &SearchFields{}
+		v := reflect.ValueOf(fields).Elem().Field(i)
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Int:
+			v.SetInt(7)
+		case reflect.Float64:
+			v.SetFloat(0.0000001)
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Slice:
+			v.Set(reflect.Append(v, reflect.Zero(f.Type.Elem())))
+		case reflect.Ptr:
+			v.Set(reflect.New(f.Type.Elem()))
+		default:
+			t.Fatalf("Unsupported field type %s of %s", f.Type, f.Name)
+		}
+
+		key := chartCacheKey("/data/es-hist", fields, r)
+		if ignored[f.Name] && key != base {
+			t.Errorf("Cache key changed by %s: %s", f.Name, key)
+		} else if !ignored[f.Name] && key == base {
+			t.Errorf("Cache key not changed by %s: %s", f.Name, key)
+		}
+	}
+}
+
+func TestChartCacheKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/data/es-hist?ci=1&boot=100&page=2", nil)
+
+	a := &SearchFields{Gene: "RPS12", Sample: []string{"s1", "s2"}, EditStop: -1, Limit: 10}
+	b := &SearchFields{Gene: "RPS12", Sample: []string{"s2", "s1"}, EditStop: -1, Offset: 20}
+	if chartCacheKey("/data/es-hist", a, r) != chartCacheKey("/data/es-hist", b, r) {
+		t.Errorf("Cache keys differ by sample order or paging: %s != %s", chartCacheKey("/data/es-hist", a, r), chartCacheKey("/data/es-hist", b, r))
+	}
+
+	if chartCacheKey("/data/es-hist", a, r) == chartCacheKey("/data/jl-hist", a, r) {
+		t.Errorf("Cache key missing endpoint")
+	}
+
+	plain := chartCacheKey("/data/es-hist", a, r)
+	ci := chartCacheKey("/data/es-hist", a, r, "ci", "boot")
+	if plain == ci {
+		t.Errorf("Cache key missing extra parameters: %s", ci)
+	}
+
+	other := httptest.NewRequest("GET", "/data/es-hist?ci=1&boot=200", nil)
+	if ci == chartCacheKey("/data/es-hist", a, other, "ci", "boot") {
+		t.Errorf("Cache key not changed by extra parameter value: %s", ci)
+	}
+
+	// A bound of 0 is set unlike the negative default
+	unset := &SearchFields{Gene: "RPS12", EditStop: -1}
+	unset.unsetRanges()
+	zero := *unset
+	zero.JuncLenMax = 0
+	if chartCacheKey("/data/es-hist", unset, r) == chartCacheKey("/data/es-hist", &zero, r) {
+		t.Errorf("Cache key not changed by a bound of 0: %s", chartCacheKey("/data/es-hist", &zero, r))
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	RENDER_SVG = "svg"
+	RENDER_PDF = "pdf"
+)
+
+type textAnchor int
+
+const (
+	ANCHOR_START textAnchor = iota
+	ANCHOR_MIDDLE
+	ANCHOR_END
+)
+
+type point struct {
+	X float64
+	Y float64
+}
+
+// canvas draws vector graphics in points with the origin at the top left.
+// Text is drawn in Helvetica or, if mono is set, Courier so SVG and PDF
+// output have the same layout.
+type canvas interface {
+	Rect(x, y, w, h float64, fill string)
+	Line(x1, y1, x2, y2 float64, stroke string, width float64)
+	Polyline(points []point, stroke string, width float64)
+	Text(x, y, size float64, anchor textAnchor, mono bool, color, text string)
+	Close() error
+}
+
+func newCanvas(format string, w io.Writer, width, height float64) (canvas, error) {
+	switch format {
+	case RENDER_SVG:
+		return newSvgCanvas(w, width, height), nil
+	case RENDER_PDF:
+		return &pdfCanvas{w: w, width: width, height: height}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid render format: %s", format)
+}
+
+// renderContentType returns the mime type of the render format
+func renderContentType(format string) string {
+	if format == RENDER_PDF {
+		return "application/pdf"
+	}
+	return "image/svg+xml"
+}
+
+// textWidth estimates the width of text in points
+func textWidth(text string, size float64, mono bool) float64 {
+	if mono {
+		return float64(len(text)) * size * 0.6
+	}
+
+	// Approximate Helvetica glyph widths per 1000 units of font size
+	w := 0
+	for _, c := range text {
+		switch {
+		case c == ' ' || c == '.' || c == ',' || c == ':' || c == 'i' || c == 'l' || c == 'j':
+			w += 278
+		case c == '-' || c == '(' || c == ')' || c == 'r' || c == 't' || c == 'f':
+			w += 333
+		case c >= 'A' && c <= 'Z':
+			w += 667
+		case c == 'm' || c == 'w':
+			w += 833
+		default:
+			w += 556
+		}
+	}
+	return float64(w) * size / 1000
+}
+
+type svgCanvas struct {
+	w   io.Writer
+	err error
+}
+
+func newSvgCanvas(w io.Writer, width, height float64) *svgCanvas {
+	s := &svgCanvas{w: w}
+	s.printf(`<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%s" height="%s" viewBox="0 0 %s %s">`+"\n",
+		num(width), num(height), num(width), num(height))
+	s.Rect(0, 0, width, height, "#ffffff")
+	return s
+}
+
+func (s *svgCanvas) printf(format string, args ...interface{}) {
+	if s.err != nil {
+		return
+	}
+	_, s.err = fmt.Fprintf(s.w, format, args...)
+}
+
+func (s *svgCanvas) Rect(x, y, w, h float64, fill string) {
+	s.printf(`<rect x="%s" y="%s" width="%s" height="%s" fill="%s"/>`+"\n", num(x), num(y), num(w), num(h), fill)
+}
+
+func (s *svgCanvas) Line(x1, y1, x2, y2 float64, stroke string, width float64) {
+	s.printf(`<line x1="%s" y1="%s" x2="%s" y2="%s" stroke="%s" stroke-width="%s"/>`+"\n", num(x1), num(y1), num(x2), num(y2), stroke, num(width))
+}
+
+func (s *svgCanvas) Polyline(points []point, stroke string, width float64) {
+	coords := make([]string, len(points))
+	for i, p := range points {
+		coords[i] = num(p.X) + "," + num(p.Y)
+	}
+	s.printf(`<polyline points="%s" fill="none" stroke="%s" stroke-width="%s" stroke-linejoin="round"/>`+"\n", strings.Join(coords, " "), stroke, num(width))
+}
+
+func (s *svgCanvas) Text(x, y, size float64, anchor textAnchor, mono bool, color, text string) {
+	if len(text) == 0 {
+		return
+	}
+	family := "Helvetica, Arial, sans-serif"
+	if mono {
+		family = "Courier, monospace"
+	}
+	align := "start"
+	switch anchor {
+	case ANCHOR_MIDDLE:
+		align = "middle"
+	case ANCHOR_END:
+		align = "end"
+	}
+
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(text))
+	s.printf(`<text x="%s" y="%s" font-family="%s" font-size="%s" text-anchor="%s" fill="%s" xml:space="preserve">%s</text>`+"\n",
+		num(x), num(y), family, num(size), align, color, buf.String())
+}
+
+func (s *svgCanvas) Close() error {
+	s.printf("</svg>\n")
+	return s.err
+}
+
+// pdfCanvas buffers a single page content stream and writes the document
+// with the standard Helvetica and Courier fonts on Close
+type pdfCanvas struct {
+	w       io.Writer
+	width   float64
+	height  float64
+	content bytes.Buffer
+}
+
+// pdfColor converts a #rrggbb color to PDF rgb components
+func pdfColor(color string) string {
+	if len(color) != 7 || color[0] != '#' {
+		return "0 0 0"
+	}
+	v, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return "0 0 0"
+	}
+	return fmt.Sprintf("%s %s %s", num(float64(v>>16&0xff)/255), num(float64(v>>8&0xff)/255), num(float64(v&0xff)/255))
+}
+
+// pdfString escapes text as a PDF literal string. Characters outside of
+// ASCII are replaced as the standard fonts are not embedded.
+func pdfString(text string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	for _, c := range text {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case c < 32 || c > 126:
+			buf.WriteByte('?')
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+func (p *pdfCanvas) Rect(x, y, w, h float64, fill string) {
+	fmt.Fprintf(&p.content, "%s rg %s %s %s %s re f\n", pdfColor(fill), num(x), num(p.height-y-h), num(w), num(h))
+}
+
+func (p *pdfCanvas) Line(x1, y1, x2, y2 float64, stroke string, width float64) {
+	fmt.Fprintf(&p.content, "%s RG %s w %s %s m %s %s l S\n", pdfColor(stroke), num(width), num(x1), num(p.height-y1), num(x2), num(p.height-y2))
+}
+
+func (p *pdfCanvas) Polyline(points []point, stroke string, width float64) {
+	if len(points) == 0 {
+		return
+	}
+	fmt.Fprintf(&p.content, "%s RG %s w 1 j %s %s m", pdfColor(stroke), num(width), num(points[0].X), num(p.height-points[0].Y))
+	for _, pt := range points[1:] {
+		fmt.Fprintf(&p.content, " %s %s l", num(pt.X), num(p.height-pt.Y))
+	}
+	p.content.WriteString(" S\n")
+}
+
+func (p *pdfCanvas) Text(x, y, size float64, anchor textAnchor, mono bool, color, text string) {
+	if len(text) == 0 {
+		return
+	}
+	font := "/F1"
+	if mono {
+		font = "/F2"
+	}
+	switch anchor {
+	case ANCHOR_MIDDLE:
+		x -= textWidth(text, size, mono) / 2
+	case ANCHOR_END:
+		x -= textWidth(text, size, mono)
+	}
+	fmt.Fprintf(&p.content, "BT %s %s Tf %s rg %s %s Td %s Tj ET\n", font, num(size), pdfColor(color), num(x), num(p.height-y), pdfString(text))
+}
+
+func (p *pdfCanvas) Close() error {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Contents 4 0 R /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> >>", num(p.width), num(p.height)),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Producer %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, pdfString("treat version "+TreatVersion), xref)
+
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
+
+// num formats a coordinate with at most two decimals
+func num(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,398 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+const (
+	EXPORT_PARQUET = "parquet"
+	EXPORT_ARROW   = "arrow"
+
+	// Number of rows per parquet row group or arrow record batch
+	EXPORT_BATCH_SIZE = 131072
+)
+
+type columnType int
+
+const (
+	COLUMN_BOOL columnType = iota
+	COLUMN_INT32
+	COLUMN_INT64
+	COLUMN_DOUBLE
+	COLUMN_STRING
+)
+
+type tableField struct {
+	Name string
+	Type columnType
+}
+
+// tableColumn holds the values of a single column in a batch. Only the slice
+// matching the column type is used.
+type tableColumn struct {
+	field   *tableField
+	bools   []bool
+	int32s  []int32
+	int64s  []int64
+	doubles []float64
+	strings []string
+}
+
+func (c *tableColumn) reset() {
+	c.bools = c.bools[:0]
+	c.int32s = c.int32s[:0]
+	c.int64s = c.int64s[:0]
+	c.doubles = c.doubles[:0]
+	c.strings = c.strings[:0]
+}
+
+// columnBatch is a set of rows stored by column
+type columnBatch struct {
+	fields  []*tableField
+	columns []*tableColumn
+	rows    int
+}
+
+func newColumnBatch(fields []*tableField) *columnBatch {
+	b := &columnBatch{fields: fields, columns: make([]*tableColumn, len(fields))}
+	for i, f := range fields {
+		b.columns[i] = &tableColumn{field: f}
+	}
+	return b
+}
+
+func (b *columnBatch) reset() {
+	for _, c := range b.columns {
+		c.reset()
+	}
+	b.rows = 0
+}
+
+// tableWriter writes batches of rows in a columnar file format
+type tableWriter interface {
+	WriteBatch(b *columnBatch) error
+	Close() error
+}
+
+func newTableWriter(format string, w io.Writer, fields []*tableField, compress bool) (tableWriter, error) {
+	switch format {
+	case EXPORT_PARQUET:
+		return newParquetWriter(w, fields, compress)
+	case EXPORT_ARROW:
+		return newArrowWriter(w, fields)
+	}
+
+	return nil, fmt.Errorf("Invalid table format: %s", format)
+}
+
+// Alignment factors shared by all exported tables
+var tableKeyFields = []*tableField{
+	{"gene", COLUMN_STRING},
+	{"sample", COLUMN_STRING},
+	{"knock_down", COLUMN_STRING},
+	{"tetracycline", COLUMN_BOOL},
+	{"replicate", COLUMN_INT32},
+}
+
+var alignmentTableFields = append(append([]*tableField{}, tableKeyFields...),
+	&tableField{"id", COLUMN_INT64},
+	&tableField{"read_count", COLUMN_INT64},
+	&tableField{"norm_count", COLUMN_DOUBLE},
+	&tableField{"edit_stop", COLUMN_INT32},
+	&tableField{"junc_start", COLUMN_INT32},
+	&tableField{"junc_end", COLUMN_INT32},
+	&tableField{"junc_len", COLUMN_INT32},
+	&tableField{"has_mutation", COLUMN_BOOL},
+	&tableField{"mismatches", COLUMN_INT32},
+	&tableField{"indel", COLUMN_INT32},
+	&tableField{"alt_editing", COLUMN_INT32},
+	&tableField{"junc_seq", COLUMN_STRING},
+)
+
+func appendKey(b *columnBatch, key *treat.AlignmentKey) {
+	c := b.columns
+	c[0].strings = append(c[0].strings, key.Gene)
+	c[1].strings = append(c[1].strings, key.Sample)
+	c[2].strings = append(c[2].strings, key.KnockDown)
+	c[3].bools = append(c[3].bools, key.Tetracycline)
+	c[4].int32s = append(c[4].int32s, int32(key.Replicate))
+}
+
+func appendAlignment(b *columnBatch, key *treat.AlignmentKey, a *treat.Alignment) {
+	appendKey(b, key)
+
+	c := b.columns[len(tableKeyFields):]
+	c[0].int64s = append(c[0].int64s, int64(a.Id))
+	c[1].int64s = append(c[1].int64s, int64(a.ReadCount))
+	c[2].doubles = append(c[2].doubles, a.Norm)
+	c[3].int32s = append(c[3].int32s, int32(a.EditStop))
+	c[4].int32s = append(c[4].int32s, int32(a.JuncStart))
+	c[5].int32s = append(c[5].int32s, int32(a.JuncEnd))
+	c[6].int32s = append(c[6].int32s, int32(a.JuncLen))
+	c[7].bools = append(c[7].bools, a.HasMutation > 0)
+	c[8].int32s = append(c[8].int32s, int32(a.Mismatches))
+	c[9].int32s = append(c[9].int32s, int32(a.Indel))
+	c[10].int32s = append(c[10].int32s, int32(a.AltEditing))
+	c[11].strings = append(c[11].strings, a.JuncSeq)
+	b.rows++
+}
+
+// Alignment fields which can be pre-aggregated
+var aggregateFields = map[string]func(a *treat.Alignment) int{
+	"edit_stop": func(a *treat.Alignment) int { return a.EditStop },
+	"junc_end":  func(a *treat.Alignment) int { return a.JuncEnd },
+	"junc_len":  func(a *treat.Alignment) int { return a.JuncLen },
+}
+
+type aggregateKey struct {
+	key   treat.AlignmentKey
+	value int
+}
+
+type aggregateSums struct {
+	alignments int64
+	reads      int64
+	norm       float64
+}
+
+// aggregateTable sums alignment counts by sample and the value of one field
+type aggregateTable struct {
+	field string
+	value func(a *treat.Alignment) int
+	sums  map[aggregateKey]*aggregateSums
+}
+
+func newAggregateTable(field string) (*aggregateTable, error) {
+	fn, ok := aggregateFields[field]
+	if !ok {
+		return nil, fmt.Errorf("Invalid aggregate field: %s", field)
+	}
+
+	return &aggregateTable{field: field, value: fn, sums: make(map[aggregateKey]*aggregateSums)}, nil
+}
+
+func (t *aggregateTable) Add(key *treat.AlignmentKey, a *treat.Alignment) {
+	k := aggregateKey{key: *key, value: t.value(a)}
+	s, ok := t.sums[k]
+	if !ok {
+		s = &aggregateSums{}
+		t.sums[k] = s
+	}
+	s.alignments++
+	s.reads += int64(a.ReadCount)
+	s.norm += a.Norm
+}
+
+func (t *aggregateTable) Fields() []*tableField {
+	return append(append([]*tableField{}, tableKeyFields...),
+		&tableField{t.field, COLUMN_INT32},
+		&tableField{"alignments", COLUMN_INT64},
+		&tableField{"read_count", COLUMN_INT64},
+		&tableField{"norm_count", COLUMN_DOUBLE},
+	)
+}
+
+// Batch returns the sums sorted by sample and field value
+func (t *aggregateTable) Batch() *columnBatch {
+	keys := make([]aggregateKey, 0, len(t.sums))
+	for k := range t.sums {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.key != b.key {
+			ka, _ := a.key.MarshalBinary()
+			kb, _ := b.key.MarshalBinary()
+			return string(ka) < string(kb)
+		}
+		return a.value < b.value
+	})
+
+	b := newColumnBatch(t.Fields())
+	for _, k := range keys {
+		s := t.sums[k]
+		appendKey(b, &k.key)
+		c := b.columns[len(tableKeyFields):]
+		c[0].int32s = append(c[0].int32s, int32(k.value))
+		c[1].int64s = append(c[1].int64s, s.alignments)
+		c[2].int64s = append(c[2].int64s, s.reads)
+		c[3].doubles = append(c[3].doubles, s.norm)
+		b.rows++
+	}
+
+	return b
+}
+
+// TableOptions control the columnar export of alignments
+type TableOptions struct {
+	// Output format, parquet or arrow
+	Format string
+
+	// Output file. Standard output if empty
+	Output string
+
+	// Fields to pre-aggregate. Each table is written next to Output
+	Aggregate []string
+
+	// Compress parquet pages with gzip
+	Gzip bool
+
+	// Rows per row group or record batch
+	BatchSize int
+}
+
+// aggregatePath returns the path of the table aggregated by field, e.g.
+// rps12.parquet becomes rps12.edit_stop.parquet
+func aggregatePath(path, field string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + field + ext
+}
+
+// ExportTable writes the alignments matching fields and any aggregated tables
+// in a columnar format
+func ExportTable(dbpath string, fields *SearchFields, opts *TableOptions) {
+	if opts.Format != EXPORT_PARQUET && opts.Format != EXPORT_ARROW {
+		logrus.Fatalf("Invalid table format: %s", opts.Format)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = EXPORT_BATCH_SIZE
+	}
+
+	if len(opts.Aggregate) > 0 && len(opts.Output) == 0 {
+		logrus.Fatal("Please provide an output file when writing aggregated tables")
+	}
+
+	tables := make([]*aggregateTable, 0, len(opts.Aggregate))
+	for _, field := range opts.Aggregate {
+		t, err := newAggregateTable(field)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		tables = append(tables, t)
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	out := io.Writer(os.Stdout)
+	if len(opts.Output) > 0 {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	buf := bufio.NewWriter(out)
+	tw, err := newTableWriter(opts.Format, buf, alignmentTableFields, opts.Gzip)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	batch := newColumnBatch(alignmentTableFields)
+	count := 0
+	var writeErr error
+	err = s.SearchContext(context.Background(), fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if writeErr != nil {
+			return
+		}
+
+		for _, t := range tables {
+			t.Add(key, a)
+		}
+
+		appendAlignment(batch, key, a)
+		count++
+		if batch.rows >= opts.BatchSize {
+			writeErr = tw.WriteBatch(batch)
+			batch.reset()
+		}
+	})
+	if writeErr != nil {
+		logrus.Fatal(writeErr)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = tw.WriteBatch(batch)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Infof("Wrote %d alignments", count)
+
+	for _, t := range tables {
+		path := aggregatePath(opts.Output, t.field)
+		err := writeTable(path, opts.Format, t.Batch(), opts.Gzip)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Wrote alignments aggregated by %s to %s", t.field, path)
+	}
+}
+
+// writeTable writes a single batch to a new file
+func writeTable(path, format string, b *columnBatch, compress bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	tw, err := newTableWriter(format, buf, b.fields, compress)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteBatch(b)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ubccr/treat"
+)
+
+// The files in testdata were written from testBatches and checked with the
+// Apache Arrow Go readers (ipc.FileReader and pqarrow), which read back the
+// schema and every value. Regenerate them with -update only after a
+// deliberate change to the writers and check them again with an Arrow reader.
+var updateFixtures = flag.Bool("update", false, "Update the parquet and arrow test fixtures")
+
+// testBatches returns two batches of alignments with every column type, empty
+// and non ascii strings and more than 8 booleans to span bitmap bytes
+func testBatches() []*columnBatch {
+	batches := make([]*columnBatch, 0)
+	id := uint64(1)
+	for _, n := range []int{11, 3} {
+		b := newColumnBatch(alignmentTableFields)
+		for i := 0; i < n; i++ {
+			key := &treat.AlignmentKey{
+				Gene:         "RPS12",
+				Sample:       fmt.Sprintf("sample-%d", i%3),
+				KnockDown:    []string{"", "GAP1", "MRB8180", "δ"}[i%4],
+				Tetracycline: i%3 == 0,
+				Replicate:    i % 2,
+			}
+			a := &treat.Alignment{
+				Id:          id,
+				EditStop:    130 + i,
+				JuncStart:   131 + i,
+				JuncEnd:     140 + 2*i,
+				JuncLen:     i * 3,
+				ReadCount:   uint32(1000 * (i + 1)),
+				Norm:        float64(i) * 1.25,
+				HasMutation: uint8(i % 2),
+				Mismatches:  uint8(i % 4),
+				Indel:       uint8(i % 3),
+				AltEditing:  uint8(i % 5),
+				JuncSeq:     []string{"", "TTTAGT", "CCCGAATTTTT"}[i%3],
+			}
+			appendAlignment(b, key, a)
+			id += 1 << 33
+		}
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+func writeTestTable(t *testing.T, format string, compress bool, batches []*columnBatch) []byte {
+	var buf bytes.Buffer
+	tw, err := newTableWriter(format, &buf, batches[0].fields, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range batches {
+		if err := tw.WriteBatch(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestColumnarFixtures(t *testing.T) {
+	tests := []struct {
+		format   string
+		compress bool
+		fixture  string
+	}{
+		{EXPORT_ARROW, false, "alignments.arrow"},
+		{EXPORT_PARQUET, false, "alignments.parquet"},
+		{EXPORT_PARQUET, true, "alignments.gz.parquet"},
+	}
+
+	for _, test := range tests {
+		data := writeTestTable(t, test.format, test.compress, testBatches())
+		path := filepath.Join("testdata", test.fixture)
+		if *updateFixtures {
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s differs from %s. %d != %d bytes", test.format, path, len(data), len(want))
+		}
+	}
+}
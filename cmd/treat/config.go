@@ -0,0 +1,158 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DatabaseConfig is a database served by the web server. Path can be a
+// single database file or a directory of *.db files. Name is an optional
+// display name for a single database file.
+type DatabaseConfig struct {
+	Path string `yaml:"path"`
+	Name string `yaml:"name"`
+}
+
+// ServerConfig holds all web server settings. It can be loaded from a YAML
+// file, command line flags override any values set in the file.
+type ServerConfig struct {
+	Bind            string            `yaml:"bind"`
+	Port            int               `yaml:"port"`
+	TLSCert         string            `yaml:"tls_cert"`
+	TLSKey          string            `yaml:"tls_key"`
+	ReadTimeout     time.Duration     `yaml:"read_timeout"`
+	WriteTimeout    time.Duration     `yaml:"write_timeout"`
+	ShutdownTimeout time.Duration     `yaml:"shutdown_timeout"`
+	TemplateDir     string            `yaml:"templates"`
+	Databases       []*DatabaseConfig `yaml:"databases"`
+	EnableCache     bool              `yaml:"enable_cache"`
+	CacheSize       int               `yaml:"cache_size"`
+	SessionSecret   string            `yaml:"session_secret"`
+	UserFile        string            `yaml:"users"`
+	ProxyAuthHeader string            `yaml:"proxy_auth_header"`
+	Admins          []string          `yaml:"admins"`
+	Uploaders       []string          `yaml:"uploaders"`
+	AdminToken      string            `yaml:"admin_token"`
+	WatchInterval   time.Duration     `yaml:"watch_interval"`
+	EnableUpload    bool              `yaml:"enable_upload"`
+	UploadDir       string            `yaml:"upload_dir"`
+	UploadMaxSize   int64             `yaml:"upload_max_mb"`
+	JobWorkers      int               `yaml:"job_workers"`
+	JobHistory      int               `yaml:"job_history"`
+}
+
+// NewServerConfig returns a config with default values
+func NewServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Port:            8080,
+		ReadTimeout:     1 * time.Minute,
+		WriteTimeout:    10 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		CacheSize:       1000,
+		UploadMaxSize:   1024,
+		JobWorkers:      2,
+		JobHistory:      100,
+	}
+}
+
+// LoadServerConfig reads the server config from a YAML file. Unknown keys are
+// reported as errors to catch typos.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	cfg := NewServerConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.UnmarshalStrict(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the config for missing or invalid values
+func (cfg *ServerConfig) Validate() error {
+	if len(cfg.Databases) == 0 {
+		return fmt.Errorf("No databases configured")
+	}
+
+	for _, d := range cfg.Databases {
+		if len(d.Path) == 0 {
+			return fmt.Errorf("Database path is required")
+		}
+	}
+
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return fmt.Errorf("Invalid port: %d", cfg.Port)
+	}
+
+	if (len(cfg.TLSCert) > 0) != (len(cfg.TLSKey) > 0) {
+		return fmt.Errorf("Both tls_cert and tls_key are required to enable TLS")
+	}
+
+	if cfg.UploadMaxSize <= 0 {
+		return fmt.Errorf("Invalid upload_max_mb: %d", cfg.UploadMaxSize)
+	}
+
+	if cfg.JobWorkers <= 0 {
+		return fmt.Errorf("Invalid job_workers: %d", cfg.JobWorkers)
+	}
+
+	if len(cfg.Admins) > 0 && len(cfg.UserFile) == 0 && len(cfg.ProxyAuthHeader) == 0 {
+		return fmt.Errorf("admins requires authentication. Set users or proxy_auth_header, or use admin_token")
+	}
+
+	if len(cfg.Uploaders) > 0 && len(cfg.UserFile) == 0 && len(cfg.ProxyAuthHeader) == 0 {
+		return fmt.Errorf("uploaders requires authentication. Set users or proxy_auth_header")
+	}
+
+	if cfg.WatchInterval < 0 {
+		return fmt.Errorf("Invalid watch_interval: %s", cfg.WatchInterval)
+	}
+
+	return nil
+}
+
+// Addr returns the address to listen on
+func (cfg *ServerConfig) Addr() string {
+	return net.JoinHostPort(cfg.Bind, strconv.Itoa(cfg.Port))
+}
+
+// TLS returns true if the server should use https
+func (cfg *ServerConfig) TLS() bool {
+	return len(cfg.TLSCert) > 0 && len(cfg.TLSKey) > 0
+}
+
+// Auth returns the authentication options
+func (cfg *ServerConfig) Auth() *AuthOptions {
+	return &AuthOptions{
+		SessionSecret: cfg.SessionSecret,
+		UserFile:      cfg.UserFile,
+		ProxyHeader:   cfg.ProxyAuthHeader,
+	}
+}
@@ -0,0 +1,912 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ubccr/treat"
+)
+
+const (
+	EXPORT_CSV   = "csv"
+	EXPORT_TSV   = "tsv"
+	EXPORT_JSONL = "jsonl"
+
+	// Number of alignments sorted in memory before spilling to disk
+	EXPORT_CHUNK_SIZE = 100000
+)
+
+// Columns of the web interface export
+var exportDefaultColumns = []string{"id", "gene", "sample", "knock_down", "replicate", "tetracycline", "read_count", "norm_count", "pct_search", "pct_edit_stop", "edit_stop", "junc_end", "junc_len", "junc_seq"}
+
+// ExportOptions control the format of an alignment export
+type ExportOptions struct {
+	// Output format, one of csv, tsv or jsonl. Defaults to csv
+	Format string
+
+	// Columns to write. Defaults to exportDefaultColumns
+	Columns []string
+
+	// Compress the output with gzip
+	Gzip bool
+
+	// Omit the header row of csv and tsv output
+	NoHeader bool
+
+	// Sort alignments descending by read_count or norm_count. Empty writes
+	// alignments in database order.
+	Sort string
+
+	// Edit stop totals by gene, edit stop and sample used for pct_edit_stop.
+	// Computed from the database if nil.
+	EditStopTotals map[string]map[int]map[string]float64
+
+	// Number of alignments sorted in memory before spilling to disk
+	ChunkSize int
+
+	// Directory for sort spill files. Defaults to the system temp dir
+	TempDir string
+}
+
+// exportRow is a single alignment being exported
+type exportRow struct {
+	seq uint64
+	key *treat.AlignmentKey
+	aln *treat.Alignment
+}
+
+// altRegion prints alternative editing regions as A1, A2, .. in text output
+// and as numbers in json
+type altRegion uint8
+
+func (r altRegion) String() string {
+	if r == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("A%d", r)
+}
+
+type exportColumn struct {
+	// Requires the fragment of the alignment
+	fragment bool
+	value    func(x *exporter, row *exportRow, frag *treat.Fragment) interface{}
+}
+
+var exportColumns = map[string]*exportColumn{
+	"id": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.Id
+	}},
+	"gene": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.key.Gene
+	}},
+	"sample": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.key.Sample
+	}},
+	"knock_down": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.key.KnockDown
+	}},
+	"replicate": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.key.Replicate
+	}},
+	"tetracycline": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.key.Tetracycline
+	}},
+	"read_count": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.ReadCount
+	}},
+	"norm_count": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.Norm
+	}},
+	"norm": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.Norm
+	}},
+	"pct_search": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return pct(row.aln.Norm, x.totals[row.key.Sample])
+	}},
+	"pct_edit_stop": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return pct(row.aln.Norm, x.opts.EditStopTotals[row.key.Gene][row.aln.EditStop][row.key.Sample])
+	}},
+	"edit_stop": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.EditStop
+	}},
+	"junc_start": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.JuncStart
+	}},
+	"junc_end": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.JuncEnd
+	}},
+	"junc_len": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.JuncLen
+	}},
+	"junc_seq": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.JuncSeq
+	}},
+	"has_mutation": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.HasMutation
+	}},
+	"mismatches": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.Mismatches
+	}},
+	"indel": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return row.aln.Indel
+	}},
+	"alt_editing": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return altRegion(row.aln.AltEditing)
+	}},
+	"grna": {value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		tmpl, ok := x.templates[row.key.Gene]
+		if !ok {
+			return ""
+		}
+		return tmpl.GuideNames(row.aln.EditStop)
+	}},
+	"frame": {fragment: true, value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return x.translate(row, frag).Class
+	}},
+	"aa_diff": {fragment: true, value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return x.translate(row, frag).FirstDiff
+	}},
+	"protein": {fragment: true, value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return x.translate(row, frag).Protein
+	}},
+	"fragment_name": {fragment: true, value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return frag.Name
+	}},
+	"fragment_seq": {fragment: true, value: func(x *exporter, row *exportRow, frag *treat.Fragment) interface{} {
+		return frag.String()
+	}},
+}
+
+// ExportColumnNames returns the names of all columns available for export
+func ExportColumnNames() []string {
+	names := make([]string, 0, len(exportColumns))
+	for name := range exportColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseExportColumns splits a comma separated list of column names
+func ParseExportColumns(val string) []string {
+	cols := make([]string, 0)
+	for _, c := range strings.Split(val, ",") {
+		c = strings.TrimSpace(c)
+		if len(c) > 0 {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+func pct(val, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (val / total) * 100
+}
+
+// Validate checks the options and fills in defaults
+func (o *ExportOptions) Validate() error {
+	switch o.Format {
+	case "":
+		o.Format = EXPORT_CSV
+	case EXPORT_CSV, EXPORT_TSV, EXPORT_JSONL:
+	default:
+		return fmt.Errorf("Invalid export format: %s", o.Format)
+	}
+
+	if len(o.Columns) == 0 {
+		o.Columns = exportDefaultColumns
+	}
+	for _, c := range o.Columns {
+		if _, ok := exportColumns[c]; !ok {
+			return fmt.Errorf("Invalid export column: %s. Available columns: %s", c, strings.Join(ExportColumnNames(), ", "))
+		}
+	}
+
+	switch o.Sort {
+	case "", "read_count", "norm_count":
+	default:
+		return fmt.Errorf("Invalid export sort: %s", o.Sort)
+	}
+
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = EXPORT_CHUNK_SIZE
+	}
+
+	return nil
+}
+
+// ContentType returns the mime type of the export
+func (o *ExportOptions) ContentType() string {
+	if o.Gzip {
+		return "application/gzip"
+	}
+
+	switch o.Format {
+	case EXPORT_TSV:
+		return "text/tab-separated-values; charset=utf-8"
+	case EXPORT_JSONL:
+		return "application/x-ndjson"
+	}
+
+	return "text/csv; charset=utf-8"
+}
+
+// FileName returns the file name of the export with the given base name
+func (o *ExportOptions) FileName(base string) string {
+	name := base + "." + o.Format
+	if o.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// rowWriter writes exported rows in a specific format
+type rowWriter interface {
+	WriteHeader(cols []string) error
+	WriteRow(cols []string, vals []interface{}) error
+	Flush() error
+}
+
+type textRowWriter struct {
+	out *csv.Writer
+	rec []string
+}
+
+func (t *textRowWriter) WriteHeader(cols []string) error {
+	return t.out.Write(cols)
+}
+
+func (t *textRowWriter) WriteRow(cols []string, vals []interface{}) error {
+	if t.rec == nil {
+		t.rec = make([]string, len(vals))
+	}
+
+	for i, v := range vals {
+		switch val := v.(type) {
+		case nil:
+			t.rec[i] = ""
+		case string:
+			t.rec[i] = val
+		case float64:
+			t.rec[i] = fmt.Sprintf("%.4f", val)
+		case bool:
+			t.rec[i] = strconv.FormatBool(val)
+		default:
+			t.rec[i] = fmt.Sprint(val)
+		}
+	}
+
+	return t.out.Write(t.rec)
+}
+
+func (t *textRowWriter) Flush() error {
+	t.out.Flush()
+	return t.out.Error()
+}
+
+type jsonRowWriter struct {
+	out *bufio.Writer
+}
+
+func (j *jsonRowWriter) WriteHeader(cols []string) error {
+	return nil
+}
+
+// WriteRow writes the row as a json object keeping the column order
+func (j *jsonRowWriter) WriteRow(cols []string, vals []interface{}) error {
+	j.out.WriteByte('{')
+	for i, v := range vals {
+		if i > 0 {
+			j.out.WriteByte(',')
+		}
+		name, _ := json.Marshal(cols[i])
+		j.out.Write(name)
+		j.out.WriteByte(':')
+
+		if r, ok := v.(altRegion); ok {
+			v = uint8(r)
+		}
+		val, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		j.out.Write(val)
+	}
+	j.out.WriteByte('}')
+	_, err := j.out.WriteString("\n")
+	return err
+}
+
+func (j *jsonRowWriter) Flush() error {
+	return j.out.Flush()
+}
+
+type exporter struct {
+	storage *Storage
+	opts    *ExportOptions
+	cols    []*exportColumn
+	out     rowWriter
+	vals    []interface{}
+	totals  map[string]float64
+
+	// Gene templates for the grna column
+	templates map[string]*treat.Template
+
+	// Gene translators for the reading frame columns and the translation of
+	// the row being written
+	translators map[string]*treat.Translator
+	translation *treat.Translation
+}
+
+// Export writes all alignments matching fields to w without holding them in
+// memory. Sorted exports keep only the top offset+limit alignments when a
+// limit is set, otherwise alignments are sorted in chunks which are spilled
+// to disk and merged. Returns the number of alignments written.
+func Export(ctx context.Context, s *Storage, w io.Writer, fields *SearchFields, opts *ExportOptions) (int, error) {
+	x, err := newExporter(ctx, s, fields, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	closeOut := x.open(w)
+
+	if !opts.NoHeader {
+		if err := x.out.WriteHeader(opts.Columns); err != nil {
+			return 0, err
+		}
+	}
+
+	var count int
+	switch {
+	case len(opts.Sort) == 0:
+		count, err = x.writeUnsorted(ctx, fields)
+	case fields.Limit > 0:
+		count, err = x.writeTopK(ctx, fields)
+	default:
+		count, err = x.writeSorted(ctx, fields)
+	}
+
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+
+	return count, err
+}
+
+// newExporter validates opts and loads the totals, templates and translators
+// needed by the columns
+func newExporter(ctx context.Context, s *Storage, fields *SearchFields, opts *ExportOptions) (*exporter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	x := &exporter{
+		storage: s,
+		opts:    opts,
+		cols:    make([]*exportColumn, len(opts.Columns)),
+		vals:    make([]interface{}, len(opts.Columns)),
+	}
+
+	needTotals := false
+	for i, c := range opts.Columns {
+		x.cols[i] = exportColumns[c]
+		if c == "pct_search" {
+			needTotals = true
+		}
+		if c == "pct_edit_stop" && opts.EditStopTotals == nil {
+			needTotals = true
+		}
+		if c == "grna" && x.templates == nil {
+			tmap, err := s.TemplateMap()
+			if err != nil {
+				return nil, err
+			}
+			x.templates = tmap
+		}
+		if (c == "frame" || c == "aa_diff" || c == "protein") && x.translators == nil {
+			if err := x.loadTranslators(fields); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if needTotals {
+		if err := x.computeTotals(ctx, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return x, nil
+}
+
+// open sets the row writer for the output format writing to w. The returned
+// function flushes the rows and closes the gzip stream.
+func (x *exporter) open(w io.Writer) func() error {
+	var gz *gzip.Writer
+	if x.opts.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	if x.opts.Format == EXPORT_JSONL {
+		x.out = &jsonRowWriter{out: bufio.NewWriter(w)}
+	} else {
+		csvout := csv.NewWriter(w)
+		if x.opts.Format == EXPORT_TSV {
+			csvout.Comma = '\t'
+		}
+		x.out = &textRowWriter{out: csvout}
+	}
+
+	return func() error {
+		err := x.out.Flush()
+		if gz != nil {
+			if cerr := gz.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+}
+
+// computeTotals sums the normalized read counts by sample over the whole
+// search and, if not given, by gene, edit stop and sample
+func (x *exporter) computeTotals(ctx context.Context, fields *SearchFields) error {
+	x.totals = make(map[string]float64)
+
+	all := *fields
+	all.Limit = 0
+	all.Offset = 0
+	err := x.storage.SearchContext(ctx, &all, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		x.totals[key.Sample] += a.Norm
+	})
+	if err != nil || x.opts.EditStopTotals != nil {
+		return err
+	}
+
+	x.opts.EditStopTotals = make(map[string]map[int]map[string]float64)
+	genes := &SearchFields{Gene: fields.Gene, EditStop: -1, JuncEnd: -1, JuncLen: -1}
+	genes.unsetRanges()
+	return x.storage.SearchContext(ctx, genes, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		es, ok := x.opts.EditStopTotals[key.Gene]
+		if !ok {
+			es = make(map[int]map[string]float64)
+			x.opts.EditStopTotals[key.Gene] = es
+		}
+		if _, ok := es[a.EditStop]; !ok {
+			es[a.EditStop] = make(map[string]float64)
+		}
+		es[a.EditStop][key.Sample] += a.Norm
+	})
+}
+
+// loadTranslators builds the translators of the searched genes from the start
+// codon in fields, or the start codon of the gene template if not set
+func (x *exporter) loadTranslators(fields *SearchFields) error {
+	tmap, err := x.storage.TemplateMap()
+	if err != nil {
+		return err
+	}
+
+	x.translators = make(map[string]*treat.Translator)
+	for gene, tmpl := range tmap {
+		if len(fields.Gene) > 0 && fields.Gene != gene {
+			continue
+		}
+		t, err := treat.NewTranslator(tmpl, fields.StartCodon)
+		if err != nil {
+			return fmt.Errorf("Failed to translate gene %s: %s", gene, err)
+		}
+		x.translators[gene] = t
+	}
+
+	return nil
+}
+
+// translate returns the translation of the fragment of the row being written
+func (x *exporter) translate(row *exportRow, frag *treat.Fragment) *treat.Translation {
+	if x.translation == nil {
+		x.translation = x.translators[row.key.Gene].Translate(frag)
+	}
+	return x.translation
+}
+
+// write writes a single row
+func (x *exporter) write(row *exportRow) error {
+	if err := x.values(row); err != nil {
+		return err
+	}
+
+	return x.out.WriteRow(x.opts.Columns, x.vals)
+}
+
+// values sets the column values of row
+func (x *exporter) values(row *exportRow) error {
+	x.translation = nil
+	var frag *treat.Fragment
+	for i, c := range x.cols {
+		if c.fragment && frag == nil {
+			f, err := x.storage.GetFragment(row.key, row.aln.Id)
+			if err != nil {
+				return err
+			}
+			if f == nil {
+				return fmt.Errorf("Fragment not found: %s %d", row.key.Sample, row.aln.Id)
+			}
+			frag = f
+		}
+		x.vals[i] = c.value(x, row, frag)
+	}
+
+	return nil
+}
+
+// writeUnsorted writes rows in database order as they are read
+func (x *exporter) writeUnsorted(ctx context.Context, fields *SearchFields) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	count := 0
+	var writeErr error
+	err := x.storage.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if writeErr != nil {
+			return
+		}
+		writeErr = x.write(&exportRow{key: key, aln: a})
+		if writeErr != nil {
+			cancel()
+			return
+		}
+		count++
+	})
+	if writeErr != nil {
+		return count, writeErr
+	}
+
+	return count, err
+}
+
+// less orders rows descending by the sort column. Ties keep database order.
+func (x *exporter) less(a, b *exportRow) bool {
+	if x.opts.Sort == "norm_count" {
+		if a.aln.Norm != b.aln.Norm {
+			return a.aln.Norm > b.aln.Norm
+		}
+		return a.seq < b.seq
+	}
+
+	return lessReadCount(a, b)
+}
+
+// lessReadCount orders rows descending by read count. Ties keep database
+// order.
+func lessReadCount(a, b *exportRow) bool {
+	if a.aln.ReadCount != b.aln.ReadCount {
+		return a.aln.ReadCount > b.aln.ReadCount
+	}
+
+	return a.seq < b.seq
+}
+
+// rowHeap is a heap of rows. With min set the root is the row sorting last.
+type rowHeap struct {
+	less func(a, b *exportRow) bool
+	rows []*exportRow
+	min  bool
+	src  []int
+}
+
+func (h *rowHeap) Len() int { return len(h.rows) }
+func (h *rowHeap) Less(i, j int) bool {
+	if h.min {
+		return h.less(h.rows[j], h.rows[i])
+	}
+	return h.less(h.rows[i], h.rows[j])
+}
+func (h *rowHeap) Swap(i, j int) {
+	h.rows[i], h.rows[j] = h.rows[j], h.rows[i]
+	if h.src != nil {
+		h.src[i], h.src[j] = h.src[j], h.src[i]
+	}
+}
+func (h *rowHeap) Push(v interface{}) { h.rows = append(h.rows, v.(*exportRow)) }
+func (h *rowHeap) Pop() interface{} {
+	n := len(h.rows) - 1
+	row := h.rows[n]
+	h.rows = h.rows[:n]
+	if h.src != nil {
+		h.src = h.src[:n]
+	}
+	return row
+}
+
+// topRows returns the first k rows matching fields in the order of less and
+// the total number of matching rows. Only k rows are kept in memory.
+func topRows(ctx context.Context, s *Storage, fields *SearchFields, k int, less func(a, b *exportRow) bool) ([]*exportRow, int, error) {
+	h := &rowHeap{less: less, min: true, rows: make([]*exportRow, 0)}
+
+	all := *fields
+	all.Limit = 0
+	all.Offset = 0
+	seq := uint64(0)
+	err := s.SearchContext(ctx, &all, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		row := &exportRow{seq: seq, key: key, aln: a}
+		seq++
+		if h.Len() < k {
+			heap.Push(h, row)
+		} else if k > 0 && less(row, h.rows[0]) {
+			h.rows[0] = row
+			heap.Fix(h, 0)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows := h.rows
+	sort.Slice(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+
+	return rows, int(seq), nil
+}
+
+// writeTopK writes the rows between offset and offset+limit in sort order
+// keeping only offset+limit rows in memory
+func (x *exporter) writeTopK(ctx context.Context, fields *SearchFields) (int, error) {
+	rows, _, err := topRows(ctx, x.storage, fields, fields.Offset+fields.Limit, x.less)
+	if err != nil {
+		return 0, err
+	}
+
+	if fields.Offset >= len(rows) {
+		return 0, nil
+	}
+
+	count := 0
+	for _, row := range rows[fields.Offset:] {
+		if err := x.write(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// writeSorted sorts all matching rows in chunks of ChunkSize. Chunks are
+// spilled to temp files and merged if the rows don't fit in one chunk.
+func (x *exporter) writeSorted(ctx context.Context, fields *SearchFields) (int, error) {
+	chunk := make([]*exportRow, 0, x.opts.ChunkSize)
+	spills := make([]*os.File, 0)
+	defer func() {
+		for _, f := range spills {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	sortChunk := func() {
+		sort.Slice(chunk, func(i, j int) bool { return x.less(chunk[i], chunk[j]) })
+	}
+
+	scan, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	all := *fields
+	all.Offset = 0
+	var spillErr error
+	seq := uint64(0)
+	err := x.storage.SearchContext(scan, &all, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if spillErr != nil {
+			return
+		}
+
+		chunk = append(chunk, &exportRow{seq: seq, key: key, aln: a})
+		seq++
+		if len(chunk) < x.opts.ChunkSize {
+			return
+		}
+
+		sortChunk()
+		f, err := x.spill(chunk)
+		if err != nil {
+			spillErr = err
+			cancel()
+			return
+		}
+		spills = append(spills, f)
+		chunk = chunk[:0]
+	})
+	if spillErr != nil {
+		return 0, spillErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sortChunk()
+	skip := fields.Offset
+	count := 0
+
+	if len(spills) == 0 {
+		for _, row := range chunk {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if err := x.write(row); err != nil {
+				return count, err
+			}
+			count++
+		}
+		return count, nil
+	}
+
+	if len(chunk) > 0 {
+		f, err := x.spill(chunk)
+		if err != nil {
+			return 0, err
+		}
+		spills = append(spills, f)
+	}
+	chunk = nil
+
+	readers := make([]*bufio.Reader, len(spills))
+	h := &rowHeap{less: x.less, src: make([]int, 0, len(spills))}
+	for i, f := range spills {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		readers[i] = bufio.NewReader(f)
+		row, err := readExportRow(readers[i])
+		if err != nil {
+			return 0, err
+		}
+		h.rows = append(h.rows, row)
+		h.src = append(h.src, i)
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		row, src := h.rows[0], h.src[0]
+		if skip > 0 {
+			skip--
+		} else {
+			if err := x.write(row); err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		next, err := readExportRow(readers[src])
+		if err == io.EOF {
+			heap.Pop(h)
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		h.rows[0] = next
+		heap.Fix(h, 0)
+	}
+
+	return count, nil
+}
+
+// spill writes sorted rows to a temp file
+func (x *exporter) spill(rows []*exportRow) (*os.File, error) {
+	f, err := ioutil.TempFile(x.opts.TempDir, "treat-export-")
+	if err != nil {
+		return nil, err
+	}
+
+	out := bufio.NewWriter(f)
+	for _, row := range rows {
+		err = writeExportRow(out, row)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// writeExportRow encodes a row as seq, id, key and alignment. The key and
+// alignment are length prefixed.
+func writeExportRow(w *bufio.Writer, row *exportRow) error {
+	key, err := row.key.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	aln, err := row.aln.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint64(buf[0:8], row.seq)
+	binary.BigEndian.PutUint64(buf[8:16], row.aln.Id)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[20:24], uint32(len(aln)))
+	w.Write(buf)
+	w.Write(key)
+	_, err = w.Write(aln)
+	return err
+}
+
+// readExportRow decodes a row written by writeExportRow. Returns io.EOF at
+// the end of the file.
+func readExportRow(r *bufio.Reader) (*exportRow, error) {
+	buf := make([]byte, 24)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(buf[16:20])+binary.BigEndian.Uint32(buf[20:24]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	row := &exportRow{
+		seq: binary.BigEndian.Uint64(buf[0:8]),
+		key: new(treat.AlignmentKey),
+		aln: new(treat.Alignment),
+	}
+
+	n := binary.BigEndian.Uint32(buf[16:20])
+	if err := row.key.UnmarshalBinary(data[:n]); err != nil {
+		return nil, err
+	}
+	if err := row.aln.UnmarshalBinary(data[n:]); err != nil {
+		return nil, err
+	}
+	row.aln.Id = binary.BigEndian.Uint64(buf[8:16])
+
+	return row, nil
+}
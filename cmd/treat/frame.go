@@ -0,0 +1,92 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ubccr/treat"
+)
+
+// frameClassifier translates the fragments of alignments and classifies
+// their reading frame. Translators are built once per gene from the current
+// template.
+type frameClassifier struct {
+	start       int
+	translators map[string]*treat.Translator
+}
+
+// newFrameClassifier returns a classifier using the 1-based start codon
+// position in the fully edited template. If start is 0 the start codon of
+// each gene template is used.
+func newFrameClassifier(start int) *frameClassifier {
+	return &frameClassifier{
+		start:       start,
+		translators: make(map[string]*treat.Translator),
+	}
+}
+
+// translator returns the translator for gene
+func (fc *frameClassifier) translator(tx *bolt.Tx, gene string) (*treat.Translator, error) {
+	if t, ok := fc.translators[gene]; ok {
+		return t, nil
+	}
+
+	v := tx.Bucket([]byte(BUCKET_TEMPLATES)).Get([]byte(gene))
+	if v == nil {
+		return nil, fmt.Errorf("database error. template not found for gene: %s", gene)
+	}
+
+	tmpl := new(treat.Template)
+	if err := tmpl.UnmarshalBytes(v); err != nil {
+		return nil, err
+	}
+
+	t, err := treat.NewTranslator(tmpl, fc.start)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to translate gene %s: %s", gene, err)
+	}
+
+	fc.translators[gene] = t
+	return t, nil
+}
+
+// translate returns the translation of the fragment with id in the sample
+// with key. Alignments without a stored fragment are untranslated.
+func (fc *frameClassifier) translate(tx *bolt.Tx, key []byte, gene string, id []byte) (*treat.Translation, error) {
+	t, err := fc.translator(tx, gene)
+	if err != nil {
+		return nil, err
+	}
+
+	var v []byte
+	if b := tx.Bucket([]byte(BUCKET_FRAGMENTS)).Bucket(key); b != nil {
+		v = b.Get(id)
+	}
+	if v == nil {
+		return &treat.Translation{Class: treat.FRAME_UNTRANSLATED}, nil
+	}
+
+	frag := new(treat.Fragment)
+	if err := frag.UnmarshalBytes(v); err != nil {
+		return nil, err
+	}
+
+	return t.Translate(frag), nil
+}
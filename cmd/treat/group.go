@@ -0,0 +1,407 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ubccr/treat"
+)
+
+const (
+	GROUP_COUNT = "count"
+	GROUP_SUM   = "sum"
+	GROUP_MEAN  = "mean"
+	GROUP_MIN   = "min"
+	GROUP_MAX   = "max"
+
+	// Column pivoted into columns of wide output
+	GROUP_PIVOT = "sample"
+)
+
+// Columns which can be aggregated. Only norm is not an integer.
+var groupNumericColumns = map[string]bool{
+	"norm":       false,
+	"norm_count": false,
+	"read_count": true,
+	"edit_stop":  true,
+	"junc_start": true,
+	"junc_end":   true,
+	"junc_len":   true,
+	"mismatches": true,
+	"replicate":  true,
+	"aa_diff":    true,
+}
+
+var groupAggregateRegexp = regexp.MustCompile(`^(\w+)\((\w+)\)$`)
+
+// GroupOptions control the aggregation of search results
+type GroupOptions struct {
+	// Columns to group alignments by
+	GroupBy []string
+
+	// Aggregates of each group. Either count or the sum, mean, min or max of
+	// a numeric column, e.g. sum(norm). Defaults to count
+	Aggregates []string
+
+	// Pivot samples into columns with one row per group of the other columns
+	Wide bool
+}
+
+type groupAggregate struct {
+	// Output column name, e.g. sum_norm
+	name string
+	fn   string
+	// Column aggregated, empty for count
+	col      string
+	integral bool
+}
+
+func parseGroupAggregate(val string) (*groupAggregate, error) {
+	if val == GROUP_COUNT {
+		return &groupAggregate{name: GROUP_COUNT, fn: GROUP_COUNT, integral: true}, nil
+	}
+
+	m := groupAggregateRegexp.FindStringSubmatch(val)
+	if m == nil {
+		return nil, fmt.Errorf("Invalid aggregate: %s. Must be count or sum, mean, min or max of a column, e.g. sum(norm)", val)
+	}
+
+	switch m[1] {
+	case GROUP_SUM, GROUP_MEAN, GROUP_MIN, GROUP_MAX:
+	default:
+		return nil, fmt.Errorf("Invalid aggregate function: %s. Must be sum, mean, min or max", m[1])
+	}
+
+	integral, ok := groupNumericColumns[m[2]]
+	if !ok {
+		names := make([]string, 0, len(groupNumericColumns))
+		for name := range groupNumericColumns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Invalid aggregate column: %s. Available columns: %s", m[2], strings.Join(names, ", "))
+	}
+
+	return &groupAggregate{
+		name:     m[1] + "_" + m[2],
+		fn:       m[1],
+		col:      m[2],
+		integral: integral && m[1] != GROUP_MEAN,
+	}, nil
+}
+
+// groupAccumulator aggregates the values of one column of a group
+type groupAccumulator struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (acc *groupAccumulator) add(v float64) {
+	if acc.count == 0 || v < acc.min {
+		acc.min = v
+	}
+	if acc.count == 0 || v > acc.max {
+		acc.max = v
+	}
+	acc.count++
+	acc.sum += v
+}
+
+// value returns the aggregate of the group. Empty groups of wide output have
+// a count and sum of 0, other aggregates are missing.
+func (acc *groupAccumulator) value(agg *groupAggregate) interface{} {
+	var v float64
+	switch agg.fn {
+	case GROUP_COUNT:
+		return acc.count
+	case GROUP_SUM:
+		v = acc.sum
+	case GROUP_MEAN:
+		if acc.count == 0 {
+			return nil
+		}
+		v = acc.sum / float64(acc.count)
+	case GROUP_MIN:
+		if acc.count == 0 {
+			return nil
+		}
+		v = acc.min
+	case GROUP_MAX:
+		if acc.count == 0 {
+			return nil
+		}
+		v = acc.max
+	}
+
+	if agg.integral {
+		return int64(math.Round(v))
+	}
+	return v
+}
+
+type groupRow struct {
+	keys []interface{}
+	// Accumulators of each aggregate by sample for wide output, or by "" for
+	// long output
+	accs map[string][]*groupAccumulator
+}
+
+// groupNumber converts a column value to a number
+func groupNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case altRegion:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// compareGroupValues orders numbers numerically and everything else as text
+func compareGroupValues(a, b interface{}) int {
+	x, xok := groupNumber(a)
+	y, yok := groupNumber(b)
+	if xok && yok {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// Group aggregates the alignments matching fields by the group columns and
+// writes one row per group sorted by the group columns. Rows of wide output
+// have the aggregates of each sample in columns named by the sample, or
+// sample_aggregate if there is more than one aggregate. Returns the number of
+// rows written.
+func Group(ctx context.Context, s *Storage, w io.Writer, fields *SearchFields, opts *ExportOptions, group *GroupOptions) (int, error) {
+	if len(opts.Sort) > 0 {
+		return 0, fmt.Errorf("Sorting is not supported with grouping. Rows are sorted by the group columns")
+	}
+	if fields.Limit > 0 || fields.Offset > 0 {
+		return 0, fmt.Errorf("Limit and offset are not supported with grouping. Groups aggregate all matching alignments")
+	}
+
+	aggs := make([]*groupAggregate, 0, len(group.Aggregates))
+	for _, val := range group.Aggregates {
+		agg, err := parseGroupAggregate(val)
+		if err != nil {
+			return 0, err
+		}
+		aggs = append(aggs, agg)
+	}
+	if len(aggs) == 0 {
+		agg, _ := parseGroupAggregate(GROUP_COUNT)
+		aggs = append(aggs, agg)
+	}
+
+	keyCols := make([]string, 0, len(group.GroupBy))
+	for _, c := range group.GroupBy {
+		if group.Wide && c == GROUP_PIVOT {
+			continue
+		}
+		keyCols = append(keyCols, c)
+	}
+
+	// Columns read from each alignment
+	index := make(map[string]int)
+	columns := make([]string, 0)
+	addColumn := func(c string) {
+		if _, ok := index[c]; !ok {
+			index[c] = len(columns)
+			columns = append(columns, c)
+		}
+	}
+	for _, c := range keyCols {
+		addColumn(c)
+	}
+	if group.Wide {
+		addColumn(GROUP_PIVOT)
+	}
+	for _, agg := range aggs {
+		if len(agg.col) > 0 {
+			addColumn(agg.col)
+		}
+	}
+
+	xopts := *opts
+	xopts.Columns = columns
+	x, err := newExporter(ctx, s, fields, &xopts)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := make(map[string]*groupRow)
+	samples := make(map[string]bool)
+	var rowErr error
+	scan, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	err = s.SearchContext(scan, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if rowErr != nil {
+			return
+		}
+		if rowErr = x.values(&exportRow{key: key, aln: a}); rowErr != nil {
+			cancel()
+			return
+		}
+
+		keys := make([]interface{}, len(keyCols))
+		ids := make([]string, len(keyCols))
+		for i, c := range keyCols {
+			keys[i] = x.vals[index[c]]
+			ids[i] = fmt.Sprint(keys[i])
+		}
+		id := strings.Join(ids, "\x00")
+
+		row, ok := rows[id]
+		if !ok {
+			row = &groupRow{keys: keys, accs: make(map[string][]*groupAccumulator)}
+			rows[id] = row
+		}
+
+		pivot := ""
+		if group.Wide {
+			pivot = fmt.Sprint(x.vals[index[GROUP_PIVOT]])
+			samples[pivot] = true
+		}
+
+		accs, ok := row.accs[pivot]
+		if !ok {
+			accs = make([]*groupAccumulator, len(aggs))
+			for i := range accs {
+				accs[i] = new(groupAccumulator)
+			}
+			row.accs[pivot] = accs
+		}
+
+		for i, agg := range aggs {
+			v := float64(1)
+			if len(agg.col) > 0 {
+				v, _ = groupNumber(x.vals[index[agg.col]])
+			}
+			accs[i].add(v)
+		}
+	})
+	if rowErr != nil {
+		return 0, rowErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sorted := make([]*groupRow, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		for k := range keyCols {
+			if c := compareGroupValues(sorted[i].keys[k], sorted[j].keys[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	pivots := []string{""}
+	header := append([]string(nil), keyCols...)
+	if group.Wide {
+		pivots = make([]string, 0, len(samples))
+		for sample := range samples {
+			pivots = append(pivots, sample)
+		}
+		sort.Strings(pivots)
+		for _, sample := range pivots {
+			for _, agg := range aggs {
+				if len(aggs) == 1 {
+					header = append(header, sample)
+				} else {
+					header = append(header, sample+"_"+agg.name)
+				}
+			}
+		}
+	} else {
+		for _, agg := range aggs {
+			header = append(header, agg.name)
+		}
+	}
+
+	closeOut := x.open(w)
+	if !opts.NoHeader {
+		if err := x.out.WriteHeader(header); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	vals := make([]interface{}, len(header))
+	empty := new(groupAccumulator)
+	for _, row := range sorted {
+		copy(vals, row.keys)
+		i := len(row.keys)
+		for _, pivot := range pivots {
+			for a, agg := range aggs {
+				acc := empty
+				if accs, ok := row.accs[pivot]; ok {
+					acc = accs[a]
+				}
+				vals[i] = acc.value(agg)
+				i++
+			}
+		}
+		if err = x.out.WriteRow(header, vals); err != nil {
+			break
+		}
+		count++
+	}
+
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+
+	return count, err
+}
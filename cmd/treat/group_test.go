@@ -0,0 +1,282 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// groupTestDB adds the sample "subset" with the first 3 clones to the test
+// database so some groups have alignments of only one sample
+func groupTestDB(t *testing.T) (*Storage, func()) {
+	dbpath, cleanup := testDB(t)
+
+	data, err := ioutil.ReadFile(filepath.Join("..", "..", "examples", "clones.fa"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	recs := strings.Split(string(data), "\n>")
+	fasta := filepath.Join(filepath.Dir(dbpath), "subset.fa")
+	err = ioutil.WriteFile(fasta, []byte(strings.Join(recs[:3], "\n>")+"\n"), 0644)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	err = loadSample(s, &LoadOptions{
+		Gene:         "RPS12",
+		Sample:       "subset",
+		EditBase:     "T",
+		TemplatePath: filepath.Join("..", "..", "examples", "templates.fa"),
+		FastaPath:    fasta,
+		Log:          log,
+		Progress:     func(count int) {},
+	})
+	if err != nil {
+		s.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.Close()
+		cleanup()
+	}
+}
+
+func groupTestFields() *SearchFields {
+	fields := &SearchFields{Gene: "RPS12", EditStop: -1, JuncLen: -1, JuncEnd: -1}
+	fields.unsetRanges()
+	return fields
+}
+
+// groupRows runs Group and returns the rows decoded from json lines
+func groupRows(t *testing.T, s *Storage, fields *SearchFields, group *GroupOptions) []map[string]interface{} {
+	var buf bytes.Buffer
+	n, err := Group(context.Background(), s, &buf, fields, &ExportOptions{Format: EXPORT_JSONL}, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		row := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if n != len(rows) {
+		t.Errorf("Wrong number of rows returned: %d != %d", n, len(rows))
+	}
+
+	return rows
+}
+
+// groupExpected aggregates the alignments of each sample and edit stop
+type groupExpected struct {
+	count   int
+	norm    float64
+	juncLen float64
+	minRc   float64
+	maxRc   float64
+}
+
+func groupExpect(t *testing.T, s *Storage) map[string]map[float64]*groupExpected {
+	want := make(map[string]map[float64]*groupExpected)
+	err := s.Search(groupTestFields(), func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if _, ok := want[key.Sample]; !ok {
+			want[key.Sample] = make(map[float64]*groupExpected)
+		}
+		es := float64(a.EditStop)
+		e, ok := want[key.Sample][es]
+		if !ok {
+			e = &groupExpected{minRc: math.Inf(1), maxRc: math.Inf(-1)}
+			want[key.Sample][es] = e
+		}
+		rc := float64(a.ReadCount)
+		e.count++
+		e.norm += a.Norm
+		e.juncLen += float64(a.JuncLen)
+		e.minRc = math.Min(e.minRc, rc)
+		e.maxRc = math.Max(e.maxRc, rc)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want["clones"]) == 0 || len(want["subset"]) == 0 {
+		t.Fatalf("No alignments found for the test samples: %v", want)
+	}
+
+	return want
+}
+
+func groupFloat(t *testing.T, row map[string]interface{}, col string, want float64) {
+	v, ok := row[col].(float64)
+	if !ok {
+		t.Errorf("Missing %s in row %v", col, row)
+		return
+	}
+	if math.Abs(v-want) > 1e-9 {
+		t.Errorf("Wrong %s in row %v. %f != %f", col, row, v, want)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	s, cleanup := groupTestDB(t)
+	defer cleanup()
+
+	want := groupExpect(t, s)
+	rows := groupRows(t, s, groupTestFields(), &GroupOptions{
+		GroupBy:    []string{"sample", "edit_stop"},
+		Aggregates: []string{"count", "sum(norm)", "mean(junc_len)", "min(read_count)", "max(read_count)"},
+	})
+
+	n := 0
+	for _, groups := range want {
+		n += len(groups)
+	}
+	if len(rows) != n {
+		t.Fatalf("Wrong number of groups: %d != %d", len(rows), n)
+	}
+
+	for i, row := range rows {
+		sample, _ := row["sample"].(string)
+		es, _ := row["edit_stop"].(float64)
+		e, ok := want[sample][es]
+		if !ok {
+			t.Errorf("Unexpected group %v", row)
+			continue
+		}
+
+		groupFloat(t, row, "count", float64(e.count))
+		groupFloat(t, row, "sum_norm", e.norm)
+		groupFloat(t, row, "mean_junc_len", e.juncLen/float64(e.count))
+		groupFloat(t, row, "min_read_count", e.minRc)
+		groupFloat(t, row, "max_read_count", e.maxRc)
+
+		if i > 0 {
+			prev := rows[i-1]
+			if prev["sample"].(string) > sample || (prev["sample"] == sample && prev["edit_stop"].(float64) >= es) {
+				t.Errorf("Groups not sorted by sample and edit stop: %v before %v", prev, row)
+			}
+		}
+	}
+}
+
+func TestGroupWide(t *testing.T) {
+	s, cleanup := groupTestDB(t)
+	defer cleanup()
+
+	want := groupExpect(t, s)
+	rows := groupRows(t, s, groupTestFields(), &GroupOptions{
+		GroupBy:    []string{"edit_stop"},
+		Aggregates: []string{"count", "sum(norm)", "mean(junc_len)", "max(read_count)"},
+		Wide:       true,
+	})
+
+	if len(rows) != len(want["clones"]) {
+		t.Fatalf("Wrong number of groups: %d != %d", len(rows), len(want["clones"]))
+	}
+
+	empty := 0
+	for _, row := range rows {
+		es, _ := row["edit_stop"].(float64)
+		for _, sample := range []string{"clones", "subset"} {
+			e, ok := want[sample][es]
+			if !ok {
+				// Samples without alignments in the group
+				empty++
+				groupFloat(t, row, sample+"_count", 0)
+				groupFloat(t, row, sample+"_sum_norm", 0)
+				for _, col := range []string{"_mean_junc_len", "_max_read_count"} {
+					if v, ok := row[sample+col]; !ok || v != nil {
+						t.Errorf("Expected empty %s%s in row %v", sample, col, row)
+					}
+				}
+				continue
+			}
+
+			groupFloat(t, row, sample+"_count", float64(e.count))
+			groupFloat(t, row, sample+"_sum_norm", e.norm)
+			groupFloat(t, row, sample+"_mean_junc_len", e.juncLen/float64(e.count))
+			groupFloat(t, row, sample+"_max_read_count", e.maxRc)
+		}
+	}
+	if empty == 0 {
+		t.Errorf("No groups without alignments of a sample")
+	}
+
+	// Columns are named by the sample with a single aggregate
+	rows = groupRows(t, s, groupTestFields(), &GroupOptions{GroupBy: []string{"edit_stop"}, Wide: true})
+	for _, row := range rows {
+		es, _ := row["edit_stop"].(float64)
+		for _, sample := range []string{"clones", "subset"} {
+			count := 0
+			if e, ok := want[sample][es]; ok {
+				count = e.count
+			}
+			groupFloat(t, row, sample, float64(count))
+		}
+	}
+}
+
+func TestGroupLimit(t *testing.T) {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, set := range []func(f *SearchFields){
+		func(f *SearchFields) { f.Limit = 5 },
+		func(f *SearchFields) { f.Offset = 5 },
+	} {
+		fields := groupTestFields()
+		set(fields)
+		_, err := Group(context.Background(), s, ioutil.Discard, fields, &ExportOptions{Format: EXPORT_TSV}, &GroupOptions{GroupBy: []string{"edit_stop"}})
+		if err == nil {
+			t.Errorf("Expected error grouping with limit %d and offset %d", fields.Limit, fields.Offset)
+		}
+	}
+}
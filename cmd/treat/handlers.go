@@ -19,9 +19,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -34,11 +36,24 @@ import (
 
 func renderTemplate(app *Application, tmpl string, w http.ResponseWriter, data interface{}) {
 	if data == nil {
+		dbs := app.Dbs()
+		if app.authEnabled() {
+			dbs = nil
+		}
 		data = map[string]interface{}{
-			"dbs":   app.dbs,
+			"dbs":   dbs,
 			"curdb": ""}
 	}
 
+	if vars, ok := data.(map[string]interface{}); ok {
+		if app.loginEnabled() {
+			vars["auth"] = true
+		}
+		if app.enableUpload {
+			vars["upload"] = true
+		}
+	}
+
 	var buf bytes.Buffer
 	t := app.templates[tmpl]
 	err := t.ExecuteTemplate(&buf, "layout", data)
@@ -99,10 +114,11 @@ func IndexHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.AllowedDbs(r),
 			"curdb":      db.name,
 			"Template":   tmpl,
 			"Count":      count,
+			"CI":         r.URL.Query().Get("ci") == "1",
 			"Fields":     fields,
 			"Samples":    db.geneSamples[fields.Gene],
 			"KnockDowns": db.geneKnockDowns[fields.Gene],
@@ -167,13 +183,6 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		return
 	}
 
-	if app.enableCache {
-		if _, ok := db.cache[r.URL.String()]; ok {
-			w.Write(db.cache[r.URL.String()])
-			return
-		}
-	}
-
 	fields, err := app.NewSearchFields(w, r, db)
 	fields.Limit = 0
 	fields.Offset = 0
@@ -190,6 +199,12 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		return
 	}
 
+	export := r.URL.Query().Get("export") == "1"
+	cacheKey := chartCacheKey(r.URL.Path, fields, r, "ci", "boot", "alpha")
+	if !export && app.cachedChart(w, db, cacheKey) {
+		return
+	}
+
 	tmpl, ok := db.geneTemplates[fields.Gene]
 	if !ok {
 		logrus.Printf("Invalid gene: %s", fields.Gene)
@@ -198,6 +213,8 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 	}
 
 	samples := make(map[string]map[int]float64)
+	boot := newBootstrapFromRequest(r)
+	observations := make(map[string][]treat.Observation)
 
 	max := maxMap[fields.Gene]
 	err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
@@ -212,6 +229,10 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		val := f(a)
 
 		samples[key.Sample][val] += a.Norm
+
+		if boot != nil {
+			observations[key.Sample] = append(observations[key.Sample], treat.Observation{Value: val, ReadCount: a.ReadCount, Norm: a.Norm})
+		}
 	})
 
 	if err != nil {
@@ -230,6 +251,7 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 	if !junclen {
 		offset = int(tmpl.EditOffset)
 	}
+	intervals := make(map[string][]*treat.BinInterval)
 	for _, k := range skeys {
 		v := samples[k]
 		x := make([]float64, max+1-offset+1)
@@ -245,6 +267,33 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		m["name"] = k
 		m["type"] = "spline"
 		series = append(series, m)
+
+		if boot != nil {
+			// Error band drawn behind the sample series
+			intervals[k] = make([]*treat.BinInterval, len(x))
+			ranges := make([][]float64, len(x))
+			for i := range ranges {
+				ranges[i] = []float64{0, 0}
+			}
+			for _, bin := range boot.Histogram(observations[k]) {
+				i := max - bin.Value
+				if i < 0 || i >= len(x) {
+					continue
+				}
+				intervals[k][i] = bin
+				ranges[i] = []float64{bin.Norm.Lower, bin.Norm.Upper}
+			}
+
+			m = make(map[string]interface{})
+			m["data"] = ranges
+			m["name"] = k + " CI"
+			m["type"] = "arearange"
+			m["linkedTo"] = ":previous"
+			m["fillOpacity"] = 0.3
+			m["lineWidth"] = 0
+			m["zIndex"] = 0
+			series = append(series, m)
+		}
 	}
 
 	cats := make([]int, max+1-offset+1)
@@ -256,8 +305,13 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 	data := make(map[string]interface{})
 	data["cats"] = cats
 	data["series"] = series
+	if !junclen {
+		data["guides"] = guidePlotBands(tmpl, func(site int) float64 {
+			return float64(max - site)
+		})
+	}
 
-	if r.URL.Query().Get("export") == "1" {
+	if export {
 		csvout := csv.NewWriter(w)
 		defer csvout.Flush()
 		col := "edit_stop"
@@ -266,17 +320,37 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		} else if r.URL.Path == "/data/je-hist" {
 			col = "junc_end"
 		}
-		csvout.Write([]string{col, "name", "norm_count"})
+		header := []string{col, "name", "norm_count"}
+		if boot != nil {
+			header = append(header, "norm_lower", "norm_upper", "frac", "frac_lower", "frac_upper")
+		}
+		csvout.Write(header)
 
 		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
 		w.Header().Set("Content-Disposition", "attachment; filename="+col+".csv")
 
 		for _, rec := range series {
+			if rec["type"] == "arearange" {
+				continue
+			}
 			for i := len(cats) - 1; i >= 0; i-- {
 				es := cats[i]
 				norm := reflect.ValueOf(rec["data"])
-				name := reflect.ValueOf(rec["name"])
-				csvout.Write([]string{strconv.Itoa(es), fmt.Sprintf("%s", name), fmt.Sprintf("%.4f", norm.Index(i).Float())})
+				name := fmt.Sprintf("%s", reflect.ValueOf(rec["name"]))
+				row := []string{strconv.Itoa(es), name, fmt.Sprintf("%.4f", norm.Index(i).Float())}
+				if boot != nil {
+					bin := intervals[name][i]
+					if bin == nil {
+						bin = &treat.BinInterval{}
+					}
+					row = append(row,
+						fmt.Sprintf("%.4f", bin.Norm.Lower),
+						fmt.Sprintf("%.4f", bin.Norm.Upper),
+						fmt.Sprintf("%.6f", bin.Frac.Estimate),
+						fmt.Sprintf("%.6f", bin.Frac.Lower),
+						fmt.Sprintf("%.6f", bin.Frac.Upper))
+				}
+				csvout.Write(row)
 			}
 		}
 
@@ -290,14 +364,33 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		return
 	}
 
-	if app.enableCache {
-		db.cache[r.URL.String()] = out
-	}
+	app.cacheChart(db, cacheKey, out)
 
 	w.Write(out)
 	//json.NewEncoder(w).Encode(data)
 }
 
+// newBootstrapFromRequest returns a bootstrap if confidence intervals were
+// requested with ci=1. The number of replicates and alpha can be set with
+// boot and alpha.
+func newBootstrapFromRequest(r *http.Request) *treat.Bootstrap {
+	if r.URL.Query().Get("ci") != "1" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(r.URL.Query().Get("boot"))
+	if err != nil || n > 10000 {
+		n = 0
+	}
+
+	alpha, err := strconv.ParseFloat(r.URL.Query().Get("alpha"), 64)
+	if err != nil {
+		alpha = 0
+	}
+
+	return treat.NewBootstrap(n, alpha, 1)
+}
+
 func ShowHandler(app *Application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		db, err := app.GetDbFromContext(r)
@@ -361,7 +454,7 @@ func ShowHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":       app.dbs,
+			"dbs":       app.AllowedDbs(r),
 			"curdb":     db.name,
 			"Template":  tmpl,
 			"Fragment":  frag,
@@ -372,11 +465,43 @@ func ShowHandler(app *Application) http.Handler {
 	})
 }
 
-func SearchHandler(app *Application) http.Handler {
+const (
+	// Number of samples shown on each page of the pileup
+	PILEUP_SAMPLES = 4
+
+	// Default and max number of alignments per sample in the pileup
+	PILEUP_TOP     = 20
+	PILEUP_MAX_TOP = 200
+)
+
+// topAlignments returns the n alignments with the highest read count for
+// each sample matching fields
+func topAlignments(ctx context.Context, s *Storage, fields *SearchFields, n int) (map[string][]*treat.Alignment, error) {
+	top := make(map[string][]*treat.Alignment)
+	err := s.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		rows := top[key.Sample]
+		if len(rows) == n && rows[n-1].ReadCount >= a.ReadCount {
+			return
+		}
+
+		a.Key = key
+		i := sort.Search(len(rows), func(i int) bool { return rows[i].ReadCount < a.ReadCount })
+		if len(rows) < n {
+			rows = append(rows, nil)
+		}
+		copy(rows[i+1:], rows[i:])
+		rows[i] = a
+		top[key.Sample] = rows
+	})
+
+	return top, err
+}
+
+func PileupHandler(app *Application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		db, err := app.GetDbFromContext(r)
 		if err != nil {
-			logrus.Error("search handler: database not found in request context")
+			logrus.Error("pileup handler: database not found in request context")
 			errorHandler(app, w, http.StatusInternalServerError)
 			return
 		}
@@ -397,53 +522,242 @@ func SearchHandler(app *Application) http.Handler {
 			return
 		}
 
-		totalMap := make(map[string]float64)
+		// Limit is the number of alignments shown for each sample
+		if fields.Limit <= 0 {
+			fields.Limit = PILEUP_TOP
+		}
+		if fields.Limit > PILEUP_MAX_TOP {
+			fields.Limit = PILEUP_MAX_TOP
+		}
 
-		limit := fields.Limit
+		samples := fields.Sample
+		if len(samples) == 0 {
+			samples = db.geneSamples[fields.Gene]
+		}
+
+		pages := (len(samples) + PILEUP_SAMPLES - 1) / PILEUP_SAMPLES
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+		if page > pages {
+			page = pages
+		}
+
+		pageSamples := []string{}
+		if pages > 0 {
+			end := page * PILEUP_SAMPLES
+			if end > len(samples) {
+				end = len(samples)
+			}
+			pageSamples = samples[(page-1)*PILEUP_SAMPLES : end]
+		}
+
+		pfields := *fields
+		pfields.Sample = pageSamples
+		pfields.Limit = 0
+		pfields.Offset = 0
+
+		pileup := treat.NewPileup(tmpl)
+		if len(pageSamples) > 0 {
+			top, err := topAlignments(r.Context(), db.storage, &pfields, fields.Limit)
+			if err != nil {
+				logrus.Printf("Error fetching alignments for gene: %s", fields.Gene)
+				errorHandler(app, w, http.StatusInternalServerError)
+				return
+			}
+
+			for _, sample := range pageSamples {
+				for _, a := range top[sample] {
+					frag, err := db.storage.GetFragment(a.Key, a.Id)
+					if err != nil || frag == nil {
+						logrus.Printf("fragment not found for alignment %s %d: %s", sample, a.Id, err)
+						continue
+					}
+
+					pileup.Add(fmt.Sprintf("%d", a.Id), frag, a)
+				}
+			}
+		}
+
+		vars := map[string]interface{}{
+			"dbs":         app.AllowedDbs(r),
+			"curdb":       db.name,
+			"Template":    tmpl,
+			"Pileup":      pileup,
+			"Page":        page,
+			"PageCount":   pages,
+			"PageSamples": pageSamples,
+			"Fields":      fields,
+			"Samples":     db.geneSamples[fields.Gene],
+			"KnockDowns":  db.geneKnockDowns[fields.Gene],
+			"Replicates":  db.geneReplicates[fields.Gene],
+			"Pages":       []int{10, 20, 50, 100, 200},
+			"Genes":       db.genes}
+
+		renderTemplate(app, "pileup.html", w, vars)
+	})
+}
+
+// RenderHandler renders an alignment or chart as SVG or PDF for download
+func RenderHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("render handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		fields, err := app.NewSearchFields(w, r, db)
+		if err != nil {
+			logrus.Printf("Error parsing get request: %s", err)
+			http.Error(w, "Invalid get parameter in request", http.StatusBadRequest)
+			return
+		}
 		fields.Limit = 0
 		fields.Offset = 0
-		alignments := make([]*treat.Alignment, 0)
-		err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
-			a.Key = key
-			alignments = append(alignments, a)
 
-			totalMap[a.Key.Sample] += a.Norm
-		})
+		if _, ok := db.geneTemplates[fields.Gene]; !ok {
+			http.Error(w, "Invalid gene", http.StatusBadRequest)
+			return
+		}
+
+		vals := r.URL.Query()
+		opts := &RenderOptions{
+			Chart:  vals.Get("chart"),
+			Format: vals.Get("format"),
+			Title:  vals.Get("title"),
+		}
+		// Alignments always render synchronously so cap them as in the pileup
+		opts.Top, _ = strconv.Atoi(vals.Get("top"))
+		if opts.Top > PILEUP_MAX_TOP {
+			opts.Top = PILEUP_MAX_TOP
+		}
+		opts.Columns, _ = strconv.Atoi(vals.Get("width"))
+		for _, v := range vals["id"] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid alignment id", http.StatusBadRequest)
+				return
+			}
+			opts.Ids = append(opts.Ids, id)
+		}
+		if len(opts.Ids) > PILEUP_MAX_TOP {
+			http.Error(w, fmt.Sprintf("Too many alignment ids. Max is %d", PILEUP_MAX_TOP), http.StatusBadRequest)
+			return
+		}
 
+		if len(opts.Chart) == 0 {
+			opts.Chart = RENDER_ALIGNMENT
+		}
+		if len(opts.Format) == 0 {
+			opts.Format = RENDER_SVG
+		}
+
+		switch opts.Chart {
+		case RENDER_ALIGNMENT, RENDER_EDIT_STOP, RENDER_JUNC_LEN, RENDER_JUNC_END, RENDER_HEAT:
+		default:
+			http.Error(w, "Invalid chart: "+opts.Chart, http.StatusBadRequest)
+			return
+		}
+		if opts.Format != RENDER_SVG && opts.Format != RENDER_PDF {
+			http.Error(w, "Invalid format: "+opts.Format, http.StatusBadRequest)
+			return
+		}
+
+		gene := fields.Gene
+		name := renderFileName(opts.Chart, opts.Format)
+		render := func(ctx context.Context, db *Database, out io.Writer) error {
+			tmpl, ok := db.geneTemplates[gene]
+			if !ok {
+				return fmt.Errorf("Gene not found: %s", gene)
+			}
+			return renderChart(ctx, db.storage, tmpl, fields, opts, out)
+		}
+
+		if wantsAsync(r) && opts.Chart != RENDER_ALIGNMENT {
+			app.submitAnalysis(w, r, db, fmt.Sprintf("Render %s for gene %s", opts.Chart, gene), name, renderContentType(opts.Format), "", render)
+			return
+		}
+
+		var buf bytes.Buffer
+		err = render(r.Context(), db, &buf)
 		if err != nil {
-			logrus.Printf("Error fetching alignments for gene: %s", fields.Gene)
+			logrus.Printf("Error rendering %s for gene %s: %s", opts.Chart, gene, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", renderContentType(opts.Format))
+		w.Header().Set("Content-Disposition", "attachment; filename="+name)
+		w.Write(buf.Bytes())
+	})
+}
+
+func SearchHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("search handler: database not found in request context")
 			errorHandler(app, w, http.StatusInternalServerError)
 			return
 		}
 
-		sort.Sort(ByReadCount{alignments})
+		fields, err := app.NewSearchFields(w, r, db)
+
+		if err != nil {
+			logrus.Printf("Error parsing get request: %s", err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		tmpl, ok := db.geneTemplates[fields.Gene]
+
+		if !ok {
+			logrus.Warnf("Error fetching template for gene: %s", fields.Gene)
+			http.Redirect(w, r, fmt.Sprintf("/?gene=%s", url.QueryEscape(db.defaultGene)), 302)
+			return
+		}
+
+		limit := fields.Limit
+		fields.Limit = 0
+		fields.Offset = 0
 
 		if r.URL.Query().Get("export") == "1" {
-			csvout := csv.NewWriter(w)
-			defer csvout.Flush()
-			csvout.Write([]string{"id", "gene", "sample", "knock_down", "replicate", "tetracycline", "read_count", "norm_count", "pct_search", "pct_edit_stop", "edit_stop", "junc_end", "junc_len", "junc_seq"})
+			opts, err := exportOptionsFromRequest(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-			w.Header().Set("Content-Disposition", "attachment; filename=treat-export.csv")
-
-			for _, a := range alignments {
-				csvout.Write([]string{
-					strconv.Itoa(int(a.Id)),
-					a.Key.Gene,
-					a.Key.Sample,
-					a.Key.KnockDown,
-					strconv.Itoa(a.Key.Replicate),
-					strconv.FormatBool(a.Key.Tetracycline),
-					strconv.Itoa(int(a.ReadCount)),
-					fmt.Sprintf("%.4f", a.Norm),
-					pctSearchFunc(a, totalMap),
-					pctEditStopFunc(a, db.cacheEditStopTotals[fields.Gene]),
-					strconv.Itoa(int(a.EditStop)),
-					strconv.Itoa(int(a.JuncEnd)),
-					strconv.Itoa(int(a.JuncLen)),
-					a.JuncSeq})
+			fields.Limit, _ = strconv.Atoi(r.URL.Query().Get("top"))
+			if fields.Limit < 0 {
+				fields.Limit = 0
+			}
+
+			if wantsAsync(r) {
+				app.submitAnalysis(w, r, db, fmt.Sprintf("Export alignments for gene %s", fields.Gene), opts.FileName("treat-export"), opts.ContentType(), "", func(ctx context.Context, db *Database, out io.Writer) error {
+					_, err := Export(ctx, db.storage, out, fields, opts)
+					return err
+				})
+				return
+			}
+
+			w.Header().Set("Content-Type", opts.ContentType())
+			w.Header().Set("Content-Disposition", "attachment; filename="+opts.FileName("treat-export"))
+
+			_, err = Export(r.Context(), db.storage, w, fields, opts)
+			if err != nil {
+				logrus.Printf("Error exporting alignments for gene %s: %s", fields.Gene, err)
 			}
+			return
+		}
 
+		alignments, totalMap, err := searchAlignments(r.Context(), db, fields)
+		if err != nil {
+			logrus.Printf("Error fetching alignments for gene: %s", fields.Gene)
+			errorHandler(app, w, http.StatusInternalServerError)
 			return
 		}
 
@@ -480,13 +794,26 @@ func SearchHandler(app *Application) http.Handler {
 			showing = count
 		}
 
+		var searchCI, editStopCI []*treat.Interval
+		if boot := newBootstrapFromRequest(r); boot != nil {
+			searchCI, editStopCI, err = pctIntervals(r.Context(), db, boot, fields.Gene, alignments, alignments[fields.Offset:end])
+			if err != nil {
+				logrus.Printf("Error computing confidence intervals for gene: %s", fields.Gene)
+				errorHandler(app, w, http.StatusInternalServerError)
+				return
+			}
+		}
+
 		vars := map[string]interface{}{
-			"dbs":            app.dbs,
+			"dbs":            app.AllowedDbs(r),
 			"curdb":          db.name,
 			"Template":       tmpl,
 			"Count":          count,
 			"SearchTotals":   totalMap,
 			"EditStopTotals": db.cacheEditStopTotals[fields.Gene],
+			"CI":             r.URL.Query().Get("ci") == "1",
+			"SearchCI":       searchCI,
+			"EditStopCI":     editStopCI,
 			"Showing":        showing,
 			"Page":           page,
 			"Query":          r.URL.RawQuery,
@@ -528,9 +855,10 @@ func HeatHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.AllowedDbs(r),
 			"curdb":      db.name,
 			"Template":   tmpl,
+			"CI":         r.URL.Query().Get("ci") == "1",
 			"Fields":     fields,
 			"Samples":    db.geneSamples[fields.Gene],
 			"KnockDowns": db.geneKnockDowns[fields.Gene],
@@ -575,49 +903,26 @@ func HeatMapJson(app *Application) http.Handler {
 			return
 		}
 
-		n := tmpl.Len()
-
-		heat := make([][]float64, n)
-		for i := 0; i < n; i++ {
-			heat[i] = make([]float64, n)
+		cacheKey := chartCacheKey(r.URL.Path, fields, r, "ci", "boot", "alpha")
+		if app.cachedChart(w, db, cacheKey) {
+			return
 		}
 
-		err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
-			if a.EditStop >= int(tmpl.EditOffset) {
-				heat[a.EditStop-int(tmpl.EditOffset)][a.JuncLen] += a.Norm
-			}
-		})
+		boot := newBootstrapFromRequest(r)
+		if wantsAsync(r) {
+			app.submitAnalysis(w, r, db, fmt.Sprintf("Heat map for gene %s", fields.Gene), "heat.json", "application/json", cacheKey, jsonAnalysis(fields.Gene, func(ctx context.Context, db *Database, tmpl *treat.Template) (interface{}, error) {
+				return heatMapData(ctx, db, tmpl, fields, boot)
+			}))
+			return
+		}
 
+		data, err := heatMapData(r.Context(), db, tmpl, fields, boot)
 		if err != nil {
 			logrus.Printf("Fatal error: %s", err)
 			http.Error(w, "Fatal database error.", http.StatusInternalServerError)
 			return
 		}
 
-		series := make([][]interface{}, n*n)
-		max := float64(0.0)
-		k := 0
-		for i := 0; i < n; i++ {
-			for j := 0; j < n; j++ {
-				series[k] = make([]interface{}, 3)
-				series[k][0] = i + int(tmpl.EditOffset)
-				series[k][1] = j
-				if i+int(tmpl.EditOffset) == int(tmpl.EditStop) && j == 0 {
-					series[k][2] = 0.0
-				} else {
-					series[k][2] = heat[i][j]
-					if heat[i][j] > max {
-						max = heat[i][j]
-					}
-				}
-				k++
-			}
-		}
-
-		data := make(map[string]interface{})
-		data["series"] = series
-		data["max"] = max
-
 		out, err := json.Marshal(data)
 		if err != nil {
 			logrus.Printf("Error encoding data as json: %s", err)
@@ -625,6 +930,7 @@ func HeatMapJson(app *Application) http.Handler {
 			return
 		}
 
+		app.cacheChart(db, cacheKey, out)
 		w.Write(out)
 	})
 }
@@ -655,7 +961,7 @@ func BubbleHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.AllowedDbs(r),
 			"curdb":      db.name,
 			"Template":   tmpl,
 			"Fields":     fields,
@@ -702,59 +1008,25 @@ func BubbleJson(app *Application) http.Handler {
 			return
 		}
 
-		bubbleMap := make(map[int]map[uint32]float64)
-
-		err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
-			if a.EditStop >= tmpl.EditStop {
-				frag, err := db.storage.GetFragment(key, a.Id)
-				if err != nil || frag == nil {
-					logrus.Printf("fragment not found: %s", err)
-					return
-				}
+		cacheKey := chartCacheKey(r.URL.Path, fields, r)
+		if app.cachedChart(w, db, cacheKey) {
+			return
+		}
 
-				for i, t := range frag.EditSite {
-					eb, ok := bubbleMap[i]
-					if !ok {
-						eb = make(map[uint32]float64)
-					}
-					eb[t] += a.Norm
-					bubbleMap[i] = eb
-				}
-			}
-		})
+		if wantsAsync(r) {
+			app.submitAnalysis(w, r, db, fmt.Sprintf("Bubble chart for gene %s", fields.Gene), "bubble.json", "application/json", cacheKey, jsonAnalysis(fields.Gene, func(ctx context.Context, db *Database, tmpl *treat.Template) (interface{}, error) {
+				return bubbleData(ctx, db, tmpl, fields)
+			}))
+			return
+		}
 
+		bubbles, err := bubbleData(r.Context(), db, tmpl, fields)
 		if err != nil {
 			logrus.Printf("Fatal error: %s", err)
 			http.Error(w, "Fatal database error.", http.StatusInternalServerError)
 			return
 		}
 
-		type editSiteBubble struct {
-			Name  int             `json:"name"`
-			Total float64         `json:"total"`
-			T     [][]interface{} `json:"t"`
-			Pre   int             `json:"pre"`
-			Full  int             `json:"full"`
-		}
-
-		n := tmpl.Len()
-		bubbles := make([]*editSiteBubble, n)
-
-		for key, val := range bubbleMap {
-			b := &editSiteBubble{
-				Name: (n - 1) - int(key) + int(tmpl.EditOffset),
-				T:    make([][]interface{}, 0),
-				Full: int(tmpl.EditSite[0][key]),
-				Pre:  int(tmpl.EditSite[1][key]),
-			}
-
-			for t, cnt := range val {
-				b.T = append(b.T, []interface{}{int(t), cnt})
-				b.Total += cnt
-			}
-			bubbles[int(key)] = b
-		}
-
 		out, err := json.Marshal(bubbles)
 		if err != nil {
 			logrus.Printf("Error encoding bubble data as json: %s", err)
@@ -762,6 +1034,7 @@ func BubbleJson(app *Application) http.Handler {
 			return
 		}
 
+		app.cacheChart(db, cacheKey, out)
 		w.Write(out)
 	})
 }
@@ -792,7 +1065,7 @@ func TemplateSummaryHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.AllowedDbs(r),
 			"curdb":      db.name,
 			"Template":   tmpl,
 			"Fields":     fields,
@@ -838,6 +1111,11 @@ func TemplateSummaryHistogramHandler(app *Application) http.Handler {
 			return
 		}
 
+		cacheKey := chartCacheKey(r.URL.Path, fields, r)
+		if app.cachedChart(w, db, cacheKey) {
+			return
+		}
+
 		samples := make(map[string]map[int]float64)
 
 		err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
@@ -900,6 +1178,7 @@ func TemplateSummaryHistogramHandler(app *Application) http.Handler {
 			return
 		}
 
+		app.cacheChart(db, cacheKey, out)
 		w.Write(out)
 	})
 }
@@ -918,6 +1197,14 @@ func DbHandler(app *Application) http.Handler {
 			return
 		}
 
+		if !app.CanAccess(r, name) {
+			logrus.WithFields(logrus.Fields{
+				"dbname": name,
+			}).Warn("Access denied to database")
+			errorHandler(app, w, http.StatusForbidden)
+			return
+		}
+
 		session.Values[TREAT_COOKIE_DB] = name
 		session.Values[TREAT_COOKIE_SEARCH] = nil
 		err = session.Save(r, w)
@@ -964,15 +1251,25 @@ func StatsHandler(app *Application) http.Handler {
 			return
 		}
 
-		stats, err := geneStats(db.storage, fields.Gene, countBy)
+		stats, err := geneStats(db.storage, fields.Gene, countBy, fields.StartCodon)
 		if err != nil {
 			logrus.Printf("Failed to compute stats for gene %s: %s", fields.Gene, err)
 			errorHandler(app, w, http.StatusInternalServerError)
 			return
 		}
 
+		if export := r.URL.Query().Get("export"); export == "1" || export == "groups" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=treat-stats.csv")
+
+			csvout := csv.NewWriter(w)
+			defer csvout.Flush()
+			writeStats(csvout, stats, export == "groups", true)
+			return
+		}
+
 		vars := map[string]interface{}{
-			"dbs":      app.dbs,
+			"dbs":      app.AllowedDbs(r),
 			"curdb":    db.name,
 			"stats":    stats,
 			"Fields":   fields,
@@ -984,3 +1281,248 @@ func StatsHandler(app *Application) http.Handler {
 		renderTemplate(app, "stats.html", w, vars)
 	})
 }
+
+func JunctionsHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("junctions handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		fields, err := app.NewSearchFields(w, r, db)
+		if err != nil {
+			logrus.Printf("Error parsing get request: %s", err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		tmpl, ok := db.geneTemplates[fields.Gene]
+		if !ok {
+			logrus.Warnf("Error fetching template for gene: %s", fields.Gene)
+			http.Redirect(w, r, fmt.Sprintf("/?gene=%s", url.QueryEscape(db.defaultGene)), 302)
+			return
+		}
+
+		maxDist, err := strconv.Atoi(r.URL.Query().Get("dist"))
+		if err != nil || maxDist < 0 {
+			maxDist = 1
+		}
+
+		top, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || top <= 0 {
+			top = 5
+		}
+
+		limit := fields.Limit
+		fields.Limit = 0
+		fields.Offset = 0
+
+		if r.URL.Query().Get("export") == "1" {
+			if wantsAsync(r) {
+				app.submitAnalysis(w, r, db, fmt.Sprintf("Export junctions for gene %s", fields.Gene), "treat-junctions.csv", "text/csv; charset=utf-8", "", func(ctx context.Context, db *Database, out io.Writer) error {
+					return writeJunctionsExport(ctx, out, db, fields, maxDist)
+				})
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=treat-junctions.csv")
+
+			err = writeJunctionsExport(r.Context(), w, db, fields, maxDist)
+			if err != nil {
+				logrus.Printf("Error exporting junctions for gene %s: %s", fields.Gene, err)
+			}
+			return
+		}
+
+		summary := treat.NewJuncSummary(tmpl.EditBase, maxDist)
+		err = db.storage.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+			summary.Add(key.Sample, a)
+		})
+		if err != nil {
+			logrus.Printf("Error fetching junctions for gene: %s", fields.Gene)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		clusters := summary.Clusters()
+		samples := summary.Samples()
+
+		fields.Limit = limit
+		if fields.Limit == 0 {
+			fields.Limit = 10
+		}
+
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+
+		if page > (int(len(clusters)/fields.Limit) + 1) {
+			page = (int(len(clusters)/fields.Limit) + 1)
+		}
+
+		start := (page - 1) * fields.Limit
+		end := start + fields.Limit
+		if end > len(clusters) {
+			end = len(clusters)
+		}
+
+		vars := map[string]interface{}{
+			"dbs":         app.AllowedDbs(r),
+			"curdb":       db.name,
+			"Template":    tmpl,
+			"Count":       len(clusters),
+			"Showing":     end,
+			"Page":        page,
+			"Top":         top,
+			"MaxDist":     maxDist,
+			"Clusters":    clusters[start:end],
+			"JuncSamples": samples,
+			"Fields":      fields,
+			"Samples":     db.geneSamples[fields.Gene],
+			"KnockDowns":  db.geneKnockDowns[fields.Gene],
+			"Replicates":  db.geneReplicates[fields.Gene],
+			"Pages":       []int{10, 50, 100, 1000},
+			"Genes":       db.genes}
+
+		renderTemplate(app, "junctions.html", w, vars)
+	})
+}
+
+func ProfileJson(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("profile json handler: database not found in request context")
+			http.Error(w, "Fatal error", http.StatusInternalServerError)
+			return
+		}
+
+		fields, err := app.NewSearchFields(w, r, db)
+		if err != nil {
+			logrus.Printf("Error parsing get request: %s", err)
+			http.Error(w, "Invalid get parameter in request", http.StatusInternalServerError)
+			return
+		}
+		fields.Limit = 0
+		fields.Offset = 0
+
+		tmpl, ok := db.geneTemplates[fields.Gene]
+		if !ok {
+			logrus.Printf("Invalid gene: %s", fields.Gene)
+			http.Error(w, "Invalid gene", http.StatusInternalServerError)
+			return
+		}
+
+		export := r.URL.Query().Get("export") == "1"
+		cacheKey := chartCacheKey(r.URL.Path, fields, r, "raw")
+		if !export {
+			w.Header().Set("Content-Type", "application/json")
+			if app.cachedChart(w, db, cacheKey) {
+				return
+			}
+		}
+
+		profile, err := editProfile(db.storage, tmpl, fields, r.URL.Query().Get("raw") == "1")
+		if err != nil {
+			logrus.Printf("Fatal error: %s", err)
+			http.Error(w, "Fatal database error.", http.StatusInternalServerError)
+			return
+		}
+
+		if export {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=treat-profile.csv")
+
+			csvout := csv.NewWriter(w)
+			defer csvout.Flush()
+			writeProfile(csvout, fields.Gene, profile.Rows(), true)
+			return
+		}
+
+		out, err := json.Marshal(profile.Rows())
+		if err != nil {
+			logrus.Printf("Error encoding profile data as json: %s", err)
+			http.Error(w, "Fatal system error", http.StatusInternalServerError)
+			return
+		}
+
+		app.cacheChart(db, cacheKey, out)
+		w.Write(out)
+	})
+}
+
+func LoginHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.loginEnabled() {
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+
+		// Only redirect to local paths after login
+		next := localRedirect(r.FormValue("next"))
+
+		vars := map[string]interface{}{
+			"dbs":   nil,
+			"curdb": "",
+			"Next":  next}
+
+		if r.Method == "POST" {
+			name := r.FormValue("username")
+			user, ok := app.users[name]
+			if !ok || !user.CheckPassword(r.FormValue("password")) {
+				logrus.WithFields(logrus.Fields{
+					"user":   name,
+					"remote": r.RemoteAddr,
+				}).Warn("Failed login attempt")
+				vars["Failed"] = true
+				vars["Username"] = name
+				w.WriteHeader(http.StatusUnauthorized)
+				renderTemplate(app, "login.html", w, vars)
+				return
+			}
+
+			session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+			session.Values[TREAT_COOKIE_USER] = user.Name
+			session.Values[TREAT_COOKIE_DB] = nil
+			session.Values[TREAT_COOKIE_SEARCH] = nil
+			err := session.Save(r, w)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("Login handler: failed to save session")
+				errorHandler(app, w, http.StatusInternalServerError)
+				return
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"user": user.Name,
+			}).Info("User logged in")
+			http.Redirect(w, r, next, 302)
+			return
+		}
+
+		renderTemplate(app, "login.html", w, vars)
+	})
+}
+
+func LogoutHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+		delete(session.Values, TREAT_COOKIE_USER)
+		delete(session.Values, TREAT_COOKIE_DB)
+		delete(session.Values, TREAT_COOKIE_SEARCH)
+		session.Options.MaxAge = -1
+		err := session.Save(r, w)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Logout handler: failed to save session")
+		}
+
+		http.Redirect(w, r, "/login", 302)
+	})
+}
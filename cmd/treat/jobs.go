@@ -0,0 +1,497 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	JOB_QUEUED   = "queued"
+	JOB_RUNNING  = "running"
+	JOB_DONE     = "done"
+	JOB_FAILED   = "failed"
+	JOB_CANCELED = "canceled"
+
+	// Max number of log lines kept per job
+	JOB_MAX_LOG = 1000
+)
+
+// Job is a long running task executed in the background by a JobQueue
+type Job struct {
+	ID    string
+	Kind  string
+	Title string
+	Owner string
+
+	mu       sync.Mutex
+	state    string
+	progress float64
+	message  string
+	err      string
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	log      []string
+	run      func(j *Job) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	dir        string
+	resultPath string
+	resultName string
+	resultType string
+}
+
+// JobStatus is a point in time copy of the state of a job
+type JobStatus struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Title    string     `json:"title"`
+	Owner    string     `json:"owner,omitempty"`
+	State    string     `json:"state"`
+	Progress float64    `json:"progress"`
+	Message  string     `json:"message,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   string     `json:"result,omitempty"`
+	Log      []string   `json:"log,omitempty"`
+}
+
+// Percent returns the progress as a percentage
+func (s *JobStatus) Percent() int {
+	return int(s.Progress * 100)
+}
+
+// IsFinished returns true if the job is no longer queued or running
+func (s *JobStatus) IsFinished() bool {
+	return s.State == JOB_DONE || s.State == JOB_FAILED || s.State == JOB_CANCELED
+}
+
+// NewJob returns a new job which calls run when executed
+func NewJob(kind, title, owner string, run func(j *Job) error) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Job{
+		ID:     newJobID(),
+		Kind:   kind,
+		Title:  title,
+		Owner:  owner,
+		state:  JOB_QUEUED,
+		run:    run,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Logf appends a line to the job log
+func (j *Job) Logf(format string, args ...interface{}) {
+	line := fmt.Sprintf("%s %s", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.log = append(j.log, line)
+	if len(j.log) > JOB_MAX_LOG {
+		j.log = j.log[len(j.log)-JOB_MAX_LOG:]
+	}
+}
+
+// SetProgress sets the fraction of work done and a short status message
+func (j *Job) SetProgress(progress float64, message string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if progress < 0 {
+		progress = 0
+	} else if progress > 1 {
+		progress = 1
+	}
+	j.progress = progress
+	j.message = message
+}
+
+// Context returns the context of the job which is done when the job is
+// canceled. Long running jobs should check it regularly.
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// Cancel stops the job. Queued jobs won't run, running jobs are canceled
+// through their context. Returns false if the job already finished.
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	switch j.state {
+	case JOB_QUEUED:
+		j.state = JOB_CANCELED
+		j.finished = time.Now()
+	case JOB_RUNNING:
+	default:
+		return false
+	}
+
+	j.cancel()
+	return true
+}
+
+// CreateResult creates the result file of the job. name is the file name
+// offered for download and contentType its mime type.
+func (j *Job) CreateResult(name, contentType string) (*os.File, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.resultPath) > 0 {
+		return nil, fmt.Errorf("Job result already exists")
+	}
+
+	f, err := ioutil.TempFile(j.dir, "result-"+j.ID+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	j.resultPath = f.Name()
+	j.resultName = filepath.Base(name)
+	j.resultType = contentType
+
+	return f, nil
+}
+
+// Result returns the path, download name and content type of the result of a
+// finished job
+func (j *Job) Result() (string, string, string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state != JOB_DONE || len(j.resultPath) == 0 {
+		return "", "", "", false
+	}
+
+	return j.resultPath, j.resultName, j.resultType, true
+}
+
+// removeResult deletes the result file
+func (j *Job) removeResult() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.resultPath) > 0 {
+		os.Remove(j.resultPath)
+		j.resultPath = ""
+	}
+}
+
+// State returns the current state of the job
+func (j *Job) State() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state
+}
+
+// Status returns a copy of the job state. The log is included if withLog is
+// set.
+func (j *Job) Status(withLog bool) *JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := &JobStatus{
+		ID:       j.ID,
+		Kind:     j.Kind,
+		Title:    j.Title,
+		Owner:    j.Owner,
+		State:    j.state,
+		Progress: j.progress,
+		Message:  j.message,
+		Error:    j.err,
+		Created:  j.created,
+	}
+
+	if !j.started.IsZero() {
+		started := j.started
+		status.Started = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		status.Finished = &finished
+	}
+	if j.state == JOB_DONE && len(j.resultPath) > 0 {
+		status.Result = j.resultName
+	}
+	if withLog {
+		status.Log = append([]string{}, j.log...)
+	}
+
+	return status
+}
+
+// Logger returns a logger which writes to the job log
+func (j *Job) Logger() logrus.FieldLogger {
+	log := logrus.New()
+	log.Out = &jobLogWriter{job: j}
+	log.Formatter = &jobLogFormatter{}
+	return log
+}
+
+type jobLogWriter struct {
+	job *Job
+}
+
+func (w *jobLogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		w.job.Logf("%s", line)
+	}
+
+	return len(p), nil
+}
+
+// jobLogFormatter formats log entries as plain messages. Timestamps are added
+// by the job log.
+type jobLogFormatter struct{}
+
+func (f *jobLogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	msg := entry.Message
+	if entry.Level <= logrus.WarnLevel {
+		msg = fmt.Sprintf("%s: %s", entry.Level, msg)
+	}
+
+	return []byte(msg + "\n"), nil
+}
+
+func (j *Job) execute() {
+	j.mu.Lock()
+	if j.state == JOB_CANCELED {
+		j.mu.Unlock()
+		j.Logf("Canceled")
+		return
+	}
+	j.state = JOB_RUNNING
+	j.started = time.Now()
+	j.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"job":   j.ID,
+		"kind":  j.Kind,
+		"owner": j.Owner,
+	}).Info("Job started")
+
+	err := j.run(j)
+	canceled := j.ctx.Err() != nil
+	j.cancel()
+
+	if err != nil || canceled {
+		j.removeResult()
+	}
+
+	j.mu.Lock()
+	j.finished = time.Now()
+	if canceled {
+		j.state = JOB_CANCELED
+		j.message = "Canceled"
+	} else if err != nil {
+		j.state = JOB_FAILED
+		j.err = err.Error()
+	} else {
+		j.state = JOB_DONE
+		j.progress = 1
+		j.message = "Done"
+	}
+	j.mu.Unlock()
+
+	if canceled {
+		j.Logf("Canceled")
+		logrus.WithFields(logrus.Fields{
+			"job": j.ID,
+		}).Info("Job canceled")
+		return
+	}
+
+	if err != nil {
+		j.Logf("Failed: %s", err)
+		logrus.WithFields(logrus.Fields{
+			"job":   j.ID,
+			"error": err.Error(),
+		}).Error("Job failed")
+		return
+	}
+
+	j.Logf("Done")
+	logrus.WithFields(logrus.Fields{
+		"job": j.ID,
+	}).Info("Job finished")
+}
+
+// JobQueue runs jobs in the background with a fixed number of workers
+type JobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	order   []*Job
+	queue   chan *Job
+	history int
+	dir     string
+	closed  bool
+}
+
+// NewJobQueue starts workers to run jobs. At most size jobs can wait in the
+// queue and the status of the last history finished jobs is kept. Job
+// results are stored in a new directory created in dir.
+func NewJobQueue(workers, size, history int, dir string) (*JobQueue, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	rdir, err := ioutil.TempDir(dir, "treat-jobs-")
+	if err != nil {
+		return nil, err
+	}
+
+	q := &JobQueue{
+		jobs:    make(map[string]*Job),
+		order:   make([]*Job, 0),
+		queue:   make(chan *Job, size),
+		history: history,
+		dir:     rdir,
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range q.queue {
+				j.execute()
+				q.prune()
+			}
+		}()
+	}
+
+	return q, nil
+}
+
+// Submit adds a job to the queue. Returns an error if the queue is full.
+func (q *JobQueue) Submit(j *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("Server is shutting down")
+	}
+
+	j.created = time.Now()
+	j.dir = q.dir
+	j.Logf("Queued %s", j.Title)
+
+	select {
+	case q.queue <- j:
+	default:
+		return fmt.Errorf("Job queue is full. Please try again later")
+	}
+
+	q.jobs[j.ID] = j
+	q.order = append(q.order, j)
+
+	return nil
+}
+
+// Get returns the job with the given id
+func (q *JobQueue) Get(id string) (*Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	return j, ok
+}
+
+// List returns all known jobs, newest first
+func (q *JobQueue) List() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(q.order))
+	for i := len(q.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, q.order[i])
+	}
+
+	return jobs
+}
+
+// prune forgets the oldest finished jobs beyond the history limit
+func (q *JobQueue) prune() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	finished := 0
+	for _, j := range q.order {
+		if s := j.State(); s == JOB_DONE || s == JOB_FAILED || s == JOB_CANCELED {
+			finished++
+		}
+	}
+
+	keep := make([]*Job, 0, len(q.order))
+	for _, j := range q.order {
+		if s := j.State(); finished > q.history && (s == JOB_DONE || s == JOB_FAILED || s == JOB_CANCELED) {
+			j.removeResult()
+			delete(q.jobs, j.ID)
+			finished--
+			continue
+		}
+		keep = append(keep, j)
+	}
+	q.order = keep
+}
+
+// Close cancels all jobs and removes their results
+func (q *JobQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	jobs := append([]*Job{}, q.order...)
+	q.mu.Unlock()
+
+	for _, j := range jobs {
+		j.Cancel()
+	}
+
+	// Give running jobs a moment to notice before removing their files
+	deadline := time.Now().Add(5 * time.Second)
+	for _, j := range jobs {
+		for !j.Status(false).IsFinished() && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	os.RemoveAll(q.dir)
+}
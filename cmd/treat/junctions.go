@@ -0,0 +1,126 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+func Junctions(dbpath string, fields *SearchFields, maxDist, top int, csvOutput, noHeader bool) {
+	if len(fields.Gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	summary, err := juncSummary(s, fields, maxDist)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	csvout := csv.NewWriter(os.Stdout)
+	defer csvout.Flush()
+
+	if !csvOutput {
+		csvout.Comma = '\t'
+	}
+
+	writeJuncClusters(csvout, fields.Gene, summary.Clusters(), summary.Samples(), top, !noHeader)
+}
+
+func juncSummary(s *Storage, fields *SearchFields, maxDist int) (*treat.JuncSummary, error) {
+	tmpl, err := s.GetTemplate(fields.Gene)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := treat.NewJuncSummary(tmpl.EditBase, maxDist)
+	err = s.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		summary.Add(key.Sample, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+func siteString(sites []uint32) string {
+	parts := make([]string, len(sites))
+	for i, t := range sites {
+		parts[i] = strconv.Itoa(int(t))
+	}
+	return strings.Join(parts, ",")
+}
+
+// writeJuncClusters writes one row per junction variant and sample. If top
+// is > 0 only the top most abundant variants in each cluster are written.
+func writeJuncClusters(csvout *csv.Writer, gene string, clusters []*treat.JuncCluster, samples []string, top int, header bool) {
+	if header {
+		csvout.Write([]string{
+			"gene",
+			"edit_stop",
+			"cluster",
+			"variant",
+			"junc_end",
+			"junc_len",
+			"junc_seq",
+			"site_t",
+			"sample",
+			"norm_count",
+			"read_count",
+			"cluster_norm"})
+	}
+
+	for ci, c := range clusters {
+		for vi, v := range c.Variants {
+			if top > 0 && vi >= top {
+				break
+			}
+			for _, sample := range samples {
+				norm, ok := v.Norm[sample]
+				if !ok {
+					continue
+				}
+				csvout.Write([]string{
+					gene,
+					strconv.Itoa(c.EditStop),
+					strconv.Itoa(ci + 1),
+					strconv.Itoa(vi + 1),
+					strconv.Itoa(v.JuncEnd),
+					strconv.Itoa(v.JuncLen),
+					v.Seq,
+					siteString(v.Sites),
+					sample,
+					fmt.Sprintf("%.4f", RoundPlus(norm, 4)),
+					strconv.Itoa(int(v.ReadCount[sample])),
+					fmt.Sprintf("%.4f", RoundPlus(c.Norm[sample], 4))})
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@
 package main
 
 import (
+	"fmt"
 	"path/filepath"
 	"strings"
 
@@ -39,6 +40,19 @@ type LoadOptions struct {
 	Force        bool
 	Tetracycline bool
 	Collapse     bool
+
+	// Log receives progress messages. Defaults to the standard logger
+	Log logrus.FieldLogger
+	// Progress is called periodically with the number of fragments loaded
+	Progress func(count int)
+}
+
+func (options *LoadOptions) logger() logrus.FieldLogger {
+	if options.Log != nil {
+		return options.Log
+	}
+
+	return logrus.StandardLogger()
 }
 
 func cleanName(name string) string {
@@ -51,17 +65,47 @@ func cleanName(name string) string {
 }
 
 func Load(dbpath string, options *LoadOptions) {
-	if len(options.Gene) == 0 {
-		logrus.Fatal("Gene name is required")
-	}
 	if len(options.TemplatePath) == 0 {
 		logrus.Fatal("Please provide path to templates file")
 	}
+
+	storage, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = loadSample(storage, options)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// loadSample loads a fasta file into an open database. If no template path
+// is given the template already stored for the gene is used.
+func loadSample(storage *Storage, options *LoadOptions) error {
+	log := options.logger()
+
 	if len(options.FastaPath) == 0 {
-		logrus.Fatal("Please provide a fasta file to load")
+		return fmt.Errorf("Please provide a fasta file to load")
 	}
 	if len(options.EditBase) != 1 {
-		logrus.Fatal("Please provide the edit base")
+		return fmt.Errorf("Please provide the edit base")
+	}
+
+	var tmpl *treat.Template
+	if len(options.TemplatePath) > 0 {
+		t, spec, err := loadTemplate(options.TemplatePath, options.EditBase, options.EditOffset)
+		if err != nil {
+			return err
+		}
+		if len(options.Gene) == 0 {
+			options.Gene = spec.Gene
+		}
+		tmpl = t
+	}
+
+	if len(options.Gene) == 0 {
+		return fmt.Errorf("Gene name is required")
 	}
 
 	if len(options.Sample) == 0 {
@@ -73,33 +117,30 @@ func Load(dbpath string, options *LoadOptions) {
 	options.Sample = cleanName(options.Sample)
 	options.KnockDown = cleanName(options.KnockDown)
 
-	tmpl, err := treat.NewTemplateFromFasta(options.TemplatePath, treat.FORWARD, rune(options.EditBase[0]))
+	err := storage.Initialize()
 	if err != nil {
-		logrus.Fatalln(err)
+		return err
 	}
 
-	tmpl.SetOffset(options.EditOffset)
+	if tmpl != nil {
+		log.Printf("Using template Edit Stop Site: %d", tmpl.EditStop)
+		log.Printf("Using Edit Site numbering offset: %d", tmpl.EditOffset)
 
-	logrus.Printf("Using template Edit Stop Site: %d", tmpl.EditStop)
-	logrus.Printf("Using Edit Site numbering offset: %d", tmpl.EditOffset)
-
-	storage, err := NewStorageWrite(dbpath)
-	if err != nil {
-		logrus.Fatal(err)
-	}
+		version, err := storage.PutTemplate(options.Gene, tmpl)
+		if err != nil {
+			return err
+		}
 
-	err = storage.Initialize()
-	if err != nil {
-		logrus.Fatal(err)
-	}
+		log.Printf("Using template version: %d", version)
+	} else {
+		tmpl, err := storage.GetTemplate(options.Gene)
+		if err != nil {
+			return fmt.Errorf("No template found for gene %s. Please provide a templates file", options.Gene)
+		}
 
-	err = storage.PutTemplate(options.Gene, tmpl)
-	if err != nil {
-		logrus.Fatal(err)
+		log.Printf("Using stored template for gene %s with Edit Stop Site: %d", options.Gene, tmpl.EditStop)
 	}
 
 	_, err = storage.ImportSample(options.FastaPath, options)
-	if err != nil {
-		logrus.Fatal(err)
-	}
+	return err
 }
@@ -20,6 +20,8 @@ package main
 import (
 	"os"
 
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
 	"github.com/urfave/cli"
 )
 
@@ -61,7 +63,7 @@ func main() {
 				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
 				&cli.StringFlag{Name: "sample, s", Usage: "Sample Name"},
 				&cli.StringFlag{Name: "knock-down, k", Usage: "Knock Down Gene"},
-				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
+				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in YAML, JSON or FASTA format"},
 				&cli.StringFlag{Name: "fasta, f", Usage: "Path to fragment FASTA files"},
 				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
 				&cli.BoolFlag{Name: "skip-fragments", Usage: "Do not store raw fragments. Only alignment summary data."},
@@ -92,12 +94,14 @@ func main() {
 			Name:  "align",
 			Usage: "Align one or more fragments",
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
+				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in YAML, JSON or FASTA format"},
 				&cli.StringFlag{Name: "fragment, f", Usage: "Path to fragment FASTA file"},
 				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
 				&cli.StringFlag{Name: "s1, 1", Usage: "first sequence to align"},
 				&cli.StringFlag{Name: "s2, 2", Usage: "second sequence to align"},
 				&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+				&cli.BoolFlag{Name: "pileup, p", Usage: "Stack all fragments under the templates"},
+				&cli.IntFlag{Name: "width, w", Value: 80, Usage: "Text width of the alignment output"},
 			},
 			Action: func(c *cli.Context) {
 				Align(&AlignOptions{
@@ -107,6 +111,8 @@ func main() {
 					S1:           c.String("s1"),
 					S2:           c.String("s2"),
 					EditOffset:   c.Int("offset"),
+					Pileup:       c.Bool("pileup"),
+					Width:        c.Int("width"),
 				})
 			},
 		},
@@ -114,28 +120,235 @@ func main() {
 			Name:  "mutant",
 			Usage: "Indel mutation analysis",
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
+				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in YAML, JSON or FASTA format"},
 				&cli.StringSliceFlag{Name: "fragment, f", Value: &cli.StringSlice{}, Usage: "One or more fragment FASTA files"},
 				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
 				&cli.IntFlag{Name: "n", Value: 5, Usage: "Max number of indels to ouptut"},
+				&cli.StringFlag{Name: "format", Usage: "Output mutation catalog in csv or vcf format"},
+				&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples"},
+				&cli.StringSliceFlag{Name: "knock-down, k", Value: &cli.StringSlice{}, Usage: "One or more knock downs"},
+				&cli.BoolFlag{Name: "no-header, x", Usage: "Exclude header from output"},
 			},
 			Action: func(c *cli.Context) {
-				Mutant(&AlignOptions{
+				options := &AlignOptions{
 					TemplatePath: c.String("template"),
 					EditBase:     c.String("base"),
-				}, c.StringSlice("fragment"), c.Int("n"))
+					EditOffset:   c.Int("offset"),
+				}
+
+				if len(c.String("format")) == 0 {
+					Mutant(options, c.StringSlice("fragment"), c.Int("n"))
+				} else {
+					fields := &SearchFields{
+						Gene:      c.String("gene"),
+						Sample:    c.StringSlice("sample"),
+						KnockDown: c.StringSlice("knock-down"),
+						EditStop:  -1,
+						JuncLen:   -1,
+						JuncEnd:   -1,
+					}
+					fields.unsetRanges()
+					MutationCatalog(c.GlobalString("db"), options, fields, c.StringSlice("fragment"), c.String("format"), c.Bool("no-header"))
+				}
+			},
+		},
+		{
+			Name:  "template",
+			Usage: "Work with template files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "validate",
+					Usage:     "Validate template files in YAML, JSON or FASTA format",
+					ArgsUsage: "FILE...",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base if not set in the template file"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateValidate(c.Args(), c.String("base"), c.Int("offset"))
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "Print the edit site table of a template file or the template stored for a gene",
+					ArgsUsage: "[FILE]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "gene, g", Usage: "Show the template stored for this gene"},
+						&cli.IntFlag{Name: "version, v", Usage: "Template version of the gene. Defaults to the current template"},
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base if not set in the template file"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+						&cli.BoolFlag{Name: "csv", Usage: "Output in csv format"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateShow(c.GlobalString("db"), c.String("gene"), uint64(c.Int("version")), c.Args(), c.String("base"), c.Int("offset"), c.Bool("csv"))
+					},
+				},
+				{
+					Name:      "add",
+					Usage:     "Store a template file as the new current template version for a gene",
+					ArgsUsage: "FILE",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "gene, g", Usage: "Gene Name. Defaults to the gene set in the template file"},
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base if not set in the template file"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateAdd(c.GlobalString("db"), c.String("gene"), c.Args(), c.String("base"), c.Int("offset"))
+					},
+				},
+				{
+					Name:  "versions",
+					Usage: "List the template versions of a gene and the samples aligned against each",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateVersions(c.GlobalString("db"), c.String("gene"))
+					},
+				},
+				{
+					Name:  "predict",
+					Usage: "Predict the fully edited template from the pre-edited sequence and gRNAs",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "pre, p", Usage: "Pre-edited sequence in FASTA format or a template file"},
+						&cli.StringFlag{Name: "grna", Usage: "Path to gRNA sequences in FASTA format (5' -> 3')"},
+						&cli.IntFlag{Name: "anchor", Value: treat.DEFAULT_ANCHOR_LEN, Usage: "Number of gRNA 5' nucleotides which must pair with the mRNA"},
+						&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+						&cli.StringFlag{Name: "out, o", Usage: "Output file. Defaults to stdout"},
+						&cli.StringFlag{Name: "format, f", Usage: "Output format yaml, json or fasta. Defaults to the output file extension or yaml"},
+					},
+					Action: func(c *cli.Context) {
+						TemplatePredict(&PredictOptions{
+							PrePath:   c.String("pre"),
+							GuidePath: c.String("grna"),
+							Output:    c.String("out"),
+							Format:    c.String("format"),
+							Gene:      c.String("gene"),
+							Anchor:    c.Int("anchor"),
+						})
+					},
+				},
+				{
+					Name:      "diff",
+					Usage:     "Compare two template files or a template file to the template stored for a gene",
+					ArgsUsage: "FILE [FILE]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "gene, g", Usage: "Compare to the template stored for this gene"},
+						&cli.IntFlag{Name: "version, v", Usage: "Template version of the gene. Defaults to the current template"},
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base if not set in the template file"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateDiff(c.GlobalString("db"), c.String("gene"), uint64(c.Int("version")), c.Args(), c.String("base"), c.Int("offset"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "realign",
+			Usage: "Recompute alignments from stored fragments against the current template",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples. Defaults to all samples of the gene"},
+				&cli.IntFlag{Name: "version, v", Usage: "Template version. An older version is added again as the current template. Defaults to the current template"},
+				&cli.BoolFlag{Name: "exclude-snps", Usage: "Exclude fragments containing SNPs."},
+			},
+			Action: func(c *cli.Context) {
+				Realign(c.GlobalString("db"), &RealignOptions{
+					Gene:        c.String("gene"),
+					Samples:     c.StringSlice("sample"),
+					Version:     uint64(c.Int("version")),
+					ExcludeSnps: c.Bool("exclude-snps"),
+				})
 			},
 		},
 		{
 			Name:  "server",
 			Usage: "Run http server",
 			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "config, c", Usage: "Path to server config file in YAML format"},
 				&cli.StringFlag{Name: "templates, t", Usage: "Path to html templates directory"},
+				&cli.StringFlag{Name: "bind", Usage: "Address to listen on. Defaults to all interfaces"},
 				&cli.IntFlag{Name: "port, p", Value: 8080, Usage: "Port to listen on"},
-				&cli.BoolFlag{Name: "enable-cache", Usage: "Enable url caching"},
+				&cli.StringFlag{Name: "tls-cert", Usage: "Path to TLS certificate"},
+				&cli.StringFlag{Name: "tls-key", Usage: "Path to TLS private key"},
+				&cli.BoolFlag{Name: "enable-cache", Usage: "Enable caching of chart data"},
+				&cli.StringFlag{Name: "session-secret", EnvVar: "TREAT_SESSION_SECRET", Usage: "Secret key used to sign session cookies"},
+				&cli.StringFlag{Name: "users", Usage: "Path to htpasswd style user file. Enables authentication"},
+				&cli.StringFlag{Name: "proxy-auth-header", Usage: "Trust user name from this header set by a reverse proxy"},
+				&cli.StringFlag{Name: "admin-token", EnvVar: "TREAT_ADMIN_TOKEN", Usage: "Bearer token allowed to POST /admin/reload. Admin routes are disabled unless set or admins are configured"},
+				&cli.DurationFlag{Name: "watch", Usage: "Poll database files for changes at this interval and reload (e.g. 30s)"},
+				&cli.BoolFlag{Name: "enable-upload", Usage: "Allow loading samples from the web interface"},
+				&cli.StringFlag{Name: "upload-dir", Usage: "Directory for uploaded files. Defaults to the system temp directory"},
 			},
 			Action: func(c *cli.Context) {
-				Server(c.GlobalString("db"), c.String("templates"), c.Int("port"), c.Bool("enable-cache"))
+				cfg := NewServerConfig()
+				if c.IsSet("config") {
+					var err error
+					cfg, err = LoadServerConfig(c.String("config"))
+					if err != nil {
+						logrus.Fatal(err)
+					}
+				}
+
+				// Command line flags override the config file
+				if len(cfg.Databases) == 0 || c.GlobalIsSet("db") {
+					cfg.Databases = []*DatabaseConfig{{Path: c.GlobalString("db")}}
+				}
+				if c.IsSet("templates") {
+					cfg.TemplateDir = c.String("templates")
+				}
+				if c.IsSet("bind") {
+					cfg.Bind = c.String("bind")
+				}
+				if c.IsSet("port") {
+					cfg.Port = c.Int("port")
+				}
+				if c.IsSet("tls-cert") {
+					cfg.TLSCert = c.String("tls-cert")
+				}
+				if c.IsSet("tls-key") {
+					cfg.TLSKey = c.String("tls-key")
+				}
+				if c.IsSet("enable-cache") {
+					cfg.EnableCache = c.Bool("enable-cache")
+				}
+				if len(c.String("session-secret")) > 0 {
+					cfg.SessionSecret = c.String("session-secret")
+				}
+				if c.IsSet("users") {
+					cfg.UserFile = c.String("users")
+				}
+				if c.IsSet("enable-upload") {
+					cfg.EnableUpload = c.Bool("enable-upload")
+				}
+				if c.IsSet("upload-dir") {
+					cfg.UploadDir = c.String("upload-dir")
+				}
+				if c.IsSet("watch") {
+					cfg.WatchInterval = c.Duration("watch")
+				}
+				if c.IsSet("proxy-auth-header") {
+					cfg.ProxyAuthHeader = c.String("proxy-auth-header")
+				}
+				if len(c.String("admin-token")) > 0 {
+					cfg.AdminToken = c.String("admin-token")
+				}
+
+				Server(cfg)
+			},
+		},
+		{
+			Name:  "passwd",
+			Usage: "Generate user file entry with bcrypt hashed password read from stdin",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "user, u", Usage: "User name"},
+				&cli.StringSliceFlag{Name: "db, d", Value: &cli.StringSlice{}, Usage: "One or more databases the user can access. Defaults to all"},
+			},
+			Action: func(c *cli.Context) {
+				Passwd(c.String("user"), c.StringSlice("db"))
 			},
 		},
 		{
@@ -145,9 +358,12 @@ func main() {
 				&cli.StringFlag{Name: "gene, g", Usage: "Filter by gene"},
 				&cli.BoolFlag{Name: "unique, u", Usage: "Use unique fragment counts only"},
 				&cli.BoolFlag{Name: "norm, n", Usage: "Use normalized fragment counts only"},
+				&cli.BoolFlag{Name: "csv", Usage: "Output editing metrics in csv format"},
+				&cli.BoolFlag{Name: "group-means", Usage: "Output editing metrics averaged across replicates (with --csv)"},
+				&cli.IntFlag{Name: "start", Usage: "Start codon position in the fully edited template (default from template)"},
 			},
 			Action: func(c *cli.Context) {
-				ShowStats(c.GlobalString("db"), c.String("gene"), c.Bool("unique"), c.Bool("norm"))
+				ShowStats(c.GlobalString("db"), c.String("gene"), c.Bool("unique"), c.Bool("norm"), c.Bool("csv"), c.Bool("group-means"), c.Int("start"))
 			},
 		},
 		{
@@ -171,29 +387,228 @@ func main() {
 				&cli.IntFlag{Name: "junc-end", Value: -1, Usage: "Junction end"},
 				&cli.IntFlag{Name: "junc-len", Value: -1, Usage: "Junction len"},
 				&cli.IntFlag{Name: "alt", Value: 0, Usage: "Alt editing region"},
+				&cli.IntFlag{Name: "edit-stop-min", Value: -1, Usage: "Minimum edit stop"},
+				&cli.IntFlag{Name: "edit-stop-max", Value: -1, Usage: "Maximum edit stop"},
+				&cli.IntFlag{Name: "junc-start-min", Value: -1, Usage: "Minimum junction start"},
+				&cli.IntFlag{Name: "junc-start-max", Value: -1, Usage: "Maximum junction start"},
+				&cli.IntFlag{Name: "junc-end-min", Value: -1, Usage: "Minimum junction end"},
+				&cli.IntFlag{Name: "junc-end-max", Value: -1, Usage: "Maximum junction end"},
+				&cli.IntFlag{Name: "junc-len-min", Value: -1, Usage: "Minimum junction len"},
+				&cli.IntFlag{Name: "junc-len-max", Value: -1, Usage: "Maximum junction len"},
+				&cli.IntFlag{Name: "read-count-min", Value: -1, Usage: "Minimum read count"},
+				&cli.IntFlag{Name: "read-count-max", Value: -1, Usage: "Maximum read count"},
+				&cli.Float64Flag{Name: "norm-min", Value: -1, Usage: "Minimum normalized read count"},
+				&cli.Float64Flag{Name: "norm-max", Value: -1, Usage: "Maximum normalized read count"},
 				&cli.IntFlag{Name: "offset,o", Value: 0, Usage: "offset"},
 				&cli.IntFlag{Name: "limit,l", Value: 0, Usage: "limit"},
 				&cli.BoolFlag{Name: "has-mutation", Usage: "Has mutation"},
 				&cli.BoolFlag{Name: "all,a", Usage: "Include all sequences"},
 				&cli.BoolFlag{Name: "has-alt", Usage: "Has Alternative Editing"},
+				&cli.StringFlag{Name: "frame", Usage: "Reading frame: in-frame, frameshift, premature-stop or untranslated"},
+				&cli.IntFlag{Name: "start", Usage: "Start codon position in the fully edited template (default from template)"},
+				&cli.StringFlag{Name: "where, w", Usage: "Filter expression, e.g. 'kd in (GAP1, MRB8180) and tet and junc_len > 10'"},
 				&cli.BoolFlag{Name: "csv", Usage: "Output in csv format"},
 				&cli.BoolFlag{Name: "fasta", Usage: "Output in fasta format"},
 				&cli.BoolFlag{Name: "no-header, x", Usage: "Exclude header from output"},
+				&cli.StringFlag{Name: "format, f", Usage: "Output format: tsv, csv or jsonl (default tsv)"},
+				&cli.StringFlag{Name: "columns", Usage: "Comma separated list of columns to output"},
+				&cli.StringFlag{Name: "sort", Usage: "Sort descending by read_count or norm_count"},
+				&cli.BoolFlag{Name: "gzip, z", Usage: "Compress output with gzip"},
+				&cli.StringFlag{Name: "group-by", Usage: "Comma separated list of columns to group alignments by"},
+				&cli.StringFlag{Name: "agg", Usage: "Comma separated list of aggregates of each group: count, sum(col), mean(col), min(col) or max(col) (default count)"},
+				&cli.BoolFlag{Name: "wide", Usage: "Output grouped results with samples as columns"},
 			},
 			Action: func(c *cli.Context) {
+				format := c.String("format")
+				if len(format) == 0 {
+					format = EXPORT_TSV
+					if c.Bool("csv") {
+						format = EXPORT_CSV
+					}
+				}
+
 				Search(c.GlobalString("db"), &SearchFields{
+					Gene:         c.String("gene"),
+					Sample:       c.StringSlice("sample"),
+					EditStop:     c.Int("edit-stop"),
+					JuncLen:      c.Int("junc-len"),
+					JuncEnd:      c.Int("junc-end"),
+					Offset:       c.Int("offset"),
+					Limit:        c.Int("limit"),
+					AltRegion:    c.Int("alt"),
+					HasMutation:  c.Bool("has-mutation"),
+					HasAlt:       c.Bool("has-alt"),
+					All:          c.Bool("all"),
+					Frame:        c.String("frame"),
+					StartCodon:   c.Int("start"),
+					Where:        c.String("where"),
+					EditStopMin:  c.Int("edit-stop-min"),
+					EditStopMax:  c.Int("edit-stop-max"),
+					JuncStartMin: c.Int("junc-start-min"),
+					JuncStartMax: c.Int("junc-start-max"),
+					JuncEndMin:   c.Int("junc-end-min"),
+					JuncEndMax:   c.Int("junc-end-max"),
+					JuncLenMin:   c.Int("junc-len-min"),
+					JuncLenMax:   c.Int("junc-len-max"),
+					ReadCountMin: c.Int("read-count-min"),
+					ReadCountMax: c.Int("read-count-max"),
+					NormMin:      c.Float64("norm-min"),
+					NormMax:      c.Float64("norm-max"),
+				}, &ExportOptions{
+					Format:   format,
+					Columns:  ParseExportColumns(c.String("columns")),
+					Gzip:     c.Bool("gzip"),
+					NoHeader: c.Bool("no-header"),
+					Sort:     c.String("sort"),
+				}, &GroupOptions{
+					GroupBy:    ParseExportColumns(c.String("group-by")),
+					Aggregates: ParseExportColumns(c.String("agg")),
+					Wide:       c.Bool("wide"),
+				}, c.Bool("fasta"))
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "Export alignments in columnar format",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples"},
+				&cli.IntFlag{Name: "edit-stop", Value: -1, Usage: "Edit stop"},
+				&cli.IntFlag{Name: "junc-end", Value: -1, Usage: "Junction end"},
+				&cli.IntFlag{Name: "junc-len", Value: -1, Usage: "Junction len"},
+				&cli.IntFlag{Name: "alt", Value: 0, Usage: "Alt editing region"},
+				&cli.BoolFlag{Name: "has-mutation", Usage: "Has mutation"},
+				&cli.BoolFlag{Name: "all,a", Usage: "Include all sequences"},
+				&cli.BoolFlag{Name: "has-alt", Usage: "Has Alternative Editing"},
+				&cli.StringFlag{Name: "format, f", Value: EXPORT_PARQUET, Usage: "Output format: parquet or arrow"},
+				&cli.StringFlag{Name: "out, o", Usage: "Output file"},
+				&cli.StringSliceFlag{Name: "aggregate", Value: &cli.StringSlice{}, Usage: "Also write tables aggregated by edit_stop, junc_end or junc_len"},
+				&cli.BoolFlag{Name: "gzip, z", Usage: "Compress parquet pages with gzip"},
+				&cli.IntFlag{Name: "batch-size", Value: EXPORT_BATCH_SIZE, Usage: "Rows per row group or record batch"},
+			},
+			Action: func(c *cli.Context) {
+				fields := &SearchFields{
 					Gene:        c.String("gene"),
 					Sample:      c.StringSlice("sample"),
 					EditStop:    c.Int("edit-stop"),
 					JuncLen:     c.Int("junc-len"),
 					JuncEnd:     c.Int("junc-end"),
-					Offset:      c.Int("offset"),
-					Limit:       c.Int("limit"),
 					AltRegion:   c.Int("alt"),
 					HasMutation: c.Bool("has-mutation"),
 					HasAlt:      c.Bool("has-alt"),
 					All:         c.Bool("all"),
-				}, c.Bool("csv"), c.Bool("no-header"), c.Bool("fasta"))
+				}
+				fields.unsetRanges()
+				ExportTable(c.GlobalString("db"), fields, &TableOptions{
+					Format:    c.String("format"),
+					Output:    c.String("out"),
+					Aggregate: c.StringSlice("aggregate"),
+					Gzip:      c.Bool("gzip"),
+					BatchSize: c.Int("batch-size"),
+				})
+			},
+		},
+		{
+			Name:  "render",
+			Usage: "Render alignments and charts to SVG or PDF",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "chart, c", Value: RENDER_ALIGNMENT, Usage: "Chart to render: alignment, edit-stop, junc-len, junc-end or heat"},
+				&cli.StringFlag{Name: "format, f", Usage: "Output format: svg or pdf (default from output file extension or svg)"},
+				&cli.StringFlag{Name: "out, o", Usage: "Output file"},
+				&cli.StringFlag{Name: "title", Usage: "Chart title"},
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples"},
+				&cli.IntSliceFlag{Name: "id", Value: &cli.IntSlice{}, Usage: "One or more alignment ids to render"},
+				&cli.IntFlag{Name: "top, n", Value: 10, Usage: "Number of alignments to render per sample if no ids given"},
+				&cli.IntFlag{Name: "width, w", Value: RENDER_ALIGNMENT_COLS, Usage: "Columns per line of the alignment"},
+				&cli.IntFlag{Name: "edit-stop", Value: -1, Usage: "Edit stop"},
+				&cli.IntFlag{Name: "junc-end", Value: -1, Usage: "Junction end"},
+				&cli.IntFlag{Name: "junc-len", Value: -1, Usage: "Junction len"},
+				&cli.IntFlag{Name: "alt", Value: 0, Usage: "Alt editing region"},
+				&cli.BoolFlag{Name: "has-mutation", Usage: "Has mutation"},
+				&cli.BoolFlag{Name: "has-alt", Usage: "Has Alternative Editing"},
+				&cli.StringFlag{Name: "template, t", Usage: "Render alignments of a fragment FASTA file to these templates"},
+				&cli.StringFlag{Name: "fragment", Usage: "Path to fragment FASTA file"},
+				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
+				&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+			},
+			Action: func(c *cli.Context) {
+				fields := &SearchFields{
+					Gene:        c.String("gene"),
+					Sample:      c.StringSlice("sample"),
+					EditStop:    c.Int("edit-stop"),
+					JuncLen:     c.Int("junc-len"),
+					JuncEnd:     c.Int("junc-end"),
+					AltRegion:   c.Int("alt"),
+					HasMutation: c.Bool("has-mutation"),
+					HasAlt:      c.Bool("has-alt"),
+				}
+				fields.unsetRanges()
+				Render(c.GlobalString("db"), fields, &RenderOptions{
+					Chart:        c.String("chart"),
+					Format:       c.String("format"),
+					Output:       c.String("out"),
+					Title:        c.String("title"),
+					Ids:          c.IntSlice("id"),
+					Top:          c.Int("top"),
+					Columns:      c.Int("width"),
+					TemplatePath: c.String("template"),
+					FragmentPath: c.String("fragment"),
+					EditBase:     c.String("base"),
+					EditOffset:   c.Int("offset"),
+				})
+			},
+		},
+		{
+			Name:  "junctions",
+			Usage: "Cluster junction sequences by edit stop",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples"},
+				&cli.IntFlag{Name: "edit-stop", Value: -1, Usage: "Edit stop"},
+				&cli.IntFlag{Name: "max-dist, d", Value: 1, Usage: "Max edit distance for near-identical junction sequences"},
+				&cli.IntFlag{Name: "top, n", Value: 0, Usage: "Max number of variants to output per cluster (0 for all)"},
+				&cli.BoolFlag{Name: "has-alt", Usage: "Has Alternative Editing"},
+				&cli.BoolFlag{Name: "csv", Usage: "Output in csv format"},
+				&cli.BoolFlag{Name: "no-header, x", Usage: "Exclude header from output"},
+			},
+			Action: func(c *cli.Context) {
+				fields := &SearchFields{
+					Gene:     c.String("gene"),
+					Sample:   c.StringSlice("sample"),
+					EditStop: c.Int("edit-stop"),
+					JuncLen:  -1,
+					JuncEnd:  -1,
+					HasAlt:   c.Bool("has-alt"),
+				}
+				fields.unsetRanges()
+				Junctions(c.GlobalString("db"), fields, c.Int("max-dist"), c.Int("top"), c.Bool("csv"), c.Bool("no-header"))
+			},
+		},
+		{
+			Name:  "profile",
+			Usage: "Per edit site editing frequency profile in csv format",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples"},
+				&cli.StringSliceFlag{Name: "knock-down, k", Value: &cli.StringSlice{}, Usage: "One or more knock downs"},
+				&cli.IntFlag{Name: "edit-stop", Value: -1, Usage: "Edit stop"},
+				&cli.BoolFlag{Name: "has-alt", Usage: "Has Alternative Editing"},
+				&cli.BoolFlag{Name: "raw", Usage: "Weight by raw read count instead of normalized count"},
+				&cli.BoolFlag{Name: "no-header, x", Usage: "Exclude header from output"},
+			},
+			Action: func(c *cli.Context) {
+				fields := &SearchFields{
+					Gene:      c.String("gene"),
+					Sample:    c.StringSlice("sample"),
+					KnockDown: c.StringSlice("knock-down"),
+					EditStop:  c.Int("edit-stop"),
+					JuncLen:   -1,
+					JuncEnd:   -1,
+					HasAlt:    c.Bool("has-alt"),
+				}
+				fields.unsetRanges()
+				Profile(c.GlobalString("db"), fields, c.Bool("raw"), c.Bool("no-header"))
 			},
 		}}
 
@@ -20,10 +20,56 @@ package main
 import (
 	"context"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
+// AuthContext authenticates the request and sets the user context. Requests
+// without a valid user are redirected to the login page, or rejected for api
+// requests.
+func AuthContext(app *Application, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Admin requests may authenticate with the admin token instead
+		if strings.HasPrefix(r.URL.Path, "/admin/") && app.hasAdminToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := app.authenticate(r)
+		if user == nil {
+			if strings.HasPrefix(r.URL.Path, API_PREFIX) {
+				apiErrorf(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+
+			if !app.loginEnabled() {
+				// Proxy auth, nothing to log into
+				w.WriteHeader(http.StatusUnauthorized)
+				renderTemplate(app, "error.html", w, nil)
+				return
+			}
+
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), 302)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user", user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // DbContext sets the database context for the request
 func DbContext(app *Application, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -40,16 +86,39 @@ func DbContext(app *Application, next http.Handler) http.Handler {
 
 		// If neither cookie or url is set the use default
 		if len(dbname) == 0 {
-			dbname = app.defaultDb
+			dbname = app.defaultDbFor(r)
 		}
 
-		db, err := app.GetDb(dbname)
-		if err != nil {
+		if !app.CanAccess(r, dbname) {
 			logrus.WithFields(logrus.Fields{
 				"dbname": dbname,
-			}).Warn("Invalid database name. Using default")
-			dbname = app.defaultDb
-			db, _ = app.GetDb(app.defaultDb)
+			}).Warn("Invalid database name or access denied. Using default")
+			dbname = app.defaultDbFor(r)
+		}
+
+		// API handlers acquire the database named in the request path
+		api := strings.HasPrefix(r.URL.Path, API_PREFIX)
+
+		var db *Database
+		var err error
+		if api {
+			db, err = app.GetDb(dbname)
+		} else {
+			db, err = app.AcquireDb(dbname)
+		}
+		if err != nil {
+			if r.URL.Path == "/login" || r.URL.Path == "/logout" || strings.HasPrefix(r.URL.Path, "/static/") || strings.HasPrefix(r.URL.Path, API_PREFIX) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// User has access to no databases
+			errorHandler(app, w, http.StatusForbidden)
+			return
+		}
+
+		if !api {
+			defer db.release()
 		}
 
 		session.Values[TREAT_COOKIE_DB] = dbname
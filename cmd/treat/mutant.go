@@ -18,9 +18,13 @@
 package main
 
 import (
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/aebruno/gofasta"
@@ -63,7 +67,7 @@ func Mutant(options *AlignOptions, fragments []string, n int) {
 		logrus.Fatal("Please provide the edit base")
 	}
 
-	tmpl, err := treat.NewTemplateFromFasta(options.TemplatePath, treat.FORWARD, rune(options.EditBase[0]))
+	tmpl, _, err := loadTemplate(options.TemplatePath, options.EditBase, options.EditOffset)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -78,7 +82,7 @@ func Mutant(options *AlignOptions, fragments []string, n int) {
 		defer f.Close()
 
 		for rec := range gofasta.SimpleParser(f) {
-			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
+			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, tmpl.EditBase)
 			aln1, aln2, _ := nwalgo.Align(tmpl.Bases, frag.Bases, 1, -1, -1)
 			if strings.Index(aln1, "-") != -1 {
 				tm[aln1]++
@@ -109,3 +113,153 @@ func Mutant(options *AlignOptions, fragments []string, n int) {
 		}
 	}
 }
+
+// MutationCatalog writes a catalog of SNPs and indels along with their read
+// count weighted frequency per sample. Fragments are read from FASTA files,
+// one sample per file, or from the fragments stored in the database when no
+// files are given.
+func MutationCatalog(dbpath string, options *AlignOptions, fields *SearchFields, fragments []string, format string, noHeader bool) {
+	if format != "csv" && format != "vcf" {
+		logrus.Fatal("Invalid format. Must be csv or vcf")
+	}
+
+	var catalog *treat.MutationCatalog
+	var err error
+
+	if len(fragments) > 0 {
+		catalog, err = fastaCatalog(options, fields.Gene, fragments)
+	} else {
+		catalog, err = dbCatalog(dbpath, fields)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if format == "vcf" {
+		if err := catalog.WriteVCF(os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	csvout := csv.NewWriter(os.Stdout)
+	defer csvout.Flush()
+
+	writeCatalog(csvout, catalog, !noHeader)
+}
+
+func fastaCatalog(options *AlignOptions, gene string, fragments []string) (*treat.MutationCatalog, error) {
+	if len(options.TemplatePath) == 0 {
+		return nil, errors.New("Please provide path to templates file")
+	}
+	if len(options.EditBase) != 1 {
+		return nil, errors.New("Please provide the edit base")
+	}
+
+	tmpl, spec, err := loadTemplate(options.TemplatePath, options.EditBase, options.EditOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(gene) == 0 {
+		gene = spec.Gene
+	}
+	if len(gene) == 0 {
+		gene = strings.TrimSuffix(filepath.Base(options.TemplatePath), filepath.Ext(options.TemplatePath))
+	}
+
+	catalog := treat.NewMutationCatalog(gene, tmpl)
+	for _, path := range fragments {
+		sample := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for rec := range gofasta.SimpleParser(f) {
+			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, tmpl.EditBase)
+			catalog.Add(sample, frag, float64(frag.ReadCount))
+		}
+		f.Close()
+	}
+
+	return catalog, nil
+}
+
+func dbCatalog(dbpath string, fields *SearchFields) (*treat.MutationCatalog, error) {
+	if len(fields.Gene) == 0 {
+		return nil, errors.New("Gene name is required")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	tmpl, err := s.GetTemplate(fields.Gene)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := treat.NewMutationCatalog(fields.Gene, tmpl)
+	missing := 0
+
+	add := func(key *treat.AlignmentKey, a *treat.Alignment) {
+		frag, err := s.GetFragment(key, a.Id)
+		if err != nil || frag == nil {
+			missing++
+			return
+		}
+
+		catalog.Add(key.Sample, frag, float64(a.ReadCount))
+	}
+
+	// Searches exclude alignments with mutations and alternative editing by
+	// default. Include both so the catalog covers every read as it does for
+	// fragments read from FASTA files.
+	fields.All = true
+	fields.HasAlt = false
+	if err = s.Search(fields, add); err != nil {
+		return nil, err
+	}
+
+	fields.HasAlt = true
+	if err = s.Search(fields, add); err != nil {
+		return nil, err
+	}
+
+	if missing > 0 {
+		logrus.Warnf("Fragments not found for %d alignments. Was data loaded with --skip-fragments?", missing)
+	}
+
+	return catalog, nil
+}
+
+func writeCatalog(csvout *csv.Writer, catalog *treat.MutationCatalog, header bool) {
+	if header {
+		csvout.Write([]string{"gene", "type", "edit_site", "pos", "ref", "alt", "sample", "read_count", "sample_total", "freq"})
+	}
+
+	samples := catalog.Samples()
+	for _, e := range catalog.Entries() {
+		for _, s := range samples {
+			if e.Counts[s] == 0 {
+				continue
+			}
+
+			csvout.Write([]string{
+				catalog.Gene,
+				e.Type,
+				strconv.Itoa(e.EditSite),
+				strconv.Itoa(e.Pos),
+				e.Ref,
+				e.Alt,
+				s,
+				fmt.Sprintf("%.0f", e.Counts[s]),
+				fmt.Sprintf("%.0f", catalog.Total(s)),
+				fmt.Sprintf("%.6f", RoundPlus(catalog.Frequency(e, s), 6))})
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ubccr/treat"
+)
+
+func catalogTypes(catalog *treat.MutationCatalog) map[string]int {
+	types := make(map[string]int)
+	for _, e := range catalog.Entries() {
+		types[e.Type]++
+	}
+	return types
+}
+
+func TestDbCatalogIndels(t *testing.T) {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	fields := &SearchFields{Gene: "RPS12", EditStop: -1, JuncLen: -1, JuncEnd: -1}
+	fields.unsetRanges()
+	catalog, err := dbCatalog(dbpath, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := &AlignOptions{
+		TemplatePath: filepath.Join("..", "..", "examples", "templates.fa"),
+		EditBase:     "T",
+	}
+	fasta, err := fastaCatalog(options, "RPS12", []string{filepath.Join("..", "..", "examples", "clones.fa")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := catalogTypes(catalog)
+	if db[treat.MUTATION_INS]+db[treat.MUTATION_DEL] == 0 {
+		t.Errorf("No indels found in database catalog: %v", db)
+	}
+
+	want := catalogTypes(fasta)
+	for _, typ := range []string{treat.MUTATION_SNP, treat.MUTATION_INS, treat.MUTATION_DEL} {
+		if db[typ] != want[typ] {
+			t.Errorf("Wrong number of %s in database catalog. %d != %d", typ, db[typ], want[typ])
+		}
+	}
+}
@@ -28,46 +28,60 @@ func Normalize(dbpath, gene string, norm float64) {
 		logrus.Fatal(err)
 	}
 
-	genes, err := s.Genes()
+	err = normalizeStorage(s, gene, norm, logrus.StandardLogger())
 	if err != nil {
 		logrus.Fatal(err)
 	}
+}
+
+// normalizeStorage normalizes the read counts of all samples of gene, or of
+// all genes if gene is empty. A norm of 0 normalizes to the average read count
+// across all samples.
+func normalizeStorage(s *Storage, gene string, norm float64, log logrus.FieldLogger) error {
+	genes, err := s.Genes()
+	if err != nil {
+		return err
+	}
 
 	for _, g := range genes {
 		if len(gene) > 0 && g != gene {
 			continue
 		}
-		logrus.Printf("Processing gene %s...", g)
+		log.Printf("Processing gene %s...", g)
 
 		samples, err := s.SampleKeys(g)
 		if err != nil {
-			logrus.Fatal(err)
+			return err
 		}
 
 		gnorm := norm
 
 		// Default norm to average read count
 		if gnorm == 0 {
-			logrus.Info("Using default option of normalizing to average read count across all samples")
+			log.Info("Using default option of normalizing to average read count across all samples")
 
 			total := 0
-			err := s.Search(&SearchFields{Gene: g, HasMutation: false, EditStop: -1, JuncLen: -1, JuncEnd: -1}, func(key *treat.AlignmentKey, a *treat.Alignment) {
+			fields := &SearchFields{Gene: g, HasMutation: false, EditStop: -1, JuncLen: -1, JuncEnd: -1}
+			fields.unsetRanges()
+			err := s.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
 				total += int(a.ReadCount)
 			})
 			if err != nil {
-				logrus.Fatal(err)
+				return err
 			}
 
 			gnorm = float64(total) / float64(len(samples))
-			logrus.Printf("Total standard reads across all samples: %d", total)
+			log.Printf("Total standard reads across all samples: %d", total)
 		}
 
-		logrus.Printf("Normalizing to read count: %.4f", gnorm)
+		log.Printf("Normalizing to read count: %.4f", gnorm)
 		for _, skey := range samples {
 			err = s.NormalizeSample(skey, gnorm)
 			if err != nil {
-				logrus.Fatal(err)
+				return err
 			}
 		}
 	}
+
+	return nil
 }
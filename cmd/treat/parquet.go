@@ -0,0 +1,368 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Minimal Apache Parquet writer for flat tables of required columns. Each
+// batch is written as a row group with a single PLAIN encoded data page per
+// column. See https://github.com/apache/parquet-format
+
+const (
+	PARQUET_MAGIC = "PAR1"
+
+	// Physical types
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	// Converted types
+	parquetUTF8 = 0
+
+	// Repetition types
+	parquetRequired = 0
+
+	// Encodings
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	// Compression codecs
+	parquetUncompressed = 0
+	parquetGzip         = 2
+
+	// Page types
+	parquetDataPage = 0
+)
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftEncoder writes thrift structs using the compact protocol
+type thriftEncoder struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (e *thriftEncoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf.Write(b[:n])
+}
+
+func (e *thriftEncoder) zigzag(v int64) {
+	e.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (e *thriftEncoder) field(id int16, typ byte) {
+	delta := id - e.last
+	if delta > 0 && delta <= 15 {
+		e.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		e.buf.WriteByte(typ)
+		e.zigzag(int64(id))
+	}
+	e.last = id
+}
+
+func (e *thriftEncoder) I32(id int16, v int32) {
+	e.field(id, thriftI32)
+	e.zigzag(int64(v))
+}
+
+func (e *thriftEncoder) I64(id int16, v int64) {
+	e.field(id, thriftI64)
+	e.zigzag(v)
+}
+
+func (e *thriftEncoder) String(id int16, s string) {
+	e.field(id, thriftBinary)
+	e.varint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// List starts a list field of n elements of type typ. Elements are written
+// with the List* methods or, for structs, between Begin and End.
+func (e *thriftEncoder) List(id int16, typ byte, n int) {
+	e.field(id, thriftList)
+	if n < 15 {
+		e.buf.WriteByte(byte(n)<<4 | typ)
+	} else {
+		e.buf.WriteByte(0xf0 | typ)
+		e.varint(uint64(n))
+	}
+}
+
+func (e *thriftEncoder) ListI32(v int32) {
+	e.zigzag(int64(v))
+}
+
+func (e *thriftEncoder) ListString(s string) {
+	e.varint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// Struct starts a struct field
+func (e *thriftEncoder) Struct(id int16) {
+	e.field(id, thriftStruct)
+	e.Begin()
+}
+
+// Begin starts a struct which is the top level struct or a list element
+func (e *thriftEncoder) Begin() {
+	e.stack = append(e.stack, e.last)
+	e.last = 0
+}
+
+// End ends the current struct
+func (e *thriftEncoder) End() {
+	e.buf.WriteByte(0)
+	e.last = e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+}
+
+type parquetColumnChunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+type parquetRowGroup struct {
+	columns []*parquetColumnChunk
+	rows    int64
+	size    int64
+}
+
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	fields    []*tableField
+	codec     int32
+	rowGroups []*parquetRowGroup
+	rows      int64
+	page      bytes.Buffer
+	zbuf      bytes.Buffer
+}
+
+func newParquetWriter(w io.Writer, fields []*tableField, compress bool) (*parquetWriter, error) {
+	p := &parquetWriter{w: w, fields: fields, codec: parquetUncompressed}
+	if compress {
+		p.codec = parquetGzip
+	}
+
+	return p, p.write([]byte(PARQUET_MAGIC))
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+func parquetType(t columnType) int32 {
+	switch t {
+	case COLUMN_BOOL:
+		return parquetBoolean
+	case COLUMN_INT32:
+		return parquetInt32
+	case COLUMN_INT64:
+		return parquetInt64
+	case COLUMN_DOUBLE:
+		return parquetDouble
+	}
+
+	return parquetByteArray
+}
+
+// encodePlain writes the column values with the PLAIN encoding
+func encodePlain(buf *bytes.Buffer, c *tableColumn) {
+	var b [8]byte
+	switch c.field.Type {
+	case COLUMN_BOOL:
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		buf.Write(packed)
+	case COLUMN_INT32:
+		for _, v := range c.int32s {
+			binary.LittleEndian.PutUint32(b[:4], uint32(v))
+			buf.Write(b[:4])
+		}
+	case COLUMN_INT64:
+		for _, v := range c.int64s {
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			buf.Write(b[:])
+		}
+	case COLUMN_DOUBLE:
+		for _, v := range c.doubles {
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			buf.Write(b[:])
+		}
+	case COLUMN_STRING:
+		for _, v := range c.strings {
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+			buf.Write(b[:4])
+			buf.WriteString(v)
+		}
+	}
+}
+
+// WriteBatch writes the batch as a row group
+func (p *parquetWriter) WriteBatch(b *columnBatch) error {
+	if b.rows == 0 {
+		return nil
+	}
+
+	rg := &parquetRowGroup{rows: int64(b.rows)}
+	for _, c := range b.columns {
+		p.page.Reset()
+		encodePlain(&p.page, c)
+		data := p.page.Bytes()
+		uncompressed := len(data)
+
+		if p.codec == parquetGzip {
+			p.zbuf.Reset()
+			zw := gzip.NewWriter(&p.zbuf)
+			zw.Write(data)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			data = p.zbuf.Bytes()
+		}
+
+		hdr := &thriftEncoder{}
+		hdr.Begin()
+		hdr.I32(1, parquetDataPage)
+		hdr.I32(2, int32(uncompressed))
+		hdr.I32(3, int32(len(data)))
+		hdr.Struct(5)
+		hdr.I32(1, int32(b.rows))
+		hdr.I32(2, parquetPlain)
+		hdr.I32(3, parquetRLE)
+		hdr.I32(4, parquetRLE)
+		hdr.End()
+		hdr.End()
+
+		chunk := &parquetColumnChunk{
+			offset:       p.offset,
+			values:       int64(b.rows),
+			uncompressed: int64(hdr.buf.Len() + uncompressed),
+			compressed:   int64(hdr.buf.Len() + len(data)),
+		}
+
+		if err := p.write(hdr.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(data); err != nil {
+			return err
+		}
+
+		rg.columns = append(rg.columns, chunk)
+		rg.size += chunk.uncompressed
+	}
+
+	p.rowGroups = append(p.rowGroups, rg)
+	p.rows += rg.rows
+
+	return nil
+}
+
+// Close writes the file footer
+func (p *parquetWriter) Close() error {
+	meta := &thriftEncoder{}
+	meta.Begin()
+	meta.I32(1, 1)
+
+	meta.List(2, thriftStruct, len(p.fields)+1)
+	meta.Begin()
+	meta.String(4, "schema")
+	meta.I32(5, int32(len(p.fields)))
+	meta.End()
+	for _, f := range p.fields {
+		meta.Begin()
+		meta.I32(1, parquetType(f.Type))
+		meta.I32(3, parquetRequired)
+		meta.String(4, f.Name)
+		if f.Type == COLUMN_STRING {
+			meta.I32(6, parquetUTF8)
+		}
+		meta.End()
+	}
+
+	meta.I64(3, p.rows)
+
+	meta.List(4, thriftStruct, len(p.rowGroups))
+	for _, rg := range p.rowGroups {
+		meta.Begin()
+		meta.List(1, thriftStruct, len(rg.columns))
+		for i, c := range rg.columns {
+			meta.Begin()
+			meta.I64(2, c.offset)
+			meta.Struct(3)
+			meta.I32(1, parquetType(p.fields[i].Type))
+			meta.List(2, thriftI32, 2)
+			meta.ListI32(parquetPlain)
+			meta.ListI32(parquetRLE)
+			meta.List(3, thriftBinary, 1)
+			meta.ListString(p.fields[i].Name)
+			meta.I32(4, p.codec)
+			meta.I64(5, c.values)
+			meta.I64(6, c.uncompressed)
+			meta.I64(7, c.compressed)
+			meta.I64(9, c.offset)
+			meta.End()
+			meta.End()
+		}
+		meta.I64(2, rg.size)
+		meta.I64(3, rg.rows)
+		meta.End()
+	}
+
+	meta.String(6, "treat version "+TreatVersion)
+	meta.End()
+
+	if err := p.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(meta.buf.Len()))
+	if err := p.write(size[:]); err != nil {
+		return err
+	}
+
+	return p.write([]byte(PARQUET_MAGIC))
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+func Profile(dbpath string, fields *SearchFields, raw, noHeader bool) {
+	if len(fields.Gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	tmpl, err := s.GetTemplate(fields.Gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	profile, err := editProfile(s, tmpl, fields, raw)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	csvout := csv.NewWriter(os.Stdout)
+	defer csvout.Flush()
+
+	writeProfile(csvout, fields.Gene, profile.Rows(), !noHeader)
+}
+
+// editProfile computes the per edit site profile of all alignments matching
+// fields. Reads are weighted by normalized count unless raw is set in which
+// case the raw read count is used.
+func editProfile(s *Storage, tmpl *treat.Template, fields *SearchFields, raw bool) (*treat.EditProfile, error) {
+	profile := treat.NewEditProfile(tmpl)
+	missing := 0
+	skipped := 0
+
+	err := s.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		frag, err := s.GetFragment(key, a.Id)
+		if err != nil || frag == nil {
+			missing++
+			return
+		}
+
+		weight := a.Norm
+		if raw {
+			weight = float64(a.ReadCount)
+		}
+
+		if err := profile.Add(key.Sample, frag, weight); err != nil {
+			skipped++
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if missing > 0 {
+		logrus.Warnf("Fragments not found for %d alignments. Was data loaded with --skip-fragments?", missing)
+	}
+	if skipped > 0 {
+		logrus.Infof("Skipped %d fragments containing indels", skipped)
+	}
+
+	return profile, nil
+}
+
+func writeProfile(csvout *csv.Writer, gene string, rows []*treat.ProfileRow, header bool) {
+	if header {
+		csvout.Write([]string{"gene", "sample", "edit_site", "category", "norm", "frac"})
+	}
+
+	for _, r := range rows {
+		csvout.Write([]string{
+			gene,
+			r.Sample,
+			strconv.Itoa(r.EditSite),
+			r.Category,
+			fmt.Sprintf("%.4f", RoundPlus(r.Norm, 4)),
+			fmt.Sprintf("%.6f", RoundPlus(r.Frac, 6))})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+type RealignOptions struct {
+	Gene        string
+	Samples     []string
+	Version     uint64
+	ExcludeSnps bool
+}
+
+// Realign recomputes the alignments of samples from their stored fragments
+// against the current template of the gene. Defaults to all samples of the
+// gene. An older template version is first added again as the new current
+// version.
+func Realign(dbpath string, options *RealignOptions) {
+	if len(options.Gene) == 0 {
+		logrus.Fatal("Please provide a gene name")
+	}
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer s.Close()
+
+	err = s.Initialize()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	versions, err := s.TemplateVersions(options.Gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	current := versions[len(versions)-1]
+	if options.Version == 0 {
+		options.Version = current
+	}
+
+	tmpl, err := s.GetTemplateVersion(options.Gene, options.Version)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if options.Version != current {
+		current, err = s.PutTemplate(options.Gene, tmpl)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Printf("Added template version %d of gene %s again as current version %d", options.Version, options.Gene, current)
+		options.Version = current
+	}
+
+	keys, err := s.SampleKeys(options.Gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	fields := &SearchFields{Sample: options.Samples}
+	n := 0
+	for _, k := range keys {
+		if len(options.Samples) > 0 && !fields.HasSample(k.Sample) {
+			continue
+		}
+
+		count, err := s.RealignSample(k, tmpl, options.Version, options.ExcludeSnps)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		logrus.Printf("Realigned %d fragments for sample %s against template version %d", count, k.Sample, options.Version)
+		n++
+	}
+
+	if n == 0 {
+		logrus.Fatal("No samples found to realign")
+	}
+
+	stale := 0
+	for _, k := range keys {
+		version, err := s.SampleTemplateVersion(k)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if version != current {
+			logrus.Warnf("Sample %s is aligned against template version %d, not the current version %d", k.Sample, version, current)
+			stale++
+		}
+	}
+	if stale > 0 {
+		logrus.Warnf("%d samples of gene %s are not aligned against the current template. Use treat realign to update them", stale, options.Gene)
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dbSnapshot is an immutable set of open databases. Reloading swaps in a new
+// snapshot, requests already running keep using the databases they started
+// with.
+type dbSnapshot struct {
+	dbs       map[string]*Database
+	defaultDb string
+}
+
+// dbSpec is a database file found on disk
+type dbSpec struct {
+	name    string
+	title   string
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func (spec *dbSpec) String() string {
+	return fmt.Sprintf("%s|%s|%d|%d", spec.name, spec.path, spec.modTime.UnixNano(), spec.size)
+}
+
+// scanDatabases returns all database files of the configured paths in order
+func scanDatabases(configs []*DatabaseConfig) ([]*dbSpec, error) {
+	specs := make([]*dbSpec, 0)
+	for _, dbcfg := range configs {
+		fi, err := os.Stat(dbcfg.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		paths := []string{dbcfg.Path}
+		if fi.IsDir() {
+			dbabs, _ := filepath.Abs(dbcfg.Path)
+			paths, err = filepath.Glob(filepath.Join(dbabs, "*.db"))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, d := range paths {
+			abs, _ := filepath.Abs(d)
+			dfi, err := os.Stat(abs)
+			if err != nil {
+				return nil, err
+			}
+
+			spec := &dbSpec{
+				name:    filepath.Base(abs),
+				path:    abs,
+				modTime: dfi.ModTime(),
+				size:    dfi.Size(),
+			}
+			if !fi.IsDir() {
+				spec.title = dbcfg.Name
+			}
+
+			specs = append(specs, spec)
+		}
+	}
+
+	return specs, nil
+}
+
+func (a *Application) snapshot() *dbSnapshot {
+	a.snapMu.RLock()
+	defer a.snapMu.RUnlock()
+	return a.snap
+}
+
+// Dbs returns all open databases
+func (a *Application) Dbs() map[string]*Database {
+	return a.snapshot().dbs
+}
+
+// DefaultDb returns the name of the default database
+func (a *Application) DefaultDb() string {
+	return a.snapshot().defaultDb
+}
+
+// Reload rescans the configured database paths. New databases are opened,
+// removed databases are closed and databases whose file changed are
+// reopened with fresh caches. Unchanged databases are kept as is.
+func (a *Application) Reload() error {
+	return a.reload(false)
+}
+
+// reload the databases. If strict is set any failure is returned as an error,
+// otherwise broken databases are logged and skipped.
+func (a *Application) reload(strict bool) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	specs, err := scanDatabases(a.dbConfigs)
+	if err != nil {
+		return err
+	}
+
+	old := a.snapshot()
+	snap := &dbSnapshot{dbs: make(map[string]*Database)}
+	retired := make([]*Database, 0)
+	opened := make([]*Database, 0)
+
+	fail := func(err error) error {
+		if strict {
+			for _, db := range opened {
+				db.close()
+			}
+			return err
+		}
+		logrus.Error(err)
+		return nil
+	}
+
+	for _, spec := range specs {
+		if _, ok := snap.dbs[spec.name]; ok {
+			if err := fail(fmt.Errorf("Duplicate database name: %s", spec.name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		cur, exists := old.dbs[spec.name]
+		if exists && cur.path == spec.path && cur.title == spec.title && cur.modTime.Equal(spec.modTime) && cur.size == spec.size {
+			snap.dbs[spec.name] = cur
+		} else {
+			db, err := a.openDb(spec)
+			if err != nil {
+				if err := fail(err); err != nil {
+					return err
+				}
+				// Keep serving the previous version if there is one
+				if exists {
+					snap.dbs[spec.name] = cur
+				}
+				continue
+			}
+
+			opened = append(opened, db)
+			snap.dbs[spec.name] = db
+			if exists {
+				logrus.Infof("Reloaded database: %s", spec.name)
+				retired = append(retired, cur)
+			} else if !strict {
+				logrus.Infof("Added database: %s", spec.name)
+			}
+		}
+
+		if len(snap.defaultDb) == 0 {
+			snap.defaultDb = spec.name
+		}
+	}
+
+	if len(snap.dbs) == 0 {
+		if strict {
+			return fmt.Errorf("No db files found")
+		}
+		logrus.Error("No db files found. Keeping current databases")
+		return nil
+	}
+
+	for name, db := range old.dbs {
+		if _, ok := snap.dbs[name]; !ok {
+			logrus.Infof("Removed database: %s", name)
+			retired = append(retired, db)
+		}
+	}
+
+	a.snapMu.Lock()
+	a.snap = snap
+	a.snapMu.Unlock()
+
+	if snap.defaultDb != old.defaultDb {
+		logrus.Infof("Default DB is: %s", snap.defaultDb)
+	}
+
+	// Close old databases once in-flight requests are done
+	for _, db := range retired {
+		go db.close()
+	}
+
+	return nil
+}
+
+// acquire locks the database for reading for the duration of a request.
+// Returns false if the database was closed by a reload.
+func (db *Database) acquire() bool {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+func (db *Database) release() {
+	db.mu.RUnlock()
+}
+
+// close waits for all requests using the database to finish and closes it
+func (db *Database) close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return
+	}
+
+	db.closed = true
+	db.cache.Purge()
+	err := db.storage.Close()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"dbname": db.name,
+			"error":  err.Error(),
+		}).Error("Failed to close database")
+	}
+}
+
+// AcquireDb returns the named database locked for reading. The caller must
+// call release when done.
+func (a *Application) AcquireDb(name string) (*Database, error) {
+	for {
+		db, err := a.GetDb(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if db.acquire() {
+			return db, nil
+		}
+
+		// Database was closed by a reload, retry with the new snapshot
+	}
+}
+
+// watchDatabases polls the configured database paths and reloads when a
+// database file is added, removed or modified
+func (a *Application) watchDatabases(interval time.Duration, stop <-chan struct{}) {
+	fingerprint := func() string {
+		specs, err := scanDatabases(a.dbConfigs)
+		if err != nil {
+			logrus.Warnf("Failed to scan databases: %s", err)
+			return ""
+		}
+
+		keys := make([]string, 0, len(specs))
+		for _, s := range specs {
+			keys = append(keys, s.String())
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, "\n")
+	}
+
+	last := fingerprint()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			cur := fingerprint()
+			if len(cur) == 0 || cur == last {
+				continue
+			}
+
+			logrus.Info("Database files changed, reloading")
+			if err := a.Reload(); err != nil {
+				logrus.Errorf("Failed to reload databases: %s", err)
+			}
+			last = cur
+		}
+	}
+}
+
+// adminEnabled returns true if the admin routes are served. Either an admin
+// token, or authentication and at least one admin user, must be configured.
+func (a *Application) adminEnabled() bool {
+	return len(a.adminToken) > 0 || (a.authEnabled() && len(a.admins) > 0)
+}
+
+// hasAdminToken returns true if the request sends the admin token in an
+// Authorization: Bearer header
+func (a *Application) hasAdminToken(r *http.Request) bool {
+	if len(a.adminToken) == 0 {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.adminToken)) == 1
+}
+
+// isAdmin returns true if the request may perform admin tasks. The request
+// must send the admin token or, with authentication enabled, be from a user
+// listed in admins. The remote address is never trusted as requests behind a
+// reverse proxy all come from localhost.
+func (a *Application) isAdmin(r *http.Request) bool {
+	if a.hasAdminToken(r) {
+		return true
+	}
+
+	if !a.authEnabled() {
+		return false
+	}
+
+	user := a.GetUserFromContext(r)
+	if user == nil {
+		return false
+	}
+	for _, name := range a.admins {
+		if name == user.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ReloadHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAdmin(r) {
+			apiErrorf(w, http.StatusForbidden, "admin access required")
+			return
+		}
+
+		err := app.Reload()
+		if err != nil {
+			logrus.Errorf("Failed to reload databases: %s", err)
+			apiErrorf(w, http.StatusInternalServerError, "failed to reload databases: %s", err)
+			return
+		}
+
+		names := make([]string, 0)
+		for name := range app.Dbs() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"databases": names})
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func adminRequest(remote, token string, user *User) *http.Request {
+	r := httptest.NewRequest("POST", "/admin/reload", nil)
+	r.RemoteAddr = remote
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if user != nil {
+		r = r.WithContext(context.WithValue(r.Context(), "user", user))
+	}
+	return r
+}
+
+func TestIsAdmin(t *testing.T) {
+	users := map[string]*User{"alice": {Name: "alice"}, "bob": {Name: "bob"}}
+
+	tests := []struct {
+		name  string
+		app   *Application
+		r     *http.Request
+		admin bool
+	}{
+		{"no auth localhost", &Application{}, adminRequest("127.0.0.1:1234", "", nil), false},
+		{"no auth ipv6 localhost", &Application{}, adminRequest("[::1]:1234", "", nil), false},
+		{"token", &Application{adminToken: "secret"}, adminRequest("10.0.0.1:1234", "secret", nil), true},
+		{"wrong token", &Application{adminToken: "secret"}, adminRequest("127.0.0.1:1234", "guess", nil), false},
+		{"no token set", &Application{}, adminRequest("127.0.0.1:1234", "secret", nil), false},
+		{"admin user", &Application{users: users, admins: []string{"alice"}}, adminRequest("10.0.0.1:1234", "", users["alice"]), true},
+		{"other user", &Application{users: users, admins: []string{"alice"}}, adminRequest("127.0.0.1:1234", "", users["bob"]), false},
+		{"no user", &Application{users: users, admins: []string{"alice"}}, adminRequest("127.0.0.1:1234", "", nil), false},
+		{"admins without auth", &Application{admins: []string{"alice"}}, adminRequest("127.0.0.1:1234", "", &User{Name: "alice"}), false},
+	}
+
+	for _, test := range tests {
+		if admin := test.app.isAdmin(test.r); admin != test.admin {
+			t.Errorf("%s: wrong admin access. %t != %t", test.name, admin, test.admin)
+		}
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	users := map[string]*User{"alice": {Name: "alice"}}
+
+	tests := []struct {
+		name    string
+		app     *Application
+		enabled bool
+	}{
+		{"none", &Application{}, false},
+		{"admins without auth", &Application{admins: []string{"alice"}}, false},
+		{"auth without admins", &Application{users: users}, false},
+		{"admins", &Application{users: users, admins: []string{"alice"}}, true},
+		{"token", &Application{adminToken: "secret"}, true},
+	}
+
+	for _, test := range tests {
+		var match mux.RouteMatch
+		test.app.router().Match(adminRequest("127.0.0.1:1234", "", nil), &match)
+		if enabled := match.Route != nil; enabled != test.enabled {
+			t.Errorf("%s: wrong admin route. %t != %t", test.name, enabled, test.enabled)
+		}
+	}
+}
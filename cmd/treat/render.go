@@ -0,0 +1,885 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aebruno/gofasta"
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+const (
+	RENDER_ALIGNMENT = "alignment"
+	RENDER_EDIT_STOP = "edit-stop"
+	RENDER_JUNC_LEN  = "junc-len"
+	RENDER_JUNC_END  = "junc-end"
+	RENDER_HEAT      = "heat"
+
+	// Default number of edit site columns per line of a rendered alignment
+	RENDER_ALIGNMENT_COLS = 100
+
+	// Height of a row of the gRNA track drawn below charts
+	RENDER_GUIDE_ROW = 14.0
+)
+
+// Same colors as the web interface stylesheet
+var renderColors = map[string]string{
+	"FE":       "#d9edf7",
+	"PE":       "#dff0d8",
+	"alt":      "#fcf8e3",
+	"RD":       "#d0d0d0",
+	"base":     "#f5f5f5",
+	"junction": "#efd6ef",
+	"mutant":   "#eda6a6",
+	"grna":     "#e0e0f8",
+	"anchor":   "#a9a9e0",
+}
+
+// Default Highcharts series colors
+var seriesColors = []string{"#7cb5ec", "#434348", "#90ed7d", "#f7a35c", "#8085e9", "#f15c80", "#e4d354", "#2b908f", "#f45b5b", "#91e8e1"}
+
+// RenderOptions control rendering alignments and charts to SVG or PDF
+type RenderOptions struct {
+	// Chart to render: alignment, edit-stop, junc-len, junc-end or heat
+	Chart string
+
+	// Output format, svg or pdf
+	Format string
+
+	// Output file. Standard output if empty
+	Output string
+
+	// Render the alignment of sequences in FASTA files instead of the database
+	TemplatePath string
+	FragmentPath string
+	EditBase     string
+	EditOffset   int
+
+	// Alignment ids to render for each sample. The top alignments by read
+	// count if empty
+	Ids []int
+	Top int
+
+	// Edit site columns per line of the alignment
+	Columns int
+
+	Title string
+}
+
+func renderFileName(chart, format string) string {
+	return fmt.Sprintf("treat-%s.%s", chart, format)
+}
+
+// renderFormat returns the format of the options or the output file extension
+func renderFormat(opts *RenderOptions) string {
+	if len(opts.Format) > 0 {
+		return opts.Format
+	}
+	if strings.EqualFold(filepath.Ext(opts.Output), ".pdf") {
+		return RENDER_PDF
+	}
+	return RENDER_SVG
+}
+
+type glyph struct {
+	char byte
+	fill string
+}
+
+// renderPileup draws the pileup rows wrapped at cols characters with the
+// edit sites colored by the template they match
+func renderPileup(format string, w io.Writer, p *treat.Pileup, title string, cols int) error {
+	if cols <= 0 {
+		cols = RENDER_ALIGNMENT_COLS
+	}
+
+	tmpl := p.Template
+	siteColor := func(i int) string {
+		if i < 2 {
+			return renderColors[p.Labels[i]]
+		}
+		return renderColors["alt"]
+	}
+
+	labels := []string{""}
+	lines := [][]glyph{}
+
+	ruler := p.Ruler()
+	rl := make([]glyph, len(ruler))
+	for i := range ruler {
+		rl[i] = glyph{char: ruler[i]}
+	}
+	lines = append(lines, rl)
+
+	for i, t := range tmpl.EditSite {
+		line := make([]glyph, 0, p.Width())
+		for ti := range t {
+			fill := siteColor(i)
+			for j := t[ti]; j < p.Widths[ti]; j++ {
+				line = append(line, glyph{'-', fill})
+			}
+			for j := uint32(0); j < t[ti]; j++ {
+				line = append(line, glyph{byte(tmpl.EditBase), fill})
+			}
+			if ti < len(tmpl.Bases) {
+				line = append(line, glyph{tmpl.Bases[ti], renderColors["base"]})
+			}
+		}
+		labels = append(labels, p.Labels[i])
+		lines = append(lines, line)
+	}
+
+	for _, g := range tmpl.Guides {
+		track := p.GuideTrack(g)
+		line := make([]glyph, len(track))
+		for i := range track {
+			switch track[i] {
+			case '#':
+				line[i] = glyph{' ', renderColors["anchor"]}
+			case '~':
+				line[i] = glyph{' ', renderColors["grna"]}
+			default:
+				line[i] = glyph{char: ' '}
+			}
+		}
+		labels = append(labels, g.Name)
+		lines = append(lines, line)
+	}
+
+	for _, row := range p.Rows {
+		line := make([]glyph, 0, p.Width())
+		for ti, c := range row.Cells {
+			fill := ""
+			if c.Match >= 0 {
+				fill = siteColor(c.Match)
+			}
+			if c.Junction {
+				fill = renderColors["junction"]
+			}
+			if c.Mismatch {
+				fill = renderColors["mutant"]
+			}
+			for j := c.Count; j < p.Widths[ti]; j++ {
+				line = append(line, glyph{'-', fill})
+			}
+			for j := uint32(0); j < c.Count; j++ {
+				line = append(line, glyph{byte(tmpl.EditBase), fill})
+			}
+			if c.Base != 0 {
+				fill = renderColors["base"]
+				if ti < len(tmpl.Bases) && c.Base != tmpl.Bases[ti] {
+					fill = renderColors["mutant"]
+				}
+				line = append(line, glyph{c.Base, fill})
+			}
+		}
+		labels = append(labels, row.Label)
+		lines = append(lines, line)
+	}
+
+	const (
+		margin   = 20.0
+		size     = 10.0
+		rowH     = 13.0
+		titleH   = 34.0
+		charW    = size * 0.6
+		baseline = 10.0
+	)
+
+	lw := 0
+	for _, l := range labels {
+		if len(l) > lw {
+			lw = len(l)
+		}
+	}
+	labelW := float64(lw+1) * charW
+
+	width := p.Width()
+	if cols > width {
+		cols = width
+	}
+	blocks := (width + cols - 1) / cols
+
+	cw := margin*2 + labelW + float64(cols)*charW
+	ch := margin*2 + titleH + float64(blocks*(len(lines)+1))*rowH
+
+	c, err := newCanvas(format, w, math.Ceil(cw), math.Ceil(ch))
+	if err != nil {
+		return err
+	}
+
+	c.Text(margin, margin+12, 14, ANCHOR_START, false, "#333333", title)
+	if len(p.Rows) == 1 {
+		a := p.Rows[0].Alignment
+		c.Text(margin, margin+28, 10, ANCHOR_START, false, "#666666",
+			fmt.Sprintf("JSS: %d  ESS: %d  JES: %d  Junc Len: %d", a.JuncStart, a.EditStop, a.JuncEnd, a.JuncLen))
+	}
+
+	y := margin + titleH
+	for start := 0; start < width; start += cols {
+		end := start + cols
+		if end > width {
+			end = width
+		}
+
+		for i, line := range lines {
+			if i > 0 {
+				fill := ""
+				if i <= tmpl.Size() {
+					fill = siteColor(i - 1)
+				} else if i <= tmpl.Size()+len(tmpl.Guides) {
+					fill = renderColors["grna"]
+				} else {
+					fill = renderColors["RD"]
+				}
+				c.Rect(margin, y, labelW-charW/2, rowH, fill)
+			}
+			c.Text(margin+1, y+baseline, size, ANCHOR_START, true, "#333333", labels[i])
+
+			x := margin + labelW
+			var text strings.Builder
+			for j := start; j < end && j < len(line); j++ {
+				if len(line[j].fill) > 0 {
+					c.Rect(x+float64(j-start)*charW, y, charW, rowH, line[j].fill)
+				}
+				text.WriteByte(line[j].char)
+			}
+			color := "#333333"
+			if i == 0 {
+				color = "#999999"
+			}
+			c.Text(x, y+baseline, size, ANCHOR_START, true, color, strings.TrimRight(text.String(), " "))
+			y += rowH
+		}
+		y += rowH
+	}
+
+	return c.Close()
+}
+
+// chartSeries is a named series of values, one per category
+type chartSeries struct {
+	Name string
+	Data []float64
+}
+
+type histogramChart struct {
+	Title  string
+	XLabel string
+	Cats   []int
+	Series []*chartSeries
+	// gRNAs drawn below edit site charts and the template offset of their
+	// bounds
+	Guides []*treat.GuideRegion
+	Offset int
+}
+
+// histogramData sums the normalized counts of the field by sample in the
+// same bins as the histogram charts of the web interface. Alignments
+// matching the template exactly are skipped.
+func histogramData(ctx context.Context, s *Storage, tmpl *treat.Template, fields *SearchFields, chart string) (*histogramChart, error) {
+	h := &histogramChart{}
+	var f func(a *treat.Alignment) int
+	offset := int(tmpl.EditOffset)
+	switch chart {
+	case RENDER_EDIT_STOP:
+		h.Title, h.XLabel = "Edit Stop Site", "Edit stop"
+		f = func(a *treat.Alignment) int { return a.EditStop }
+		h.Guides, h.Offset = tmpl.Guides, offset
+	case RENDER_JUNC_END:
+		h.Title, h.XLabel = "Junction End Site", "Junction end"
+		f = func(a *treat.Alignment) int { return a.JuncEnd }
+		h.Guides, h.Offset = tmpl.Guides, offset
+	case RENDER_JUNC_LEN:
+		h.Title, h.XLabel = "Junction Length", "Junction length"
+		f = func(a *treat.Alignment) int { return a.JuncLen }
+		offset = 0
+	default:
+		return nil, fmt.Errorf("Invalid histogram: %s", chart)
+	}
+
+	samples := make(map[string]map[int]float64)
+	max := 0
+	err := s.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if a.EditStop == int(tmpl.EditStop) && a.JuncLen == 0 {
+			return
+		}
+
+		if _, ok := samples[key.Sample]; !ok {
+			samples[key.Sample] = make(map[int]float64)
+		}
+		samples[key.Sample][f(a)] += a.Norm
+
+		m := a.JuncEnd
+		if chart == RENDER_JUNC_LEN {
+			m = a.JuncLen
+		}
+		if m > max {
+			max = m
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if max < offset {
+		max = offset
+	}
+
+	h.Cats = make([]int, max+1-offset+1)
+	for i := range h.Cats {
+		h.Cats[i] = max - i
+	}
+
+	names := make([]string, 0, len(samples))
+	for k := range samples {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		series := &chartSeries{Name: k, Data: make([]float64, len(h.Cats))}
+		for i, cat := range h.Cats {
+			series.Data[i] = samples[k][cat]
+		}
+		h.Series = append(h.Series, series)
+	}
+
+	return h, nil
+}
+
+// niceMax rounds v up to 1, 2 or 5 times a power of ten
+func niceMax(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	p := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*p {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+func formatTick(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// renderHistogram draws one line per sample over the categories
+func renderHistogram(format string, w io.Writer, h *histogramChart, title string) error {
+	const (
+		width   = 900.0
+		height  = 450.0
+		left    = 70.0
+		right   = 170.0
+		top     = 50.0
+		bottom  = 60.0
+		plotW   = width - left - right
+		plotH   = height - top - bottom
+		ticks   = 5
+		axisClr = "#666666"
+		gridClr = "#e6e6e6"
+	)
+
+	if len(title) == 0 {
+		title = h.Title
+	}
+
+	_, rows := guideLanes(h.Guides)
+	track := 0.0
+	if rows > 0 {
+		track = float64(rows)*RENDER_GUIDE_ROW + 10
+	}
+
+	c, err := newCanvas(format, w, width, height+track)
+	if err != nil {
+		return err
+	}
+
+	ymax := 0.0
+	for _, s := range h.Series {
+		for _, v := range s.Data {
+			if v > ymax {
+				ymax = v
+			}
+		}
+	}
+	ymax = niceMax(ymax)
+
+	c.Text(width/2, 25, 16, ANCHOR_MIDDLE, false, "#333333", title)
+
+	for i := 0; i <= ticks; i++ {
+		v := ymax * float64(i) / ticks
+		y := top + plotH - plotH*float64(i)/ticks
+		c.Line(left, y, left+plotW, y, gridClr, 1)
+		c.Text(left-6, y+4, 10, ANCHOR_END, false, axisClr, formatTick(v))
+	}
+	c.Text(left, top-10, 10, ANCHOR_END, false, axisClr, "Norm Count")
+
+	n := len(h.Cats)
+	step := plotW
+	if n > 1 {
+		step = plotW / float64(n-1)
+	}
+	every := (n + 19) / 20
+	if every < 1 {
+		every = 1
+	}
+
+	c.Line(left, top+plotH, left+plotW, top+plotH, axisClr, 1)
+	for i, cat := range h.Cats {
+		x := left + step*float64(i)
+		if i%every != 0 {
+			continue
+		}
+		c.Line(x, top+plotH, x, top+plotH+5, axisClr, 1)
+		c.Text(x, top+plotH+17, 10, ANCHOR_MIDDLE, false, axisClr, strconv.Itoa(cat))
+	}
+	c.Text(left+plotW/2, height-15, 12, ANCHOR_MIDDLE, false, "#333333", h.XLabel)
+
+	for si, s := range h.Series {
+		color := seriesColors[si%len(seriesColors)]
+		points := make([]point, len(s.Data))
+		for i, v := range s.Data {
+			points[i] = point{X: left + step*float64(i), Y: top + plotH - plotH*v/ymax}
+		}
+		c.Polyline(points, color, 2)
+
+		ly := top + 10 + float64(si)*18
+		c.Rect(left+plotW+20, ly-8, 12, 10, color)
+		c.Text(left+plotW+38, ly+1, 11, ANCHOR_START, false, "#333333", s.Name)
+	}
+
+	if rows > 0 {
+		max := 0
+		if n > 0 {
+			max = h.Cats[0]
+		}
+		drawGuides(c, h.Guides, left-step/2, left+plotW+step/2, height, func(idx int) (float64, float64) {
+			x := left + step*float64(max-(idx+h.Offset))
+			return x - step/2, x + step/2
+		})
+	}
+
+	return c.Close()
+}
+
+// heatMatrix sums normalized counts by edit stop (rows) and junction length
+// (columns). The count of alignments matching the template exactly is
+// excluded. If cells is not nil the alignments of each cell are appended as
+// observations with value row*n+column for bootstrapping.
+func heatMatrix(ctx context.Context, s *Storage, tmpl *treat.Template, fields *SearchFields, cells *[]treat.Observation) ([][]float64, float64, error) {
+	n := tmpl.Len()
+
+	heat := make([][]float64, n)
+	for i := 0; i < n; i++ {
+		heat[i] = make([]float64, n)
+	}
+
+	es := int(tmpl.EditStop) - int(tmpl.EditOffset)
+	err := s.SearchContext(ctx, fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if a.EditStop >= int(tmpl.EditOffset) {
+			i := a.EditStop - int(tmpl.EditOffset)
+			heat[i][a.JuncLen] += a.Norm
+			if cells != nil && (i != es || a.JuncLen != 0) {
+				*cells = append(*cells, treat.Observation{Value: i*n + a.JuncLen, ReadCount: a.ReadCount, Norm: a.Norm})
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if es >= 0 && es < n {
+		heat[es][0] = 0
+	}
+
+	max := float64(0.0)
+	for i := range heat {
+		for _, v := range heat[i] {
+			if v > max {
+				max = v
+			}
+		}
+	}
+
+	return heat, max, nil
+}
+
+// heatColor interpolates between the min and max colors of the web heat map
+func heatColor(v, max float64) string {
+	f := 0.0
+	if max > 0 {
+		f = v / max
+	}
+	lo := [3]float64{0xef, 0xef, 0xff}
+	hi := [3]float64{0x00, 0x33, 0x99}
+	var rgb [3]int
+	for i := range rgb {
+		rgb[i] = int(math.Round(lo[i] + (hi[i]-lo[i])*f))
+	}
+	return fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2])
+}
+
+// renderHeat draws the heat map of edit stop by junction length
+func renderHeat(format string, w io.Writer, tmpl *treat.Template, heat [][]float64, max float64, title string) error {
+	if len(title) == 0 {
+		title = "Edit Stop by Junction Length"
+	}
+
+	// Trim junction lengths with no counts
+	cols := 1
+	for i := range heat {
+		for j, v := range heat[i] {
+			if v > 0 && j+1 > cols {
+				cols = j + 1
+			}
+		}
+	}
+
+	const (
+		left   = 70.0
+		top    = 50.0
+		bottom = 60.0
+		legend = 120.0
+		plotW  = 760.0
+		plotH  = 400.0
+	)
+
+	rows := len(heat)
+	cellW := plotW / float64(rows)
+	cellH := plotH / float64(cols)
+	width := left + plotW + legend
+	height := top + plotH + bottom
+
+	_, lanes := guideLanes(tmpl.Guides)
+	track := 0.0
+	if lanes > 0 {
+		track = float64(lanes)*RENDER_GUIDE_ROW + 10
+	}
+
+	c, err := newCanvas(format, w, width, height+track)
+	if err != nil {
+		return err
+	}
+
+	c.Text(width/2, 25, 16, ANCHOR_MIDDLE, false, "#333333", title)
+
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			c.Rect(left+cellW*float64(i), top+plotH-cellH*float64(j+1), cellW+0.2, cellH+0.2, heatColor(heat[i][j], max))
+		}
+	}
+
+	every := (rows + 19) / 20
+	for i := 0; i < rows; i += every {
+		x := left + cellW*(float64(i)+0.5)
+		c.Text(x, top+plotH+15, 10, ANCHOR_MIDDLE, false, "#666666", strconv.Itoa(i+int(tmpl.EditOffset)))
+	}
+	c.Text(left+plotW/2, height-15, 12, ANCHOR_MIDDLE, false, "#333333", "Edit stop")
+
+	every = (cols + 19) / 20
+	for j := 0; j < cols; j += every {
+		y := top + plotH - cellH*(float64(j)+0.5)
+		c.Text(left-6, y+4, 10, ANCHOR_END, false, "#666666", strconv.Itoa(j))
+	}
+	c.Text(left, top-10, 10, ANCHOR_END, false, "#666666", "Junction length")
+
+	// Color scale
+	lx := left + plotW + 30
+	steps := 50
+	for k := 0; k < steps; k++ {
+		y := top + plotH - plotH*float64(k+1)/float64(steps)
+		c.Rect(lx, y, 16, plotH/float64(steps)+0.2, heatColor(max*float64(k)/float64(steps-1), max))
+	}
+	c.Text(lx+22, top+plotH, 10, ANCHOR_START, false, "#666666", "0")
+	c.Text(lx+22, top+8, 10, ANCHOR_START, false, "#666666", fmt.Sprintf("%.2f", max))
+
+	if lanes > 0 {
+		drawGuides(c, tmpl.Guides, left, left+plotW, height, func(idx int) (float64, float64) {
+			return left + cellW*float64(idx), left + cellW*float64(idx+1)
+		})
+	}
+
+	return c.Close()
+}
+
+// guideLanes assigns overlapping gRNAs to separate rows of the gRNA track.
+// Returns the row of each gRNA and the number of rows.
+func guideLanes(guides []*treat.GuideRegion) ([]int, int) {
+	order := make([]int, len(guides))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return guides[order[a]].Start < guides[order[b]].Start
+	})
+
+	lanes := make([]int, len(guides))
+	ends := make([]int, 0)
+	for _, i := range order {
+		g := guides[i]
+		lane := 0
+		for lane < len(ends) && ends[lane] >= g.Start {
+			lane++
+		}
+		if lane == len(ends) {
+			ends = append(ends, 0)
+		}
+		ends[lane] = g.End
+		lanes[i] = lane
+	}
+
+	return lanes, len(ends)
+}
+
+// drawGuides draws the gRNA track at y with the anchor of each gRNA shaded
+// darker. span returns the horizontal extent of an edit site index, blocks
+// are clipped to xmin-xmax.
+func drawGuides(c canvas, guides []*treat.GuideRegion, xmin, xmax, y float64, span func(idx int) (float64, float64)) {
+	block := func(start, end int) (float64, float64) {
+		l1, r1 := span(start)
+		l2, r2 := span(end)
+		return math.Max(math.Min(l1, l2), xmin), math.Min(math.Max(r1, r2), xmax)
+	}
+
+	c.Text(xmin-6, y+9, 10, ANCHOR_END, false, "#666666", "gRNA")
+
+	lanes, _ := guideLanes(guides)
+	for i, g := range guides {
+		gy := y + float64(lanes[i])*RENDER_GUIDE_ROW
+		x1, x2 := block(g.Start, g.End)
+		if x2 <= x1 {
+			continue
+		}
+		c.Rect(x1, gy, x2-x1, RENDER_GUIDE_ROW-2, renderColors["grna"])
+		if g.Anchor != nil {
+			if a1, a2 := block(g.Anchor.Start, g.Anchor.End); a2 > a1 {
+				c.Rect(a1, gy, a2-a1, RENDER_GUIDE_ROW-2, renderColors["anchor"])
+			}
+		}
+		c.Text((x1+x2)/2, gy+9, 9, ANCHOR_MIDDLE, false, "#333333", g.Name)
+	}
+}
+
+// alignmentPileup builds a pileup of the given alignment ids, or the top
+// alignments by read count, of each sample matching fields
+func alignmentPileup(ctx context.Context, s *Storage, tmpl *treat.Template, fields *SearchFields, samples []string, ids []int, top int) (*treat.Pileup, error) {
+	p := treat.NewPileup(tmpl)
+
+	for _, sample := range samples {
+		key, err := s.GetKey(fields.Gene, sample)
+		if err != nil {
+			return nil, err
+		}
+
+		var alignments []*treat.Alignment
+		if len(ids) > 0 {
+			for _, id := range ids {
+				a, err := s.GetAlignment(key, uint64(id))
+				if err != nil || a == nil {
+					return nil, fmt.Errorf("Alignment %d not found for sample %s", id, sample)
+				}
+				a.Key = key
+				a.Id = uint64(id)
+				alignments = append(alignments, a)
+			}
+		} else {
+			sfields := *fields
+			sfields.Sample = []string{sample}
+			sfields.Limit = 0
+			sfields.Offset = 0
+			res, err := topAlignments(ctx, s, &sfields, top)
+			if err != nil {
+				return nil, err
+			}
+			alignments = res[sample]
+		}
+
+		for _, a := range alignments {
+			frag, err := s.GetFragment(a.Key, a.Id)
+			if err != nil || frag == nil {
+				return nil, fmt.Errorf("Fragment %d not found for sample %s", a.Id, sample)
+			}
+			label := strconv.FormatUint(a.Id, 10)
+			if len(samples) > 1 {
+				label = sample + ":" + label
+			}
+			p.Add(label, frag, a)
+		}
+	}
+
+	return p, nil
+}
+
+// fastaPileup aligns all sequences in the fragment FASTA file to the templates
+func fastaPileup(opts *RenderOptions) (*treat.Pileup, error) {
+	tmpl, _, err := loadTemplate(opts.TemplatePath, opts.EditBase, opts.EditOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(opts.FragmentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := treat.NewPileup(tmpl)
+	for rec := range gofasta.SimpleParser(f) {
+		frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, tmpl.EditBase)
+		p.Add(fmt.Sprintf("R%d", len(p.Rows)+1), frag, treat.NewAlignment(frag, tmpl, false))
+	}
+
+	return p, nil
+}
+
+// renderChart renders a chart of the alignments matching fields
+func renderChart(ctx context.Context, s *Storage, tmpl *treat.Template, fields *SearchFields, opts *RenderOptions, w io.Writer) error {
+	format := renderFormat(opts)
+
+	switch opts.Chart {
+	case RENDER_ALIGNMENT, "":
+		samples := fields.Sample
+		if len(samples) == 0 {
+			return fmt.Errorf("Please provide one or more samples")
+		}
+		if len(opts.Ids) > 0 && len(samples) > 1 {
+			return fmt.Errorf("Please provide a single sample when rendering alignment ids")
+		}
+		top := opts.Top
+		if top <= 0 {
+			top = 10
+		}
+		p, err := alignmentPileup(ctx, s, tmpl, fields, samples, opts.Ids, top)
+		if err != nil {
+			return err
+		}
+		if len(p.Rows) == 0 {
+			return fmt.Errorf("No alignments found")
+		}
+		title := opts.Title
+		if len(title) == 0 {
+			title = fields.Gene + " " + strings.Join(samples, ", ")
+			if len(p.Rows) == 1 {
+				title += " " + p.Rows[0].Fragment.Name
+			}
+		}
+		return renderPileup(format, w, p, title, opts.Columns)
+	case RENDER_EDIT_STOP, RENDER_JUNC_LEN, RENDER_JUNC_END:
+		h, err := histogramData(ctx, s, tmpl, fields, opts.Chart)
+		if err != nil {
+			return err
+		}
+		return renderHistogram(format, w, h, opts.Title)
+	case RENDER_HEAT:
+		heat, max, err := heatMatrix(ctx, s, tmpl, fields, nil)
+		if err != nil {
+			return err
+		}
+		return renderHeat(format, w, tmpl, heat, max, opts.Title)
+	}
+
+	return fmt.Errorf("Invalid chart: %s", opts.Chart)
+}
+
+// Render writes an alignment or chart in SVG or PDF format
+func Render(dbpath string, fields *SearchFields, opts *RenderOptions) {
+	format := renderFormat(opts)
+	if format != RENDER_SVG && format != RENDER_PDF {
+		logrus.Fatalf("Invalid render format: %s", format)
+	}
+
+	out := io.Writer(os.Stdout)
+	if len(opts.Output) > 0 {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	buf := bufio.NewWriter(out)
+
+	if len(opts.TemplatePath) > 0 || len(opts.FragmentPath) > 0 {
+		if opts.Chart != RENDER_ALIGNMENT && opts.Chart != "" {
+			logrus.Fatal("Only alignments can be rendered from FASTA files")
+		}
+		if len(opts.TemplatePath) == 0 || len(opts.FragmentPath) == 0 {
+			logrus.Fatal("Please provide both a template and fragment FASTA file")
+		}
+
+		p, err := fastaPileup(opts)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if len(p.Rows) == 0 {
+			logrus.Fatal("No fragments found")
+		}
+
+		title := opts.Title
+		if len(title) == 0 {
+			title = filepath.Base(opts.FragmentPath)
+		}
+
+		err = renderPileup(format, buf, p, title, opts.Columns)
+		if err == nil {
+			err = buf.Flush()
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	if len(fields.Gene) == 0 {
+		logrus.Fatal("Please provide a gene")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	tmpl, err := s.GetTemplate(fields.Gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = renderChart(context.Background(), s, tmpl, fields, opts, buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+const renderTestTitle = `RPS12 <clones> & "edits" (x)\y ü`
+
+func renderTestChart(t *testing.T, chart, format string) []byte {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tmpl, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := &SearchFields{Gene: "RPS12", Sample: []string{"clones"}, EditStop: -1, JuncLen: -1, JuncEnd: -1}
+	fields.unsetRanges()
+	opts := &RenderOptions{Chart: chart, Format: format, Title: renderTestTitle, Top: 5}
+
+	var buf bytes.Buffer
+	err = renderChart(context.Background(), s, tmpl, fields, opts, &buf)
+	if err != nil {
+		t.Fatalf("Failed to render %s %s: %s", chart, format, err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRenderSvg(t *testing.T) {
+	for _, chart := range []string{RENDER_ALIGNMENT, RENDER_EDIT_STOP, RENDER_JUNC_LEN, RENDER_HEAT} {
+		data := renderTestChart(t, chart, RENDER_SVG)
+
+		dec := xml.NewDecoder(bytes.NewReader(data))
+		var root string
+		var texts []string
+		var inText bool
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Invalid SVG for %s: %s", chart, err)
+			}
+			switch el := tok.(type) {
+			case xml.StartElement:
+				if len(root) == 0 {
+					root = el.Name.Local
+				}
+				inText = el.Name.Local == "text"
+			case xml.EndElement:
+				inText = false
+			case xml.CharData:
+				if inText {
+					texts = append(texts, string(el))
+				}
+			}
+		}
+
+		if root != "svg" {
+			t.Errorf("Wrong root element for %s: %s", chart, root)
+		}
+
+		found := false
+		for _, text := range texts {
+			if text == renderTestTitle {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Title not found in %s SVG text: %q", chart, texts)
+		}
+	}
+}
+
+func TestRenderPdf(t *testing.T) {
+	for _, chart := range []string{RENDER_ALIGNMENT, RENDER_HEAT} {
+		data := renderTestChart(t, chart, RENDER_PDF)
+
+		m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+		if m == nil {
+			t.Fatalf("startxref not found in %s PDF", chart)
+		}
+		xref, _ := strconv.Atoi(string(m[1]))
+		if !bytes.HasPrefix(data[xref:], []byte("xref\n0 ")) {
+			t.Fatalf("startxref %d does not point at the xref table in %s PDF", xref, chart)
+		}
+
+		var first, count int
+		if _, err := fmt.Sscanf(string(data[xref:]), "xref\n%d %d\n", &first, &count); err != nil {
+			t.Fatal(err)
+		}
+		entries := regexp.MustCompile(`(\d{10}) (\d{5}) ([nf]) \n`).FindAllSubmatch(data[xref:], -1)
+		if len(entries) != count {
+			t.Fatalf("Wrong number of xref entries in %s PDF. %d != %d", chart, len(entries), count)
+		}
+		for i, e := range entries[1:] {
+			off, _ := strconv.Atoi(string(e[1]))
+			obj := fmt.Sprintf("%d 0 obj\n", i+1)
+			if !bytes.HasPrefix(data[off:], []byte(obj)) {
+				t.Errorf("xref offset %d of object %d does not point at %q in %s PDF", off, i+1, obj, chart)
+			}
+		}
+
+		loc := regexp.MustCompile(`<< /Length (\d+) >>\nstream\n`).FindSubmatchIndex(data)
+		if loc == nil {
+			t.Fatalf("Content stream not found in %s PDF", chart)
+		}
+		length, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		if !bytes.HasPrefix(data[loc[1]+length:], []byte("endstream")) {
+			t.Errorf("Wrong content stream length in %s PDF: %d", chart, length)
+		}
+
+		title := pdfString(renderTestTitle)
+		if !bytes.Contains(data, []byte(title+" Tj")) {
+			t.Errorf("Title %s not found in %s PDF", title, chart)
+		}
+	}
+}
+
+func TestPdfString(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", "()"},
+		{"RPS12 clones", "(RPS12 clones)"},
+		{"f(x)", `(f\(x\))`},
+		{"unbalanced ((", `(unbalanced \(\()`},
+		{`a\b`, `(a\\b)`},
+		{`\)`, `(\\\))`},
+		{"tab\there\nline", "(tab?here?line)"},
+		{"ü Δ", "(? ?)"},
+	}
+
+	for _, test := range tests {
+		if got := pdfString(test.text); got != test.want {
+			t.Errorf("Wrong escaping of %q. %s != %s", test.text, got, test.want)
+		}
+	}
+}
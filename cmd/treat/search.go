@@ -18,70 +18,58 @@
 package main
 
 import (
-	"encoding/csv"
+	"bufio"
+	"context"
 	"fmt"
 	"os"
-	"strconv"
 
 	"github.com/sirupsen/logrus"
 	"github.com/ubccr/treat"
 )
 
-func Search(dbpath string, fields *SearchFields, csvOutput, noHeader, fastaOutput bool) {
+// Columns of the search command output
+var searchDefaultColumns = []string{"gene", "sample", "norm", "read_count", "alt_editing", "has_mutation", "edit_stop", "junc_end", "junc_len", "junc_seq"}
+
+func Search(dbpath string, fields *SearchFields, opts *ExportOptions, group *GroupOptions, fastaOutput bool) {
 	s, err := NewStorage(dbpath)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	csvout := csv.NewWriter(os.Stdout)
-
-	if !csvOutput {
-		csvout.Comma = '\t'
-	}
+	if len(group.GroupBy) > 0 || len(group.Aggregates) > 0 || group.Wide {
+		if fastaOutput {
+			logrus.Fatal("Grouped results can not be written in fasta format")
+		}
 
-	if !noHeader && !fastaOutput {
-		csvout.Write([]string{
-			"gene",
-			"sample",
-			"norm",
-			"read_count",
-			"alt_editing",
-			"has_mutation",
-			"edit_stop",
-			"junc_end",
-			"junc_len",
-			"junc_seq"})
+		_, err = Group(context.Background(), s, os.Stdout, fields, opts, group)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
 	}
 
-	err = s.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
-		alt := fmt.Sprintf("%d", a.AltEditing)
-		if a.AltEditing != 0 {
-			alt = fmt.Sprintf("A%d", a.AltEditing)
+	if !fastaOutput {
+		if len(opts.Columns) == 0 {
+			opts.Columns = searchDefaultColumns
 		}
 
-		if fastaOutput {
-			frag, err := s.GetFragment(key, a.Id)
-			if err != nil || frag == nil {
-				logrus.Printf("fragment not found: %s", err)
-				return
-			}
-			csvout.Write([]string{">" + key.Gene + "|" + key.Sample + "|" + strconv.FormatUint(a.Id, 10) + "|" + frag.Name})
-			csvout.Write([]string{frag.String()})
-		} else {
-			csvout.Write([]string{
-				key.Gene,
-				key.Sample,
-				fmt.Sprintf("%.4f", RoundPlus(a.Norm, 4)),
-				fmt.Sprintf("%d", a.ReadCount),
-				alt,
-				fmt.Sprintf("%d", a.HasMutation),
-				fmt.Sprintf("%d", a.EditStop),
-				fmt.Sprintf("%d", a.JuncEnd),
-				fmt.Sprintf("%d", a.JuncLen),
-				a.JuncSeq})
+		_, err = Export(context.Background(), s, os.Stdout, fields, opts)
+		if err != nil {
+			logrus.Fatal(err)
 		}
+		return
+	}
 
-		csvout.Flush()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	err = s.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		frag, err := s.GetFragment(key, a.Id)
+		if err != nil || frag == nil {
+			logrus.Printf("fragment not found: %s", err)
+			return
+		}
+		fmt.Fprintf(out, ">%s|%s|%d|%s\n%s\n", key.Gene, key.Sample, a.Id, frag.Name, frag.String())
 	})
 
 	if err != nil {
@@ -18,14 +18,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aebruno/nwalgo"
 	"github.com/carbocation/interpose"
@@ -43,17 +51,37 @@ const (
 )
 
 type Application struct {
-	templates   map[string]*template.Template
-	tmpldir     string
-	enableCache bool
-	dbs         map[string]*Database
-	defaultDb   string
-	decoder     *schema.Decoder
-	cookieStore *sessions.CookieStore
+	templates     map[string]*template.Template
+	tmpldir       string
+	enableCache   bool
+	cacheSize     int
+	dbConfigs     []*DatabaseConfig
+	snap          *dbSnapshot
+	snapMu        sync.RWMutex
+	reloadMu      sync.Mutex
+	decoder       *schema.Decoder
+	cookieStore   *sessions.CookieStore
+	users         map[string]*User
+	proxyHeader   string
+	admins        []string
+	uploaders     []string
+	adminToken    string
+	jobs          *JobQueue
+	enableUpload  bool
+	uploadDir     string
+	uploadMaxSize int64
+	writeMu       sync.Mutex
+	writeLocks    map[string]*sync.Mutex
 }
 
 type Database struct {
 	name                string
+	title               string
+	path                string
+	modTime             time.Time
+	size                int64
+	mu                  sync.RWMutex
+	closed              bool
 	storage             *Storage
 	geneTemplates       map[string]*treat.Template
 	geneSamples         map[string][]string
@@ -64,7 +92,7 @@ type Database struct {
 	maxJuncEnd          map[string]int
 	genes               []string
 	defaultGene         string
-	cache               map[string][]byte
+	cache               *chartCache
 	cacheEditStopTotals map[string]map[int]map[string]float64
 }
 
@@ -72,50 +100,22 @@ func init() {
 	gob.Register(&SearchFields{})
 }
 
-func NewApplication(dbpath, tmpldir string, enableCache bool) (*Application, error) {
+func NewApplication(cfg *ServerConfig) (*Application, error) {
 	app := &Application{}
-	app.dbs = make(map[string]*Database)
-
-	fi, err := os.Stat(dbpath)
+	app.dbConfigs = cfg.Databases
+	app.admins = cfg.Admins
+	app.uploaders = cfg.Uploaders
+	app.adminToken = cfg.AdminToken
+	app.enableCache = cfg.EnableCache
+	app.cacheSize = cfg.CacheSize
+	app.snap = &dbSnapshot{dbs: make(map[string]*Database)}
+
+	err := app.reload(true)
 	if err != nil {
 		return nil, err
 	}
 
-	if fi.IsDir() {
-		dbabs, _ := filepath.Abs(dbpath)
-		dbfiles, err := filepath.Glob(filepath.Join(dbabs, "*.db"))
-		if err != nil {
-			return nil, err
-		}
-		for _, d := range dbfiles {
-			abs, _ := filepath.Abs(d)
-			base := filepath.Base(abs)
-
-			err = app.loadDb(base, abs)
-			if err != nil {
-				return nil, err
-			}
-
-			if len(app.defaultDb) == 0 {
-				app.defaultDb = base
-			}
-		}
-	} else {
-		abs, _ := filepath.Abs(dbpath)
-		base := filepath.Base(abs)
-		err = app.loadDb(base, abs)
-		if err != nil {
-			return nil, err
-		}
-		app.defaultDb = base
-	}
-
-	logrus.Infof("Default DB is: %s", app.defaultDb)
-
-	if len(app.dbs) == 0 {
-		return nil, fmt.Errorf("No db files found")
-	}
-
+	tmpldir := cfg.TemplateDir
 	if len(tmpldir) == 0 {
 		// default to directory of current executable
 		path, err := filepath.EvalSymlinks(os.Args[0])
@@ -139,11 +139,15 @@ func NewApplication(dbpath, tmpldir string, enableCache bool) (*Application, err
 		"increment":   incrementFunc,
 		"decrement":   decrementFunc,
 		"percent":     percent,
+		"fraction":    fractionFunc,
 		"round":       roundFunc,
 		"juncseq":     juncseqFunc,
 		"pctSearch":   pctSearchFunc,
 		"pctEditStop": pctEditStopFunc,
+		"pctInterval": pctIntervalFunc,
 		"align":       alignFunc,
+		"pileup":      pileupFunc,
+		"sites":       siteString,
 	}
 
 	app.templates = make(map[string]*template.Template)
@@ -156,25 +160,79 @@ func NewApplication(dbpath, tmpldir string, enableCache bool) (*Application, err
 		}
 	}
 
-	app.enableCache = enableCache
 	app.tmpldir = tmpldir
 	app.decoder = schema.NewDecoder()
-	// Create secure cookie with in-secure key. Make this configurable in the future
-	app.cookieStore = sessions.NewCookieStore([]byte("not-secure"))
 	app.decoder.IgnoreUnknownKeys(true)
 
+	auth := cfg.Auth()
+	app.cookieStore = sessions.NewCookieStore(sessionSecret(auth.SessionSecret))
+	app.cookieStore.Options.HttpOnly = true
+	// Browsers don't send the session with cross site requests, which
+	// protects POST requests such as uploads from CSRF
+	app.cookieStore.Options.SameSite = http.SameSiteStrictMode
+
+	if len(auth.UserFile) > 0 {
+		app.users, err = LoadUsers(auth.UserFile)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Loaded %d users from %s", len(app.users), auth.UserFile)
+	}
+
+	app.proxyHeader = auth.ProxyHeader
+	if len(app.proxyHeader) > 0 {
+		logrus.Infof("Trusting reverse proxy user header: %s", app.proxyHeader)
+	}
+
+	app.jobs, err = NewJobQueue(cfg.JobWorkers, 100, cfg.JobHistory, cfg.UploadDir)
+	if err != nil {
+		return nil, err
+	}
+	app.enableUpload = cfg.EnableUpload
+	app.uploadDir = cfg.UploadDir
+	app.uploadMaxSize = cfg.UploadMaxSize << 20
+	if app.enableUpload {
+		logrus.Infof("Uploads enabled. Max upload size: %d MB", cfg.UploadMaxSize)
+		if len(app.uploaders) == 0 && len(app.admins) == 0 {
+			logrus.Warn("No uploaders or admins configured. Only requests with the admin token can upload")
+		}
+	}
+
 	return app, nil
 }
 
-func (a *Application) loadDb(base, dbpath string) error {
-	logrus.Infof("Processing database: %s", base)
-	db := &Database{name: base}
-	stg, err := NewStorage(dbpath)
+// openDb opens the database and precomputes per gene caches
+func (a *Application) openDb(spec *dbSpec) (*Database, error) {
+	logrus.Infof("Processing database: %s", spec.name)
+	db := &Database{
+		name:    spec.name,
+		title:   spec.title,
+		path:    spec.path,
+		modTime: spec.modTime,
+		size:    spec.size,
+	}
+
+	stg, err := NewStorage(spec.path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	db.storage = stg
 
+	err = db.load()
+	if err != nil {
+		stg.Close()
+		return nil, fmt.Errorf("Failed to load database %s: %s", spec.name, err)
+	}
+
+	if a.enableCache {
+		db.cache = newChartCache(a.cacheSize)
+	}
+
+	return db, nil
+}
+
+func (db *Database) load() error {
+	var err error
 	db.geneTemplates, err = db.storage.TemplateMap()
 	if err != nil {
 		return err
@@ -221,6 +279,7 @@ func (a *Application) loadDb(base, dbpath string) error {
 		}
 
 		fields := &SearchFields{Gene: k, EditStop: -1, JuncEnd: -1, JuncLen: -1}
+		fields.unsetRanges()
 		err = db.storage.Search(fields, func(key *treat.AlignmentKey, aln *treat.Alignment) {
 			if _, ok := db.cacheEditStopTotals[k][aln.EditStop]; !ok {
 				db.cacheEditStopTotals[k][aln.EditStop] = make(map[string]float64)
@@ -258,14 +317,32 @@ func (a *Application) loadDb(base, dbpath string) error {
 	// Set default gene for dropdown menu
 	db.defaultGene = db.genes[0]
 
-	db.cache = make(map[string][]byte)
-	a.dbs[base] = db
-
 	return nil
 }
 
+// Close cancels all jobs and closes all databases after waiting for
+// in-flight requests
+func (a *Application) Close() {
+	if a.jobs != nil {
+		a.jobs.Close()
+	}
+
+	for _, db := range a.snapshot().dbs {
+		db.close()
+	}
+}
+
+// Title returns the display name of the database
+func (db *Database) Title() string {
+	if len(db.title) > 0 {
+		return db.title
+	}
+
+	return db.name
+}
+
 func (a *Application) GetDb(name string) (*Database, error) {
-	db, ok := a.dbs[name]
+	db, ok := a.snapshot().dbs[name]
 	if !ok {
 		return nil, fmt.Errorf("Database not found: %s", name)
 	}
@@ -298,6 +375,7 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 	fields.EditStop = -2
 	fields.JuncLen = -2
 	fields.JuncEnd = -2
+	fields.unsetRanges()
 	fields.Gene = db.defaultGene
 	fields.Limit = 10
 
@@ -312,6 +390,7 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 			fields.EditStop = -2
 			fields.JuncLen = -2
 			fields.JuncEnd = -2
+			fields.unsetRanges()
 			fields.Gene = db.defaultGene
 			fields.Limit = 10
 		}
@@ -364,6 +443,24 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 		if vals.Get("tet") == "" {
 			fields.Tetracycline = ""
 		}
+		if vals.Get("frame") == "" {
+			fields.Frame = ""
+		}
+		if vals.Get("start") == "" {
+			fields.StartCodon = 0
+		}
+		fields.clearRanges(vals)
+		if vals.Get("where") == "" {
+			fields.Where = ""
+		}
+	}
+
+	// Invalid where expressions are reported in the search form and not
+	// stored in the session
+	fields.WhereError = ""
+	if _, err := ParseWhere(fields.Where); err != nil {
+		fields.WhereError = fmt.Sprintf("%q: %s", fields.Where, err)
+		fields.Where = ""
 	}
 
 	session.Values[TREAT_COOKIE_SEARCH] = fields
@@ -379,6 +476,7 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 
 func (a *Application) middlewareStruct() (*interpose.Middleware, error) {
 	mw := interpose.New()
+	mw.Use(func(next http.Handler) http.Handler { return AuthContext(a, next) })
 	mw.Use(func(next http.Handler) http.Handler { return DbContext(a, next) })
 	mw.UseHandler(a.router())
 
@@ -395,19 +493,33 @@ func (a *Application) router() *mux.Router {
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(fmt.Sprintf("%s/static", a.tmpldir)))))
 
 	router.Path("/").Handler(IndexHandler(a)).Methods("GET")
+	router.Path("/login").Handler(LoginHandler(a)).Methods("GET", "POST")
+	router.Path("/logout").Handler(LogoutHandler(a)).Methods("GET")
 	router.Path("/data/es-hist").Handler(EditHistogramHandler(a)).Methods("GET")
 	router.Path("/data/jl-hist").Handler(JuncLenHistogramHandler(a)).Methods("GET")
 	router.Path("/data/je-hist").Handler(JuncEndHistogramHandler(a)).Methods("GET")
 	router.Path("/data/heat").Handler(HeatMapJson(a)).Methods("GET")
 	router.Path("/data/bubble").Handler(BubbleJson(a)).Methods("GET")
 	router.Path("/data/tmpl").Handler(TemplateSummaryHistogramHandler(a)).Methods("GET")
+	router.Path("/data/profile").Handler(ProfileJson(a)).Methods("GET")
 	router.Path("/heat").Handler(HeatHandler(a)).Methods("GET")
 	router.Path("/bubble").Handler(BubbleHandler(a)).Methods("GET")
 	router.Path("/search").Handler(SearchHandler(a)).Methods("GET")
 	router.Path("/show").Handler(ShowHandler(a)).Methods("GET")
+	router.Path("/pileup").Handler(PileupHandler(a)).Methods("GET")
+	router.Path("/render").Handler(RenderHandler(a)).Methods("GET")
 	router.Path("/stats").Handler(StatsHandler(a)).Methods("GET")
 	router.Path("/db").Handler(DbHandler(a)).Methods("GET")
 	router.Path("/tmpl-report").Handler(TemplateSummaryHandler(a)).Methods("GET")
+	router.Path("/junctions").Handler(JunctionsHandler(a)).Methods("GET")
+	if a.adminEnabled() {
+		router.Path("/admin/reload").Handler(ReloadHandler(a)).Methods("POST")
+	}
+	router.Path("/upload").Handler(UploadHandler(a)).Methods("GET", "POST")
+	router.Path("/jobs").Handler(JobsHandler(a)).Methods("GET")
+	router.Path("/jobs/{id}").Handler(JobHandler(a)).Methods("GET")
+
+	a.apiRouter(router)
 
 	return router
 }
@@ -542,6 +654,27 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 	}
 	writeBase(buf[fragCount-1], n, frag.EditBase, frag.EditSite[fi], max, cat)
 
+	// gRNA rows below the read using the site numbering of the header row
+	classes := append([]string{}, labels...)
+	for _, g := range tmpl.Guides {
+		row := make([]string, n+1)
+		ti = 0
+		for ai := 0; ai < n; ai++ {
+			if aln1[ai] == '-' {
+				row[ai] = `<td></td><td></td>`
+				continue
+			}
+			cat := guideClass(g, n-ti)
+			row[ai] = `<td class="tcell ` + cat + `"></td><td class="` + cat + `"></td>`
+			ti++
+		}
+		row[n] = `<td class="tcell ` + guideClass(g, 0) + `"></td>`
+
+		buf = append(buf, row)
+		labels = append(labels, template.HTMLEscapeString(g.Name))
+		classes = append(classes, "grna")
+	}
+
 	cols := 17
 	rows := len(buf[0]) / cols
 	if (len(buf[0]) % cols) > 0 {
@@ -556,7 +689,7 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 			if i == 0 {
 				html += `<td>&nbsp;</td>`
 			} else {
-				html += `<td class="` + labels[i-1] + `">` + labels[i-1] + `</td>`
+				html += `<td class="` + classes[i-1] + `">` + labels[i-1] + `</td>`
 			}
 
 			end := (r * cols) + cols
@@ -579,6 +712,104 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 	return template.HTML(html)
 }
 
+// guideClass returns the css class of edit site index idx in the row of the
+// gRNA
+func guideClass(g *treat.GuideRegion, idx int) string {
+	if g.InAnchor(idx) {
+		return "grna-anchor"
+	}
+	if idx >= g.Start && idx <= g.End {
+		return "grna"
+	}
+	return ""
+}
+
+// pileupFunc renders the pileup as table rows with one pair of columns per
+// edit site. Fragments are grouped by sample and link to their alignment.
+func pileupFunc(p *treat.Pileup, db string) template.HTML {
+	tmpl := p.Template
+	cols := tmpl.Len() * 2
+
+	var buf bytes.Buffer
+	buf.WriteString(`<tr><td>&nbsp;</td>`)
+	for i := 0; i < tmpl.Len(); i++ {
+		fmt.Fprintf(&buf, `<td class="text-center">%d</td>`, p.Position(i))
+		if i < len(tmpl.Bases) {
+			fmt.Fprintf(&buf, `<td class="text-center base-index">%d</td>`, tmpl.BaseIndex[i])
+		}
+	}
+	buf.WriteString(`</tr>`)
+
+	for i, t := range tmpl.EditSite {
+		fmt.Fprintf(&buf, `<tr><td class="%s">%s</td>`, p.Labels[i], p.Labels[i])
+		for ti := range t {
+			fmt.Fprintf(&buf, `<td class="tcell %s">%s%s</td>`, p.Labels[i], strings.Repeat("-", int(p.Widths[ti]-t[ti])), strings.Repeat(string(tmpl.EditBase), int(t[ti])))
+			if ti < len(tmpl.Bases) {
+				fmt.Fprintf(&buf, `<td class="text-center base">%c</td>`, tmpl.Bases[ti])
+			}
+		}
+		buf.WriteString(`</tr>`)
+	}
+
+	for _, g := range tmpl.Guides {
+		fmt.Fprintf(&buf, `<tr><td class="grna" style="white-space: nowrap">%s</td>`, template.HTMLEscapeString(g.Name))
+		for ti := 0; ti < tmpl.Len(); ti++ {
+			cat := guideClass(g, tmpl.Len()-1-ti)
+			fmt.Fprintf(&buf, `<td class="tcell %s"></td>`, cat)
+			if ti < len(tmpl.Bases) {
+				fmt.Fprintf(&buf, `<td class="%s"></td>`, cat)
+			}
+		}
+		buf.WriteString(`</tr>`)
+	}
+
+	sample := ""
+	for _, row := range p.Rows {
+		a := row.Alignment
+		if a.Key != nil && a.Key.Sample != sample {
+			sample = a.Key.Sample
+			fmt.Fprintf(&buf, `<tr class="active"><th colspan="%d">%s</th></tr>`, cols, template.HTMLEscapeString(sample))
+		}
+
+		label := template.HTMLEscapeString(row.Label)
+		if a.Key != nil {
+			label = fmt.Sprintf(`<a href="/show?gene=%s&amp;sample=%s&amp;id=%d&amp;db=%s" title="Read count: %d, ESS: %d, JES: %d">%s</a>`,
+				url.QueryEscape(a.Key.Gene), url.QueryEscape(a.Key.Sample), a.Id, url.QueryEscape(db), a.ReadCount, a.EditStop, a.JuncEnd, label)
+		}
+		fmt.Fprintf(&buf, `<tr><td class="RD" style="white-space: nowrap">%s</td>`, label)
+
+		for ti, c := range row.Cells {
+			cat := ""
+			if c.Match >= 0 {
+				cat = p.Labels[c.Match]
+			}
+			if c.Junction {
+				cat += " junction"
+			}
+			if c.Mismatch {
+				cat += " mutant"
+			}
+
+			title := ""
+			if len(c.Insert) > 0 {
+				title = ` title="Insertion: ` + c.Insert + `"`
+			}
+
+			fmt.Fprintf(&buf, `<td class="tcell %s"%s>%s%s</td>`, cat, title, strings.Repeat("-", int(p.Widths[ti]-c.Count)), strings.Repeat(string(tmpl.EditBase), int(c.Count)))
+			if c.Base != 0 {
+				cat = "base"
+				if ti < len(tmpl.Bases) && c.Base != tmpl.Bases[ti] {
+					cat += " mutant"
+				}
+				fmt.Fprintf(&buf, `<td class="text-center %s">%c</td>`, cat, c.Base)
+			}
+		}
+		buf.WriteString(`</tr>`)
+	}
+
+	return template.HTML(buf.String())
+}
+
 func incrementFunc(x int) int {
 	x++
 	return x
@@ -593,6 +824,10 @@ func roundFunc(val float64) string {
 	return fmt.Sprintf("%.2f", val)
 }
 
+func fractionFunc(val float64) string {
+	return fmt.Sprintf("%.2f", val*100)
+}
+
 func pctSearchFunc(a *treat.Alignment, totals map[string]float64) string {
 	y := totals[a.Key.Sample]
 	if y == 0 {
@@ -613,6 +848,14 @@ func pctEditStopFunc(a *treat.Alignment, totals map[int]map[string]float64) stri
 	return fmt.Sprintf("%.4f", d)
 }
 
+func pctIntervalFunc(ci *treat.Interval) string {
+	if ci == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%.4f - %.4f", ci.Lower*100, ci.Upper*100)
+}
+
 func juncseqFunc(val string) template.HTML {
 	html := ""
 	for _, b := range val {
@@ -626,9 +869,13 @@ func juncseqFunc(val string) template.HTML {
 	return template.HTML(html)
 }
 
-func Server(dbpath, tmpldir string, port int, enableCache bool) {
+func Server(cfg *ServerConfig) {
+	err := cfg.Validate()
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
 
-	app, err := NewApplication(dbpath, tmpldir, enableCache)
+	app, err := NewApplication(cfg)
 	if err != nil {
 		logrus.Fatal(err.Error())
 	}
@@ -638,12 +885,66 @@ func Server(dbpath, tmpldir string, port int, enableCache bool) {
 		logrus.Fatal(err.Error())
 	}
 
-	if enableCache {
-		logrus.Info("URL caching enabled")
+	if cfg.EnableCache {
+		logrus.Infof("Chart caching enabled. Max entries per database: %d", cfg.CacheSize)
 	}
 
-	http.Handle("/", middle)
-	logrus.Printf("Running on http://127.0.0.1:%d", port)
+	srv := &http.Server{
+		Addr:         cfg.Addr(),
+		Handler:      middle,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+
+	// Reload databases on SIGHUP
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			logrus.Info("Received SIGHUP, reloading databases")
+			if err := app.Reload(); err != nil {
+				logrus.Errorf("Failed to reload databases: %s", err)
+			}
+		}
+	}()
+
+	stopWatch := make(chan struct{})
+	if cfg.WatchInterval > 0 {
+		logrus.Infof("Watching databases for changes every %s", cfg.WatchInterval)
+		go app.watchDatabases(cfg.WatchInterval, stopWatch)
+	}
+
+	// Drain in-flight requests on shutdown
+	done := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		logrus.Infof("Received %s, shutting down server", sig)
+		close(stopWatch)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Errorf("Failed to shutdown server gracefully: %s", err)
+		}
+		close(done)
+	}()
+
+	if cfg.TLS() {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		logrus.Printf("Running on https://%s", cfg.Addr())
+		err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		logrus.Printf("Running on http://%s", cfg.Addr())
+		err = srv.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		logrus.Fatal(err.Error())
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	<-done
+	app.Close()
+	logrus.Info("Server stopped")
 }
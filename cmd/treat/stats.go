@@ -18,7 +18,12 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -42,12 +47,42 @@ type Stats struct {
 
 type SampleStats struct {
 	Stats
+	KnockDown    string
+	Tetracycline bool
+	Replicate    int
+	Editing      *treat.EditMetrics
+	// Read counts by reading frame class
+	Frames  map[string]int
+	summary *treat.EditSummary
+}
+
+// GroupStats holds editing metrics averaged across replicates of the same
+// knock down and tetracycline condition
+type GroupStats struct {
+	KnockDown    string
+	Tetracycline bool
+	Samples      []string
+	Editing      *treat.EditMetrics
 }
 
 type GeneStats struct {
 	Stats
 	Name      string
 	SampleMap map[string]*SampleStats
+	Groups    []*GroupStats
+	// Start codon reads were translated from, 0 if reading frames were not
+	// classified
+	StartCodon int
+}
+
+// SampleNames returns the sorted sample names
+func (g *GeneStats) SampleNames() []string {
+	names := make([]string, 0, len(g.SampleMap))
+	for k := range g.SampleMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func percent(x, y int) float64 {
@@ -58,7 +93,7 @@ func percent(x, y int) float64 {
 	return (float64(x) / float64(y)) * float64(100)
 }
 
-func ShowStats(dbpath, gene string, unique bool, norm bool) {
+func ShowStats(dbpath, gene string, unique, norm, csvOutput, groups bool, start int) {
 	s, err := NewStorage(dbpath)
 	if err != nil {
 		logrus.Fatal(err)
@@ -69,6 +104,28 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 		countby = COUNT_UNIQUE
 	}
 
+	if csvOutput {
+		genes, err := s.Genes()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		csvout := csv.NewWriter(os.Stdout)
+		defer csvout.Flush()
+		for i, g := range genes {
+			if len(gene) > 0 && g != gene {
+				continue
+			}
+
+			stats, err := geneStats(s, g, countby, start)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			writeStats(csvout, stats, groups, i == 0 || len(gene) > 0)
+		}
+		return
+	}
+
 	fmt.Printf("db path: %s\n", dbpath)
 	fmt.Printf("version: %.1f\n\n", s.version)
 
@@ -82,7 +139,7 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 			continue
 		}
 
-		stats, err := geneStats(s, g, countby)
+		stats, err := geneStats(s, g, countby, start)
 		if err != nil {
 			logrus.Fatal(err)
 		}
@@ -133,17 +190,94 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 			}
 		}
 
+		fmt.Println(strings.Repeat("-", 80))
+		fmt.Printf("%-15s%9s%9s%8s%8s%8s%8s%9s\n", "Sample", "Mean ES", "Med ES", "FE %", "PE %", "Mean JL", "Junc %", "Entropy")
+		fmt.Println(strings.Repeat("-", 80))
+		for _, sample := range stats.SampleNames() {
+			printMetrics(sample, stats.SampleMap[sample].Editing)
+		}
+		for _, g := range stats.Groups {
+			tet := "tet-"
+			if g.Tetracycline {
+				tet = "tet+"
+			}
+			printMetrics(fmt.Sprintf("%s %s (n=%d)", g.KnockDown, tet, len(g.Samples)), g.Editing)
+		}
+
+		if stats.StartCodon > 0 {
+			fmt.Println(strings.Repeat("-", 80))
+			fmt.Printf("%-15s%9s%9s%5s%9s%5s%9s%5s%9s%5s\n", "Sample", "Total", "In-Frame", "%", "Shift", "%", "Stop", "%", "Untrans", "%")
+			fmt.Println(strings.Repeat("-", 80))
+			for _, sample := range stats.SampleNames() {
+				printFrames(sample, stats.SampleMap[sample])
+			}
+		}
+
 		fmt.Println()
 	}
 }
 
-func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
+func printMetrics(name string, m *treat.EditMetrics) {
+	if len(name) > 14 {
+		name = name[0:12] + ".."
+	}
+	fmt.Printf("%-15s%9.2f%9.1f%8.2f%8.2f%8.2f%8.2f%9.3f\n",
+		name,
+		m.MeanEditStop,
+		m.MedianEditStop,
+		m.FracFullyEdited*100,
+		m.FracPreEdited*100,
+		m.MeanJuncLen,
+		m.FracJunction*100,
+		m.Entropy)
+}
+
+// printFrames prints the read counts of a sample by reading frame class
+func printFrames(name string, rec *SampleStats) {
+	if len(name) > 12 {
+		name = name[0:12] + ".."
+	}
+	fmt.Printf("%-15s%9d%9d%5.1f%9d%5.1f%9d%5.1f%9d%5.1f\n",
+		name,
+		rec.Total,
+		rec.Frames[treat.FRAME_IN_FRAME],
+		percent(rec.Frames[treat.FRAME_IN_FRAME], rec.Total),
+		rec.Frames[treat.FRAME_SHIFT],
+		percent(rec.Frames[treat.FRAME_SHIFT], rec.Total),
+		rec.Frames[treat.FRAME_PREMATURE_STOP],
+		percent(rec.Frames[treat.FRAME_PREMATURE_STOP], rec.Total),
+		rec.Frames[treat.FRAME_UNTRANSLATED],
+		percent(rec.Frames[treat.FRAME_UNTRANSLATED], rec.Total))
+}
+
+// geneStats computes the alignment stats of gene by sample. Reads are also
+// classified by reading frame if start is set or the gene template has a
+// start codon.
+func geneStats(s *Storage, gene string, countby, start int) (*GeneStats, error) {
+	tmpl, err := s.GetTemplate(gene)
+	if err != nil {
+		return nil, err
+	}
+
 	gstat := &GeneStats{Name: gene}
 	gstat.SampleMap = make(map[string]*SampleStats)
+	if start > 0 {
+		gstat.StartCodon = start
+	} else {
+		gstat.StartCodon = tmpl.StartCodon
+	}
 
-	err := s.Search(&SearchFields{Gene: gene, All: true, EditStop: -1, JuncLen: -1, JuncEnd: -1}, func(key *treat.AlignmentKey, a *treat.Alignment) {
+	fields := &SearchFields{Gene: gene, All: true, EditStop: -1, JuncLen: -1, JuncEnd: -1, StartCodon: start}
+	fields.unsetRanges()
+	err = s.search(context.Background(), fields, gstat.StartCodon > 0, func(key *treat.AlignmentKey, a *treat.Alignment, tr *treat.Translation) {
 		if _, ok := gstat.SampleMap[key.Sample]; !ok {
-			gstat.SampleMap[key.Sample] = &SampleStats{}
+			gstat.SampleMap[key.Sample] = &SampleStats{
+				KnockDown:    key.KnockDown,
+				Tetracycline: key.Tetracycline,
+				Replicate:    key.Replicate,
+				Frames:       make(map[string]int),
+				summary:      treat.NewEditSummary(tmpl),
+			}
 		}
 
 		var readCount int
@@ -156,6 +290,7 @@ func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
 		if a.HasMutation == uint8(0) {
 			gstat.SampleMap[key.Sample].Std += readCount
 			gstat.Std += readCount
+			gstat.SampleMap[key.Sample].summary.Add(a, float64(readCount))
 		} else {
 			gstat.SampleMap[key.Sample].NonStd += readCount
 			gstat.NonStd += readCount
@@ -175,6 +310,10 @@ func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
 			gstat.Snps += readCount
 		}
 
+		if tr != nil {
+			gstat.SampleMap[key.Sample].Frames[tr.Class] += readCount
+		}
+
 		gstat.SampleMap[key.Sample].Total += readCount
 		gstat.Total += readCount
 	})
@@ -183,5 +322,101 @@ func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
 		return nil, err
 	}
 
+	groups := make(map[string]*GroupStats)
+	groupMetrics := make(map[string][]*treat.EditMetrics)
+	keys := make([]string, 0)
+	for _, name := range gstat.SampleNames() {
+		rec := gstat.SampleMap[name]
+		rec.Editing = rec.summary.Metrics()
+
+		gkey := fmt.Sprintf("%s;%t", rec.KnockDown, rec.Tetracycline)
+		if _, ok := groups[gkey]; !ok {
+			groups[gkey] = &GroupStats{KnockDown: rec.KnockDown, Tetracycline: rec.Tetracycline}
+			keys = append(keys, gkey)
+		}
+		groups[gkey].Samples = append(groups[gkey].Samples, name)
+		groupMetrics[gkey] = append(groupMetrics[gkey], rec.Editing)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		groups[k].Editing = treat.MeanMetrics(groupMetrics[k])
+		gstat.Groups = append(gstat.Groups, groups[k])
+	}
+
 	return gstat, nil
 }
+
+func metricsRow(m *treat.EditMetrics) []string {
+	return []string{
+		fmt.Sprintf("%.4f", m.MeanEditStop),
+		fmt.Sprintf("%.4f", m.MedianEditStop),
+		fmt.Sprintf("%.6f", m.FracFullyEdited),
+		fmt.Sprintf("%.6f", m.FracPreEdited),
+		fmt.Sprintf("%.4f", m.MeanJuncLen),
+		fmt.Sprintf("%.6f", m.FracJunction),
+		fmt.Sprintf("%.6f", m.Entropy)}
+}
+
+var metricsHeader = []string{
+	"mean_edit_stop",
+	"median_edit_stop",
+	"frac_fully_edited",
+	"frac_pre_edited",
+	"mean_junc_len",
+	"frac_junction",
+	"entropy"}
+
+var framesHeader = []string{
+	"frac_in_frame",
+	"frac_frameshift",
+	"frac_premature_stop",
+	"frac_untranslated"}
+
+// framesRow returns the fraction of reads of the sample by reading frame
+// class. Empty if reads were not translated.
+func framesRow(stats *GeneStats, rec *SampleStats) []string {
+	row := make([]string, len(treat.FrameClasses))
+	if stats.StartCodon == 0 {
+		return row
+	}
+	for i, class := range treat.FrameClasses {
+		row[i] = fmt.Sprintf("%.6f", percent(rec.Frames[class], rec.Total)/100)
+	}
+	return row
+}
+
+// writeStats writes the per sample editing metrics or, if groups is set, the
+// metrics averaged across replicates
+func writeStats(csvout *csv.Writer, stats *GeneStats, groups, header bool) {
+	if groups {
+		if header {
+			csvout.Write(append([]string{"gene", "knock_down", "tetracycline", "replicates"}, metricsHeader...))
+		}
+		for _, g := range stats.Groups {
+			csvout.Write(append([]string{
+				stats.Name,
+				g.KnockDown,
+				strconv.FormatBool(g.Tetracycline),
+				strconv.Itoa(len(g.Samples))}, metricsRow(g.Editing)...))
+		}
+		return
+	}
+
+	if header {
+		header := append([]string{"gene", "sample", "knock_down", "tetracycline", "replicate", "total", "std", "non_std"}, metricsHeader...)
+		csvout.Write(append(header, framesHeader...))
+	}
+	for _, name := range stats.SampleNames() {
+		rec := stats.SampleMap[name]
+		csvout.Write(append([]string{
+			stats.Name,
+			name,
+			rec.KnockDown,
+			strconv.FormatBool(rec.Tetracycline),
+			strconv.Itoa(rec.Replicate),
+			strconv.Itoa(rec.Total),
+			strconv.Itoa(rec.Std),
+			strconv.Itoa(rec.NonStd)}, append(metricsRow(rec.Editing), framesRow(stats, rec)...)...))
+	}
+}
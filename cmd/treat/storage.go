@@ -19,10 +19,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aebruno/gofasta"
@@ -32,12 +35,14 @@ import (
 )
 
 const (
-	BUCKET_ALIGNMENTS   = "alignments"
-	BUCKET_TEMPLATES    = "templates"
-	BUCKET_FRAGMENTS    = "fragments"
-	BUCKET_META         = "meta"
-	STORAGE_VERSION_KEY = "version"
-	STORAGE_VERSION     = 0.2
+	BUCKET_ALIGNMENTS        = "alignments"
+	BUCKET_TEMPLATES         = "templates"
+	BUCKET_TEMPLATE_VERSIONS = "template_versions"
+	BUCKET_SAMPLE_TEMPLATES  = "sample_templates"
+	BUCKET_FRAGMENTS         = "fragments"
+	BUCKET_META              = "meta"
+	STORAGE_VERSION_KEY      = "version"
+	STORAGE_VERSION          = 0.2
 )
 
 type Storage struct {
@@ -60,7 +65,27 @@ type SearchFields struct {
 	Tetracycline string   `schema:"tet"`
 	All          bool     `schema:"all"`
 	AltRegion    int      `schema:"alt"`
+	Frame        string   `schema:"frame"`
+	StartCodon   int      `schema:"start"`
+	Where        string   `schema:"where"`
 	FormOpen     bool     `schema:"form_open"`
+
+	// Parse error of a where expression entered in the web search form
+	WhereError string `schema:"-"`
+
+	// Inclusive ranges. Negative bounds are not set.
+	EditStopMin  int     `schema:"edit_stop_min"`
+	EditStopMax  int     `schema:"edit_stop_max"`
+	JuncStartMin int     `schema:"junc_start_min"`
+	JuncStartMax int     `schema:"junc_start_max"`
+	JuncEndMin   int     `schema:"junc_end_min"`
+	JuncEndMax   int     `schema:"junc_end_max"`
+	JuncLenMin   int     `schema:"junc_len_min"`
+	JuncLenMax   int     `schema:"junc_len_max"`
+	ReadCountMin int     `schema:"read_count_min"`
+	ReadCountMax int     `schema:"read_count_max"`
+	NormMin      float64 `schema:"norm_min"`
+	NormMax      float64 `schema:"norm_max"`
 }
 
 type AlignmentResults []*treat.Alignment
@@ -159,6 +184,60 @@ func (fields *SearchFields) HasKeyMatch(k *treat.AlignmentKey) bool {
 	return true
 }
 
+// unsetRanges unsets all range bounds
+func (fields *SearchFields) unsetRanges() {
+	fields.clearRanges(nil)
+}
+
+// clearRanges unsets the range bounds not given in vals
+func (fields *SearchFields) clearRanges(vals url.Values) {
+	bounds := map[string]*int{
+		"edit_stop_min":  &fields.EditStopMin,
+		"edit_stop_max":  &fields.EditStopMax,
+		"junc_start_min": &fields.JuncStartMin,
+		"junc_start_max": &fields.JuncStartMax,
+		"junc_end_min":   &fields.JuncEndMin,
+		"junc_end_max":   &fields.JuncEndMax,
+		"junc_len_min":   &fields.JuncLenMin,
+		"junc_len_max":   &fields.JuncLenMax,
+		"read_count_min": &fields.ReadCountMin,
+		"read_count_max": &fields.ReadCountMax,
+	}
+	for name, b := range bounds {
+		if vals.Get(name) == "" {
+			*b = -1
+		}
+	}
+	if vals.Get("norm_min") == "" {
+		fields.NormMin = -1
+	}
+	if vals.Get("norm_max") == "" {
+		fields.NormMax = -1
+	}
+}
+
+// inRange returns true if val is within min and max. Negative bounds are not
+// set.
+func inRange(val, min, max float64) bool {
+	if min >= 0 && val < min {
+		return false
+	}
+	if max >= 0 && val > max {
+		return false
+	}
+	return true
+}
+
+// HasRangeMatch returns true if a is within all range filters
+func (fields *SearchFields) HasRangeMatch(a *treat.Alignment) bool {
+	return inRange(float64(a.EditStop), float64(fields.EditStopMin), float64(fields.EditStopMax)) &&
+		inRange(float64(a.JuncStart), float64(fields.JuncStartMin), float64(fields.JuncStartMax)) &&
+		inRange(float64(a.JuncEnd), float64(fields.JuncEndMin), float64(fields.JuncEndMax)) &&
+		inRange(float64(a.JuncLen), float64(fields.JuncLenMin), float64(fields.JuncLenMax)) &&
+		inRange(float64(a.ReadCount), float64(fields.ReadCountMin), float64(fields.ReadCountMax)) &&
+		inRange(a.Norm, fields.NormMin, fields.NormMax)
+}
+
 func (fields *SearchFields) HasMatch(a *treat.Alignment) bool {
 	if !fields.All {
 		if fields.HasMutation && a.HasMutation == 0 {
@@ -184,7 +263,7 @@ func (fields *SearchFields) HasMatch(a *treat.Alignment) bool {
 		return false
 	}
 
-	return true
+	return fields.HasRangeMatch(a)
 }
 
 // From: https://gist.github.com/DavidVaini/10308388
@@ -237,11 +316,49 @@ func openBolt(dbpath string, mode os.FileMode, options *bolt.Options) (*Storage,
 	return storage, nil
 }
 
+func (s *Storage) Close() error {
+	return s.DB.Close()
+}
+
 func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *treat.Alignment)) error {
+	return s.SearchContext(context.Background(), fields, f)
+}
+
+// SearchContext is like Search but stops and returns the context error when
+// ctx is done
+func (s *Storage) SearchContext(ctx context.Context, fields *SearchFields, f func(k *treat.AlignmentKey, a *treat.Alignment)) error {
+	return s.search(ctx, fields, len(fields.Frame) > 0, func(k *treat.AlignmentKey, a *treat.Alignment, tr *treat.Translation) {
+		f(k, a)
+	})
+}
+
+// SearchFrames is like SearchContext but also translates the fragment of each
+// alignment from the start codon in fields or, if not set, the start codon of
+// the gene template
+func (s *Storage) SearchFrames(ctx context.Context, fields *SearchFields, f func(k *treat.AlignmentKey, a *treat.Alignment, tr *treat.Translation)) error {
+	return s.search(ctx, fields, true, f)
+}
+
+func (s *Storage) search(ctx context.Context, fields *SearchFields, translate bool, f func(k *treat.AlignmentKey, a *treat.Alignment, tr *treat.Translation)) error {
+	if len(fields.Frame) > 0 && !treat.IsFrameClass(fields.Frame) {
+		return fmt.Errorf("Invalid reading frame: %s. Must be one of %s", fields.Frame, strings.Join(treat.FrameClasses, ", "))
+	}
+
+	where, err := ParseWhere(fields.Where)
+	if err != nil {
+		return err
+	}
+
 	count := 0
 	offset := 0
+	seen := 0
 
-	err := s.DB.View(func(tx *bolt.Tx) error {
+	var frames *frameClassifier
+	if translate {
+		frames = newFrameClassifier(fields.StartCodon)
+	}
+
+	err = s.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BUCKET_ALIGNMENTS))
 		c := b.Cursor()
 
@@ -255,6 +372,11 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 			bucket := c.Bucket().Bucket(k).Cursor()
 
 			for ak, av := bucket.First(); ak != nil; ak, av = bucket.Next() {
+				seen++
+				if seen%1024 == 0 && ctx.Err() != nil {
+					return ctx.Err()
+				}
+
 				a := new(treat.Alignment)
 				a.Id = binary.BigEndian.Uint64(ak)
 				err := a.UnmarshalBinary(av)
@@ -266,11 +388,26 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 					continue
 				}
 
+				if where != nil && !where.Match(key, a) {
+					continue
+				}
+
 				// By default, don't include alt editing
 				if !fields.HasAlt && a.AltEditing > 0 {
 					continue
 				}
 
+				var tr *treat.Translation
+				if frames != nil {
+					tr, err = frames.translate(tx, k, key.Gene, ak)
+					if err != nil {
+						return err
+					}
+					if len(fields.Frame) > 0 && tr.Class != fields.Frame {
+						continue
+					}
+				}
+
 				if fields.Offset > 0 && offset < fields.Offset {
 					offset++
 					continue
@@ -280,7 +417,7 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 					return nil
 				}
 
-				f(key, a)
+				f(key, a, tr)
 				count++
 				offset++
 			}
@@ -292,23 +429,167 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 	return err
 }
 
-func (s *Storage) PutTemplate(gene string, tmpl *treat.Template) error {
+// PutTemplate stores tmpl as the current template for gene and returns its
+// version number. A new version is only added if tmpl differs from the
+// current template. In databases created before templates were versioned the
+// existing template is kept as version 1.
+func (s *Storage) PutTemplate(gene string, tmpl *treat.Template) (uint64, error) {
+	var version uint64
 	err := s.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BUCKET_TEMPLATES))
 		if b == nil {
 			return fmt.Errorf("database error. templates bucket does not exist!")
 		}
 
+		vb, err := tx.Bucket([]byte(BUCKET_TEMPLATE_VERSIONS)).CreateBucketIfNotExists([]byte(gene))
+		if err != nil {
+			return err
+		}
+
+		if cur := b.Get([]byte(gene)); cur != nil {
+			if vb.Sequence() == 0 {
+				version, _ = vb.NextSequence()
+				if err := vb.Put(versionKey(version), cur); err != nil {
+					return err
+				}
+			}
+
+			old := new(treat.Template)
+			if err := old.UnmarshalBytes(cur); err != nil {
+				return err
+			}
+			if len(old.Diff(tmpl)) == 0 {
+				version = vb.Sequence()
+				return nil
+			}
+		}
+
 		data, err := tmpl.MarshalBytes()
 		if err != nil {
 			return err
 		}
 
-		err = b.Put([]byte(gene), data)
+		version, _ = vb.NextSequence()
+		if err := vb.Put(versionKey(version), data); err != nil {
+			return err
+		}
+
+		return b.Put([]byte(gene), data)
+	})
+
+	return version, err
+}
+
+// GetTemplateVersion returns the version of the template for gene. Databases
+// created before templates were versioned only have version 1.
+func (s *Storage) GetTemplateVersion(gene string, version uint64) (*treat.Template, error) {
+	var tmpl *treat.Template
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var v []byte
+		if vb := templateVersionBucket(tx, gene); vb != nil {
+			v = vb.Get(versionKey(version))
+		} else if version == 1 {
+			v = tx.Bucket([]byte(BUCKET_TEMPLATES)).Get([]byte(gene))
+		}
+		if v == nil {
+			return fmt.Errorf("Template version %d not found for gene: %s", version, gene)
+		}
+
+		tmpl = new(treat.Template)
+		return tmpl.UnmarshalBytes(v)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// TemplateVersions returns all template version numbers of gene. The last
+// version is the current template.
+func (s *Storage) TemplateVersions(gene string) ([]uint64, error) {
+	versions := make([]uint64, 0)
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		vb := templateVersionBucket(tx, gene)
+		if vb == nil {
+			if tx.Bucket([]byte(BUCKET_TEMPLATES)).Get([]byte(gene)) == nil {
+				return fmt.Errorf("database error. template not found for gene: %s", gene)
+			}
+			versions = append(versions, 1)
+			return nil
+		}
+
+		return vb.ForEach(func(k, v []byte) error {
+			versions = append(versions, binary.BigEndian.Uint64(k))
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// SampleTemplateVersion returns the template version the sample was aligned
+// against. Samples loaded before templates were versioned use version 1.
+func (s *Storage) SampleTemplateVersion(akey *treat.AlignmentKey) (uint64, error) {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	version := uint64(1)
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_SAMPLE_TEMPLATES))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(key); v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+
+	return version, err
+}
+
+// setSampleTemplateVersion records the template version the sample was
+// aligned against
+func (s *Storage) setSampleTemplateVersion(akey *treat.AlignmentKey, version uint64) error {
+	key, err := akey.MarshalBinary()
+	if err != nil {
 		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_SAMPLE_TEMPLATES)).Put(key, versionKey(version))
 	})
+}
 
-	return err
+// currentTemplateVersion returns the version number of the current template
+// for gene
+func currentTemplateVersion(tx *bolt.Tx, gene string) uint64 {
+	if vb := templateVersionBucket(tx, gene); vb != nil && vb.Sequence() > 0 {
+		return vb.Sequence()
+	}
+	return 1
+}
+
+func templateVersionBucket(tx *bolt.Tx, gene string) *bolt.Bucket {
+	b := tx.Bucket([]byte(BUCKET_TEMPLATE_VERSIONS))
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(gene))
+}
+
+func versionKey(version uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, version)
+	return buf
 }
 
 func (s *Storage) GetTemplate(gene string) (*treat.Template, error) {
@@ -623,6 +904,16 @@ func (s *Storage) Initialize() error {
 			return err
 		}
 
+		_, err = tx.CreateBucketIfNotExists([]byte(BUCKET_TEMPLATE_VERSIONS))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(BUCKET_SAMPLE_TEMPLATES))
+		if err != nil {
+			return err
+		}
+
 		return nil
 	})
 
@@ -719,6 +1010,15 @@ func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.Alignm
 		return nil, err
 	}
 
+	var version uint64
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		version = currentTemplateVersion(tx, options.Gene)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	err = s.InitSample(akey, options.Force)
 	if err != nil {
 		return nil, err
@@ -730,9 +1030,10 @@ func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.Alignm
 	var fragBucket *bolt.Bucket
 	count := 0
 
-	logrus.Printf("Processing fragments for sample name: %s", options.Sample)
+	log := options.logger()
+	log.Printf("Processing fragments for sample name: %s", options.Sample)
 	if options.SkipFrags {
-		logrus.Info("not storing raw fragment reads")
+		log.Info("not storing raw fragment reads")
 	}
 
 	for rec := range gofasta.SimpleParser(f) {
@@ -742,7 +1043,11 @@ func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.Alignm
 				if err := tx.Commit(); err != nil {
 					return nil, err
 				}
-				fmt.Printf("\rLoaded %d fragments...", count)
+				if options.Progress != nil {
+					options.Progress(count)
+				} else {
+					fmt.Printf("\rLoaded %d fragments...", count)
+				}
 			}
 			tx, err = s.DB.Begin(true)
 			if err != nil {
@@ -752,7 +1057,7 @@ func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.Alignm
 			fragBucket = tx.Bucket([]byte(BUCKET_FRAGMENTS)).Bucket(key)
 		}
 
-		frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
+		frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, tmpl.EditBase)
 		aln := treat.NewAlignment(frag, tmpl, options.ExcludeSnps)
 
 		id, _ := alnBucket.NextSequence()
@@ -792,8 +1097,18 @@ func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.Alignm
 	s.DB.NoSync = false
 	s.DB.Sync()
 
-	fmt.Println()
-	logrus.Printf("Done. Loaded %d fragment sequences for sample %s", count, options.Sample)
+	// Only record the template version once all fragments are aligned
+	err = s.setSampleTemplateVersion(akey, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Progress != nil {
+		options.Progress(count)
+	} else {
+		fmt.Println()
+	}
+	log.Printf("Done. Loaded %d fragment sequences for sample %s", count, options.Sample)
 
 	return akey, nil
 }
@@ -881,3 +1196,100 @@ func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error
 
 	return nil
 }
+
+// RealignSample recomputes all alignments of the sample from its stored
+// fragments against tmpl and records version as the sample template version.
+// Charts, stats and exports read the current template of the gene so version
+// must be the current template. Normalized counts are rescaled to the same
+// total as before.
+func (s *Storage) RealignSample(akey *treat.AlignmentKey, tmpl *treat.Template, version uint64, excludeSnps bool) (int, error) {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if cur := currentTemplateVersion(tx, akey.Gene); version != cur {
+			return fmt.Errorf("version %d is not current (%d)", version, cur)
+		}
+
+		ab := tx.Bucket([]byte(BUCKET_ALIGNMENTS)).Bucket(key)
+		fb := tx.Bucket([]byte(BUCKET_FRAGMENTS)).Bucket(key)
+		if ab == nil || fb == nil {
+			return fmt.Errorf("Sample not found: %s", akey.Sample)
+		}
+
+		// Normalized total of standard reads
+		norm := 0.0
+		n := 0
+		err := ab.ForEach(func(k, v []byte) error {
+			a := new(treat.Alignment)
+			if err := a.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			if a.HasMutation == 0 {
+				norm += a.Norm
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if fb.Stats().KeyN < n {
+			return fmt.Errorf("No fragments stored for sample %s. Please reload the sample from FASTA", akey.Sample)
+		}
+
+		total := 0
+		c := fb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			frag := new(treat.Fragment)
+			if err := frag.UnmarshalBytes(v); err != nil {
+				return err
+			}
+
+			a := treat.NewAlignment(frag, tmpl, excludeSnps)
+			if a.HasMutation == 0 {
+				total += int(a.ReadCount)
+			}
+
+			data, err := a.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := ab.Put(k, data); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if norm > 0 && total > 0 {
+			scale := norm / float64(total)
+			c := ab.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				a := new(treat.Alignment)
+				if err := a.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				if a.HasMutation != 0 {
+					continue
+				}
+
+				a.Norm = scale * float64(a.ReadCount)
+				data, err := a.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				if err := ab.Put(k, data); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Bucket([]byte(BUCKET_SAMPLE_TEMPLATES)).Put(key, versionKey(version))
+	})
+
+	return count, err
+}
@@ -0,0 +1,439 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// testDB loads the example clones into a new database for gene RPS12 and
+// sample clones. Returns the database path and a cleanup function.
+func testDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "treat-db-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbpath := filepath.Join(dir, "treat.db")
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	err = loadSample(s, &LoadOptions{
+		Gene:         "RPS12",
+		Sample:       "clones",
+		EditBase:     "T",
+		TemplatePath: filepath.Join("..", "..", "examples", "templates.fa"),
+		FastaPath:    filepath.Join("..", "..", "examples", "clones.fa"),
+		Log:          log,
+		Progress:     func(count int) {},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return dbpath, func() { os.RemoveAll(dir) }
+}
+
+// testTemplate returns the example template with the first alt region
+// widened so it differs from the template loaded by testDB
+func testTemplate(t *testing.T) *treat.Template {
+	tmpl, _, err := loadTemplate(filepath.Join("..", "..", "examples", "templates.fa"), "T", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.AltRegion[0].End += 2
+	return tmpl
+}
+
+// sampleAlignments returns the stored alignments and fragments of the sample
+func sampleAlignments(t *testing.T, s *Storage, akey *treat.AlignmentKey) ([]*treat.Alignment, []*treat.Fragment) {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alns := make([]*treat.Alignment, 0)
+	frags := make([]*treat.Fragment, 0)
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(BUCKET_ALIGNMENTS)).Bucket(key).ForEach(func(k, v []byte) error {
+			a := new(treat.Alignment)
+			alns = append(alns, a)
+			return a.UnmarshalBinary(v)
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte(BUCKET_FRAGMENTS)).Bucket(key).ForEach(func(k, v []byte) error {
+			f := new(treat.Fragment)
+			frags = append(frags, f)
+			return f.UnmarshalBytes(v)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return alns, frags
+}
+
+func TestPutTemplate(t *testing.T) {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	v1, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the current template again does not add a version
+	version, err := s.PutTemplate("RPS12", v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("Wrong version for unchanged template: %d != 1", version)
+	}
+
+	version, err = s.PutTemplate("RPS12", testTemplate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("Wrong version for new template: %d != 2", version)
+	}
+
+	versions, err := s.TemplateVersions("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, []uint64{1, 2}) {
+		t.Errorf("Wrong template versions: %v", versions)
+	}
+
+	cur, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cur.Diff(testTemplate(t))) != 0 {
+		t.Errorf("Current template is not the new template: %v", cur.Diff(testTemplate(t)))
+	}
+
+	old, err := s.GetTemplateVersion("RPS12", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old.Diff(v1)) != 0 {
+		t.Errorf("Template version 1 changed: %v", old.Diff(v1))
+	}
+
+	if _, err := s.GetTemplateVersion("RPS12", 3); err == nil {
+		t.Errorf("Expected error for missing template version")
+	}
+
+	// Samples keep the version they were loaded with
+	keys, err := s.SampleKeys("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err = s.SampleTemplateVersion(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("Wrong sample template version: %d != 1", version)
+	}
+}
+
+// Databases created before templates were versioned have one template per
+// gene and no sample versions
+func TestTemplateVersionMigration(t *testing.T) {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	v1, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(BUCKET_TEMPLATE_VERSIONS)); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(BUCKET_SAMPLE_TEMPLATES))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s.TemplateVersions("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, []uint64{1}) {
+		t.Errorf("Wrong legacy template versions: %v", versions)
+	}
+
+	old, err := s.GetTemplateVersion("RPS12", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old.Diff(v1)) != 0 {
+		t.Errorf("Wrong legacy template version 1: %v", old.Diff(v1))
+	}
+
+	keys, err := s.SampleKeys("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.SampleTemplateVersion(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("Wrong legacy sample template version: %d != 1", version)
+	}
+
+	if err := s.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The legacy template is kept as version 1 when a new one is stored
+	version, err = s.PutTemplate("RPS12", testTemplate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("Wrong version for new template: %d != 2", version)
+	}
+
+	old, err = s.GetTemplateVersion("RPS12", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old.Diff(v1)) != 0 {
+		t.Errorf("Legacy template not kept as version 1: %v", old.Diff(v1))
+	}
+}
+
+func TestRealignSample(t *testing.T) {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	keys, err := s.SampleKeys("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	akey := keys[0]
+
+	v1, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := sampleAlignments(t, s, akey)
+	norm := 0.0
+	for _, a := range before {
+		if a.HasMutation == 0 {
+			norm += a.Norm
+		}
+	}
+
+	tmpl := testTemplate(t)
+	version, err := s.PutTemplate("RPS12", tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the current template can be used
+	if _, err := s.RealignSample(akey, v1, 1, false); err == nil {
+		t.Errorf("Expected error realigning against an older template version")
+	}
+	if v, _ := s.SampleTemplateVersion(akey); v != 1 {
+		t.Errorf("Sample template version changed by failed realign: %d != 1", v)
+	}
+
+	count, err := s.RealignSample(akey, tmpl, version, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 18 {
+		t.Errorf("Wrong number of fragments realigned: %d != 18", count)
+	}
+
+	v, err := s.SampleTemplateVersion(akey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != version {
+		t.Errorf("Wrong sample template version after realign: %d != %d", v, version)
+	}
+
+	after, frags := sampleAlignments(t, s, akey)
+	if len(after) != len(frags) {
+		t.Fatalf("Wrong number of alignments: %d != %d", len(after), len(frags))
+	}
+
+	total := 0.0
+	for i, a := range after {
+		want := treat.NewAlignment(frags[i], tmpl, false)
+		if a.EditStop != want.EditStop || a.JuncStart != want.JuncStart || a.JuncEnd != want.JuncEnd ||
+			a.JuncLen != want.JuncLen || a.AltEditing != want.AltEditing || a.HasMutation != want.HasMutation {
+			t.Errorf("Alignment %d not realigned against the new template: %+v != %+v", i, a, want)
+		}
+		if a.HasMutation == 0 {
+			total += a.Norm
+		}
+	}
+
+	if math.Abs(total-norm) > 1e-9 {
+		t.Errorf("Normalized total changed by realign: %f != %f", total, norm)
+	}
+}
+
+// Realigning against an older version adds it again as the current template
+func TestRealignVersion(t *testing.T) {
+	dbpath, cleanup := testDB(t)
+	defer cleanup()
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutTemplate("RPS12", testTemplate(t)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	Realign(dbpath, &RealignOptions{Gene: "RPS12", Version: 1})
+
+	s, err = NewStorage(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	versions, err := s.TemplateVersions("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[2] != 3 {
+		t.Fatalf("Template version 1 not added again as version 3: %v", versions)
+	}
+
+	cur, err := s.GetTemplate("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cur.Diff(v1); len(d) != 0 {
+		t.Errorf("Current template differs from version 1: %v", d)
+	}
+
+	keys, err := s.SampleKeys("RPS12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.SampleTemplateVersion(keys[0]); v != 3 {
+		t.Errorf("Wrong sample template version after realign: %d != 3", v)
+	}
+}
+
+func TestHasRangeMatch(t *testing.T) {
+	a := &treat.Alignment{EditStop: 0, JuncStart: 3, JuncEnd: 8, JuncLen: 0, ReadCount: 2, Norm: 0.5}
+
+	tests := []struct {
+		name  string
+		set   func(f *SearchFields)
+		match bool
+	}{
+		{"unset", func(f *SearchFields) {}, true},
+		{"edit_stop_max 0", func(f *SearchFields) { f.EditStopMax = 0 }, true},
+		{"edit_stop_min 1", func(f *SearchFields) { f.EditStopMin = 1 }, false},
+		{"junc_start_max 0", func(f *SearchFields) { f.JuncStartMax = 0 }, false},
+		{"junc_start 3-3", func(f *SearchFields) { f.JuncStartMin, f.JuncStartMax = 3, 3 }, true},
+		{"junc_end_max 7", func(f *SearchFields) { f.JuncEndMax = 7 }, false},
+		{"junc_len_max 0", func(f *SearchFields) { f.JuncLenMax = 0 }, true},
+		{"junc_len_min 0", func(f *SearchFields) { f.JuncLenMin = 0 }, true},
+		{"junc_len_min 1", func(f *SearchFields) { f.JuncLenMin = 1 }, false},
+		{"read_count_max 1", func(f *SearchFields) { f.ReadCountMax = 1 }, false},
+		{"norm_max 0", func(f *SearchFields) { f.NormMax = 0 }, false},
+		{"norm 0-0.5", func(f *SearchFields) { f.NormMin, f.NormMax = 0, 0.5 }, true},
+	}
+
+	for _, test := range tests {
+		fields := new(SearchFields)
+		fields.unsetRanges()
+		test.set(fields)
+		if m := fields.HasRangeMatch(a); m != test.match {
+			t.Errorf("%s: wrong range match %t != %t", test.name, m, test.match)
+		}
+	}
+}
+
+// Bounds missing from the search form are unset while a bound of 0 is kept
+func TestClearRanges(t *testing.T) {
+	fields := &SearchFields{EditStopMin: 5, JuncLenMax: 0, NormMin: 2}
+	fields.clearRanges(url.Values{"junc_len_max": []string{"0"}})
+
+	if fields.JuncLenMax != 0 {
+		t.Errorf("Bound of 0 given in the form was unset: %d", fields.JuncLenMax)
+	}
+	if fields.EditStopMin != -1 || fields.NormMin != -1 || fields.ReadCountMax != -1 {
+		t.Errorf("Bounds missing from the form not unset: %+v", fields)
+	}
+}
@@ -0,0 +1,513 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aebruno/gofasta"
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// loadTemplate reads the templates from a YAML, JSON or FASTA file. The edit
+// base and offset are used unless set in the template spec. A non-zero
+// offset always overrides the offset in the spec.
+func loadTemplate(path, base string, offset int) (*treat.Template, *treat.TemplateSpec, error) {
+	if len(base) != 1 {
+		return nil, nil, fmt.Errorf("Please provide the edit base")
+	}
+
+	spec, err := treat.ReadTemplateSpec(path, rune(base[0]))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Alt regions and guides are numbered with the offset so it must be set
+	// before the spec is validated
+	if offset != 0 {
+		spec.EditOffset = offset
+	}
+
+	tmpl, err := spec.Template(treat.FORWARD)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tmpl, spec, nil
+}
+
+// TemplateValidate checks each template file and prints all errors and
+// warnings found. A non-zero offset overrides the offset in the spec as in
+// load. Exits non-zero if any file is invalid.
+func TemplateValidate(paths []string, base string, offset int) {
+	if len(paths) == 0 {
+		logrus.Fatal("Please provide one or more template files to validate")
+	}
+	if len(base) != 1 {
+		logrus.Fatal("Please provide the edit base")
+	}
+
+	invalid := 0
+	for _, path := range paths {
+		spec, err := treat.ReadTemplateSpec(path, rune(base[0]))
+		if err != nil {
+			fmt.Printf("%s: ERROR %s\n", path, err)
+			invalid++
+			continue
+		}
+		if offset != 0 {
+			spec.EditOffset = offset
+		}
+
+		errs, warnings := spec.Validate()
+		for _, w := range warnings {
+			fmt.Printf("%s: WARNING %s\n", path, w)
+		}
+		for _, e := range errs {
+			fmt.Printf("%s: ERROR %s\n", path, e)
+		}
+		if len(errs) > 0 {
+			invalid++
+			continue
+		}
+
+		tmpl, err := spec.Template(treat.FORWARD)
+		if err != nil {
+			fmt.Printf("%s: ERROR %s\n", path, err)
+			invalid++
+			continue
+		}
+
+		gene := spec.Gene
+		if len(gene) == 0 {
+			gene = "-"
+		}
+		fmt.Printf("%s: OK gene=%s templates=%d edit_sites=%d edit_stop=%d offset=%d\n",
+			path, gene, tmpl.Size(), tmpl.Len(), tmpl.EditStop, tmpl.EditOffset)
+	}
+
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+// templateSource returns a version of the template stored for gene in the
+// database or the template read from path if gene is empty. Version 0 is the
+// current template.
+func templateSource(dbpath, gene string, version uint64, path, base string, offset int) (*treat.Template, error) {
+	if len(gene) == 0 {
+		tmpl, _, err := loadTemplate(path, base, offset)
+		return tmpl, err
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	defer s.DB.Close()
+
+	if version > 0 {
+		return s.GetTemplateVersion(gene, version)
+	}
+
+	return s.GetTemplate(gene)
+}
+
+// TemplateShow prints the edit site table of a template file or the template
+// stored for gene
+func TemplateShow(dbpath, gene string, version uint64, paths []string, base string, offset int, csvOutput bool) {
+	if len(gene) == 0 && len(paths) != 1 {
+		logrus.Fatal("Please provide a template file or a gene name")
+	}
+	if len(gene) > 0 && len(paths) > 0 {
+		logrus.Fatal("Please provide either a template file or a gene name, not both")
+	}
+
+	path := ""
+	if len(paths) > 0 {
+		path = paths[0]
+	}
+
+	tmpl, err := templateSource(dbpath, gene, version, path, base, offset)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	labels := tmpl.Labels()
+	guides := len(tmpl.Guides) > 0
+
+	if csvOutput {
+		out := csv.NewWriter(os.Stdout)
+		header := append([]string{"site", "base"}, labels...)
+		header = append(header, "edit")
+		if guides {
+			header = append(header, "grna")
+		}
+		out.Write(header)
+		for _, site := range tmpl.Sites() {
+			row := []string{strconv.Itoa(site.Site), site.Base}
+			for _, c := range site.Counts {
+				row = append(row, strconv.Itoa(int(c)))
+			}
+			row = append(row, siteEdit(site))
+			if guides {
+				row = append(row, tmpl.GuideNames(site.Site))
+			}
+			out.Write(row)
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	fmt.Printf("Edit base: %c\n", tmpl.EditBase)
+	fmt.Printf("Edit sites: %d\n", tmpl.Len())
+	fmt.Printf("Edit stop site: %d\n", tmpl.EditStop)
+	fmt.Printf("Edit site offset: %d\n", tmpl.EditOffset)
+	for i, r := range tmpl.AltRegion {
+		fmt.Printf("Alt region %s: %d-%d\n", labels[i+2], tmpl.IndexLabel(r.Start), tmpl.IndexLabel(r.End))
+	}
+	for _, g := range tmpl.Guides {
+		fmt.Printf("gRNA %s: %d-%d", g.Name, tmpl.IndexLabel(g.Start), tmpl.IndexLabel(g.End))
+		if g.Anchor != nil {
+			fmt.Printf(" anchor %d-%d", tmpl.IndexLabel(g.Anchor.Start), tmpl.IndexLabel(g.Anchor.End))
+		}
+		fmt.Println()
+	}
+	if tmpl.StartCodon > 0 {
+		t, err := treat.NewTranslator(tmpl, 0)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Start codon: %d\n", tmpl.StartCodon)
+		fmt.Printf("Fully edited protein: %s\n", t.Protein)
+	}
+	fmt.Println()
+
+	fmt.Printf("%6s%6s", "Site", "Base")
+	for _, l := range labels {
+		fmt.Printf("%5s", l)
+	}
+	if guides {
+		fmt.Printf("  %-4s  %s\n", "Edit", "gRNA")
+	} else {
+		fmt.Printf("  %s\n", "Edit")
+	}
+	for _, site := range tmpl.Sites() {
+		b := site.Base
+		if len(b) == 0 {
+			b = "-"
+		}
+		fmt.Printf("%6d%6s", site.Site, b)
+		for _, c := range site.Counts {
+			fmt.Printf("%5d", c)
+		}
+		if guides {
+			fmt.Print(strings.TrimRight(fmt.Sprintf("  %-4s  %s", siteEdit(site), tmpl.GuideNames(site.Site)), " "))
+		} else if edit := siteEdit(site); len(edit) > 0 {
+			fmt.Printf("  %s", edit)
+		}
+		fmt.Println()
+	}
+}
+
+// siteEdit returns whether edit bases are inserted or deleted at site
+func siteEdit(site *treat.TemplateSite) string {
+	if site.Inserted() {
+		return "ins"
+	} else if site.Deleted() {
+		return "del"
+	}
+	return ""
+}
+
+// TemplateDiff prints the differences between two template files or between
+// a template file and the template stored for gene. Exits non-zero if the
+// templates differ.
+func TemplateDiff(dbpath, gene string, version uint64, paths []string, base string, offset int) {
+	var a, b *treat.Template
+	var names []string
+	var err error
+
+	switch {
+	case len(gene) > 0 && len(paths) == 1:
+		a, err = templateSource(dbpath, gene, version, "", base, offset)
+		if err == nil {
+			b, err = templateSource(dbpath, "", 0, paths[0], base, offset)
+		}
+		names = []string{gene, paths[0]}
+		if version > 0 {
+			names[0] = fmt.Sprintf("%s version %d", gene, version)
+		}
+	case len(gene) == 0 && len(paths) == 2:
+		a, err = templateSource(dbpath, "", 0, paths[0], base, offset)
+		if err == nil {
+			b, err = templateSource(dbpath, "", 0, paths[1], base, offset)
+		}
+		names = paths
+	default:
+		logrus.Fatal("Please provide two template files or a gene name and a template file")
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	diffs := a.Diff(b)
+	if len(diffs) == 0 {
+		fmt.Printf("Templates %s are identical\n", strings.Join(names, " and "))
+		return
+	}
+
+	fmt.Printf("--- %s\n+++ %s\n", names[0], names[1])
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	os.Exit(1)
+}
+
+// TemplateAdd stores a template file as a new version of the template for
+// gene
+func TemplateAdd(dbpath, gene string, paths []string, base string, offset int) {
+	if len(paths) != 1 {
+		logrus.Fatal("Please provide a template file")
+	}
+
+	tmpl, spec, err := loadTemplate(paths[0], base, offset)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if len(gene) == 0 {
+		gene = spec.Gene
+	}
+	if len(gene) == 0 {
+		logrus.Fatal("Please provide a gene name")
+	}
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer s.Close()
+
+	err = s.Initialize()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	version, err := s.PutTemplate(cleanName(gene), tmpl)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Printf("Current template version for gene %s: %d", gene, version)
+}
+
+// TemplateVersions lists all template versions of gene and the samples
+// aligned against each version
+func TemplateVersions(dbpath, gene string) {
+	if len(gene) == 0 {
+		logrus.Fatal("Please provide a gene name")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer s.Close()
+
+	versions, err := s.TemplateVersions(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	keys, err := s.SampleKeys(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	samples := make(map[uint64][]string)
+	for _, k := range keys {
+		v, err := s.SampleTemplateVersion(k)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		samples[v] = append(samples[v], k.Sample)
+	}
+
+	current := versions[len(versions)-1]
+	fmt.Printf("%-9s%11s%9s%6s  %s\n", "Version", "Edit Stop", "Offset", "Alt", "Samples")
+	for _, v := range versions {
+		tmpl, err := s.GetTemplateVersion(gene, v)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		label := strconv.FormatUint(v, 10)
+		if v == current {
+			label += "*"
+		}
+		fmt.Printf("%-9s%11d%9d%6d  %s\n", label, tmpl.EditStop, tmpl.EditOffset, len(tmpl.AltRegion), strings.Join(samples[v], ","))
+	}
+
+	stale := len(keys) - len(samples[current])
+	if stale > 0 {
+		fmt.Printf("\n%d samples are not aligned against the current template (*). Use treat realign to update them.\n", stale)
+	}
+}
+
+type PredictOptions struct {
+	PrePath   string
+	GuidePath string
+	Output    string
+	Format    string
+	Gene      string
+	Anchor    int
+}
+
+// readGuides returns all gRNA sequences in a FASTA file
+func readGuides(path string) ([]*treat.GuideRNA, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	guides := make([]*treat.GuideRNA, 0)
+	for rec := range gofasta.SimpleParser(f) {
+		guides = append(guides, &treat.GuideRNA{Name: rec.Id, Sequence: rec.Seq})
+	}
+
+	if len(guides) == 0 {
+		return nil, fmt.Errorf("No gRNA sequences found in %s", path)
+	}
+
+	return guides, nil
+}
+
+// preEditedSpec returns a template spec holding the pre-edited sequence. The
+// pre-edited template is taken from template files, otherwise the first
+// record of the FASTA file is used.
+func preEditedSpec(path string) (*treat.TemplateSpec, error) {
+	if treat.IsTemplateSpecFile(path) {
+		spec, err := treat.ReadTemplateSpec(path, 'T')
+		if err != nil {
+			return nil, err
+		}
+		if spec.PreEdit == nil {
+			return nil, fmt.Errorf("Missing pre-edited template sequence in %s", path)
+		}
+		return &treat.TemplateSpec{
+			Gene:       spec.Gene,
+			EditOffset: spec.EditOffset,
+			Primers:    spec.Primers,
+			PreEdit:    spec.PreEdit,
+		}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	for rec := range gofasta.SimpleParser(f) {
+		return &treat.TemplateSpec{PreEdit: &treat.SequenceSpec{Name: rec.Id, Sequence: rec.Seq}}, nil
+	}
+
+	return nil, fmt.Errorf("No pre-edited sequence found in %s", path)
+}
+
+// TemplatePredict predicts the fully edited sequence from the pre-edited
+// sequence and gRNAs and writes the resulting templates
+func TemplatePredict(options *PredictOptions) {
+	if len(options.PrePath) == 0 {
+		logrus.Fatal("Please provide the pre-edited sequence file")
+	}
+	if len(options.GuidePath) == 0 {
+		logrus.Fatal("Please provide the gRNA FASTA file")
+	}
+
+	spec, err := preEditedSpec(options.PrePath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	guides, err := readGuides(options.GuidePath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	p, err := treat.PredictEdited(spec.PreEdit.Sequence, guides, options.Anchor)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	for _, step := range p.Steps {
+		logrus.Printf("gRNA %s anchored at %d-%d guided %d nt: %d inserted %d deleted",
+			step.Name, step.AnchorStart+1, step.AnchorEnd+1, step.Guided, step.Inserted, step.Deleted)
+	}
+	for _, name := range p.Unused {
+		logrus.Warnf("gRNA %s did not anchor", name)
+	}
+
+	spec.EditBase = "T"
+	spec.FullEdit = &treat.SequenceSpec{Name: "Predicted Fully Edited", Sequence: p.Sequence}
+	if len(options.Gene) > 0 {
+		spec.Gene = options.Gene
+	}
+
+	tmpl, err := spec.Template(treat.FORWARD)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Printf("Predicted template Edit Stop Site: %d", tmpl.EditStop)
+
+	format := options.Format
+	if len(format) == 0 {
+		format = treat.TEMPLATE_FORMAT_YAML
+		if len(options.Output) > 0 {
+			format = treat.TemplateFormat(options.Output)
+		}
+	}
+
+	out := os.Stdout
+	if len(options.Output) > 0 {
+		out, err = os.Create(options.Output)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer out.Close()
+	}
+
+	w := bufio.NewWriter(out)
+	err = spec.Write(w, format)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Alt regions of FASTA templates are numbered with the edit site offset given
+// on the command line
+func TestLoadTemplateOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "treat-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fasta := func(start, stop string) string {
+		path := filepath.Join(dir, "alt-"+start+"-"+stop+".fa")
+		data := ">FE Example Fully Edited Template\nAATTCTTGCTTTCTTGTGAATA\n" +
+			">PE Example Pre-Edited Template\nAACTGCCTTTGGTTAATAT\n" +
+			">A1 Alternative Edited Template alt_start=" + start + " alt_stop=" + stop + "\n" +
+			"AATTCTTGTTTCTTCTGTTGAATA\n"
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		start  string
+		stop   string
+		offset int
+		ok     bool
+	}{
+		{"4", "7", 0, true},
+		{"14", "17", 10, true},
+		{"14", "17", 0, false},
+		{"4", "7", 10, false},
+	}
+
+	for _, test := range tests {
+		tmpl, _, err := loadTemplate(fasta(test.start, test.stop), "T", test.offset)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("alt region %s-%s with offset %d: expected error", test.start, test.stop, test.offset)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("alt region %s-%s with offset %d: %s", test.start, test.stop, test.offset, err)
+			continue
+		}
+
+		if int(tmpl.EditOffset) != test.offset {
+			t.Errorf("alt region %s-%s: wrong offset %d != %d", test.start, test.stop, tmpl.EditOffset, test.offset)
+		}
+		// Regions are stored as edit site indexes
+		if r := tmpl.AltRegion[0]; r.Start != 4 || r.End != 7 {
+			t.Errorf("alt region %s-%s with offset %d: wrong region %d-%d != 4-7", test.start, test.stop, test.offset, r.Start, r.End)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Fetch chart data as a background job. The server either answers right away
+// (e.g. cached data) or queues a job and returns 202 with a handle which is
+// polled until the result is ready.
+function getJobJSON(url, success, progress) {
+    url += (url.indexOf('?') < 0 ? '?' : '&') + 'async=1';
+
+    $.getJSON(url, function (data, status, xhr) {
+        if (xhr.status != 202) {
+            success(data);
+            return;
+        }
+
+        var poll = setInterval(function () {
+            $.getJSON(data.status_url, function (job) {
+                if (progress) {
+                    progress(job);
+                }
+                if (job.state == 'done') {
+                    clearInterval(poll);
+                    $.getJSON(data.result_url, success);
+                } else if (job.state == 'failed' || job.state == 'canceled') {
+                    clearInterval(poll);
+                }
+            }).fail(function () {
+                clearInterval(poll);
+            });
+        }, 1000);
+    });
+}
@@ -0,0 +1,572 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// prepareReads makes sure the reads file is plain FASTA so it can be imported.
+// Gzip compressed files are decompressed and FASTQ is converted to FASTA.
+// Returns the path to the FASTA file and the number of reads.
+func prepareReads(path string) (string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	var in io.Reader
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	gzipped := len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+	if gzipped {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", 0, err
+		}
+		defer gz.Close()
+		in = gz
+	} else {
+		in = br
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	// Skip to the first record to detect the format
+	first := ""
+	for scanner.Scan() {
+		first = strings.TrimSpace(scanner.Text())
+		if len(first) > 0 {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", 0, err
+	}
+
+	switch {
+	case strings.HasPrefix(first, ">"):
+		if !gzipped {
+			count := 1
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), ">") {
+					count++
+				}
+			}
+			return path, count, scanner.Err()
+		}
+	case strings.HasPrefix(first, "@"):
+	default:
+		return "", 0, fmt.Errorf("Reads file must be in FASTA or FASTQ format")
+	}
+
+	out, err := os.Create(path + ".fasta")
+	if err != nil {
+		return "", 0, err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	count := 0
+	if strings.HasPrefix(first, ">") {
+		// Decompressed FASTA
+		fmt.Fprintln(w, first)
+		count++
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, ">") {
+				count++
+			}
+			fmt.Fprintln(w, line)
+		}
+	} else {
+		// FASTQ records are 4 lines: @id, sequence, +, quality
+		header := first
+		for {
+			if !scanner.Scan() {
+				return "", 0, fmt.Errorf("Truncated FASTQ record: %s", header)
+			}
+			seq := strings.TrimSpace(scanner.Text())
+			if !scanner.Scan() || !scanner.Scan() {
+				return "", 0, fmt.Errorf("Truncated FASTQ record: %s", header)
+			}
+
+			fmt.Fprintf(w, ">%s\n%s\n", header[1:], seq)
+			count++
+
+			header = ""
+			for scanner.Scan() {
+				header = strings.TrimSpace(scanner.Text())
+				if len(header) > 0 {
+					break
+				}
+			}
+			if len(header) == 0 {
+				break
+			}
+			if !strings.HasPrefix(header, "@") {
+				return "", 0, fmt.Errorf("Invalid FASTQ record: %s", header)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", 0, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", 0, err
+	}
+
+	return out.Name(), count, nil
+}
+
+// lockDbWrite serializes jobs writing to the same database. Returns the
+// function to release the lock.
+func (a *Application) lockDbWrite(name string) func() {
+	a.writeMu.Lock()
+	if a.writeLocks == nil {
+		a.writeLocks = make(map[string]*sync.Mutex)
+	}
+	mu, ok := a.writeLocks[name]
+	if !ok {
+		mu = &sync.Mutex{}
+		a.writeLocks[name] = mu
+	}
+	a.writeMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// loadJob returns a job which loads an uploaded sample into a database. The
+// served database is opened read-only, so the sample is loaded into a copy
+// which then replaces the original and the database is reloaded.
+func (a *Application) loadJob(dbname, dir string, options *LoadOptions, normalize bool, norm float64) func(j *Job) error {
+	return func(j *Job) error {
+		defer os.RemoveAll(dir)
+
+		options.Log = j.Logger()
+
+		j.SetProgress(0, "Reading uploaded reads")
+		fasta, total, err := prepareReads(options.FastaPath)
+		if err != nil {
+			return err
+		}
+		if total == 0 {
+			return fmt.Errorf("No reads found in uploaded file")
+		}
+		options.FastaPath = fasta
+		j.Logf("Found %d reads", total)
+
+		unlock := a.lockDbWrite(dbname)
+		defer unlock()
+
+		if err := j.Context().Err(); err != nil {
+			return err
+		}
+
+		db, err := a.AcquireDb(dbname)
+		if err != nil {
+			return err
+		}
+
+		dbpath, modTime, size := db.path, db.modTime, db.size
+		tmp := fmt.Sprintf("%s.load-%s", dbpath, j.ID)
+		defer os.Remove(tmp)
+
+		j.Logf("Copying database %s", dbname)
+		err = db.storage.DB.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(tmp, 0644)
+		})
+		db.release()
+		if err != nil {
+			return err
+		}
+
+		s, err := NewStorageWrite(tmp)
+		if err != nil {
+			return err
+		}
+
+		options.Progress = func(count int) {
+			j.SetProgress(0.9*float64(count)/float64(total), fmt.Sprintf("Loaded %d of %d reads", count, total))
+		}
+		err = loadSample(s, options)
+		if err == nil && normalize {
+			j.SetProgress(0.9, "Normalizing")
+			err = normalizeStorage(s, options.Gene, norm, options.Log)
+		}
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := j.Context().Err(); err != nil {
+			return err
+		}
+
+		// Refuse to overwrite changes made to the database while loading
+		fi, err := os.Stat(dbpath)
+		if err != nil {
+			return err
+		}
+		if !fi.ModTime().Equal(modTime) || fi.Size() != size {
+			return fmt.Errorf("Database %s was modified while loading. Please try again", dbname)
+		}
+
+		err = os.Rename(tmp, dbpath)
+		if err != nil {
+			return err
+		}
+
+		j.SetProgress(0.95, "Reloading database")
+		j.Logf("Reloading database %s", dbname)
+		return a.Reload()
+	}
+}
+
+// saveUpload writes an uploaded file to path
+func saveUpload(path string, fh *multipart.FileHeader) (string, error) {
+	in, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// sampleName returns the default sample name for an uploaded reads file
+func sampleName(filename string) string {
+	name := filepath.Base(filename)
+	for _, ext := range []string{".gz", ".fastq", ".fq", ".fasta", ".fa", ".fna"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	return name
+}
+
+// canUpload returns true if the request may load samples into the database.
+// Uploads write to the database so besides view access the request must be
+// from an admin or a user listed in uploaders.
+func (a *Application) canUpload(r *http.Request, dbname string) bool {
+	if !a.CanAccess(r, dbname) {
+		return false
+	}
+	if a.isAdmin(r) {
+		return true
+	}
+	if !a.authEnabled() {
+		return false
+	}
+
+	user := a.GetUserFromContext(r)
+	if user == nil {
+		return false
+	}
+	for _, name := range a.uploaders {
+		if name == user.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func UploadHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.enableUpload {
+			errorHandler(app, w, http.StatusNotFound)
+			return
+		}
+
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("upload handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		dbs := make(map[string]*Database)
+		for name, d := range app.AllowedDbs(r) {
+			if app.canUpload(r, name) {
+				dbs[name] = d
+			}
+		}
+		if len(dbs) == 0 {
+			errorHandler(app, w, http.StatusForbidden)
+			return
+		}
+
+		vars := map[string]interface{}{
+			"dbs":   dbs,
+			"curdb": db.name,
+			"Genes": db.genes,
+			"Base":  "T",
+			"Norm":  true,
+		}
+
+		if r.Method != "POST" {
+			renderTemplate(app, "upload.html", w, vars)
+			return
+		}
+
+		fail := func(status int, format string, args ...interface{}) {
+			vars["Error"] = fmt.Sprintf(format, args...)
+			w.WriteHeader(status)
+			renderTemplate(app, "upload.html", w, vars)
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, app.uploadMaxSize)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			fail(http.StatusBadRequest, "Invalid upload: %s", err)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		vars["Gene"] = r.FormValue("gene")
+		vars["Sample"] = r.FormValue("sample")
+		vars["KnockDown"] = r.FormValue("kd")
+		vars["Tet"] = r.FormValue("tet") == "1"
+		vars["Replicate"] = r.FormValue("rep")
+		vars["Base"] = r.FormValue("base")
+		vars["Offset"] = r.FormValue("offset")
+		vars["ExcludeSnps"] = r.FormValue("exclude_snps") == "1"
+		vars["SkipFrags"] = r.FormValue("skip_frags") == "1"
+		vars["Force"] = r.FormValue("force") == "1"
+		vars["Norm"] = r.FormValue("normalize") == "1"
+		vars["NormValue"] = r.FormValue("norm")
+
+		dbname := db.name
+		if len(r.FormValue("db")) > 0 {
+			dbname = r.FormValue("db")
+		}
+		if !app.CanAccess(r, dbname) {
+			fail(http.StatusForbidden, "Database not found: %s", dbname)
+			return
+		}
+		if !app.canUpload(r, dbname) {
+			fail(http.StatusForbidden, "Not allowed to upload to database: %s", dbname)
+			return
+		}
+		vars["curdb"] = dbname
+
+		options := &LoadOptions{
+			Gene:         strings.TrimSpace(r.FormValue("gene")),
+			Sample:       strings.TrimSpace(r.FormValue("sample")),
+			KnockDown:    strings.TrimSpace(r.FormValue("kd")),
+			EditBase:     strings.ToUpper(strings.TrimSpace(r.FormValue("base"))),
+			Tetracycline: r.FormValue("tet") == "1",
+			ExcludeSnps:  r.FormValue("exclude_snps") == "1",
+			SkipFrags:    r.FormValue("skip_frags") == "1",
+			Force:        r.FormValue("force") == "1",
+		}
+
+		if len(options.Gene) == 0 {
+			fail(http.StatusBadRequest, "Gene name is required")
+			return
+		}
+		if len(options.EditBase) != 1 {
+			fail(http.StatusBadRequest, "Edit base must be a single base")
+			return
+		}
+		if v := r.FormValue("rep"); len(v) > 0 {
+			options.Replicate, err = strconv.Atoi(v)
+			if err != nil || options.Replicate < 0 {
+				fail(http.StatusBadRequest, "Invalid replicate: %s", v)
+				return
+			}
+		}
+		if v := r.FormValue("offset"); len(v) > 0 {
+			options.EditOffset, err = strconv.Atoi(v)
+			if err != nil {
+				fail(http.StatusBadRequest, "Invalid edit site offset: %s", v)
+				return
+			}
+		}
+
+		normalize := r.FormValue("normalize") == "1"
+		norm := float64(0)
+		if v := r.FormValue("norm"); normalize && len(v) > 0 {
+			norm, err = strconv.ParseFloat(v, 64)
+			if err != nil || norm < 0 {
+				fail(http.StatusBadRequest, "Invalid normalization read count: %s", v)
+				return
+			}
+		}
+
+		reads := r.MultipartForm.File["reads"]
+		if len(reads) != 1 {
+			fail(http.StatusBadRequest, "Please choose a FASTA or FASTQ file to upload")
+			return
+		}
+		if len(options.Sample) == 0 {
+			options.Sample = sampleName(reads[0].Filename)
+		}
+
+		dir, err := ioutil.TempDir(app.uploadDir, "treat-upload-")
+		if err != nil {
+			logrus.Errorf("Failed to create upload directory: %s", err)
+			fail(http.StatusInternalServerError, "Failed to save upload")
+			return
+		}
+
+		options.FastaPath, err = saveUpload(filepath.Join(dir, "reads"), reads[0])
+		if err == nil {
+			if tmpls := r.MultipartForm.File["template"]; len(tmpls) == 1 {
+				name := "template.fasta"
+				if treat.IsTemplateSpecFile(tmpls[0].Filename) {
+					name = "template" + strings.ToLower(filepath.Ext(tmpls[0].Filename))
+				}
+				options.TemplatePath, err = saveUpload(filepath.Join(dir, name), tmpls[0])
+			}
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			logrus.Errorf("Failed to save upload: %s", err)
+			fail(http.StatusInternalServerError, "Failed to save upload")
+			return
+		}
+
+		owner := ""
+		if user := app.GetUserFromContext(r); user != nil {
+			owner = user.Name
+		}
+
+		title := fmt.Sprintf("Load sample %s gene %s into %s", options.Sample, options.Gene, dbname)
+		job := NewJob("load", title, owner, app.loadJob(dbname, dir, options, normalize, norm))
+		if err := app.jobs.Submit(job); err != nil {
+			os.RemoveAll(dir)
+			fail(http.StatusServiceUnavailable, "%s", err)
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"job":    job.ID,
+			"dbname": dbname,
+			"gene":   options.Gene,
+			"sample": options.Sample,
+			"user":   owner,
+		}).Info("Upload queued")
+
+		http.Redirect(w, r, "/jobs/"+job.ID, 302)
+	})
+}
+
+// canViewJob returns true if the request may view the job. With
+// authentication enabled users only see their own jobs, admins see all.
+func (a *Application) canViewJob(r *http.Request, j *Job) bool {
+	if !a.authEnabled() {
+		return true
+	}
+
+	user := a.GetUserFromContext(r)
+	if user == nil {
+		return false
+	}
+
+	return user.Name == j.Owner || a.isAdmin(r)
+}
+
+// visibleJobs returns the status of all jobs the request may view
+func (a *Application) visibleJobs(r *http.Request) []*JobStatus {
+	jobs := make([]*JobStatus, 0)
+	for _, j := range a.jobs.List() {
+		if a.canViewJob(r, j) {
+			jobs = append(jobs, j.Status(false))
+		}
+	}
+
+	return jobs
+}
+
+func JobsHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("jobs handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		vars := map[string]interface{}{
+			"dbs":   app.AllowedDbs(r),
+			"curdb": db.name,
+			"Jobs":  app.visibleJobs(r),
+		}
+
+		renderTemplate(app, "jobs.html", w, vars)
+	})
+}
+
+func JobHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("job handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		job, ok := app.jobs.Get(mux.Vars(r)["id"])
+		if !ok || !app.canViewJob(r, job) {
+			errorHandler(app, w, http.StatusNotFound)
+			return
+		}
+
+		vars := map[string]interface{}{
+			"dbs":   app.AllowedDbs(r),
+			"curdb": db.name,
+			"Job":   job.Status(true),
+		}
+
+		renderTemplate(app, "job.html", w, vars)
+	})
+}
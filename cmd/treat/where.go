@@ -0,0 +1,528 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ubccr/treat"
+)
+
+// Where expressions filter alignments by boolean combinations of comparisons
+// on the fields of the alignment and its sample, for example:
+//
+//   kd in (GAP1, MRB8180) and tet and junc_len > 10 and junc_seq contains "TTTT"
+//
+// Comparisons are =, !=, <, <=, >, >=, in (..) and contains. They are combined
+// with and, or, not and parentheses. A field on its own is true if it is set.
+// Keywords and field names are case insensitive, values are not. Values with
+// spaces or operator characters must be quoted.
+
+type whereKind int
+
+const (
+	whereString whereKind = iota
+	whereNumber
+	whereBool
+)
+
+type whereField struct {
+	kind whereKind
+	str  func(k *treat.AlignmentKey, a *treat.Alignment) string
+	num  func(k *treat.AlignmentKey, a *treat.Alignment) float64
+}
+
+func whereBoolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var whereFields = map[string]*whereField{
+	"gene": {kind: whereString, str: func(k *treat.AlignmentKey, a *treat.Alignment) string {
+		return k.Gene
+	}},
+	"sample": {kind: whereString, str: func(k *treat.AlignmentKey, a *treat.Alignment) string {
+		return k.Sample
+	}},
+	"kd": {kind: whereString, str: func(k *treat.AlignmentKey, a *treat.Alignment) string {
+		return k.KnockDown
+	}},
+	"rep": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(k.Replicate)
+	}},
+	"tet": {kind: whereBool, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return whereBoolValue(k.Tetracycline)
+	}},
+	"id": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.Id)
+	}},
+	"edit_stop": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.EditStop)
+	}},
+	"junc_start": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.JuncStart)
+	}},
+	"junc_end": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.JuncEnd)
+	}},
+	"junc_len": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.JuncLen)
+	}},
+	"junc_seq": {kind: whereString, str: func(k *treat.AlignmentKey, a *treat.Alignment) string {
+		return a.JuncSeq
+	}},
+	"read_count": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.ReadCount)
+	}},
+	"norm": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return a.Norm
+	}},
+	"has_mutation": {kind: whereBool, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return whereBoolValue(a.HasMutation > 0)
+	}},
+	"mismatches": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.Mismatches)
+	}},
+	"indel": {kind: whereBool, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return whereBoolValue(a.Indel > 0)
+	}},
+	"alt": {kind: whereNumber, num: func(k *treat.AlignmentKey, a *treat.Alignment) float64 {
+		return float64(a.AltEditing)
+	}},
+}
+
+// Alternate field names matching the search and export columns
+var whereAliases = map[string]string{
+	"knock_down":   "kd",
+	"knockdown":    "kd",
+	"replicate":    "rep",
+	"tetracycline": "tet",
+	"norm_count":   "norm",
+	"alt_editing":  "alt",
+}
+
+// WhereFieldNames returns the names of all fields of where expressions
+func WhereFieldNames() []string {
+	names := make([]string, 0, len(whereFields)+len(whereAliases))
+	for name := range whereFields {
+		names = append(names, name)
+	}
+	for name := range whereAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const (
+	whereTokenEOF = iota
+	whereTokenWord
+	whereTokenNumber
+	whereTokenString
+	whereTokenOp
+)
+
+type whereToken struct {
+	kind int
+	text string
+	num  float64
+	pos  int
+}
+
+func (t whereToken) String() string {
+	switch t.kind {
+	case whereTokenEOF:
+		return "end of expression"
+	case whereTokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// is returns true if t is the operator or case insensitive keyword s
+func (t whereToken) is(s string) bool {
+	switch t.kind {
+	case whereTokenOp:
+		return t.text == s
+	case whereTokenWord:
+		return strings.EqualFold(t.text, s)
+	}
+	return false
+}
+
+type whereError struct {
+	pos int
+	msg string
+}
+
+func (e *whereError) Error() string {
+	return fmt.Sprintf("Invalid where expression at position %d: %s", e.pos+1, e.msg)
+}
+
+func isWhereWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-+", r)
+}
+
+func lexWhere(query string) ([]whereToken, error) {
+	runes := []rune(query)
+	tokens := make([]whereToken, 0)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			var buf strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				buf.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, &whereError{i, "unterminated string"}
+			}
+			tokens = append(tokens, whereToken{kind: whereTokenString, text: buf.String(), pos: i})
+			i = j + 1
+		case strings.ContainsRune("(),", r):
+			tokens = append(tokens, whereToken{kind: whereTokenOp, text: string(r), pos: i})
+			i++
+		case strings.ContainsRune("=!<>&|", r):
+			op := string(r)
+			if i+1 < len(runes) {
+				switch two := op + string(runes[i+1]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "&" || op == "|" {
+				return nil, &whereError{i, fmt.Sprintf("unknown operator '%s'", op)}
+			}
+			tokens = append(tokens, whereToken{kind: whereTokenOp, text: op, pos: i})
+			i += len(op)
+		case isWhereWordRune(r):
+			j := i
+			for j < len(runes) && isWhereWordRune(runes[j]) {
+				j++
+			}
+			word := string(runes[i:j])
+			if n, err := strconv.ParseFloat(word, 64); err == nil {
+				tokens = append(tokens, whereToken{kind: whereTokenNumber, text: word, num: n, pos: i})
+			} else {
+				tokens = append(tokens, whereToken{kind: whereTokenWord, text: word, pos: i})
+			}
+			i = j
+		default:
+			return nil, &whereError{i, fmt.Sprintf("unexpected character '%c'", r)}
+		}
+	}
+
+	return append(tokens, whereToken{kind: whereTokenEOF, pos: len(runes)}), nil
+}
+
+type whereExpr interface {
+	match(k *treat.AlignmentKey, a *treat.Alignment) bool
+}
+
+type whereAnd struct{ left, right whereExpr }
+
+func (e *whereAnd) match(k *treat.AlignmentKey, a *treat.Alignment) bool {
+	return e.left.match(k, a) && e.right.match(k, a)
+}
+
+type whereOr struct{ left, right whereExpr }
+
+func (e *whereOr) match(k *treat.AlignmentKey, a *treat.Alignment) bool {
+	return e.left.match(k, a) || e.right.match(k, a)
+}
+
+type whereNot struct{ expr whereExpr }
+
+func (e *whereNot) match(k *treat.AlignmentKey, a *treat.Alignment) bool {
+	return !e.expr.match(k, a)
+}
+
+// whereTruth is a field on its own. Numbers are true if not 0, strings if not
+// empty.
+type whereTruth struct{ field *whereField }
+
+func (e *whereTruth) match(k *treat.AlignmentKey, a *treat.Alignment) bool {
+	if e.field.kind == whereString {
+		return len(e.field.str(k, a)) > 0
+	}
+	return e.field.num(k, a) != 0
+}
+
+type whereCompare struct {
+	field *whereField
+	op    string
+	strs  []string
+	nums  []float64
+}
+
+func (e *whereCompare) match(k *treat.AlignmentKey, a *treat.Alignment) bool {
+	if e.field.kind == whereString {
+		v := e.field.str(k, a)
+		switch e.op {
+		case "=":
+			return v == e.strs[0]
+		case "!=":
+			return v != e.strs[0]
+		case "contains":
+			return strings.Contains(v, e.strs[0])
+		}
+		for _, s := range e.strs {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	v := e.field.num(k, a)
+	switch e.op {
+	case "=":
+		return v == e.nums[0]
+	case "!=":
+		return v != e.nums[0]
+	case "<":
+		return v < e.nums[0]
+	case "<=":
+		return v <= e.nums[0]
+	case ">":
+		return v > e.nums[0]
+	case ">=":
+		return v >= e.nums[0]
+	}
+	for _, n := range e.nums {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+type whereParser struct {
+	tokens []whereToken
+	pos    int
+}
+
+func (p *whereParser) peek() whereToken {
+	return p.tokens[p.pos]
+}
+
+func (p *whereParser) next() whereToken {
+	t := p.tokens[p.pos]
+	if t.kind != whereTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *whereParser) expect(op string) error {
+	if t := p.next(); !t.is(op) {
+		return &whereError{t.pos, fmt.Sprintf("expected '%s' but found %s", op, t)}
+	}
+	return nil
+}
+
+func (p *whereParser) parseOr() (whereExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("or") || p.peek().is("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *whereParser) parseAnd() (whereExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("and") || p.peek().is("&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *whereParser) parseNot() (whereExpr, error) {
+	if p.peek().is("not") || p.peek().is("!") {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &whereNot{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *whereParser) parsePrimary() (whereExpr, error) {
+	t := p.next()
+	if t.is("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	if t.kind != whereTokenWord {
+		return nil, &whereError{t.pos, fmt.Sprintf("expected a field name but found %s", t)}
+	}
+
+	name := strings.ToLower(t.text)
+	if alias, ok := whereAliases[name]; ok {
+		name = alias
+	}
+	field, ok := whereFields[name]
+	if !ok {
+		return nil, &whereError{t.pos, fmt.Sprintf("unknown field '%s'. Must be one of %s", t.text, strings.Join(WhereFieldNames(), ", "))}
+	}
+
+	opToken := p.peek()
+	op := strings.ToLower(opToken.text)
+	switch {
+	case opToken.kind == whereTokenOp && (op == "=" || op == "==" || op == "!=" || op == "<" || op == "<=" || op == ">" || op == ">="):
+	case opToken.kind == whereTokenWord && (op == "in" || op == "contains"):
+	default:
+		return &whereTruth{field}, nil
+	}
+	p.next()
+	if op == "==" {
+		op = "="
+	}
+
+	switch {
+	case op == "contains" && field.kind != whereString:
+		return nil, &whereError{opToken.pos, fmt.Sprintf("contains can only be used with text fields not %s", t.text)}
+	case (op == "<" || op == "<=" || op == ">" || op == ">=") && field.kind != whereNumber:
+		return nil, &whereError{opToken.pos, fmt.Sprintf("%s can only be used with numeric fields not %s", op, t.text)}
+	}
+
+	values := make([]whereToken, 0)
+	value := func() error {
+		v := p.next()
+		if v.kind == whereTokenEOF || v.kind == whereTokenOp {
+			return &whereError{v.pos, fmt.Sprintf("expected a value but found %s", v)}
+		}
+		values = append(values, v)
+		return nil
+	}
+	if op == "in" {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			if err := value(); err != nil {
+				return nil, err
+			}
+			if p.peek().is(",") {
+				p.next()
+				continue
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	} else if err := value(); err != nil {
+		return nil, err
+	}
+
+	cmp := &whereCompare{field: field, op: op}
+	for _, v := range values {
+		switch field.kind {
+		case whereString:
+			cmp.strs = append(cmp.strs, v.text)
+		case whereNumber:
+			if v.kind != whereTokenNumber {
+				return nil, &whereError{v.pos, fmt.Sprintf("%s is not a number", v)}
+			}
+			cmp.nums = append(cmp.nums, v.num)
+		case whereBool:
+			switch strings.ToLower(v.text) {
+			case "true", "1":
+				cmp.nums = append(cmp.nums, 1)
+			case "false", "0":
+				cmp.nums = append(cmp.nums, 0)
+			default:
+				return nil, &whereError{v.pos, fmt.Sprintf("%s must be true or false", t.text)}
+			}
+		}
+	}
+
+	return cmp, nil
+}
+
+// Where is a parsed where expression
+type Where struct {
+	expr whereExpr
+}
+
+// ParseWhere parses the where expression query. Returns nil if query is
+// blank.
+func ParseWhere(query string) (*Where, error) {
+	tokens, err := lexWhere(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, nil
+	}
+
+	p := &whereParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != whereTokenEOF {
+		return nil, &whereError{t.pos, fmt.Sprintf("unexpected %s", t)}
+	}
+
+	return &Where{expr: expr}, nil
+}
+
+// Match returns true if the alignment a of the sample with key k matches the
+// expression
+func (w *Where) Match(k *treat.AlignmentKey, a *treat.Alignment) bool {
+	return w.expr.match(k, a)
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ubccr/treat"
+)
+
+var (
+	whereTestKey = &treat.AlignmentKey{
+		Gene:         "RPS12",
+		Sample:       `wt "A" 1`,
+		KnockDown:    "MRB8180",
+		Tetracycline: true,
+		Replicate:    2,
+	}
+	whereTestAlignment = &treat.Alignment{
+		Id:         7,
+		EditStop:   40,
+		JuncStart:  38,
+		JuncEnd:    52,
+		JuncLen:    12,
+		JuncSeq:    "ACTTTTG",
+		ReadCount:  25,
+		Norm:       12.5,
+		Mismatches: 1,
+	}
+)
+
+func TestWhereMatch(t *testing.T) {
+	tests := []struct {
+		query string
+		match bool
+	}{
+		// Fields on their own
+		{"tet", true},
+		{"gene", true},
+		{"junc_len", true},
+		{"mismatches", true},
+		{"has_mutation", false},
+		{"indel", false},
+
+		// Numbers
+		{"edit_stop = 40", true},
+		{"edit_stop == 40", true},
+		{"edit_stop != 40", false},
+		{"edit_stop < 40", false},
+		{"edit_stop <= 40", true},
+		{"junc_end > 51", true},
+		{"junc_end >= 53", false},
+		{"norm = 12.5", true},
+		{"norm > 12.4", true},
+		{"edit_stop != -1", true},
+		{"id = 7", true},
+		{"read_count == 25", true},
+
+		// Booleans
+		{"tet = true", true},
+		{"tet = false", false},
+		{"has_mutation = 0", true},
+		{"indel = 1", false},
+
+		// Strings are case sensitive, keywords and field names are not
+		{"kd = MRB8180", true},
+		{"kd = mrb8180", false},
+		{"KD = MRB8180", true},
+		{"kd != GAP1", true},
+		{"TET AND Rep = 2", true},
+
+		// in
+		{"kd in (GAP1, MRB8180)", true},
+		{"kd in (GAP1)", false},
+		{"kd IN ('MRB8180')", true},
+		{"rep in (1, 3)", false},
+		{"rep in (2)", true},
+		{"tet in (false, true)", true},
+
+		// contains
+		{"junc_seq contains TTTT", true},
+		{`junc_seq contains "TTTT"`, true},
+		{"junc_seq contains GG", false},
+		{"gene CONTAINS PS", true},
+
+		// Quoting and escapes
+		{`sample = "wt \"A\" 1"`, true},
+		{`sample = 'wt "A" 1'`, true},
+		{`sample = "wt \"A\""`, false},
+		{`sample in ("x", 'wt "A" 1')`, true},
+		{`junc_seq contains "T\"T"`, false},
+		{`junc_seq contains "\TT"`, true},
+
+		// Aliases
+		{"knock_down = MRB8180", true},
+		{"knockdown = MRB8180", true},
+		{"replicate = 2", true},
+		{"tetracycline", true},
+		{"norm_count >= 12.5", true},
+		{"alt_editing = 0", true},
+		{"alt", false},
+
+		// and binds tighter than or, not tighter than and
+		{"tet or rep = 5 and junc_len > 100", true},
+		{"(tet or rep = 5) and junc_len > 100", false},
+		{"rep = 5 and junc_len > 100 or tet", true},
+		{"rep = 5 and (junc_len > 100 or tet)", false},
+		{"not tet or rep = 2", true},
+		{"not (tet or rep = 2)", false},
+		{"not tet and rep = 2", false},
+		{"not not tet", true},
+		{"! tet", false},
+		{"!indel && tet", true},
+		{"indel || tet", true},
+		{"((tet))", true},
+		{"(indel or (has_mutation or kd = MRB8180)) and not (edit_stop < 10)", true},
+	}
+
+	for _, test := range tests {
+		w, err := ParseWhere(test.query)
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err)
+			continue
+		}
+		if w == nil {
+			t.Errorf("%s: no expression parsed", test.query)
+			continue
+		}
+		if m := w.Match(whereTestKey, whereTestAlignment); m != test.match {
+			t.Errorf("%s: wrong match %t != %t", test.query, m, test.match)
+		}
+	}
+}
+
+func TestWhereBlank(t *testing.T) {
+	for _, query := range []string{"", "   ", "\t\n"} {
+		w, err := ParseWhere(query)
+		if err != nil || w != nil {
+			t.Errorf("%q: expected no expression and no error, got %v, %v", query, w, err)
+		}
+	}
+}
+
+func TestWhereErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		// Position of the error starting at 1
+		pos int
+		msg string
+	}{
+		{"junc_len > ten", 12, "'ten' is not a number"},
+		{`junc_len = "10"`, 12, `"10" is not a number`},
+		{"kd > GAP1", 4, "> can only be used with numeric fields not kd"},
+		{"tet >= 1", 5, ">= can only be used with numeric fields not tet"},
+		{"rep contains 1", 5, "contains can only be used with text fields not rep"},
+		{"tet = maybe", 7, "tet must be true or false"},
+		{"foo = 1", 1, "unknown field 'foo'. Must be one of"},
+		{"tet and bar", 9, "unknown field 'bar'"},
+		{"(tet or rep = 2", 16, "expected ')' but found end of expression"},
+		{"tet and", 8, "expected a field name but found end of expression"},
+		{"tet and )", 9, "expected a field name but found ')'"},
+		{"= 1", 1, "expected a field name but found '='"},
+		{`sample = "abc`, 10, "unterminated string"},
+		{`sample = 'abc"`, 10, "unterminated string"},
+		{"tet & rep", 5, "unknown operator '&'"},
+		{"tet | rep", 5, "unknown operator '|'"},
+		{"tet # 1", 5, "unexpected character '#'"},
+		{"kd in (GAP1 MRB8180)", 13, "expected ')' but found 'MRB8180'"},
+		{"kd in GAP1", 7, "expected '(' but found 'GAP1'"},
+		{"kd in (GAP1,)", 13, "expected a value but found ')'"},
+		{"kd in ()", 8, "expected a value but found ')'"},
+		{"kd =", 5, "expected a value but found end of expression"},
+		{"kd = (", 6, "expected a value but found '('"},
+		{"tet rep", 5, "unexpected 'rep'"},
+		{"tet)", 4, "unexpected ')'"},
+	}
+
+	for _, test := range tests {
+		w, err := ParseWhere(test.query)
+		if err == nil {
+			t.Errorf("%s: expected error, got %v", test.query, w)
+			continue
+		}
+
+		werr, ok := err.(*whereError)
+		if !ok {
+			t.Errorf("%s: wrong error type %T", test.query, err)
+			continue
+		}
+		if werr.pos+1 != test.pos {
+			t.Errorf("%s: wrong error position %d != %d: %s", test.query, werr.pos+1, test.pos, err)
+		}
+		if !strings.HasPrefix(werr.msg, test.msg) {
+			t.Errorf("%s: wrong error message %q != %q", test.query, werr.msg, test.msg)
+		}
+	}
+
+	_, err := ParseWhere("junc_len > ten")
+	if want := "Invalid where expression at position 12: 'ten' is not a number"; err == nil || err.Error() != want {
+		t.Errorf("Wrong error string %v != %s", err, want)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/aebruno/nwalgo v0.0.0-20160817130739-4a232086e3ad
 	github.com/boltdb/bolt v1.3.1
 	github.com/carbocation/interpose v0.0.0-20161206215253-723534742ba3
+	github.com/google/flatbuffers v1.12.1
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/schema v1.1.0
@@ -14,5 +15,7 @@ require (
 	github.com/sirupsen/logrus v1.4.2
 	github.com/urfave/cli v1.21.0
 	github.com/willf/bitset v1.1.10
+	golang.org/x/crypto v0.10.0
 	gopkg.in/vmihailenco/msgpack.v2 v2.9.1
+	gopkg.in/yaml.v2 v2.4.0
 )
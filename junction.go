@@ -0,0 +1,229 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// JuncVariant is a single distinct junction sequence observed at an edit stop
+type JuncVariant struct {
+	Seq       string
+	EditStop  int
+	JuncEnd   int
+	JuncLen   int
+	Sites     []uint32
+	Norm      map[string]float64
+	ReadCount map[string]uint32
+	Total     float64
+}
+
+// JuncCluster groups identical and near-identical junction sequences sharing
+// the same edit stop. Variants are sorted by abundance so Variants[0] is the
+// dominant junction form.
+type JuncCluster struct {
+	EditStop int
+	Variants []*JuncVariant
+	Norm     map[string]float64
+	Total    float64
+}
+
+// JuncSummary accumulates junction sequences from alignments and clusters
+// them per edit stop.
+type JuncSummary struct {
+	EditBase rune
+	MaxDist  int
+	variants map[int]map[string]*JuncVariant
+	samples  map[string]bool
+}
+
+func NewJuncSummary(base rune, maxDist int) *JuncSummary {
+	if maxDist < 0 {
+		maxDist = 0
+	}
+
+	return &JuncSummary{
+		EditBase: unicode.ToUpper(base),
+		MaxDist:  maxDist,
+		variants: make(map[int]map[string]*JuncVariant),
+		samples:  make(map[string]bool),
+	}
+}
+
+// JuncSites returns the edit base count at each edit site of a junction
+// sequence. Sites are ordered 5' -> 3' which is from JuncEnd down to
+// EditStop+1.
+func JuncSites(seq string, base rune) []uint32 {
+	base = unicode.ToUpper(base)
+	sites := make([]uint32, 0)
+	count := uint32(0)
+	for _, r := range strings.ToUpper(seq) {
+		if r == base {
+			count++
+			continue
+		}
+		sites = append(sites, count)
+		count = 0
+	}
+
+	if count > 0 {
+		sites = append(sites, count)
+	}
+
+	return sites
+}
+
+// Add records the junction sequence of an alignment for the given sample.
+// Alignments without a junction sequence are ignored.
+func (s *JuncSummary) Add(sample string, a *Alignment) {
+	if a.JuncLen <= 0 || len(a.JuncSeq) == 0 {
+		return
+	}
+
+	s.samples[sample] = true
+
+	es, ok := s.variants[a.EditStop]
+	if !ok {
+		es = make(map[string]*JuncVariant)
+		s.variants[a.EditStop] = es
+	}
+
+	v, ok := es[a.JuncSeq]
+	if !ok {
+		v = &JuncVariant{
+			Seq:       a.JuncSeq,
+			EditStop:  a.EditStop,
+			JuncEnd:   a.JuncEnd,
+			JuncLen:   a.JuncLen,
+			Sites:     JuncSites(a.JuncSeq, s.EditBase),
+			Norm:      make(map[string]float64),
+			ReadCount: make(map[string]uint32),
+		}
+		es[a.JuncSeq] = v
+	}
+
+	v.Norm[sample] += a.Norm
+	v.ReadCount[sample] += a.ReadCount
+	v.Total += a.Norm
+}
+
+// Samples returns the sorted list of samples seen by the summary
+func (s *JuncSummary) Samples() []string {
+	list := make([]string, 0, len(s.samples))
+	for k := range s.samples {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Clusters groups variants at each edit stop. Variants are visited from most
+// to least abundant and joined to the first cluster whose dominant sequence
+// is within MaxDist edits, otherwise they seed a new cluster. Clusters are
+// returned ordered by edit stop and then abundance.
+func (s *JuncSummary) Clusters() []*JuncCluster {
+	stops := make([]int, 0, len(s.variants))
+	for es := range s.variants {
+		stops = append(stops, es)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(stops)))
+
+	clusters := make([]*JuncCluster, 0)
+	for _, es := range stops {
+		vlist := make([]*JuncVariant, 0, len(s.variants[es]))
+		for _, v := range s.variants[es] {
+			vlist = append(vlist, v)
+		}
+		sortVariants(vlist)
+
+		group := make([]*JuncCluster, 0)
+		for _, v := range vlist {
+			var cluster *JuncCluster
+			for _, c := range group {
+				if editDistance(c.Variants[0].Seq, v.Seq) <= s.MaxDist {
+					cluster = c
+					break
+				}
+			}
+
+			if cluster == nil {
+				cluster = &JuncCluster{EditStop: es, Norm: make(map[string]float64)}
+				group = append(group, cluster)
+			}
+
+			cluster.Variants = append(cluster.Variants, v)
+			cluster.Total += v.Total
+			for sample, n := range v.Norm {
+				cluster.Norm[sample] += n
+			}
+		}
+
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Total > group[j].Total
+		})
+		clusters = append(clusters, group...)
+	}
+
+	return clusters
+}
+
+func sortVariants(vlist []*JuncVariant) {
+	sort.Slice(vlist, func(i, j int) bool {
+		if vlist[i].Total == vlist[j].Total {
+			return vlist[i].Seq < vlist[j].Seq
+		}
+		return vlist[i].Total > vlist[j].Total
+	})
+}
+
+// Levenshtein distance between two sequences
+func editDistance(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			d := prev[j] + 1
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < d {
+				d = prev[j-1] + cost
+			}
+			cur[j] = d
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
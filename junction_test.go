@@ -0,0 +1,82 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJuncSites(t *testing.T) {
+	sites := JuncSites("TTGATCTTT", 't')
+	expect := []uint32{2, 0, 1, 3}
+	if !reflect.DeepEqual(sites, expect) {
+		t.Errorf("Wrong junction sites. %v != %v", sites, expect)
+	}
+}
+
+func TestJuncClusters(t *testing.T) {
+	s := NewJuncSummary('t', 1)
+
+	s.Add("wt", &Alignment{EditStop: 10, JuncEnd: 12, JuncLen: 2, JuncSeq: "TTGTA", Norm: 50, ReadCount: 50})
+	s.Add("kd", &Alignment{EditStop: 10, JuncEnd: 12, JuncLen: 2, JuncSeq: "TTGTA", Norm: 10, ReadCount: 10})
+	s.Add("wt", &Alignment{EditStop: 10, JuncEnd: 12, JuncLen: 2, JuncSeq: "TGTA", Norm: 5, ReadCount: 5})
+	s.Add("kd", &Alignment{EditStop: 10, JuncEnd: 13, JuncLen: 3, JuncSeq: "GACTTTC", Norm: 20, ReadCount: 20})
+	s.Add("kd", &Alignment{EditStop: 4, JuncEnd: 5, JuncLen: 1, JuncSeq: "TA", Norm: 1, ReadCount: 1})
+	s.Add("kd", &Alignment{EditStop: 4, JuncEnd: 4, JuncLen: 0, Norm: 100, ReadCount: 100})
+
+	clusters := s.Clusters()
+	if len(clusters) != 3 {
+		t.Fatalf("Wrong number of clusters. %d != %d", len(clusters), 3)
+	}
+
+	c := clusters[0]
+	if c.EditStop != 10 || len(c.Variants) != 2 || c.Variants[0].Seq != "TTGTA" {
+		t.Errorf("Wrong dominant cluster: %+v", c)
+	}
+	if c.Total != 65 || c.Norm["wt"] != 55 || c.Norm["kd"] != 10 {
+		t.Errorf("Wrong cluster abundance: %+v", c.Norm)
+	}
+
+	if clusters[1].Variants[0].Seq != "GACTTTC" {
+		t.Errorf("Wrong second cluster: %s", clusters[1].Variants[0].Seq)
+	}
+	if clusters[2].EditStop != 4 {
+		t.Errorf("Wrong edit stop ordering: %d", clusters[2].EditStop)
+	}
+
+	samples := s.Samples()
+	if !reflect.DeepEqual(samples, []string{"kd", "wt"}) {
+		t.Errorf("Wrong samples: %v", samples)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := map[[2]string]int{
+		{"TTGTA", "TTGTA"}: 0,
+		{"TTGTA", "TGTA"}:  1,
+		{"", "GA"}:         2,
+		{"GATTC", "GACTC"}: 1,
+	}
+
+	for pair, d := range tests {
+		if x := editDistance(pair[0], pair[1]); x != d {
+			t.Errorf("Wrong edit distance for %v. %d != %d", pair, x, d)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"math"
+	"sort"
+)
+
+// EditMetrics are scalar summaries of editing progression in a sample
+type EditMetrics struct {
+	MeanEditStop    float64 `json:"mean_edit_stop"`
+	MedianEditStop  float64 `json:"median_edit_stop"`
+	FracFullyEdited float64 `json:"frac_fully_edited"`
+	FracPreEdited   float64 `json:"frac_pre_edited"`
+	MeanJuncLen     float64 `json:"mean_junc_len"`
+	FracJunction    float64 `json:"frac_junction"`
+	Entropy         float64 `json:"entropy"`
+}
+
+// EditSummary accumulates weighted alignments of a single sample
+type EditSummary struct {
+	tmpl      *Template
+	total     float64
+	editStops map[int]float64
+	juncLen   float64
+	junc      float64
+	full      float64
+	pre       float64
+}
+
+func NewEditSummary(tmpl *Template) *EditSummary {
+	return &EditSummary{tmpl: tmpl, editStops: make(map[int]float64)}
+}
+
+// IsFullyEdited returns true if the alignment matches the fully edited
+// template across all edit sites
+func (tmpl *Template) IsFullyEdited(a *Alignment) bool {
+	return a.EditStop == tmpl.Len()-1+int(tmpl.EditOffset) && a.JuncLen == 0
+}
+
+// IsPreEdited returns true if the alignment has no editing beyond the
+// template edit stop
+func (tmpl *Template) IsPreEdited(a *Alignment) bool {
+	return a.EditStop == tmpl.EditStop && a.JuncLen == 0
+}
+
+// Add records an alignment with the given weight, typically the read count
+func (e *EditSummary) Add(a *Alignment, weight float64) {
+	if weight <= 0 {
+		return
+	}
+
+	e.total += weight
+	e.editStops[a.EditStop] += weight
+	e.juncLen += float64(a.JuncLen) * weight
+	if a.JuncLen > 0 {
+		e.junc += weight
+	}
+	if e.tmpl.IsFullyEdited(a) {
+		e.full += weight
+	} else if e.tmpl.IsPreEdited(a) {
+		e.pre += weight
+	}
+}
+
+// Metrics computes the editing metrics of all alignments added so far. The
+// entropy of the edit stop distribution is reported in bits.
+func (e *EditSummary) Metrics() *EditMetrics {
+	m := &EditMetrics{}
+	if e.total == 0 {
+		return m
+	}
+
+	stops := make([]int, 0, len(e.editStops))
+	for es := range e.editStops {
+		stops = append(stops, es)
+	}
+	sort.Ints(stops)
+
+	mean := 0.0
+	cum := 0.0
+	median := math.NaN()
+	for _, es := range stops {
+		w := e.editStops[es]
+		mean += float64(es) * w
+		cum += w
+		if math.IsNaN(median) && cum >= e.total/2 {
+			median = float64(es)
+		}
+
+		p := w / e.total
+		m.Entropy -= p * math.Log2(p)
+	}
+
+	m.MeanEditStop = mean / e.total
+	m.MedianEditStop = median
+	m.FracFullyEdited = e.full / e.total
+	m.FracPreEdited = e.pre / e.total
+	m.MeanJuncLen = e.juncLen / e.total
+	m.FracJunction = e.junc / e.total
+
+	return m
+}
+
+// MeanMetrics averages metrics, for example across replicates
+func MeanMetrics(list []*EditMetrics) *EditMetrics {
+	mean := &EditMetrics{}
+	if len(list) == 0 {
+		return mean
+	}
+
+	for _, m := range list {
+		mean.MeanEditStop += m.MeanEditStop
+		mean.MedianEditStop += m.MedianEditStop
+		mean.FracFullyEdited += m.FracFullyEdited
+		mean.FracPreEdited += m.FracPreEdited
+		mean.MeanJuncLen += m.MeanJuncLen
+		mean.FracJunction += m.FracJunction
+		mean.Entropy += m.Entropy
+	}
+
+	n := float64(len(list))
+	mean.MeanEditStop /= n
+	mean.MedianEditStop /= n
+	mean.FracFullyEdited /= n
+	mean.FracPreEdited /= n
+	mean.MeanJuncLen /= n
+	mean.FracJunction /= n
+	mean.Entropy /= n
+
+	return mean
+}
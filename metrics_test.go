@@ -0,0 +1,66 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"testing"
+)
+
+func TestEditMetrics(t *testing.T) {
+	fe := NewFragment("fe", "TTTCTGAGTTTAGTAT", FORWARD, 't')
+	pe := NewFragment("pe", "TTTTTTCTTTTGAGTTTTTTAGTATT", FORWARD, 't')
+
+	tmpl, err := NewTemplate(fe, pe, nil, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	full := tmpl.Len() - 1
+	s := NewEditSummary(tmpl)
+	s.Add(&Alignment{EditStop: full, JuncLen: 0}, 1)
+	s.Add(&Alignment{EditStop: tmpl.EditStop, JuncLen: 0}, 1)
+	s.Add(&Alignment{EditStop: 3, JuncLen: 2}, 2)
+	s.Add(&Alignment{EditStop: 3, JuncLen: 4}, 0)
+
+	m := s.Metrics()
+	if m.FracFullyEdited != 0.25 || m.FracPreEdited != 0.25 {
+		t.Errorf("Wrong fully/pre edited fractions: %+v", m)
+	}
+	if m.FracJunction != 0.5 || m.MeanJuncLen != 1 {
+		t.Errorf("Wrong junction metrics: %+v", m)
+	}
+	if m.MedianEditStop != 3 {
+		t.Errorf("Wrong median edit stop. %f != %f", m.MedianEditStop, 3.0)
+	}
+	mean := float64(full+tmpl.EditStop+6) / 4
+	if m.MeanEditStop != mean {
+		t.Errorf("Wrong mean edit stop. %f != %f", m.MeanEditStop, mean)
+	}
+	if m.Entropy != 1.5 {
+		t.Errorf("Wrong entropy. %f != %f", m.Entropy, 1.5)
+	}
+
+	avg := MeanMetrics([]*EditMetrics{m, &EditMetrics{}})
+	if avg.FracJunction != 0.25 {
+		t.Errorf("Wrong mean metrics: %+v", avg)
+	}
+
+	if e := NewEditSummary(tmpl).Metrics(); e.MeanEditStop != 0 {
+		t.Errorf("Empty summary should have zero metrics: %+v", e)
+	}
+}
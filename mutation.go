@@ -0,0 +1,281 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aebruno/nwalgo"
+)
+
+const (
+	MUTATION_SNP = "SNP"
+	MUTATION_INS = "INS"
+	MUTATION_DEL = "DEL"
+)
+
+// Mutation is a SNP or indel of non-edit bases relative to the template.
+// EditSite is the label of the edit site immediately 5' of the first
+// reference base (or the insertion point) and respects the template
+// EditOffset. Pos is the 1-based position of that base in the pre-edited
+// template sequence. Anchor is the pre-edited base preceding Pos, used for
+// VCF style indel records.
+type Mutation struct {
+	Type     string
+	EditSite int
+	Pos      int
+	Ref      string
+	Alt      string
+	Anchor   string
+}
+
+// Key uniquely identifies a mutation
+func (m *Mutation) Key() string {
+	return fmt.Sprintf("%d:%s:%s:%s", m.Pos, m.Type, m.Ref, m.Alt)
+}
+
+// preEditedPos returns the 1-based position of each non-edit template base in
+// the pre-edited sequence along with the pre-edited sequence itself
+func (tmpl *Template) preEditedPos() ([]int, string) {
+	var buf strings.Builder
+	pos := make([]int, len(tmpl.Bases)+1)
+	for i, t := range tmpl.EditSite[1] {
+		buf.WriteString(strings.Repeat(string(tmpl.EditBase), int(t)))
+		pos[i] = buf.Len() + 1
+		if i < len(tmpl.Bases) {
+			buf.WriteByte(tmpl.Bases[i])
+		}
+	}
+
+	return pos, buf.String()
+}
+
+// FindMutations aligns the non-edit bases of frag against the template and
+// returns all SNPs and indels. Consecutive indel columns are merged into a
+// single event.
+func FindMutations(frag *Fragment, tmpl *Template) []*Mutation {
+	aln1, aln2, _ := nwalgo.Align(tmpl.Bases, frag.Bases, 1, -1, -1)
+	pos, seq := tmpl.preEditedPos()
+	n := tmpl.Len()
+
+	newMutation := func(mtype string, ti int) *Mutation {
+		m := &Mutation{
+			Type:     mtype,
+			EditSite: tmpl.IndexLabel((n - 1) - ti),
+			Pos:      pos[ti],
+			Anchor:   "N",
+		}
+		if m.Pos >= 2 {
+			m.Anchor = string(seq[m.Pos-2])
+		}
+		return m
+	}
+
+	mutations := make([]*Mutation, 0)
+	var cur *Mutation
+
+	ti := 0
+	for ai := 0; ai < len(aln1); ai++ {
+		switch {
+		case aln1[ai] == '-':
+			if cur == nil || cur.Type != MUTATION_INS {
+				cur = newMutation(MUTATION_INS, ti)
+				mutations = append(mutations, cur)
+			}
+			cur.Alt += string(aln2[ai])
+			continue
+		case aln2[ai] == '-':
+			if cur == nil || cur.Type != MUTATION_DEL {
+				cur = newMutation(MUTATION_DEL, ti)
+				mutations = append(mutations, cur)
+			}
+			cur.Ref += string(aln1[ai])
+		case aln1[ai] != aln2[ai]:
+			cur = nil
+			m := newMutation(MUTATION_SNP, ti)
+			m.Ref = string(aln1[ai])
+			m.Alt = string(aln2[ai])
+			mutations = append(mutations, m)
+		default:
+			cur = nil
+		}
+		ti++
+	}
+
+	return mutations
+}
+
+// CatalogEntry is a mutation along with its weighted read count per sample
+type CatalogEntry struct {
+	*Mutation
+	Counts map[string]float64
+}
+
+// MutationCatalog aggregates mutations across fragments and samples
+type MutationCatalog struct {
+	Gene    string
+	tmpl    *Template
+	entries map[string]*CatalogEntry
+	totals  map[string]float64
+}
+
+func NewMutationCatalog(gene string, tmpl *Template) *MutationCatalog {
+	return &MutationCatalog{
+		Gene:    gene,
+		tmpl:    tmpl,
+		entries: make(map[string]*CatalogEntry),
+		totals:  make(map[string]float64),
+	}
+}
+
+// Add records the mutations found in frag with the given weight, typically
+// the read count
+func (c *MutationCatalog) Add(sample string, frag *Fragment, weight float64) {
+	c.totals[sample] += weight
+
+	for _, m := range FindMutations(frag, c.tmpl) {
+		e, ok := c.entries[m.Key()]
+		if !ok {
+			e = &CatalogEntry{Mutation: m, Counts: make(map[string]float64)}
+			c.entries[m.Key()] = e
+		}
+		e.Counts[sample] += weight
+	}
+}
+
+// Samples returns the sorted list of samples in the catalog
+func (c *MutationCatalog) Samples() []string {
+	list := make([]string, 0, len(c.totals))
+	for k := range c.totals {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Total returns the total weight of a sample
+func (c *MutationCatalog) Total(sample string) float64 {
+	return c.totals[sample]
+}
+
+// Frequency returns the fraction of a sample carrying the mutation
+func (c *MutationCatalog) Frequency(e *CatalogEntry, sample string) float64 {
+	if c.totals[sample] == 0 {
+		return 0
+	}
+
+	return e.Counts[sample] / c.totals[sample]
+}
+
+// Entries returns all mutations ordered by position
+func (c *MutationCatalog) Entries() []*CatalogEntry {
+	list := make([]*CatalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		list = append(list, e)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Pos != list[j].Pos {
+			return list[i].Pos < list[j].Pos
+		}
+		return list[i].Key() < list[j].Key()
+	})
+
+	return list
+}
+
+// WriteVCF writes the catalog as a VCF-like file. Positions refer to the
+// pre-edited template sequence and per sample columns hold the read count
+// and frequency of each mutation. Deletions of non-edit bases separated by
+// edit sites keep the edit bases in between, so REF is the pre-edited
+// sequence at POS.
+func (c *MutationCatalog) WriteVCF(w io.Writer) error {
+	samples := c.Samples()
+	pos, seq := c.tmpl.preEditedPos()
+	index := make(map[int]int, len(pos))
+	for i, p := range pos {
+		index[p] = i
+	}
+
+	header := []string{
+		"##fileformat=VCFv4.2",
+		"##source=treat",
+		fmt.Sprintf("##contig=<ID=%s,length=%d>", c.Gene, len(c.tmpl.preEditedSeq())),
+		`##INFO=<ID=TYPE,Number=1,Type=String,Description="Mutation type (SNP, INS, DEL)">`,
+		`##INFO=<ID=ES,Number=1,Type=Integer,Description="Edit site 5' of the mutation">`,
+		`##FORMAT=<ID=RC,Number=1,Type=Float,Description="Read count">`,
+		`##FORMAT=<ID=AF,Number=1,Type=Float,Description="Fraction of sample reads">`,
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t" + strings.Join(samples, "\t"),
+	}
+
+	for _, h := range header {
+		if _, err := fmt.Fprintln(w, h); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range c.Entries() {
+		at, ref, alt := e.Pos, e.Ref, e.Alt
+		if e.Type == MUTATION_DEL {
+			// Pre-edited sequence from the first to the last deleted base
+			last := pos[index[e.Pos]+len(e.Ref)-1]
+			ref = seq[e.Pos-1 : last]
+			alt = strings.Map(func(r rune) rune {
+				if r == c.tmpl.EditBase {
+					return r
+				}
+				return -1
+			}, ref)
+		}
+		if e.Type != MUTATION_SNP {
+			// Indels are anchored on the preceding base
+			at--
+			ref = e.Anchor + ref
+			alt = e.Anchor + alt
+		}
+
+		cols := []string{
+			c.Gene,
+			fmt.Sprintf("%d", at),
+			".",
+			ref,
+			alt,
+			".",
+			"PASS",
+			fmt.Sprintf("TYPE=%s;ES=%d", e.Type, e.EditSite),
+			"RC:AF",
+		}
+		for _, s := range samples {
+			cols = append(cols, fmt.Sprintf("%.0f:%.6f", e.Counts[s], c.Frequency(e, s)))
+		}
+
+		if _, err := fmt.Fprintln(w, strings.Join(cols, "\t")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tmpl *Template) preEditedSeq() string {
+	_, seq := tmpl.preEditedPos()
+	return seq
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFindMutations(t *testing.T) {
+	fe := NewFragment("fe", "TTTCTGAGTTTAGTAT", FORWARD, 't')
+	pe := NewFragment("pe", "TTTTTTCTTTTGAGTTTTTTAGTATT", FORWARD, 't')
+
+	tmpl, err := NewTemplate(fe, pe, nil, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tmpl.SetOffset(10)
+
+	if m := FindMutations(fe, tmpl); len(m) != 0 {
+		t.Errorf("Expected no mutations in fully edited fragment: %v", m)
+	}
+
+	tests := []struct {
+		seq      string
+		mtype    string
+		editSite int
+		pos      int
+		ref      string
+		alt      string
+	}{
+		{"TTTCCAGTTTAGTAT", MUTATION_SNP, 16, 12, "G", "C"},
+		{"TTTCTGGTTTAGTAT", MUTATION_DEL, 15, 13, "A", ""},
+		{"TTTCTGCCAGTTTAGTAT", MUTATION_INS, 15, 13, "", "CC"},
+	}
+
+	for _, test := range tests {
+		frag := NewFragment("mut", test.seq, FORWARD, 't')
+		m := FindMutations(frag, tmpl)
+		if len(m) != 1 {
+			t.Errorf("Wrong number of mutations for %s. %d != 1", test.seq, len(m))
+			continue
+		}
+		if m[0].Type != test.mtype || m[0].EditSite != test.editSite || m[0].Pos != test.pos ||
+			m[0].Ref != test.ref || m[0].Alt != test.alt {
+			t.Errorf("Wrong mutation for %s: %+v", test.seq, m[0])
+		}
+	}
+}
+
+func TestMutationCatalog(t *testing.T) {
+	fe := NewFragment("fe", "TTTCTGAGTTTAGTAT", FORWARD, 't')
+	pe := NewFragment("pe", "TTTTTTCTTTTGAGTTTTTTAGTATT", FORWARD, 't')
+
+	tmpl, err := NewTemplate(fe, pe, nil, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	del := NewFragment("del", "TTTCTGGTTTAGTAT", FORWARD, 't')
+
+	c := NewMutationCatalog("test", tmpl)
+	c.Add("wt", fe, 3)
+	c.Add("wt", del, 1)
+	c.Add("kd", del, 2)
+
+	entries := c.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Wrong number of entries. %d != 1", len(entries))
+	}
+	if f := c.Frequency(entries[0], "wt"); f != 0.25 {
+		t.Errorf("Wrong frequency. %f != %f", f, 0.25)
+	}
+	if f := c.Frequency(entries[0], "kd"); f != 1 {
+		t.Errorf("Wrong frequency. %f != %f", f, 1.0)
+	}
+
+	var buf bytes.Buffer
+	if err := c.WriteVCF(&buf); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	rec := strings.Split(lines[len(lines)-1], "\t")
+	if rec[1] != "12" || rec[3] != "GA" || rec[4] != "G" {
+		t.Errorf("Wrong VCF record: %v", rec)
+	}
+	if rec[9] != "2:1.000000" || rec[10] != "1:0.250000" {
+		t.Errorf("Wrong VCF sample columns: %v", rec)
+	}
+}
+
+// Deletions of non-edit bases separated by edit sites must match the
+// pre-edited sequence at POS
+func TestMutationCatalogVCFSpan(t *testing.T) {
+	fe := NewFragment("fe", "TTTCTGAGTTTAGTAT", FORWARD, 't')
+	pe := NewFragment("pe", "TTTTTTCTTTTGAGTTTTTTAGTATT", FORWARD, 't')
+
+	tmpl, err := NewTemplate(fe, pe, nil, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Deletes the C and G which are 4 edit bases apart in the pre-edited
+	// sequence
+	del := NewFragment("del", "TTTTAGTTTAGTAT", FORWARD, 't')
+	m := FindMutations(del, tmpl)
+	if len(m) != 1 || m[0].Type != MUTATION_DEL || m[0].Ref != "CG" {
+		t.Fatalf("Wrong mutations: %v", m)
+	}
+
+	c := NewMutationCatalog("test", tmpl)
+	c.Add("wt", del, 1)
+
+	var buf bytes.Buffer
+	if err := c.WriteVCF(&buf); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	rec := strings.Split(lines[len(lines)-1], "\t")
+	if rec[1] != "6" || rec[3] != "TCTTTTG" || rec[4] != "TTTTT" {
+		t.Errorf("Wrong VCF record: %v", rec)
+	}
+
+	seq := tmpl.preEditedSeq()
+	if pos := 6; seq[pos-1:pos-1+len(rec[3])] != rec[3] {
+		t.Errorf("REF %s does not match the pre-edited sequence %s", rec[3], seq[pos-1:pos-1+len(rec[3])])
+	}
+}
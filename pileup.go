@@ -0,0 +1,391 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aebruno/nwalgo"
+)
+
+// PileupCell is a single edit site of a fragment in a pileup
+type PileupCell struct {
+	// Number of edit bases at the site
+	Count uint32
+
+	// Non-edit base following the site. '-' if the base was deleted and 0 for
+	// the last edit site
+	Base byte
+
+	// Bases inserted in the fragment before this site, which have no column in
+	// the template layout
+	Insert string
+
+	// Index of the template the edit site matches (0 FE, 1 PE, 2.. alt) or -1
+	Match int
+
+	// Site is within the junction region of the alignment
+	Junction bool
+
+	// Site has an indel, a different base or, outside the junction region, an
+	// edit count matching none of the templates
+	Mismatch bool
+}
+
+// PileupRow is a fragment aligned to the template columns
+type PileupRow struct {
+	Label     string
+	Fragment  *Fragment
+	Alignment *Alignment
+	Cells     []*PileupCell
+}
+
+// Pileup stacks many fragments under the templates in a shared column layout.
+// As with Template.BaseIndex each edit site is as wide as the longest run of
+// edit bases at the site, here taken over both the templates and fragments.
+type Pileup struct {
+	Template *Template
+	Labels   []string
+	Widths   []uint32
+	Rows     []*PileupRow
+}
+
+func NewPileup(tmpl *Template) *Pileup {
+	labels := []string{"FE", "PE"}
+	for i := range tmpl.AltRegion {
+		labels = append(labels, fmt.Sprintf("A%d", i+1))
+	}
+
+	widths := make([]uint32, tmpl.Len())
+	for i := range widths {
+		widths[i] = tmpl.Max(i)
+	}
+
+	return &Pileup{Template: tmpl, Labels: labels, Widths: widths}
+}
+
+// Position returns the edit site position label of column i
+func (p *Pileup) Position(i int) int {
+	return p.Template.IndexLabel(p.Template.Len() - 1 - i)
+}
+
+// Column returns the offset of edit site i in the text layout
+func (p *Pileup) Column(i int) int {
+	col := 0
+	for j := 0; j < i; j++ {
+		col += int(p.Widths[j]) + 1
+	}
+	return col
+}
+
+// match returns the template matching count edit bases at site ti following
+// the same precedence used when classifying alignments
+func (p *Pileup) match(a *Alignment, ti int, count uint32) int {
+	tmpl := p.Template
+	idx := tmpl.Len() - 1 - ti
+
+	if a.AltEditing > 0 && int(a.AltEditing) <= len(tmpl.AltRegion) {
+		region := tmpl.AltRegion[a.AltEditing-1]
+		if idx > region.Start && idx < region.End && tmpl.EditSite[a.AltEditing+1][ti] == count {
+			return int(a.AltEditing) + 1
+		}
+	}
+
+	order := []int{0, 1}
+	if idx+int(tmpl.EditOffset) > a.EditStop {
+		order = []int{1, 0}
+	}
+	for i := 2; i < tmpl.Size(); i++ {
+		order = append(order, i)
+	}
+
+	for _, i := range order {
+		if tmpl.EditSite[i][ti] == count {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Add aligns the fragment to the template and appends it as a new row
+func (p *Pileup) Add(label string, frag *Fragment, a *Alignment) *PileupRow {
+	tmpl := p.Template
+	row := &PileupRow{Label: label, Fragment: frag, Alignment: a, Cells: make([]*PileupCell, tmpl.Len())}
+
+	aln1, aln2, _ := nwalgo.Align(tmpl.Bases, frag.Bases, 1, -1, -1)
+
+	var insert bytes.Buffer
+	fi := 0
+	ti := 0
+	for ai := 0; ai < len(aln1); ai++ {
+		if aln1[ai] == '-' {
+			insert.WriteString(strings.Repeat(string(frag.EditBase), int(frag.EditSite[fi])))
+			insert.WriteByte(frag.Bases[fi])
+			fi++
+			continue
+		}
+
+		cell := &PileupCell{Insert: insert.String()}
+		insert.Reset()
+
+		if aln2[ai] == '-' {
+			cell.Base = '-'
+			cell.Match = -1
+		} else {
+			cell.Count = frag.EditSite[fi]
+			cell.Base = frag.Bases[fi]
+			cell.Match = p.match(a, ti, cell.Count)
+			fi++
+		}
+
+		p.setFlags(a, ti, cell)
+		row.Cells[ti] = cell
+		ti++
+	}
+
+	// Last edit site has only edit bases
+	cell := &PileupCell{Insert: insert.String(), Count: frag.EditSite[fi]}
+	cell.Match = p.match(a, ti, cell.Count)
+	p.setFlags(a, ti, cell)
+	row.Cells[ti] = cell
+
+	for i, c := range row.Cells {
+		if c.Count > p.Widths[i] {
+			p.Widths[i] = c.Count
+		}
+	}
+
+	p.Rows = append(p.Rows, row)
+	return row
+}
+
+func (p *Pileup) setFlags(a *Alignment, ti int, cell *PileupCell) {
+	tmpl := p.Template
+	pos := p.Position(ti)
+
+	cell.Junction = pos > a.EditStop && pos <= a.JuncEnd
+	cell.Mismatch = len(cell.Insert) > 0 || cell.Base == '-' ||
+		(ti < len(tmpl.Bases) && cell.Base != tmpl.Bases[ti]) ||
+		(cell.Match == -1 && !cell.Junction)
+}
+
+// writeSite writes count edit bases right aligned in a column of width
+func writeSite(buf *bytes.Buffer, base rune, count, width uint32, b byte) {
+	writeBase(buf, base, count, width)
+	if b != 0 {
+		buf.WriteByte(b)
+	}
+}
+
+// Width returns the number of columns in the text layout
+func (p *Pileup) Width() int {
+	n := p.Template.Len() - 1
+	return p.Column(n) + int(p.Widths[n])
+}
+
+// Ruler returns the position labels of every tenth edit site aligned to the
+// text layout
+func (p *Pileup) Ruler() string {
+	ruler := []byte(strings.Repeat(" ", p.Width()))
+	last := -1
+	for i := 0; i < p.Template.Len(); i++ {
+		pos := p.Position(i)
+		if pos%10 != 0 {
+			continue
+		}
+		end := p.Column(i) + int(p.Widths[i])
+		if i == p.Template.Len()-1 {
+			end--
+		}
+		label := strconv.Itoa(pos)
+		start := end - len(label) + 1
+		if start <= last+1 || start < 0 {
+			continue
+		}
+		copy(ruler[start:], label)
+		last = end
+	}
+
+	return string(ruler)
+}
+
+// GuideTrack returns a line aligned to the text layout marking the edit
+// sites paired with the gRNA anchor with '#' and the rest of the gRNA span
+// with '~'
+func (p *Pileup) GuideTrack(g *GuideRegion) string {
+	n := p.Template.Len()
+	track := []byte(strings.Repeat(" ", p.Width()))
+	for i := 0; i < n; i++ {
+		idx := (n - 1) - i
+		if idx < g.Start || idx > g.End {
+			continue
+		}
+		mark := byte('~')
+		if g.InAnchor(idx) {
+			mark = '#'
+		}
+		// Edit bases of the site and the non-edit base following it
+		start := p.Column(i)
+		end := start + int(p.Widths[i])
+		if i < n-1 {
+			end++
+		}
+		for j := start; j < end; j++ {
+			track[j] = mark
+		}
+	}
+
+	return string(track)
+}
+
+// WriteTo writes the pileup as text wrapped at tw columns. Each fragment row
+// is followed by a marker line flagging junction sites with '=' and
+// mismatches with '*'. Templates with gRNA annotations have a track line
+// for each gRNA below the templates.
+func (p *Pileup) WriteTo(w io.Writer, tw int) error {
+	if tw <= 0 {
+		tw = 80
+	}
+
+	tmpl := p.Template
+	width := p.Width()
+
+	labels := []string{""}
+	lines := []*bytes.Buffer{bytes.NewBufferString(p.Ruler())}
+	for i, t := range tmpl.EditSite {
+		var buf bytes.Buffer
+		for ti := range t {
+			b := byte(0)
+			if ti < len(tmpl.Bases) {
+				b = tmpl.Bases[ti]
+			}
+			writeSite(&buf, tmpl.EditBase, t[ti], p.Widths[ti], b)
+		}
+		labels = append(labels, p.Labels[i])
+		lines = append(lines, &buf)
+	}
+
+	for _, g := range tmpl.Guides {
+		labels = append(labels, g.Name)
+		lines = append(lines, bytes.NewBufferString(p.GuideTrack(g)))
+	}
+
+	for _, row := range p.Rows {
+		var buf, marks bytes.Buffer
+		flagged := false
+		for ti, c := range row.Cells {
+			writeSite(&buf, tmpl.EditBase, c.Count, p.Widths[ti], c.Base)
+
+			n := int(p.Widths[ti])
+			if c.Base != 0 {
+				n++
+			}
+			mark := " "
+			if c.Mismatch {
+				mark = "*"
+			} else if c.Junction {
+				mark = "="
+			}
+			if mark != " " {
+				flagged = true
+			}
+			marks.WriteString(strings.Repeat(mark, n))
+		}
+
+		labels = append(labels, row.Label)
+		lines = append(lines, &buf)
+		if flagged {
+			labels = append(labels, "")
+			lines = append(lines, &marks)
+		}
+	}
+
+	lw := 0
+	for _, l := range labels {
+		if len(l) > lw {
+			lw = len(l)
+		}
+	}
+	if lw > tw/4 {
+		lw = tw / 4
+		for i, l := range labels {
+			if len(l) > lw {
+				labels[i] = l[:lw]
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s\n", strings.Repeat("=", tw))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range p.Rows {
+		a := row.Alignment
+		_, err := fmt.Fprintf(w, "%-*s  %s JSS: %d ESS: %d JES: %d Junc Len: %d", lw, row.Label, row.Fragment.Name, a.JuncStart, a.EditStop, a.JuncEnd, a.JuncLen)
+		if err != nil {
+			return err
+		}
+		if a.AltEditing > 0 {
+			_, err = fmt.Fprintf(w, " Alt: %d", a.AltEditing)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.Write([]byte("\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n\n", strings.Repeat("=", tw))
+	if err != nil {
+		return err
+	}
+
+	cols := tw - lw - 2
+	if cols < 10 {
+		cols = 10
+	}
+
+	for start := 0; start < width; start += cols {
+		end := start + cols
+		if end > width {
+			end = width
+		}
+
+		for i, l := range lines {
+			_, err := fmt.Fprintf(w, "%-*s  %s\n", lw, labels[i], strings.TrimRight(string(l.Bytes()[start:end]), " "))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := w.Write([]byte("\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
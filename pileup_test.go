@@ -0,0 +1,129 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aebruno/gofasta"
+)
+
+func TestPileup(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/test-templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	f, err := os.Open("examples/test-sample.fa")
+	if err != nil {
+		t.Fatalf("Failed to open test sample data")
+	}
+	defer f.Close()
+
+	p := NewPileup(tmpl)
+	for rec := range gofasta.SimpleParser(f) {
+		attr := parseKeyVal(rec.Id)
+		frag := NewFragment(rec.Id, rec.Seq, FORWARD, 't')
+		aln := NewAlignment(frag, tmpl, false)
+		row := p.Add(strings.SplitN(rec.Id, " ", 2)[0], frag, aln)
+
+		if len(row.Cells) != tmpl.Len() {
+			t.Errorf("Wrong number of cells. %d != %d for sequence id: %s", len(row.Cells), tmpl.Len(), rec.Id)
+		}
+
+		mismatch := false
+		for i, c := range row.Cells {
+			if c.Mismatch {
+				mismatch = true
+			}
+			if c.Junction != (p.Position(i) > aln.EditStop && p.Position(i) <= aln.JuncEnd) {
+				t.Errorf("Wrong junction flag at site %d for sequence id: %s", p.Position(i), rec.Id)
+			}
+		}
+
+		if mismatch != (attr["has_mutation"] > 0 || attr["mismatches"] > 0) {
+			t.Errorf("Wrong mismatch flags for sequence id: %s", rec.Id)
+		}
+	}
+
+	for i := range p.Widths {
+		if p.Widths[i] < tmpl.Max(i) {
+			t.Errorf("Column %d narrower than template. %d < %d", i, p.Widths[i], tmpl.Max(i))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = p.WriteTo(buf, 80)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Skip the header listing the fragments
+	parts := strings.SplitN(buf.String(), strings.Repeat("=", 80)+"\n\n", 2)
+	if len(parts) != 2 {
+		t.Fatalf("Missing pileup header")
+	}
+
+	for _, line := range strings.Split(parts[1], "\n") {
+		if len(line) > 80 {
+			t.Errorf("Line longer than text width: %s", line)
+		}
+	}
+
+	if !strings.Contains(parts[1], "\nFE ") {
+		t.Errorf("Missing template rows in pileup output")
+	}
+}
+
+func TestPileupGuideTrack(t *testing.T) {
+	start, stop, anchorStart, anchorStop := 1, 4, 1, 2
+	spec := &TemplateSpec{
+		EditBase: "T",
+		FullEdit: &SequenceSpec{Name: "full", Sequence: "ttCCAATTGCAATTT"},
+		PreEdit:  &SequenceSpec{Name: "pre", Sequence: "ttCCAATTTTGCAATTTTT"},
+		Guides:   []*GuideSpec{{Name: "g1", Start: &start, Stop: &stop, AnchorStart: &anchorStart, AnchorStop: &anchorStop}},
+	}
+
+	tmpl, err := spec.Template(FORWARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPileup(tmpl)
+	track := p.GuideTrack(tmpl.Guides[0])
+	if len(track) != p.Width() {
+		t.Errorf("Track width %d != pileup width %d", len(track), p.Width())
+	}
+
+	// Sites 4 and 3 are guided, sites 2 and 1 pair with the anchor
+	expected := "      ~~~~~~##"
+	if strings.TrimRight(track, " ") != expected {
+		t.Errorf("Wrong gRNA track: %q != %q", track, expected)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.WriteTo(buf, 80); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\ng1  "+expected+"\n") {
+		t.Errorf("Missing gRNA track in pileup output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Default number of gRNA 5' nucleotides which must pair with the mRNA
+	DEFAULT_ANCHOR_LEN = 10
+)
+
+// GuideRNA is a guide RNA sequence in 5' -> 3' orientation
+type GuideRNA struct {
+	Name     string
+	Sequence string
+}
+
+// GuideStep records how a single gRNA edited the mRNA
+type GuideStep struct {
+	Name string
+	// 0-based mRNA positions of the anchor duplex in the sequence before
+	// this gRNA was applied
+	AnchorStart int
+	AnchorEnd   int
+	// Number of gRNA nucleotides which guided editing past the anchor
+	Guided   int
+	Inserted int
+	Deleted  int
+}
+
+// EditPrediction is the result of simulating gRNA directed editing
+type EditPrediction struct {
+	Sequence string
+	Steps    []*GuideStep
+	// gRNAs which did not anchor to the mRNA or guided no editing
+	Unused []string
+}
+
+// pairs returns true if the gRNA base g can pair with the mRNA base m.
+// Watson-Crick pairs plus G:U wobble, using T for U.
+func pairs(g, m byte) bool {
+	switch g {
+	case 'A':
+		return m == 'T'
+	case 'T':
+		return m == 'A' || m == 'G'
+	case 'G':
+		return m == 'C' || m == 'T'
+	case 'C':
+		return m == 'G'
+	}
+	return false
+}
+
+// normalizeRNA converts a sequence to upper case using T for U
+func normalizeRNA(seq string) []byte {
+	return []byte(strings.Replace(strings.ToUpper(strings.TrimSpace(seq)), "U", "T", -1))
+}
+
+// anchorSite returns the mRNA position paired with the gRNA 5' nucleotide at
+// the 3'-most site at or before start where the first n gRNA nucleotides pair
+// with the mRNA, or -1 if the gRNA does not anchor
+func anchorSite(m, g []byte, n, start int) int {
+	if len(g) < n {
+		return -1
+	}
+
+	for e := start; e >= n-1; e-- {
+		ok := true
+		for t := 0; t < n; t++ {
+			if !pairs(g[t], m[e-t]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return e
+		}
+	}
+
+	return -1
+}
+
+// guideSite returns the 3'-most anchor site at which the gRNA guides at
+// least one nucleotide past the anchor, or -1 if there is none
+func guideSite(m, g []byte, n int) int {
+	for e := anchorSite(m, g, n, len(m)-1); e >= 0; e = anchorSite(m, g, n, e-1) {
+		if _, step := guide(m, g, e, n); step.Guided > 0 {
+			return e
+		}
+	}
+
+	return -1
+}
+
+// guide edits m 5' of the anchor duplex ending at e following the gRNA
+// nucleotides after the anchor. Runs of U between fixed bases are replaced by
+// one U for each gRNA purine until the next gRNA nucleotide pairs with the
+// next fixed base. Editing stops at the first gRNA nucleotide which can pair
+// with neither.
+func guide(m, g []byte, e, n int) ([]byte, *GuideStep) {
+	step := &GuideStep{AnchorStart: e - n + 1, AnchorEnd: e}
+
+	pos := e - n
+	q := n
+	edited := make([]byte, 0)
+	for q < len(g) {
+		k := pos
+		for k >= 0 && m[k] == 'T' {
+			k--
+		}
+		if k < 0 {
+			break
+		}
+
+		run := 0
+		matched := false
+		j := q
+		for j < len(g) {
+			if pairs(g[j], m[k]) {
+				matched = true
+				j++
+				break
+			}
+			if !pairs(g[j], 'T') {
+				break
+			}
+			run++
+			j++
+		}
+		if !matched {
+			break
+		}
+
+		old := pos - k
+		if run > old {
+			step.Inserted += run - old
+		} else {
+			step.Deleted += old - run
+		}
+		step.Guided += j - q
+
+		edited = append(edited, bytes.Repeat([]byte{'T'}, run)...)
+		edited = append(edited, m[k])
+		pos = k - 1
+		q = j
+	}
+
+	// edited is in 3' -> 5' order
+	for i, j := 0, len(edited)-1; i < j; i, j = i+1, j-1 {
+		edited[i], edited[j] = edited[j], edited[i]
+	}
+
+	out := make([]byte, 0, len(m)+step.Inserted)
+	out = append(out, m[:pos+1]...)
+	out = append(out, edited...)
+	out = append(out, m[e-n+1:]...)
+
+	return out, step
+}
+
+// PredictEdited simulates gRNA directed U insertion/deletion on the pre-edited
+// sequence. Editing proceeds 3' to 5': at each step the unused gRNA whose
+// first anchor nucleotides pair 3'-most on the current mRNA, and which guides
+// past the anchor, is applied. The 3' oligo(U) tail of each gRNA is ignored.
+func PredictEdited(pre string, guides []*GuideRNA, anchor int) (*EditPrediction, error) {
+	if anchor <= 0 {
+		anchor = DEFAULT_ANCHOR_LEN
+	}
+
+	m := normalizeRNA(pre)
+	if len(m) == 0 {
+		return nil, fmt.Errorf("Missing pre-edited sequence")
+	}
+
+	remaining := make([]*GuideRNA, 0, len(guides))
+	seqs := make(map[*GuideRNA][]byte)
+	for _, g := range guides {
+		seq := bytes.TrimRight(normalizeRNA(g.Sequence), "T")
+		if len(seq) < anchor {
+			return nil, fmt.Errorf("gRNA %s is shorter than the anchor length %d", g.Name, anchor)
+		}
+		seqs[g] = seq
+		remaining = append(remaining, g)
+	}
+
+	prediction := &EditPrediction{}
+	for len(remaining) > 0 {
+		best, site := -1, -1
+		for i, g := range remaining {
+			if e := guideSite(m, seqs[g], anchor); e > site {
+				best, site = i, e
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		g := remaining[best]
+		var step *GuideStep
+		m, step = guide(m, seqs[g], site, anchor)
+		step.Name = g.Name
+		prediction.Steps = append(prediction.Steps, step)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+
+	for _, g := range remaining {
+		prediction.Unused = append(prediction.Unused, g.Name)
+	}
+	prediction.Sequence = string(m)
+
+	return prediction, nil
+}
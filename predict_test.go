@@ -0,0 +1,97 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPredictEdited(t *testing.T) {
+	// gRNA anchors to CCCGGG at the 3' end. Guides 3 U's 3' of the A
+	// inserting 2. The 3' oligo(U) tail is ignored.
+	p, err := PredictEdited("GGAATCCCGGG", []*GuideRNA{{Name: "g1", Sequence: "CCCGGGGAAUUUCCUUUUUU"}}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Sequence != "GGAATTTCCCGGG" {
+		t.Errorf("Wrong prediction: %s != %s", p.Sequence, "GGAATTTCCCGGG")
+	}
+	if s := p.Steps[0]; s.Inserted != 2 || s.Deleted != 0 || s.AnchorStart != 5 || s.AnchorEnd != 10 {
+		t.Errorf("Wrong step: %+v", s)
+	}
+
+	// Guides 1 U between G and A deleting 2
+	p, err = PredictEdited("GGTTTACCCGGG", []*GuideRNA{{Name: "g1", Sequence: "CCCGGGTACC"}}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Sequence != "GGTACCCGGG" {
+		t.Errorf("Wrong prediction: %s != %s", p.Sequence, "GGTACCCGGG")
+	}
+	if s := p.Steps[0]; s.Inserted != 0 || s.Deleted != 2 {
+		t.Errorf("Wrong step: %+v", s)
+	}
+
+	// gRNA does not anchor
+	p, err = PredictEdited("GGTTTACCCGGG", []*GuideRNA{{Name: "g1", Sequence: "AAAAAAAAAC"}}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Unused) != 1 || p.Sequence != "GGTTTACCCGGG" {
+		t.Errorf("gRNA should not anchor: %+v", p)
+	}
+}
+
+func TestPredictEditedRPS12(t *testing.T) {
+	spec, err := ReadTemplateSpecFasta("examples/templates.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := strings.ToUpper(spec.FullEdit.Sequence)
+
+	// gRNAs complementary to overlapping windows of the fully edited
+	// sequence, listed 5' to 3' so they must be reordered
+	guides := make([]*GuideRNA, 0)
+	for end := len(full); end > 20; end -= 40 {
+		start := end - 60
+		if start < 0 {
+			start = 0
+		}
+		guides = append([]*GuideRNA{{
+			Name:     fmt.Sprintf("g%d", len(guides)+1),
+			Sequence: reverseComplement(full[start:end]) + "TTTTTTTTTT",
+		}}, guides...)
+	}
+
+	p, err := PredictEdited(spec.PreEdit.Sequence, guides, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Unused) != 0 {
+		t.Errorf("All gRNAs should anchor: %v", p.Unused)
+	}
+	if p.Sequence != full {
+		t.Errorf("Wrong prediction:\n%s\n%s", p.Sequence, full)
+	}
+}
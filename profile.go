@@ -0,0 +1,160 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	PROFILE_FE    = "FE"
+	PROFILE_PE    = "PE"
+	PROFILE_OTHER = "other"
+)
+
+// SiteProfile holds the weighted read counts at a single template edit site
+// that match the FE, PE and alt templates. Each read is counted in exactly one
+// category, the first template it matches in the order FE, PE, alt. At sites
+// where templates agree a read counts as FE. Other is the weight of reads
+// whose edit base count matches no template.
+type SiteProfile struct {
+	Site  int
+	FE    float64
+	PE    float64
+	Alt   []float64
+	Other float64
+	Total float64
+}
+
+// ProfileRow is one tidy (sample, edit site, category) observation
+type ProfileRow struct {
+	Sample   string  `json:"sample"`
+	EditSite int     `json:"edit_site"`
+	Category string  `json:"category"`
+	Norm     float64 `json:"norm"`
+	Frac     float64 `json:"frac"`
+}
+
+// EditProfile computes per edit site editing frequencies for each sample
+type EditProfile struct {
+	tmpl    *Template
+	samples map[string][]*SiteProfile
+}
+
+func NewEditProfile(tmpl *Template) *EditProfile {
+	return &EditProfile{tmpl: tmpl, samples: make(map[string][]*SiteProfile)}
+}
+
+func (p *EditProfile) newSites() []*SiteProfile {
+	n := p.tmpl.Len()
+	sites := make([]*SiteProfile, n)
+	for i := range sites {
+		sites[i] = &SiteProfile{
+			Site: p.tmpl.IndexLabel((n - 1) - i),
+			Alt:  make([]float64, p.tmpl.Size()-2),
+		}
+	}
+
+	return sites
+}
+
+// Add counts the edit base at each site of frag with the given weight
+// (typically the normalized read count). Only fragments with the same number
+// of edit sites as the template (i.e. no indels) can be profiled.
+func (p *EditProfile) Add(sample string, frag *Fragment, weight float64) error {
+	if frag.Len() != p.tmpl.Len() {
+		return fmt.Errorf("Fragment %s has %d edit sites, template has %d", frag.Name, frag.Len(), p.tmpl.Len())
+	}
+
+	sites, ok := p.samples[sample]
+	if !ok {
+		sites = p.newSites()
+		p.samples[sample] = sites
+	}
+
+	for i, t := range frag.EditSite {
+		s := sites[i]
+		s.Total += weight
+
+		if t == p.tmpl.EditSite[0][i] {
+			s.FE += weight
+			continue
+		}
+		if t == p.tmpl.EditSite[1][i] {
+			s.PE += weight
+			continue
+		}
+
+		match := false
+		for j, alt := range p.tmpl.EditSite[2:] {
+			if t == alt[i] {
+				s.Alt[j] += weight
+				match = true
+				break
+			}
+		}
+
+		if !match {
+			s.Other += weight
+		}
+	}
+
+	return nil
+}
+
+// Samples returns the sorted list of profiled samples
+func (p *EditProfile) Samples() []string {
+	list := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Sites returns the profile of a sample ordered 5' -> 3'
+func (p *EditProfile) Sites(sample string) []*SiteProfile {
+	return p.samples[sample]
+}
+
+// Rows returns the profile in tidy form, one row per sample, edit site and
+// category
+func (p *EditProfile) Rows() []*ProfileRow {
+	rows := make([]*ProfileRow, 0)
+	for _, sample := range p.Samples() {
+		for _, s := range p.samples[sample] {
+			add := func(cat string, val float64) {
+				frac := 0.0
+				if s.Total > 0 {
+					frac = val / s.Total
+				}
+				rows = append(rows, &ProfileRow{Sample: sample, EditSite: s.Site, Category: cat, Norm: val, Frac: frac})
+			}
+
+			add(PROFILE_FE, s.FE)
+			add(PROFILE_PE, s.PE)
+			for i, a := range s.Alt {
+				add(fmt.Sprintf("A%d", i+1), a)
+			}
+			add(PROFILE_OTHER, s.Other)
+		}
+	}
+
+	return rows
+}
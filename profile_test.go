@@ -0,0 +1,93 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"testing"
+)
+
+func TestEditProfile(t *testing.T) {
+	fe := NewFragment("fe", "TTTCTGAGTTTAGTAT", FORWARD, 't')
+	pe := NewFragment("pe", "TTTTTTCTTTTGAGTTTTTTAGTATT", FORWARD, 't')
+	other := NewFragment("other", "TCTGAGAGTAT", FORWARD, 't')
+
+	tmpl, err := NewTemplate(fe, pe, nil, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tmpl.SetOffset(10)
+
+	p := NewEditProfile(tmpl)
+	if err := p.Add("wt", fe, 2); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := p.Add("wt", pe, 1); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := p.Add("wt", other, 1); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	short := NewFragment("short", "TCTGAG", FORWARD, 't')
+	if err := p.Add("wt", short, 1); err == nil {
+		t.Errorf("Fragment with indel should not be profiled")
+	}
+
+	sites := p.Sites("wt")
+	if len(sites) != tmpl.Len() {
+		t.Fatalf("Wrong number of sites. %d != %d", len(sites), tmpl.Len())
+	}
+
+	// First edit site: FE=3 PE=6 other=1
+	s := sites[0]
+	if s.Site != tmpl.Len()-1+10 {
+		t.Errorf("Wrong site label. %d != %d", s.Site, tmpl.Len()-1+10)
+	}
+	if s.Total != 4 || s.FE != 2 || s.PE != 1 || s.Other != 1 {
+		t.Errorf("Wrong site profile: %+v", s)
+	}
+
+	// Categories are exclusive, sites where FE and PE agree count as FE
+	agree := 0
+	for i, s := range sites {
+		sum := s.FE + s.PE + s.Other
+		for _, a := range s.Alt {
+			sum += a
+		}
+		if sum != s.Total {
+			t.Errorf("Site %d categories sum to %f not %f", s.Site, sum, s.Total)
+		}
+		if tmpl.EditSite[0][i] == tmpl.EditSite[1][i] {
+			agree++
+			if s.PE != 0 || s.FE < 3 {
+				t.Errorf("Site %d where FE and PE agree should count as FE: %+v", s.Site, s)
+			}
+		}
+	}
+	if agree == 0 {
+		t.Fatalf("Test template should have sites where FE and PE agree")
+	}
+
+	rows := p.Rows()
+	if len(rows) != tmpl.Len()*3 {
+		t.Fatalf("Wrong number of rows. %d != %d", len(rows), tmpl.Len()*3)
+	}
+	if rows[0].Category != PROFILE_FE || rows[0].Frac != 0.5 {
+		t.Errorf("Wrong FE fraction: %+v", rows[0])
+	}
+}
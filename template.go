@@ -21,12 +21,10 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
+	"unicode"
 
-	"github.com/aebruno/gofasta"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,6 +36,17 @@ type AltRegion struct {
 	End   int
 }
 
+// GuideRegion is a gRNA annotation of the template. As with AltRegion the
+// bounds are edit site indexes without the offset. Start-End is the span of
+// edit sites covered by the gRNA including the anchor duplex.
+type GuideRegion struct {
+	Name  string
+	Start int
+	End   int
+	// Edit sites paired with the gRNA anchor. Nil if not known
+	Anchor *AltRegion
+}
+
 type Template struct {
 	Bases      string
 	EditOffset uint32
@@ -46,51 +55,35 @@ type Template struct {
 	EditSite   [][]uint32
 	BaseIndex  []uint32
 	AltRegion  []*AltRegion
+	Guides     []*GuideRegion
+	// 1-based position of the start codon in the fully edited template, 0 if
+	// not known
+	StartCodon int
+	// NCBI genetic code used to translate reads. 0 is GENETIC_CODE_MITO
+	GeneticCode int
 }
 
+// NewTemplateFromFasta reads the templates from a FASTA file. Alt records
+// must set alt_start= and alt_stop= in the header.
 func NewTemplateFromFasta(path string, orientation OrientationType, base rune) (*Template, error) {
-	f, err := os.Open(path)
+	spec, err := ReadTemplateSpecFasta(path)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid FASTA file: %s", err)
+		return nil, err
 	}
-	defer f.Close()
-
-	t := make([]*Fragment, 0, 2)
-	alt := make([]*AltRegion, 0)
-
-	for rec := range gofasta.SimpleParser(f) {
-		frag := NewFragment(rec.Id, rec.Seq, orientation, base)
-		t = append(t, frag)
-
-		if len(t) > 2 {
-			start, end := -1, -1
-
-			matches := startPattern.FindStringSubmatch(rec.Id)
-			if len(matches) == 2 {
-				start, err = strconv.Atoi(matches[1])
-				if err != nil {
-					start = 0
-				}
-			}
-			matches = endPattern.FindStringSubmatch(rec.Id)
-			if len(matches) == 2 {
-				end, err = strconv.Atoi(matches[1])
-				if err != nil {
-					end = 0
-				}
-			}
+	spec.EditBase = string(unicode.ToUpper(base))
 
-			if start > -1 && end > -1 {
-				alt = append(alt, &AltRegion{Start: start, End: end})
-			}
-		}
-	}
+	return spec.Template(orientation)
+}
 
-	if len(t) < 2 {
-		return nil, fmt.Errorf("Must provide at least 2 templates. Full and Pre edited")
+// NewTemplateFromFile reads the templates from a YAML or JSON template spec
+// or a FASTA file depending on the file extension
+func NewTemplateFromFile(path string, orientation OrientationType, base rune) (*Template, error) {
+	spec, err := ReadTemplateSpec(path, base)
+	if err != nil {
+		return nil, err
 	}
 
-	return NewTemplate(t[0], t[1], t[2:], alt)
+	return spec.Template(orientation)
 }
 
 func NewTemplate(full, pre *Fragment, alt []*Fragment, altRegion []*AltRegion) (*Template, error) {
@@ -150,13 +143,25 @@ func NewTemplate(full, pre *Fragment, alt []*Fragment, altRegion []*AltRegion) (
 	return tmpl, nil
 }
 
+// SetOffset sets the edit site numbering offset replacing any offset set
+// previously
 func (tmpl *Template) SetOffset(offset int) {
+	delta := offset - int(tmpl.EditOffset)
 	tmpl.EditOffset = uint32(offset)
-	tmpl.EditStop += offset
+	tmpl.EditStop += delta
 
 	for _, region := range tmpl.AltRegion {
-		region.Start -= offset
-		region.End -= offset
+		region.Start -= delta
+		region.End -= delta
+	}
+
+	for _, g := range tmpl.Guides {
+		g.Start -= delta
+		g.End -= delta
+		if g.Anchor != nil {
+			g.Anchor.Start -= delta
+			g.Anchor.End -= delta
+		}
 	}
 }
 
@@ -216,3 +221,200 @@ func (tmpl *Template) MarshalBytes() ([]byte, error) {
 
 	return data.Bytes(), nil
 }
+
+// TemplateSite is a single edit site of a template
+type TemplateSite struct {
+	// Edit site number including the offset
+	Site int
+	// Non-edit base 3' of the site. Empty for the site at the 3' end
+	Base string
+	// Edit base counts in template order: full, pre then alt templates
+	Counts []uint32
+}
+
+// Inserted returns true if edit bases are inserted at the site
+func (s *TemplateSite) Inserted() bool {
+	return s.Counts[0] > s.Counts[1]
+}
+
+// Deleted returns true if edit bases are deleted at the site
+func (s *TemplateSite) Deleted() bool {
+	return s.Counts[0] < s.Counts[1]
+}
+
+// Labels returns the short name of each template: FE, PE then A1, A2, ...
+// for alt templates
+func (tmpl *Template) Labels() []string {
+	labels := []string{"FE", "PE"}
+	for i := 2; i < tmpl.Size(); i++ {
+		labels = append(labels, fmt.Sprintf("A%d", i-1))
+	}
+	return labels
+}
+
+// Sites returns all edit sites ordered by site number starting at the 3' end
+func (tmpl *Template) Sites() []*TemplateSite {
+	n := tmpl.Len()
+	sites := make([]*TemplateSite, n)
+	for i := range sites {
+		j := (n - 1) - i
+		s := &TemplateSite{Site: tmpl.IndexLabel(i), Counts: make([]uint32, tmpl.Size())}
+		if j < len(tmpl.Bases) {
+			s.Base = string(tmpl.Bases[j])
+		}
+		for k := range tmpl.EditSite {
+			s.Counts[k] = tmpl.EditSite[k][j]
+		}
+		sites[i] = s
+	}
+
+	return sites
+}
+
+// TemplateDiff is a single difference between two templates. Site is -1 if
+// the difference is not specific to an edit site.
+type TemplateDiff struct {
+	Field string
+	Site  int
+	A     string
+	B     string
+}
+
+func (d *TemplateDiff) String() string {
+	if d.Site < 0 {
+		return fmt.Sprintf("%s: %s != %s", d.Field, d.A, d.B)
+	}
+	return fmt.Sprintf("site %d %s: %s != %s", d.Site, d.Field, d.A, d.B)
+}
+
+// Diff returns the differences between tmpl and other. Edit sites are
+// compared by position and numbered using the offset of tmpl. If the non-edit
+// bases differ only the first mismatch is reported as edit sites can not be
+// compared.
+func (tmpl *Template) Diff(other *Template) []*TemplateDiff {
+	diffs := make([]*TemplateDiff, 0)
+	add := func(field string, site int, a, b interface{}) {
+		diffs = append(diffs, &TemplateDiff{Field: field, Site: site, A: fmt.Sprintf("%v", a), B: fmt.Sprintf("%v", b)})
+	}
+
+	if tmpl.EditBase != other.EditBase {
+		add("edit base", -1, string(tmpl.EditBase), string(other.EditBase))
+	}
+	if tmpl.EditOffset != other.EditOffset {
+		add("edit offset", -1, tmpl.EditOffset, other.EditOffset)
+	}
+	if tmpl.EditStop != other.EditStop {
+		add("edit stop", -1, tmpl.EditStop, other.EditStop)
+	}
+	if tmpl.Size() != other.Size() {
+		add("templates", -1, tmpl.Size(), other.Size())
+	}
+	if tmpl.StartCodon != other.StartCodon {
+		add("start codon", -1, tmpl.StartCodon, other.StartCodon)
+	}
+	if tmpl.GeneticCode != other.GeneticCode {
+		add("genetic code", -1, tmpl.GeneticCode, other.GeneticCode)
+	}
+
+	for i := 0; i < len(tmpl.AltRegion) || i < len(other.AltRegion); i++ {
+		a, b := "none", "none"
+		if i < len(tmpl.AltRegion) {
+			a = tmpl.altRegionLabel(i)
+		}
+		if i < len(other.AltRegion) {
+			b = other.altRegionLabel(i)
+		}
+		if a != b {
+			add(fmt.Sprintf("alt region A%d", i+1), -1, a, b)
+		}
+	}
+
+	for i := 0; i < len(tmpl.Guides) || i < len(other.Guides); i++ {
+		a, b := "none", "none"
+		if i < len(tmpl.Guides) {
+			a = tmpl.guideLabel(tmpl.Guides[i])
+		}
+		if i < len(other.Guides) {
+			b = other.guideLabel(other.Guides[i])
+		}
+		if a != b {
+			add(fmt.Sprintf("grna %d", i+1), -1, a, b)
+		}
+	}
+
+	if tmpl.Bases != other.Bases {
+		k := 0
+		for k < len(tmpl.Bases) && k < len(other.Bases) && tmpl.Bases[k] == other.Bases[k] {
+			k++
+		}
+		a, b := "end", "end"
+		if k < len(tmpl.Bases) {
+			a = string(tmpl.Bases[k])
+		}
+		if k < len(other.Bases) {
+			b = string(other.Bases[k])
+		}
+		add("non-edit base", tmpl.IndexLabel(len(tmpl.Bases)-k), a, b)
+		return diffs
+	}
+
+	labels := tmpl.Labels()
+	as, bs := tmpl.Sites(), other.Sites()
+	for i := range as {
+		for k := 0; k < len(as[i].Counts) && k < len(bs[i].Counts); k++ {
+			if as[i].Counts[k] != bs[i].Counts[k] {
+				add(labels[k], as[i].Site, as[i].Counts[k], bs[i].Counts[k])
+			}
+		}
+	}
+
+	return diffs
+}
+
+// altRegionLabel returns the bounds of the i-th alt region including the
+// offset
+func (tmpl *Template) altRegionLabel(i int) string {
+	r := tmpl.AltRegion[i]
+	if r == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%d-%d", tmpl.IndexLabel(r.Start), tmpl.IndexLabel(r.End))
+}
+
+// guideLabel returns the name and bounds of a gRNA including the offset
+func (tmpl *Template) guideLabel(g *GuideRegion) string {
+	label := fmt.Sprintf("%s %d-%d", g.Name, tmpl.IndexLabel(g.Start), tmpl.IndexLabel(g.End))
+	if g.Anchor != nil {
+		label += fmt.Sprintf(" anchor %d-%d", tmpl.IndexLabel(g.Anchor.Start), tmpl.IndexLabel(g.Anchor.End))
+	}
+	return label
+}
+
+// GuidesAt returns the gRNAs whose span covers the edit site. Site is
+// numbered including the offset, as are alignment edit stops.
+func (tmpl *Template) GuidesAt(site int) []*GuideRegion {
+	idx := site - int(tmpl.EditOffset)
+	guides := make([]*GuideRegion, 0)
+	for _, g := range tmpl.Guides {
+		if idx >= g.Start && idx <= g.End {
+			guides = append(guides, g)
+		}
+	}
+	return guides
+}
+
+// GuideNames returns the comma separated names of the gRNAs covering the
+// edit site
+func (tmpl *Template) GuideNames(site int) string {
+	names := make([]string, 0)
+	for _, g := range tmpl.GuidesAt(site) {
+		names = append(names, g.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// InAnchor returns true if the edit site index, without the offset, is
+// paired with the gRNA anchor
+func (g *GuideRegion) InAnchor(idx int) bool {
+	return g.Anchor != nil && idx >= g.Anchor.Start && idx <= g.Anchor.End
+}
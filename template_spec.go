@@ -0,0 +1,562 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aebruno/gofasta"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TEMPLATE_FORMAT_YAML  = "yaml"
+	TEMPLATE_FORMAT_JSON  = "json"
+	TEMPLATE_FORMAT_FASTA = "fasta"
+)
+
+const (
+	// Edit sites are numbered from the 3' end. This is the TREAT default
+	NUMBERING_3PRIME = "3prime"
+	// Edit sites are numbered from the 5' end
+	NUMBERING_5PRIME = "5prime"
+)
+
+// SequenceSpec is a named template sequence
+type SequenceSpec struct {
+	Name     string `yaml:"name" json:"name"`
+	Sequence string `yaml:"sequence" json:"sequence"`
+}
+
+// AltSpec is an alternative editing template. Start and Stop are the edit
+// site bounds of the alt region using the numbering convention of the spec.
+type AltSpec struct {
+	Name     string `yaml:"name" json:"name"`
+	Sequence string `yaml:"sequence" json:"sequence"`
+	Start    *int   `yaml:"start" json:"start"`
+	Stop     *int   `yaml:"stop" json:"stop"`
+}
+
+// GuideSpec is a gRNA annotation. Start and Stop are the edit site bounds of
+// the span covered by the gRNA, including the anchor, using the numbering
+// convention of the spec. The anchor bounds are optional.
+type GuideSpec struct {
+	Name        string `yaml:"name" json:"name"`
+	Start       *int   `yaml:"start" json:"start"`
+	Stop        *int   `yaml:"stop" json:"stop"`
+	AnchorStart *int   `yaml:"anchor_start,omitempty" json:"anchor_start,omitempty"`
+	AnchorStop  *int   `yaml:"anchor_stop,omitempty" json:"anchor_stop,omitempty"`
+}
+
+// PrimerSpec holds the 5' -> 3' sequences of the amplification primers
+type PrimerSpec struct {
+	Forward string `yaml:"forward,omitempty" json:"forward,omitempty"`
+	Reverse string `yaml:"reverse,omitempty" json:"reverse,omitempty"`
+}
+
+// TemplateSpec is the structured definition of the templates for a gene.
+// Specs are read from YAML or JSON files. FASTA template files are converted
+// to a spec so both formats are validated the same way.
+type TemplateSpec struct {
+	Gene        string        `yaml:"gene,omitempty" json:"gene,omitempty"`
+	EditBase    string        `yaml:"edit_base,omitempty" json:"edit_base,omitempty"`
+	EditOffset  int           `yaml:"edit_offset,omitempty" json:"edit_offset,omitempty"`
+	Numbering   string        `yaml:"numbering,omitempty" json:"numbering,omitempty"`
+	StartCodon  int           `yaml:"start_codon,omitempty" json:"start_codon,omitempty"`
+	GeneticCode int           `yaml:"genetic_code,omitempty" json:"genetic_code,omitempty"`
+	Primers     *PrimerSpec   `yaml:"primers,omitempty" json:"primers,omitempty"`
+	FullEdit    *SequenceSpec `yaml:"full_edit" json:"full_edit"`
+	PreEdit     *SequenceSpec `yaml:"pre_edit" json:"pre_edit"`
+	Alt         []*AltSpec    `yaml:"alt,omitempty" json:"alt,omitempty"`
+	Guides      []*GuideSpec  `yaml:"grna,omitempty" json:"grna,omitempty"`
+}
+
+// IsTemplateSpecFile returns true if path has a YAML or JSON extension
+func IsTemplateSpecFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// ReadTemplateSpec reads a template spec from a YAML, JSON or FASTA file
+// depending on the file extension. If the spec does not set the edit base,
+// base is used.
+func ReadTemplateSpec(path string, base rune) (*TemplateSpec, error) {
+	var spec *TemplateSpec
+	var err error
+
+	if IsTemplateSpecFile(path) {
+		spec, err = readTemplateSpecFile(path)
+	} else {
+		spec, err = ReadTemplateSpecFasta(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(spec.EditBase) == 0 {
+		spec.EditBase = string(unicode.ToUpper(base))
+	}
+
+	return spec, nil
+}
+
+func readTemplateSpecFile(path string) (*TemplateSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template file: %s", err)
+	}
+
+	spec := &TemplateSpec{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(spec)
+	} else {
+		err = yaml.UnmarshalStrict(data, spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template file %s: %s", path, err)
+	}
+
+	return spec, nil
+}
+
+// ReadTemplateSpecFasta converts a FASTA templates file to a spec. The first
+// record is the fully edited template, the second the pre-edited template
+// and any remaining records are alt templates with the alt region given by
+// alt_start= and alt_stop= in the header.
+func ReadTemplateSpecFasta(path string) (*TemplateSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid FASTA file: %s", err)
+	}
+	defer f.Close()
+
+	spec := &TemplateSpec{}
+
+	n := 0
+	for rec := range gofasta.SimpleParser(f) {
+		n++
+		switch n {
+		case 1:
+			spec.FullEdit = &SequenceSpec{Name: rec.Id, Sequence: rec.Seq}
+		case 2:
+			spec.PreEdit = &SequenceSpec{Name: rec.Id, Sequence: rec.Seq}
+		default:
+			alt := &AltSpec{Sequence: rec.Seq}
+			alt.Start = headerInt(startPattern.FindStringSubmatch(rec.Id))
+			alt.Stop = headerInt(endPattern.FindStringSubmatch(rec.Id))
+			name := startPattern.ReplaceAllString(rec.Id, " ")
+			alt.Name = strings.TrimSpace(endPattern.ReplaceAllString(name, " "))
+			spec.Alt = append(spec.Alt, alt)
+		}
+	}
+
+	if n < 2 {
+		return nil, fmt.Errorf("Must provide at least 2 templates. Full and Pre edited")
+	}
+
+	return spec, nil
+}
+
+func headerInt(matches []string) *int {
+	if len(matches) != 2 {
+		return nil
+	}
+	v, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// Len returns the number of edit sites of the templates
+func (spec *TemplateSpec) Len() int {
+	if spec.FullEdit == nil || len(spec.EditBase) != 1 {
+		return 0
+	}
+	base := unicode.ToUpper(rune(spec.EditBase[0]))
+	return len(strings.Replace(strings.ToUpper(spec.FullEdit.Sequence), string(base), "", -1)) + 1
+}
+
+// AltRegion converts the alt region bounds of a to TREAT 3' edit site
+// numbering
+func (spec *TemplateSpec) AltRegion(a *AltSpec) *AltRegion {
+	return spec.region(a.Start, a.Stop)
+}
+
+// GuideRegion converts the span and anchor bounds of g to TREAT 3' edit site
+// numbering
+func (spec *TemplateSpec) GuideRegion(g *GuideSpec) *GuideRegion {
+	span := spec.region(g.Start, g.Stop)
+	if span == nil {
+		return nil
+	}
+
+	return &GuideRegion{Name: g.Name, Start: span.Start, End: span.End, Anchor: spec.region(g.AnchorStart, g.AnchorStop)}
+}
+
+// region converts edit site bounds to 3' numbering. Returns nil if either
+// bound is missing.
+func (spec *TemplateSpec) region(start, stop *int) *AltRegion {
+	if start == nil || stop == nil {
+		return nil
+	}
+
+	if spec.Numbering != NUMBERING_5PRIME {
+		return &AltRegion{Start: *start, End: *stop}
+	}
+
+	last := spec.Len() - 1 + 2*spec.EditOffset
+	return &AltRegion{Start: last - *stop, End: last - *start}
+}
+
+// Validate checks the spec and returns all errors found along with warnings
+// for problems which do not prevent building a template
+func (spec *TemplateSpec) Validate() ([]error, []string) {
+	errs := make([]error, 0)
+	warnings := make([]string, 0)
+
+	if len(spec.EditBase) != 1 || !strings.ContainsRune("ACGT", unicode.ToUpper(rune(spec.EditBase[0]))) {
+		errs = append(errs, fmt.Errorf("Invalid edit base %q. Must be one of A, C, G, T", spec.EditBase))
+		return errs, warnings
+	}
+	base := unicode.ToUpper(rune(spec.EditBase[0]))
+
+	switch spec.Numbering {
+	case "", NUMBERING_3PRIME, NUMBERING_5PRIME:
+	default:
+		errs = append(errs, fmt.Errorf("Invalid numbering %q. Must be %s or %s", spec.Numbering, NUMBERING_3PRIME, NUMBERING_5PRIME))
+	}
+
+	if spec.EditOffset < 0 {
+		errs = append(errs, fmt.Errorf("Invalid edit offset %d. Must be >= 0", spec.EditOffset))
+	}
+
+	if spec.FullEdit == nil || len(spec.FullEdit.Sequence) == 0 {
+		errs = append(errs, fmt.Errorf("Missing fully edited template sequence"))
+	}
+	if spec.PreEdit == nil || len(spec.PreEdit.Sequence) == 0 {
+		errs = append(errs, fmt.Errorf("Missing pre-edited template sequence"))
+	}
+	if len(errs) > 0 {
+		return errs, warnings
+	}
+
+	for _, s := range spec.sequences() {
+		if len(s.Sequence) == 0 {
+			errs = append(errs, fmt.Errorf("%s: missing sequence", s.label))
+		} else if i := strings.IndexFunc(s.Sequence, func(r rune) bool { return !strings.ContainsRune("ACGTN", unicode.ToUpper(r)) }); i > -1 {
+			errs = append(errs, fmt.Errorf("%s: invalid base %q at position %d", s.label, s.Sequence[i], i+1))
+		}
+	}
+	if len(errs) > 0 {
+		return errs, warnings
+	}
+
+	full := NewFragment(spec.FullEdit.Name, spec.FullEdit.Sequence, FORWARD, base)
+	for _, s := range spec.sequences()[1:] {
+		if err := spec.compareBases(s, full, base); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	pre := NewFragment(spec.PreEdit.Name, spec.PreEdit.Sequence, FORWARD, base)
+	if full.Bases == pre.Bases && full.String() == pre.String() {
+		warnings = append(warnings, "Fully edited and pre-edited templates are identical")
+	}
+
+	first := spec.EditOffset
+	last := spec.Len() - 1 + spec.EditOffset
+	for i, a := range spec.Alt {
+		label := fmt.Sprintf("alt %d %q", i+1, a.Name)
+		if a.Start == nil || a.Stop == nil {
+			errs = append(errs, fmt.Errorf("%s: missing alt region start and stop. Set alt_start= and alt_stop= in the FASTA header", label))
+			continue
+		}
+		if *a.Start > *a.Stop {
+			errs = append(errs, fmt.Errorf("%s: alt region start %d is after stop %d", label, *a.Start, *a.Stop))
+			continue
+		}
+		if *a.Start < first || *a.Stop > last {
+			errs = append(errs, fmt.Errorf("%s: alt region %d-%d is outside of the edit sites %d-%d", label, *a.Start, *a.Stop, first, last))
+		}
+	}
+
+	if _, err := codonTable(spec.GeneticCode); err != nil {
+		errs = append(errs, err)
+	} else if spec.StartCodon < 0 || spec.StartCodon+2 > len(spec.FullEdit.Sequence) {
+		errs = append(errs, fmt.Errorf("Start codon %d is outside of the fully edited template (%d bases)", spec.StartCodon, len(spec.FullEdit.Sequence)))
+	} else if spec.StartCodon > 0 {
+		seq := strings.ToUpper(spec.FullEdit.Sequence[spec.StartCodon-1:])
+		if codon := seq[:3]; codon != "ATG" {
+			warnings = append(warnings, fmt.Sprintf("Start codon at position %d is %s not ATG", spec.StartCodon, codon))
+		}
+		if protein, _ := Translate(seq, spec.GeneticCode); !strings.HasSuffix(protein, "*") {
+			warnings = append(warnings, "Fully edited template has no stop codon in frame with the start codon")
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, g := range spec.Guides {
+		label := fmt.Sprintf("grna %d %q", i+1, g.Name)
+		if len(g.Name) == 0 {
+			errs = append(errs, fmt.Errorf("%s: missing name", label))
+		} else if names[g.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate gRNA name", label))
+		}
+		names[g.Name] = true
+
+		if g.Start == nil || g.Stop == nil {
+			errs = append(errs, fmt.Errorf("%s: missing start and stop", label))
+			continue
+		}
+		if *g.Start > *g.Stop {
+			errs = append(errs, fmt.Errorf("%s: start %d is after stop %d", label, *g.Start, *g.Stop))
+			continue
+		}
+		if *g.Start < first || *g.Stop > last {
+			errs = append(errs, fmt.Errorf("%s: span %d-%d is outside of the edit sites %d-%d", label, *g.Start, *g.Stop, first, last))
+		}
+
+		if g.AnchorStart == nil && g.AnchorStop == nil {
+			continue
+		}
+		if g.AnchorStart == nil || g.AnchorStop == nil {
+			errs = append(errs, fmt.Errorf("%s: anchor requires both anchor_start and anchor_stop", label))
+			continue
+		}
+		if *g.AnchorStart > *g.AnchorStop {
+			errs = append(errs, fmt.Errorf("%s: anchor start %d is after stop %d", label, *g.AnchorStart, *g.AnchorStop))
+		} else if *g.AnchorStart < *g.Start || *g.AnchorStop > *g.Stop {
+			errs = append(errs, fmt.Errorf("%s: anchor %d-%d is outside of the gRNA span %d-%d", label, *g.AnchorStart, *g.AnchorStop, *g.Start, *g.Stop))
+		}
+	}
+
+	if spec.Primers != nil {
+		bases := full.Bases
+		if len(spec.Primers.Forward) > 0 {
+			fwd := NewFragment("", spec.Primers.Forward, FORWARD, base)
+			if !strings.Contains(bases, fwd.Bases) {
+				warnings = append(warnings, fmt.Sprintf("Forward primer %s not found in the templates", spec.Primers.Forward))
+			}
+		}
+		if len(spec.Primers.Reverse) > 0 {
+			rev := NewFragment("", reverseComplement(spec.Primers.Reverse), FORWARD, base)
+			if !strings.Contains(bases, rev.Bases) {
+				warnings = append(warnings, fmt.Sprintf("Reverse primer %s not found in the templates", spec.Primers.Reverse))
+			}
+		}
+	}
+
+	return errs, warnings
+}
+
+type labeledSequence struct {
+	label    string
+	Sequence string
+}
+
+// sequences returns all template sequences labeled for error messages
+func (spec *TemplateSpec) sequences() []*labeledSequence {
+	seqs := []*labeledSequence{
+		{label: fmt.Sprintf("full_edit %q", spec.FullEdit.Name), Sequence: spec.FullEdit.Sequence},
+		{label: fmt.Sprintf("pre_edit %q", spec.PreEdit.Name), Sequence: spec.PreEdit.Sequence},
+	}
+	for i, a := range spec.Alt {
+		seqs = append(seqs, &labeledSequence{label: fmt.Sprintf("alt %d %q", i+1, a.Name), Sequence: a.Sequence})
+	}
+	return seqs
+}
+
+// compareBases returns an error giving the position of the first non-edit
+// base of s which differs from the fully edited template
+func (spec *TemplateSpec) compareBases(s *labeledSequence, full *Fragment, base rune) error {
+	frag := NewFragment("", s.Sequence, FORWARD, base)
+	if frag.Bases == full.Bases {
+		return nil
+	}
+
+	k := 0
+	for k < len(frag.Bases) && k < len(full.Bases) && frag.Bases[k] == full.Bases[k] {
+		k++
+	}
+
+	site := len(full.Bases) - k + spec.EditOffset
+	if spec.Numbering == NUMBERING_5PRIME {
+		site = k + spec.EditOffset
+	}
+
+	if k == len(frag.Bases) {
+		return fmt.Errorf("%s: sequence ends after %d non-edit bases, fully edited template has %d (edit site %d)",
+			s.label, len(frag.Bases), len(full.Bases), site)
+	}
+	if k == len(full.Bases) {
+		return fmt.Errorf("%s: has %d extra non-edit bases starting at position %d",
+			s.label, len(frag.Bases)-k, basePosition(s.Sequence, base, k))
+	}
+
+	return fmt.Errorf("%s: non-edit base %c at position %d does not match %c at position %d of the fully edited template (edit site %d)",
+		s.label, frag.Bases[k], basePosition(s.Sequence, base, k), full.Bases[k], basePosition(spec.FullEdit.Sequence, base, k), site)
+}
+
+// basePosition returns the 1-based position in seq of the k-th non-edit base
+func basePosition(seq string, base rune, k int) int {
+	n := 0
+	for i, r := range strings.ToUpper(seq) {
+		if r == base {
+			continue
+		}
+		if n == k {
+			return i + 1
+		}
+		n++
+	}
+	return len(seq) + 1
+}
+
+func reverseComplement(seq string) string {
+	comp := func(r rune) rune {
+		switch unicode.ToUpper(r) {
+		case 'A':
+			return 'T'
+		case 'T':
+			return 'A'
+		case 'C':
+			return 'G'
+		case 'G':
+			return 'C'
+		}
+		return r
+	}
+	return reverse(strings.Map(comp, seq))
+}
+
+// TemplateFormat returns the template file format for the extension of path
+func TemplateFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return TEMPLATE_FORMAT_YAML
+	case ".json":
+		return TEMPLATE_FORMAT_JSON
+	}
+	return TEMPLATE_FORMAT_FASTA
+}
+
+// Write writes the spec in yaml, json or fasta format. The gene, edit offset,
+// primers, start codon and gRNA annotations can not be stored in fasta format.
+func (spec *TemplateSpec) Write(w io.Writer, format string) error {
+	switch format {
+	case TEMPLATE_FORMAT_YAML:
+		data, err := yaml.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case TEMPLATE_FORMAT_JSON:
+		data, err := json.MarshalIndent(spec, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case TEMPLATE_FORMAT_FASTA:
+		var buf bytes.Buffer
+		if spec.FullEdit != nil {
+			writeFastaRecord(&buf, spec.FullEdit.Name, spec.FullEdit.Sequence)
+		}
+		if spec.PreEdit != nil {
+			writeFastaRecord(&buf, spec.PreEdit.Name, spec.PreEdit.Sequence)
+		}
+		for _, a := range spec.Alt {
+			name := a.Name
+			if r := spec.AltRegion(a); r != nil {
+				name = fmt.Sprintf("%s alt_start=%d alt_stop=%d", name, r.Start, r.End)
+			}
+			writeFastaRecord(&buf, name, a.Sequence)
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	return fmt.Errorf("Invalid template format: %s", format)
+}
+
+func writeFastaRecord(buf *bytes.Buffer, name, seq string) {
+	buf.WriteString(">")
+	buf.WriteString(name)
+	buf.WriteString("\n")
+	for i := 0; i < len(seq); i += 60 {
+		end := i + 60
+		if end > len(seq) {
+			end = len(seq)
+		}
+		buf.WriteString(seq[i:end])
+		buf.WriteString("\n")
+	}
+}
+
+// Template validates the spec and builds the template with the spec edit
+// offset applied
+func (spec *TemplateSpec) Template(orientation OrientationType) (*Template, error) {
+	errs, _ := spec.Validate()
+	if len(errs) == 1 {
+		return nil, fmt.Errorf("Invalid templates. %s", errs[0])
+	} else if len(errs) > 1 {
+		return nil, fmt.Errorf("Invalid templates. %s (and %d more errors)", errs[0], len(errs)-1)
+	}
+
+	base := rune(spec.EditBase[0])
+
+	full := NewFragment(spec.FullEdit.Name, spec.FullEdit.Sequence, orientation, base)
+	pre := NewFragment(spec.PreEdit.Name, spec.PreEdit.Sequence, orientation, base)
+	alt := make([]*Fragment, len(spec.Alt))
+	altRegion := make([]*AltRegion, len(spec.Alt))
+	for i, a := range spec.Alt {
+		alt[i] = NewFragment(a.Name, a.Sequence, orientation, base)
+		altRegion[i] = spec.AltRegion(a)
+	}
+
+	tmpl, err := NewTemplate(full, pre, alt, altRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range spec.Guides {
+		tmpl.Guides = append(tmpl.Guides, spec.GuideRegion(g))
+	}
+	tmpl.StartCodon = spec.StartCodon
+	tmpl.GeneticCode = spec.GeneticCode
+
+	tmpl.SetOffset(spec.EditOffset)
+
+	return tmpl, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateSpec(t *testing.T) {
+	fasta, err := NewTemplateFromFile("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := ReadTemplateSpec("examples/templates.yaml", 't')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Gene != "RPS12" {
+		t.Errorf("Wrong gene name: %s", spec.Gene)
+	}
+
+	errs, warnings := spec.Validate()
+	if len(errs) != 0 || len(warnings) != 0 {
+		t.Errorf("Example spec should be valid: %v %v", errs, warnings)
+	}
+
+	tmpl, err := spec.Template(FORWARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tmpl, fasta) {
+		t.Errorf("YAML and FASTA templates differ")
+	}
+}
+
+func TestTemplateSpecErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "treat-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "templates.fa")
+	data := ">full\nttCCAATTGCAATTT\n>pre\nttCCAATTTTGCAATTTTT\n>alt\nttCCAtATTGCAATTT\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewTemplateFromFasta(path, FORWARD, 't')
+	if err == nil || !strings.Contains(err.Error(), "missing alt region") {
+		t.Errorf("Alt template without alt region should throw an error: %v", err)
+	}
+
+	spec := &TemplateSpec{
+		EditBase: "T",
+		FullEdit: &SequenceSpec{Name: "full", Sequence: "ttCCAATTGCAATTT"},
+		PreEdit:  &SequenceSpec{Name: "pre", Sequence: "ttCCAtTTAAGCAATTT"},
+	}
+
+	errs, _ := spec.Validate()
+	if len(errs) != 1 {
+		t.Fatalf("Wrong number of errors: %v", errs)
+	}
+
+	// Non-edit base A at position 10 of pre does not match G at position 9
+	// of full which follows edit site 4
+	msg := errs[0].Error()
+	if !strings.Contains(msg, "position 10") || !strings.Contains(msg, "position 9") || !strings.Contains(msg, "edit site 4") {
+		t.Errorf("Wrong mismatch position: %s", msg)
+	}
+}
+
+func TestTemplateSpecNumbering(t *testing.T) {
+	start, stop := 12, 14
+	spec := &TemplateSpec{
+		EditBase:   "T",
+		EditOffset: 10,
+		Numbering:  NUMBERING_5PRIME,
+		FullEdit:   &SequenceSpec{Name: "full", Sequence: "ttCCAATTGCAATTT"},
+		PreEdit:    &SequenceSpec{Name: "pre", Sequence: "ttttCCAATTTTGCAATTTTT"},
+		Alt:        []*AltSpec{{Name: "alt", Sequence: "ttCCAAtTGCAATTT", Start: &start, Stop: &stop}},
+	}
+
+	tmpl, err := spec.Template(FORWARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 9 edit sites numbered 10-18 from the 5' end are 18-10 from the 3' end
+	region := tmpl.AltRegion[0]
+	if region.Start != 4 || region.End != 6 {
+		t.Errorf("Wrong alt region: %d-%d != %d-%d", region.Start, region.End, 4, 6)
+	}
+
+	editStop := tmpl.EditStop
+	tmpl.SetOffset(10)
+	if tmpl.EditStop != editStop || region.Start != 4 {
+		t.Errorf("Setting the same offset twice should not change the template")
+	}
+}
+
+func TestTemplateSpecGuides(t *testing.T) {
+	start, stop, anchorStart, anchorStop := 12, 15, 12, 13
+	spec := &TemplateSpec{
+		EditBase:   "T",
+		EditOffset: 10,
+		FullEdit:   &SequenceSpec{Name: "full", Sequence: "ttCCAATTGCAATTT"},
+		PreEdit:    &SequenceSpec{Name: "pre", Sequence: "ttCCAATTTTGCAATTTTT"},
+		Guides:     []*GuideSpec{{Name: "g1", Start: &start, Stop: &stop, AnchorStart: &anchorStart, AnchorStop: &anchorStop}},
+	}
+
+	tmpl, err := spec.Template(FORWARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := tmpl.Guides[0]
+	if g.Start != 2 || g.End != 5 || g.Anchor.Start != 2 || g.Anchor.End != 3 {
+		t.Errorf("Wrong gRNA region: %d-%d anchor %d-%d", g.Start, g.End, g.Anchor.Start, g.Anchor.End)
+	}
+
+	if names := tmpl.GuideNames(15); names != "g1" {
+		t.Errorf("Edit stop 15 should fall in g1: %q", names)
+	}
+	if names := tmpl.GuideNames(16); names != "" {
+		t.Errorf("Edit stop 16 should not fall in a gRNA: %q", names)
+	}
+
+	// Same sites numbered from the 5' end
+	spec.Numbering = NUMBERING_5PRIME
+	start, stop, anchorStart, anchorStop = 13, 16, 15, 16
+	tmpl5, err := spec.Template(FORWARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := tmpl.Diff(tmpl5); len(diffs) != 0 {
+		t.Errorf("3' and 5' numbered gRNAs differ: %v", diffs)
+	}
+
+	anchorStop = 17
+	errs, _ := spec.Validate()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "outside of the gRNA span") {
+		t.Errorf("Anchor outside of the span should be an error: %v", errs)
+	}
+
+	spec.Guides = append(spec.Guides, &GuideSpec{Name: "g1"})
+	anchorStop = 16
+	errs, _ = spec.Validate()
+	if len(errs) != 2 {
+		t.Errorf("Wrong number of errors for duplicate gRNA without span: %v", errs)
+	}
+}
@@ -68,3 +68,75 @@ func TestTemplate(t *testing.T) {
 		t.Errorf("Alt region should match alt template length. Should throw and error")
 	}
 }
+
+func TestTemplateSites(t *testing.T) {
+	full := NewFragment("full", "ttCCAATTGCAATTT", FORWARD, 't')
+	pre := NewFragment("pre", "ttttCCAAGCAAT", FORWARD, 't')
+
+	tmpl, err := NewTemplate(full, pre, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SetOffset(10)
+
+	sites := tmpl.Sites()
+	if len(sites) != tmpl.Len() {
+		t.Fatalf("Wrong number of sites: %d != %d", len(sites), tmpl.Len())
+	}
+
+	// Site at the 3' end has no base
+	if sites[0].Site != 10 || sites[0].Base != "" || !sites[0].Inserted() {
+		t.Errorf("Wrong 3' site: %+v", sites[0])
+	}
+
+	// Site at the 5' end precedes the first base
+	last := sites[len(sites)-1]
+	if last.Site != 18 || last.Base != "C" || !last.Deleted() {
+		t.Errorf("Wrong 5' site: %+v", last)
+	}
+
+	if s := sites[4]; s.Base != "G" || s.Counts[0] != 2 || s.Counts[1] != 0 {
+		t.Errorf("Wrong site %d: %+v", s.Site, s)
+	}
+}
+
+func TestTemplateDiff(t *testing.T) {
+	a, err := NewTemplateFromFasta("examples/simple-templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewTemplateFromFasta("examples/simple-templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffs := a.Diff(b); len(diffs) != 0 {
+		t.Errorf("Templates should be identical: %v", diffs)
+	}
+
+	b.EditSite[1][b.Len()-4]++
+	b.SetOffset(5)
+
+	diffs := a.Diff(b)
+	if len(diffs) != 3 {
+		t.Fatalf("Wrong number of differences: %v", diffs)
+	}
+	if diffs[0].Field != "edit offset" || diffs[1].Field != "edit stop" {
+		t.Errorf("Wrong differences: %v", diffs)
+	}
+	if d := diffs[2]; d.Field != "PE" || d.Site != 3 || d.A != "1" || d.B != "2" {
+		t.Errorf("Wrong site difference: %s", d)
+	}
+
+	full := NewFragment("full", "ttCCAATTGCAATTT", FORWARD, 't')
+	pre := NewFragment("pre", "ttCCAATTGCAATTT", FORWARD, 't')
+	c, err := NewTemplate(full, pre, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs = a.Diff(c)
+	if d := diffs[len(diffs)-1]; d.Field != "non-edit base" {
+		t.Errorf("Non-edit base difference should be reported last: %v", diffs)
+	}
+}
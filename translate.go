@@ -0,0 +1,243 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// NCBI standard genetic code
+	GENETIC_CODE_STANDARD = 1
+	// NCBI mold, protozoan and coelenterate mitochondrial code. UGA codes for
+	// Trp. Used by default as the edited mRNAs are kinetoplastid mitochondrial
+	GENETIC_CODE_MITO = 4
+)
+
+const (
+	// Read keeps the reading frame of the fully edited protein
+	FRAME_IN_FRAME = "in-frame"
+	// Read is out of frame with the fully edited protein at its stop codon
+	FRAME_SHIFT = "frameshift"
+	// Read has a stop codon before the stop codon of the fully edited protein
+	FRAME_PREMATURE_STOP = "premature-stop"
+	// Start codon could not be located in the read
+	FRAME_UNTRANSLATED = "untranslated"
+)
+
+// FrameClasses lists the reading frame classes of reads
+var FrameClasses = []string{FRAME_IN_FRAME, FRAME_SHIFT, FRAME_PREMATURE_STOP, FRAME_UNTRANSLATED}
+
+const codonBases = "TCAG"
+
+// Amino acids of the standard code in TCAG codon order
+const standardCode = "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"
+
+// IsFrameClass returns true if class is a valid reading frame class
+func IsFrameClass(class string) bool {
+	for _, c := range FrameClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// codonTable returns the amino acids of the genetic code in TCAG codon order
+func codonTable(code int) (string, error) {
+	switch code {
+	case 0, GENETIC_CODE_MITO:
+		// TGA is Trp
+		return standardCode[:14] + "W" + standardCode[15:], nil
+	case GENETIC_CODE_STANDARD:
+		return standardCode, nil
+	}
+
+	return "", fmt.Errorf("Unsupported genetic code: %d. Must be %d or %d", code, GENETIC_CODE_STANDARD, GENETIC_CODE_MITO)
+}
+
+// translate returns the amino acids coded by seq up to and including the
+// first stop codon, given as '*'. Codons with ambiguous bases are 'X'.
+func translate(seq, table string) string {
+	var buf strings.Builder
+	for i := 0; i+3 <= len(seq); i += 3 {
+		idx := 0
+		for _, b := range seq[i : i+3] {
+			j := strings.IndexRune(codonBases, b)
+			if j < 0 {
+				idx = -1
+				break
+			}
+			idx = idx*4 + j
+		}
+		if idx < 0 {
+			buf.WriteByte('X')
+			continue
+		}
+		aa := table[idx]
+		buf.WriteByte(aa)
+		if aa == '*' {
+			break
+		}
+	}
+	return buf.String()
+}
+
+// Translate returns the protein coded by seq using the genetic code up to and
+// including the first stop codon
+func Translate(seq string, code int) (string, error) {
+	table, err := codonTable(code)
+	if err != nil {
+		return "", err
+	}
+
+	return translate(strings.ToUpper(seq), table), nil
+}
+
+// Translation is the reading frame analysis of a single read
+type Translation struct {
+	Class   string
+	Protein string
+	// 1-based position of the first amino acid which differs from the fully
+	// edited protein, 0 if the proteins are the same
+	FirstDiff int
+}
+
+// sitePosition locates a position of the fully edited template by the
+// non-edit base at or following it. Reads are lined up with the template at
+// that base.
+type sitePosition struct {
+	// Index of the non-edit base, len(Bases) for the 3' end
+	base int
+	// Number of edit bases between the position and the non-edit base
+	delta int
+}
+
+// basePositions returns the 0-based position in the sequence of f of each
+// non-edit base followed by the length of the sequence
+func basePositions(f *Fragment) []int {
+	pos := make([]int, len(f.EditSite))
+	p := 0
+	for i, n := range f.EditSite {
+		p += int(n)
+		pos[i] = p
+		p++
+	}
+	return pos
+}
+
+// Translator classifies the reading frame of reads relative to the protein
+// coded by the fully edited template
+type Translator struct {
+	Protein string
+	table   string
+	start   sitePosition
+	stop    sitePosition
+}
+
+// NewTranslator returns a translator for reads of tmpl. The start codon is
+// the 1-based position in the fully edited template. If start is 0 the start
+// codon of the template is used.
+func NewTranslator(tmpl *Template, start int) (*Translator, error) {
+	if start <= 0 {
+		start = tmpl.StartCodon
+	}
+
+	full := tmpl.String()
+	if start <= 0 {
+		return nil, fmt.Errorf("No start codon set for the template")
+	}
+	if start+2 > len(full) {
+		return nil, fmt.Errorf("Start codon %d is past the end of the fully edited template (%d bases)", start, len(full))
+	}
+
+	table, err := codonTable(tmpl.GeneticCode)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Translator{table: table}
+	t.Protein = translate(full[start-1:], table)
+
+	pos := basePositions(&Fragment{Bases: tmpl.Bases, EditSite: tmpl.EditSite[0]})
+	locate := func(p int) sitePosition {
+		for i, q := range pos {
+			if q >= p {
+				return sitePosition{base: i, delta: q - p}
+			}
+		}
+		return sitePosition{base: len(pos) - 1}
+	}
+
+	t.start = locate(start - 1)
+	t.stop = locate(start - 1 + 3*len(t.Protein))
+
+	return t, nil
+}
+
+// position returns the position in the sequence of frag lined up with the
+// template position p, or -1 if the read is too short
+func (t *Translator) position(pos []int, p sitePosition) int {
+	if p.base >= len(pos) || pos[p.base] < p.delta {
+		return -1
+	}
+	return pos[p.base] - p.delta
+}
+
+// Translate translates the read from the start codon and classifies its
+// reading frame. Reads with a stop codon before the stop codon of the fully
+// edited protein are prematurely terminated, otherwise reads are frame-shifted
+// if the number of bases between the start codon and the lined up stop codon
+// is not a multiple of three.
+func (t *Translator) Translate(frag *Fragment) *Translation {
+	tr := &Translation{Class: FRAME_UNTRANSLATED}
+
+	seq := frag.String()
+	pos := basePositions(frag)
+	start := t.position(pos, t.start)
+	if start < 0 || start+3 > len(seq) {
+		return tr
+	}
+
+	tr.Protein = translate(seq[start:], t.table)
+
+	for i := 0; i < len(tr.Protein) || i < len(t.Protein); i++ {
+		if i >= len(tr.Protein) || i >= len(t.Protein) || tr.Protein[i] != t.Protein[i] {
+			tr.FirstDiff = i + 1
+			break
+		}
+	}
+
+	if strings.HasSuffix(tr.Protein, "*") && len(tr.Protein) < len(t.Protein) {
+		tr.Class = FRAME_PREMATURE_STOP
+		return tr
+	}
+
+	stop := t.position(pos, t.stop)
+	if stop < 0 {
+		stop = len(seq)
+	}
+	if (stop-start)%3 != 0 {
+		tr.Class = FRAME_SHIFT
+	} else {
+		tr.Class = FRAME_IN_FRAME
+	}
+
+	return tr
+}
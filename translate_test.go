@@ -0,0 +1,139 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	protein, err := Translate("atgtgataa", GENETIC_CODE_MITO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protein != "MW*" {
+		t.Errorf("Wrong mitochondrial translation: %s", protein)
+	}
+
+	protein, err = Translate("ATGTGATAA", GENETIC_CODE_STANDARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protein != "M*" {
+		t.Errorf("Wrong standard translation: %s", protein)
+	}
+
+	if _, err := Translate("ATG", 2); err == nil {
+		t.Errorf("Unsupported genetic code should throw an error")
+	}
+}
+
+func TestTranslator(t *testing.T) {
+	spec := &TemplateSpec{
+		EditBase:   "T",
+		StartCodon: 3,
+		FullEdit:   &SequenceSpec{Name: "full", Sequence: "CCATGTTTAAATAG"},
+		PreEdit:    &SequenceSpec{Name: "pre", Sequence: "CCATGAAATAG"},
+	}
+
+	tmpl, err := spec.Template(FORWARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTranslator(tmpl, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Protein != "MFK*" {
+		t.Fatalf("Wrong fully edited protein: %s", tr.Protein)
+	}
+
+	tests := []struct {
+		seq       string
+		class     string
+		firstDiff int
+	}{
+		{"CCATGTTTAAATAG", FRAME_IN_FRAME, 0},
+		// Extra edit base before the start codon
+		{"CCTATGTTTAAATAG", FRAME_IN_FRAME, 0},
+		{"CCATGTTAAATAG", FRAME_SHIFT, 2},
+		{"CCATGTTTTAAATAG", FRAME_PREMATURE_STOP, 3},
+		{"CCATGTTTTTTAAATAG", FRAME_IN_FRAME, 3},
+		{"CCAT", FRAME_UNTRANSLATED, 0},
+	}
+
+	for _, test := range tests {
+		res := tr.Translate(NewFragment("read", test.seq, FORWARD, 'T'))
+		if res.Class != test.class || res.FirstDiff != test.firstDiff {
+			t.Errorf("Wrong translation of %s: %s %d (%s) != %s %d", test.seq, res.Class, res.FirstDiff, res.Protein, test.class, test.firstDiff)
+		}
+	}
+
+	if _, err := NewTranslator(tmpl, 13); err == nil {
+		t.Errorf("Start codon past the end of the template should throw an error")
+	}
+}
+
+func TestTranslatorRPS12(t *testing.T) {
+	tmpl, err := NewTemplateFromFile("examples/templates.yaml", FORWARD, 't')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTranslator(tmpl, 54)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Protein) != 83 || tr.Protein[:8] != "MWFLYGCC" {
+		t.Errorf("Wrong RPS12 protein: %s", tr.Protein)
+	}
+
+	full := NewFragment("full", tmpl.String(), FORWARD, 't')
+	if res := tr.Translate(full); res.Class != FRAME_IN_FRAME || res.FirstDiff != 0 {
+		t.Errorf("Fully edited read should be in frame: %s %d", res.Class, res.FirstDiff)
+	}
+}
+
+func TestTemplateSpecStartCodon(t *testing.T) {
+	spec := &TemplateSpec{
+		EditBase:   "T",
+		StartCodon: 1,
+		FullEdit:   &SequenceSpec{Name: "full", Sequence: "CCATGTTTAAATAG"},
+		PreEdit:    &SequenceSpec{Name: "pre", Sequence: "CCATGAAATAG"},
+	}
+
+	errs, warnings := spec.Validate()
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("Start codon CCA without an in-frame stop should warn twice: %v", warnings)
+	}
+
+	spec.StartCodon = 13
+	if errs, _ := spec.Validate(); len(errs) != 1 {
+		t.Errorf("Start codon past the end of the template should be an error: %v", errs)
+	}
+
+	spec.StartCodon = 3
+	spec.GeneticCode = 2
+	if errs, _ := spec.Validate(); len(errs) != 1 {
+		t.Errorf("Unsupported genetic code should be an error: %v", errs)
+	}
+}